@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often writes to the append only file are flushed to disk.
+const (
+	AppendFsyncAlways   = "always"   // before every write is acknowledged
+	AppendFsyncEverysec = "everysec" // once a second in the background
+	AppendFsyncNo       = "no"       // whenever the os gets round to it
+)
+
+var ErrAOFNotOpen = errors.New("append only file is not open")
+var ErrAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+type ErrUnknownAppendFsync string
+
+func (e ErrUnknownAppendFsync) Error() string {
+	return fmt.Sprintf("unknown appendfsync '%s', expected always, everysec or no", string(e))
+}
+
+// ErrAOFCorrupt is a log that can't be replayed, offset is where the bad command starts.
+type ErrAOFCorrupt struct {
+	File   string
+	Offset int64
+	Err    error
+}
+
+func (e ErrAOFCorrupt) Error() string {
+	return fmt.Sprintf("corrupt append only file %s at offset %d: %s", e.File, e.Offset, e.Err)
+}
+
+func (e ErrAOFCorrupt) Unwrap() error {
+	return e.Err
+}
+
+// AppendOnlyFile logs every write in the same RESP form clients send them in,
+// so replaying it through the router rebuilds the dataset. On disk it is a
+// base file plus incr files, tied together by a manifest (see aofmanifest.go).
+type AppendOnlyFile struct {
+	lock       sync.Mutex
+	dir        string // holds the manifest and every file it lists
+	name       string // prefix of all of those files
+	legacyPath string // where a single file aof from before the manifest would be
+	fsync      string
+	preamble   bool // write bases as rdb files rather than commands
+	timestamps bool // annotate incr files with #TS:<unix seconds> as time moves on
+	lastTS     int64
+	manifest   *AOFManifest
+	file       *os.File       // the incr file being appended to
+	enc        *EncryptWriter // seals appends to file when encryption is on
+	keys       *KeyRing
+	dirty      bool // written to since the last fsync
+	closed     chan struct{}
+	openTx     bool // the log ends part way through a transaction, it's closed off with a DISCARD before anything else is appended
+
+	rewriting      bool
+	lastRewriteErr error
+	rewritePerc    int   // how much the aof grows past its size after the last rewrite before we rewrite again
+	rewriteMinSize int64 // and the smallest it can be when we do
+	baseSize       int64 // size of the aof right after the last rewrite
+	currentSize    int64 // size of the base plus every incr
+}
+
+func NewAppendOnlyFile(dir string, name string, fsync string) (*AppendOnlyFile, error) {
+	switch fsync {
+	case AppendFsyncAlways, AppendFsyncEverysec, AppendFsyncNo:
+	default:
+		return nil, ErrUnknownAppendFsync(fsync)
+	}
+	if filepath.Base(name) != name {
+		return nil, fmt.Errorf("appendfilename '%s' can't contain a path", name)
+	}
+	return &AppendOnlyFile{dir: dir, name: name, fsync: fsync, preamble: true}, nil
+}
+
+// Legacy is where to look for an aof written before the multi part layout, it
+// is moved into the aof directory as the base the first time we load.
+func (aof *AppendOnlyFile) Legacy(path string) *AppendOnlyFile {
+	aof.legacyPath = path
+	return aof
+}
+
+// RDBPreamble picks rdb (the default) or plain commands for the base file.
+func (aof *AppendOnlyFile) RDBPreamble(on bool) *AppendOnlyFile {
+	aof.preamble = on
+	return aof
+}
+
+// Timestamps turns on #TS annotations, which let a backup be restored to a point in time.
+func (aof *AppendOnlyFile) Timestamps(on bool) *AppendOnlyFile {
+	aof.timestamps = on
+	return aof
+}
+
+// Encryption encrypts every file written from now on with ring, nil turns it off.
+func (aof *AppendOnlyFile) Encryption(ring *KeyRing) *AppendOnlyFile {
+	aof.keys = ring
+	return aof
+}
+
+// AutoRewrite sets when the aof rewrites itself, a percentage of 0 turns it off.
+func (aof *AppendOnlyFile) AutoRewrite(percentage int, minSize int64) *AppendOnlyFile {
+	aof.rewritePerc = percentage
+	aof.rewriteMinSize = minSize
+	return aof
+}
+
+func (aof *AppendOnlyFile) Dir() string {
+	return aof.dir
+}
+
+func (aof *AppendOnlyFile) manifestPath() string {
+	return filepath.Join(aof.dir, aofManifestName(aof.name))
+}
+
+func (aof *AppendOnlyFile) Exists() bool {
+	if _, e := os.Stat(aof.manifestPath()); e == nil {
+		return true
+	}
+	if aof.legacyPath == "" {
+		return false
+	}
+	_, e := os.Stat(aof.legacyPath)
+	return e == nil
+}
+
+// migrateLegacy moves a single file aof into the aof directory as its base.
+func (aof *AppendOnlyFile) migrateLegacy() error {
+	if aof.legacyPath == "" {
+		return nil
+	}
+	if _, e := os.Stat(aof.manifestPath()); e == nil {
+		return nil
+	}
+	if _, e := os.Stat(aof.legacyPath); e != nil {
+		return nil
+	}
+	if e := os.MkdirAll(aof.dir, 0755); e != nil {
+		return e
+	}
+	base := AOFInfo{aofBaseName(aof.name, 1, false), 1, AOFBaseType}
+	if e := os.Rename(aof.legacyPath, filepath.Join(aof.dir, base.Name)); e != nil {
+		return e
+	}
+	fmt.Println("moved", aof.legacyPath, "into", aof.dir, "as", base.Name)
+	return writeAOFManifest(aof.dir, aof.name, &AOFManifest{Base: &base})
+}
+
+// Load replays every file in the manifest through the router, returning how
+// many commands (or keys, for an rdb base) it applied. Only the last file may
+// end part way through a command: with allowTruncated it is cut back to the
+// last whole command, otherwise that is an error like any other corruption.
+func (aof *AppendOnlyFile) Load(router CommandRouter, ctx RequestContext, allowTruncated bool) (int, error) {
+	if e := aof.migrateLegacy(); e != nil {
+		return 0, e
+	}
+	m, e := LoadAOFManifest(aof.manifestPath())
+	if e != nil {
+		return 0, e
+	}
+	files := m.Files()
+	ctx.Loading.Begin(aof.sizeOf(files))
+
+	replay := &aofReplay{router: router, ctx: ctx.quietContext(), progress: ctx.Loading, keys: aof.keys}
+	for i, f := range files {
+		if allowTruncated && i == len(files)-1 {
+			replay.onTruncated = truncateAOFFile
+		}
+		if e := replay.File(filepath.Join(aof.dir, f.Name)); e != nil {
+			return replay.applied, e
+		}
+	}
+	// a crash part way through logging a transaction leaves it without its
+	// EXEC, so it wasn't applied. That's a torn write like any other.
+	if replay.ctx.Client.queueing() != nil {
+		if !allowTruncated {
+			return replay.applied, fmt.Errorf("%s ends part way through a transaction, see aof-load-truncated", aof.dir)
+		}
+		fmt.Println("aof ends part way through a transaction, leaving it out")
+		aof.openTx = true
+	}
+	return replay.applied, nil
+}
+
+func truncateAOFFile(path string, offset int64) error {
+	fmt.Println("aof ends with a partial command, truncating", path, "at offset", offset)
+	return os.Truncate(path, offset)
+}
+
+// aofReplay runs aof files through the router one after another.
+type aofReplay struct {
+	router   CommandRouter
+	ctx      RequestContext
+	progress *LoadingState
+	// until stops the replay at the first #TS annotation after it, zero replays everything.
+	until time.Time
+	// onTruncated decides what happens to a file that ends part way through a
+	// command, when it is nil that is an error.
+	onTruncated func(path string, offset int64) error
+	keys        *KeyRing // to decrypt files with, encrypted or not is detected per file
+	applied     int      // commands, and keys from rdb bases
+	stopped     bool     // reached until, the rest of the files should be skipped
+}
+
+// File replays a single base or incr file, a base may be an rdb file.
+func (r *aofReplay) File(path string) error {
+	if r.stopped {
+		return nil
+	}
+	file, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer file.Close()
+
+	plain, decrypter, e := MaybeDecrypt(progressReader{file, r.progress}, r.keys)
+	if e != nil {
+		return fmt.Errorf("opening %s: %w", path, e)
+	}
+	if magic, _ := plain.Peek(len(MagicString)); string(magic) == MagicString {
+		loader := progressVisitor{NewRDBLoaderInto(r.ctx.Dataset()), r.progress}
+		if e := NewRDBStreamParser(plain, loader).Parse(); e != nil {
+			return fmt.Errorf("loading aof base %s: %w", path, e)
+		}
+		r.applied += int(loader.Keys())
+		return nil
+	}
+
+	pr := NewProtocolReader(plain, aofParser{})
+	for {
+		record, e := pr.ReadProto()
+		if e == io.EOF {
+			return nil
+		}
+		// a torn write leaves a partial command in a plain file, and a partial
+		// chunk in an encrypted one, which has to be cut off at a chunk boundary.
+		torn := e == ErrStreamClosed && decrypter == nil
+		tornAt := pr.Consumed()
+		if decrypter != nil && errors.Is(e, ErrEncryptedTruncated) {
+			torn, tornAt = true, decrypter.Valid()
+		}
+		if torn {
+			if r.onTruncated == nil {
+				return ErrAOFCorrupt{path, tornAt, errors.New("log ends part way through a command, see aof-load-truncated")}
+			}
+			file.Close()
+			return r.onTruncated(path, tornAt)
+		}
+		if e != nil {
+			return ErrAOFCorrupt{path, pr.Consumed(), e}
+		}
+		if record.Annotation != "" {
+			if ts, ok := aofTimestamp(record.Annotation); ok && !r.until.IsZero() && ts.After(r.until) {
+				r.stopped = true
+				return nil
+			}
+			continue
+		}
+		r.router.Route(r.ctx, record.Command)
+		r.applied++
+	}
+}
+
+// aofRecord is either a command or an annotation, a line starting with '#'
+// that redis ignores when replaying (we only know about #TS:<unix seconds>).
+type aofRecord struct {
+	Command    []RespValue
+	Annotation string
+}
+
+// aofParser reads aof records, for use with a ProtocolReader.
+type aofParser struct{}
+
+func (aofParser) TryParse(b []byte) (aofRecord, int, error) {
+	var none aofRecord
+	if len(b) == 0 {
+		return none, 0, ErrIncompleteStream
+	}
+	if b[0] == '#' {
+		end := bytes.Index(b, []byte("\r\n"))
+		if end < 0 {
+			return none, 0, ErrIncompleteStream
+		}
+		return aofRecord{Annotation: string(b[1:end])}, end + 2, nil
+	}
+	v, n, e := Deserialize(b)
+	if e != nil {
+		return none, n, e
+	}
+	if !v.isArray() {
+		return none, n, errors.New("expected a command array")
+	}
+	return aofRecord{Command: v.Value.([]RespValue)}, n, nil
+}
+
+func aofTimestamp(annotation string) (time.Time, bool) {
+	secs, found := strings.CutPrefix(annotation, "TS:")
+	if !found {
+		return time.Time{}, false
+	}
+	n, e := strconv.ParseInt(secs, 10, 64)
+	if e != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0), true
+}
+
+// Open starts appending to the aof. When there is no aof yet its base is
+// written from the server's dataset, so that nothing loaded from the rdb file
+// is lost.
+func (aof *AppendOnlyFile) Open(server *Server) error {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	if e := aof.migrateLegacy(); e != nil {
+		return e
+	}
+	if e := os.MkdirAll(aof.dir, 0755); e != nil {
+		return e
+	}
+
+	m, e := LoadAOFManifest(aof.manifestPath())
+	if errors.Is(e, os.ErrNotExist) {
+		m, e = aof.createBase(server.Dataset())
+	}
+	if e != nil {
+		return e
+	}
+	if len(m.Incrs) == 0 {
+		m = m.Clone()
+		seq := m.NextIncrSeq()
+		m.Incrs = append(m.Incrs, AOFInfo{aofIncrName(aof.name, seq), seq, AOFIncrType})
+		if e := writeAOFManifest(aof.dir, aof.name, m); e != nil {
+			return e
+		}
+	}
+
+	// appends can't be mixed into a file written with encryption the other
+	// way round, carry on in a new incr instead.
+	lastPath := filepath.Join(aof.dir, m.Incrs[len(m.Incrs)-1].Name)
+	if stat, e := os.Stat(lastPath); e == nil && stat.Size() > 0 && fileIsEncrypted(lastPath) != (aof.keys != nil) {
+		m = m.Clone()
+		seq := m.NextIncrSeq()
+		m.Incrs = append(m.Incrs, AOFInfo{aofIncrName(aof.name, seq), seq, AOFIncrType})
+		if e := writeAOFManifest(aof.dir, aof.name, m); e != nil {
+			return e
+		}
+	}
+
+	file, enc, e := aof.openIncr(m.Incrs[len(m.Incrs)-1].Name)
+	if e != nil {
+		return e
+	}
+	aof.file, aof.enc = file, enc
+	aof.manifest = m
+	removeUnlistedAOFFiles(aof.dir, aof.name, m)
+	aof.currentSize = aof.sizeOf(m.Files())
+	aof.baseSize = aof.currentSize
+	if aof.openTx {
+		discard, _ := RespValue{Array, bulkStrings("DISCARD")}.Serialize()
+		if e := aof.appendPayload(discard); e != nil {
+			return e
+		}
+		aof.openTx = false
+	}
+
+	aof.closed = make(chan struct{})
+	go aof.cron(server, aof.closed)
+	return nil
+}
+
+// openIncr opens an incr file for appending.
+func (aof *AppendOnlyFile) openIncr(name string) (*os.File, *EncryptWriter, error) {
+	file, e := os.OpenFile(filepath.Join(aof.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil || aof.keys == nil {
+		return file, nil, e
+	}
+	enc, e := AppendEncryptWriter(file, aof.keys)
+	if e != nil {
+		file.Close()
+		return nil, nil, e
+	}
+	return file, enc, nil
+}
+
+// createBase starts a brand new aof holding db, called with aof.lock held.
+func (aof *AppendOnlyFile) createBase(db RevivedDB) (*AOFManifest, error) {
+	base := AOFInfo{aofBaseName(aof.name, 1, aof.preamble), 1, AOFBaseType}
+	if e := aof.writeBase(base.Name, db); e != nil {
+		return nil, e
+	}
+	m := &AOFManifest{Base: &base}
+	return m, writeAOFManifest(aof.dir, aof.name, m)
+}
+
+// writeBase writes db to a temp file and renames it into place, so a file
+// with the base's name is always complete.
+func (aof *AppendOnlyFile) writeBase(name string, db RevivedDB) error {
+	tmp := filepath.Join(aof.dir, fmt.Sprintf("%sbg-%d.aof", aofTempRewritePrefix, os.Getpid()))
+	f, e := os.Create(tmp)
+	if e != nil {
+		return e
+	}
+	w, e := MaybeEncrypt(f, aof.keys)
+	if e == nil && aof.preamble {
+		e = writeRDBSnapshot(NewRDBFileWriter(w), db, "aof-base", "1")
+	} else if e == nil {
+		e = writeDatasetCommands(w, db)
+	}
+	if e == nil {
+		e = w.Close()
+	}
+	if e == nil {
+		e = f.Sync()
+	}
+	if closeErr := f.Close(); e == nil {
+		e = closeErr
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	if e := os.Rename(tmp, filepath.Join(aof.dir, name)); e != nil {
+		return e
+	}
+	return syncDir(aof.dir)
+}
+
+func (aof *AppendOnlyFile) sizeOf(files []AOFInfo) int64 {
+	var size int64
+	for _, f := range files {
+		if stat, e := os.Stat(filepath.Join(aof.dir, f.Name)); e == nil {
+			size += stat.Size()
+		}
+	}
+	return size
+}
+
+// Append writes a single command to the log.
+func (aof *AppendOnlyFile) Append(args []RespValue) error {
+	payload, e := RespValue{Array, args}.Serialize()
+	if e != nil {
+		return e
+	}
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	return aof.appendPayload(payload)
+}
+
+// appendPayload is called with the lock held.
+func (aof *AppendOnlyFile) appendPayload(payload []byte) error {
+	if aof.file == nil {
+		return ErrAOFNotOpen
+	}
+	if now := time.Now().Unix(); aof.timestamps && now != aof.lastTS {
+		payload = append([]byte(fmt.Sprintf("#TS:%d\r\n", now)), payload...)
+		aof.lastTS = now
+	}
+	var e error
+	if aof.enc != nil {
+		// a chunk per command, so a crash can't leave half of one sealed away in a buffer.
+		_, e = aof.enc.Write(payload)
+		if e == nil {
+			e = aof.enc.Flush()
+		}
+	} else {
+		_, e = aof.file.Write(payload)
+	}
+	if e != nil {
+		return e
+	}
+	aof.currentSize += int64(len(payload))
+	if aof.fsync == AppendFsyncAlways {
+		return aof.file.Sync()
+	}
+	aof.dirty = true
+	return nil
+}
+
+// StartRewrite compacts the aof into a new base holding db, in the background.
+// The caller must hold the server's Exec lock (shared is enough) so no write
+// lands between switching to a new incr file and snapshotting db. Everything
+// written before the switch ends up in the new base, and everything after it
+// goes to the new incr, which does the job of redis' old rewrite buffer. If we
+// crash part way through, the manifest still lists the old base and every incr.
+func (aof *AppendOnlyFile) StartRewrite(db RevivedDB) error {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	if aof.rewriting {
+		return ErrAOFRewriteInProgress
+	}
+	if aof.file == nil {
+		return ErrAOFNotOpen
+	}
+
+	m := aof.manifest.Clone()
+	seq := m.NextIncrSeq()
+	incr := AOFInfo{aofIncrName(aof.name, seq), seq, AOFIncrType}
+	m.Incrs = append(m.Incrs, incr)
+	file, enc, e := aof.openIncr(incr.Name)
+	if e != nil {
+		return e
+	}
+	if e := writeAOFManifest(aof.dir, aof.name, m); e != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return e
+	}
+	aof.file.Sync()
+	aof.file.Close()
+	aof.file, aof.enc = file, enc
+	aof.dirty = false
+	aof.lastTS = 0 // every incr starts with a timestamp
+	aof.manifest = m
+	aof.rewriting = true
+
+	go aof.rewrite(db.Snapshot(), incr)
+	return nil
+}
+
+func (aof *AppendOnlyFile) rewrite(snapshot RevivedDB, firstIncr AOFInfo) {
+	start := time.Now()
+	e := aof.installBase(snapshot, firstIncr)
+	snapshot.Release()
+	aof.lock.Lock()
+	aof.rewriting = false
+	aof.lastRewriteErr = e
+	aof.lock.Unlock()
+	if e != nil {
+		fmt.Println("[err] background aof rewrite failed", e)
+		return
+	}
+	fmt.Println("background aof rewrite finished in", time.Since(start))
+}
+
+// installBase writes the new base and swaps it into the manifest in place of
+// the old base and every incr before firstIncr, which are then deleted.
+func (aof *AppendOnlyFile) installBase(snapshot RevivedDB, firstIncr AOFInfo) error {
+	aof.lock.Lock()
+	seq := aof.manifest.NextBaseSeq()
+	aof.lock.Unlock()
+
+	base := AOFInfo{aofBaseName(aof.name, seq, aof.preamble), seq, AOFBaseType}
+	if e := aof.writeBase(base.Name, snapshot); e != nil {
+		return e
+	}
+
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	m := aof.manifest.Clone()
+	m.Base = &base
+	for len(m.Incrs) > 0 && m.Incrs[0].Seq < firstIncr.Seq {
+		m.Incrs = m.Incrs[1:]
+	}
+	if e := writeAOFManifest(aof.dir, aof.name, m); e != nil {
+		return e
+	}
+	aof.manifest = m
+	removeUnlistedAOFFiles(aof.dir, aof.name, m)
+	aof.currentSize = aof.sizeOf(m.Files())
+	aof.baseSize = aof.currentSize
+	return nil
+}
+
+// cron runs once a second, doing the fsync for appendfsync everysec and
+// starting a rewrite once the aof has grown enough.
+func (aof *AppendOnlyFile) cron(server *Server, closed chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			aof.lock.Lock()
+			if aof.fsync == AppendFsyncEverysec && aof.dirty && aof.file != nil {
+				if e := aof.file.Sync(); e != nil {
+					fmt.Println("[err] aof fsync failed", e)
+				}
+				aof.dirty = false
+			}
+			rewrite := aof.shouldRewrite()
+			aof.lock.Unlock()
+
+			if rewrite {
+				fmt.Println("aof has grown past auto-aof-rewrite-percentage, rewriting")
+				server.Exec.RLock()
+				if e := aof.StartRewrite(server.Dataset()); e != nil && e != ErrAOFRewriteInProgress {
+					fmt.Println("[err] couldn't start aof rewrite", e)
+				}
+				server.Exec.RUnlock()
+			}
+		}
+	}
+}
+
+// shouldRewrite is called with aof.lock held.
+func (aof *AppendOnlyFile) shouldRewrite() bool {
+	if aof.rewritePerc <= 0 || aof.rewriting || aof.file == nil || aof.currentSize < aof.rewriteMinSize {
+		return false
+	}
+	base := aof.baseSize
+	if base == 0 {
+		base = 1
+	}
+	return (aof.currentSize-base)*100/base >= int64(aof.rewritePerc)
+}
+
+func (aof *AppendOnlyFile) Rewriting() bool {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	return aof.rewriting
+}
+
+// InfoLines reports the aof fields of the persistence section of INFO.
+func (aof *AppendOnlyFile) InfoLines() []string {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	status := "ok"
+	if aof.lastRewriteErr != nil {
+		status = "err"
+	}
+	rewriting := 0
+	if aof.rewriting {
+		rewriting = 1
+	}
+	return []string{
+		"aof_enabled:1",
+		fmt.Sprintf("aof_rewrite_in_progress:%d", rewriting),
+		fmt.Sprintf("aof_last_bgrewrite_status:%s", status),
+		fmt.Sprintf("aof_current_size:%d", aof.currentSize),
+		fmt.Sprintf("aof_base_size:%d", aof.baseSize),
+	}
+}
+
+func (aof *AppendOnlyFile) Close() error {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	if aof.file == nil {
+		return nil
+	}
+	close(aof.closed)
+	syncErr := aof.file.Sync()
+	closeErr := aof.file.Close()
+	aof.file, aof.enc = nil, nil
+	if syncErr != nil {
+		return syncErr
+	}
+	return closeErr
+}
+
+// writeDatasetCommands writes the commands that recreate db, its function
+// libraries first, skipping keys that have already expired.
+func writeDatasetCommands(w io.Writer, db RevivedDB) error {
+	for _, lib := range db.Functions.Libraries() {
+		payload, _ := RespValue{Array, bulkStrings("FUNCTION", "LOAD", lib.code)}.Serialize()
+		if _, e := w.Write(payload); e != nil {
+			return e
+		}
+	}
+	for _, key := range db.DB.Keys() {
+		value, exists := db.DB.Get(key)
+		if !exists {
+			continue
+		}
+		cmd := bulkStrings("SET", key, value.String())
+		if ts, hasExpiry := db.Expiry.Get(key); hasExpiry {
+			if ts.Expired() {
+				continue
+			}
+			cmd = append(cmd, bulkStrings("PXAT", strconv.FormatInt(ts.Expiry.UnixMilli(), 10))...)
+		}
+		payload, e := RespValue{Array, cmd}.Serialize()
+		if e != nil {
+			return e
+		}
+		if _, e := w.Write(payload); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestContext(aof *AppendOnlyFile) RequestContext {
+	server := NewServer(NewKVStore(), NewExpiryStore(), NewServerConfig())
+	server.AOF = aof
+	return NewRequestContext(io.Discard, server)
+}
+
+// lastIncr is the incr file currently being appended to.
+func lastIncr(t *testing.T, aof *AppendOnlyFile) string {
+	m, e := LoadAOFManifest(aof.manifestPath())
+	if e != nil {
+		t.Fatal(e)
+	}
+	return filepath.Join(aof.Dir(), m.Incrs[len(m.Incrs)-1].Name)
+}
+
+func TestAOFAppendAndReplay(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "appendonlydir")
+	aof, e := NewAppendOnlyFile(dir, "appendonly.aof", AppendFsyncAlways)
+	if e != nil {
+		t.Fatal(e)
+	}
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(aof)
+	if e := aof.Open(ctx.Server); e != nil {
+		t.Fatal(e)
+	}
+	router.Route(ctx, bulkStrings("SET", "a", "1"))
+	router.Route(ctx, bulkStrings("SET", "b", "2", "PX", "100000"))
+	router.Route(ctx, bulkStrings("GET", "a"))
+	aof.Close()
+
+	path := lastIncr(t, aof)
+	complete, _ := os.Stat(path)
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("*3\r\n$3\r\nSET\r\n$1\r\nc")
+	f.Close()
+
+	replayed := newTestContext(nil)
+	if _, e := aof.Load(router, replayed, false); !errors.As(e, &ErrAOFCorrupt{}) {
+		t.Fatalf("expected the partial command to be rejected, got %v", e)
+	}
+
+	replayed = newTestContext(nil)
+	n, e := aof.Load(router, replayed, true)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n != 2 {
+		t.Fatalf("replayed %d commands, only the 2 writes should be logged", n)
+	}
+	if v, _ := replayed.KVStore.Get("a"); v.String() != "1" {
+		t.Fatalf("a = %q", v.String())
+	}
+	if _, exists := replayed.ExpiryStore.Get("b"); !exists {
+		t.Fatal("b lost its expiry")
+	}
+	if truncated, _ := os.Stat(path); truncated.Size() != complete.Size() {
+		t.Fatalf("log was truncated to %d bytes, want %d", truncated.Size(), complete.Size())
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	for _, preamble := range []bool{true, false} {
+		dir := filepath.Join(t.TempDir(), "appendonlydir")
+		aof, _ := NewAppendOnlyFile(dir, "appendonly.aof", AppendFsyncNo)
+		aof.RDBPreamble(preamble)
+		router := initCommandRouter(NewCommandRouter())
+		ctx := newTestContext(aof)
+		if e := aof.Open(ctx.Server); e != nil {
+			t.Fatal(e)
+		}
+		for i := 0; i < 50; i++ {
+			router.Route(ctx, bulkStrings("SET", "a", strconv.Itoa(i)))
+		}
+		if e := aof.StartRewrite(ctx.Dataset()); e != nil {
+			t.Fatal(e)
+		}
+		// lands in the new incr while the base is being written.
+		router.Route(ctx, bulkStrings("SET", "b", "after"))
+		for aof.Rewriting() {
+			time.Sleep(time.Millisecond)
+		}
+		aof.Close()
+
+		m, e := LoadAOFManifest(aof.manifestPath())
+		if e != nil {
+			t.Fatal(e)
+		}
+		if m.Base == nil || m.Base.Seq != 2 || len(m.Incrs) != 1 || m.Incrs[0].Seq != 2 {
+			t.Fatalf("unexpected manifest after rewrite:\n%s", m.Bytes())
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 3 {
+			t.Fatalf("expected the old base and incr to be removed, found %d files", len(entries))
+		}
+
+		replayed := newTestContext(nil)
+		if _, e := aof.Load(router, replayed, false); e != nil {
+			t.Fatal(e)
+		}
+		a, _ := replayed.KVStore.Get("a")
+		b, _ := replayed.KVStore.Get("b")
+		if a.String() != "49" || b.String() != "after" {
+			t.Fatalf("preamble %v: a = %q, b = %q", preamble, a.String(), b.String())
+		}
+	}
+}
+
+func TestAOFManifestParse(t *testing.T) {
+	m, e := ParseAOFManifest(strings.NewReader("file appendonly.aof.3.base.rdb seq 3 type b\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type h\n" +
+		"file appendonly.aof.4.incr.aof seq 4 type i\n" +
+		"file appendonly.aof.5.incr.aof seq 5 type i newfield x\n"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if m.Base.Name != "appendonly.aof.3.base.rdb" || len(m.Incrs) != 2 || len(m.History) != 1 {
+		t.Fatalf("parsed %+v", m)
+	}
+	if m.NextBaseSeq() != 4 || m.NextIncrSeq() != 6 {
+		t.Fatalf("next seqs %d %d", m.NextBaseSeq(), m.NextIncrSeq())
+	}
+	for _, bad := range []string{
+		"",
+		"file a seq 1 type x\n",
+		"file ../a seq 1 type b\n",
+		"file a seq 2 type i\nfile b seq 1 type i\n",
+	} {
+		if _, e := ParseAOFManifest(strings.NewReader(bad)); !errors.As(e, &ErrAOFManifest{}) {
+			t.Fatalf("%q: expected a manifest error, got %v", bad, e)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The aof is split across several files in its own directory, same as redis 7:
+//
+//	appendonly.aof.1.base.rdb    the dataset as of the last rewrite
+//	appendonly.aof.1.incr.aof    writes since then, possibly several of these
+//	appendonly.aof.manifest      which of the above make up the aof, in order
+//
+// The manifest has a line per file, "file <name> seq <n> type <b|i|h>", where
+// h marks files from before a rewrite that are waiting to be deleted. Nothing
+// in the directory counts unless the manifest lists it, and the manifest is
+// only ever replaced with a rename, so a crash at any point leaves a complete aof.
+
+const (
+	AOFBaseType    = 'b'
+	AOFIncrType    = 'i'
+	AOFHistoryType = 'h'
+
+	aofTempManifestPrefix = "temp-"
+	aofTempRewritePrefix  = "temp-rewriteaof-"
+)
+
+type ErrAOFManifest struct {
+	Line int
+	Err  error
+}
+
+func (e ErrAOFManifest) Error() string {
+	return fmt.Sprintf("invalid aof manifest at line %d: %s", e.Line, e.Err)
+}
+
+func (e ErrAOFManifest) Unwrap() error {
+	return e.Err
+}
+
+type AOFInfo struct {
+	Name string
+	Seq  int
+	Type byte
+}
+
+type AOFManifest struct {
+	Base    *AOFInfo
+	Incrs   []AOFInfo
+	History []AOFInfo
+}
+
+func aofBaseName(name string, seq int, rdb bool) string {
+	if rdb {
+		return fmt.Sprintf("%s.%d.base.rdb", name, seq)
+	}
+	return fmt.Sprintf("%s.%d.base.aof", name, seq)
+}
+
+func aofIncrName(name string, seq int) string {
+	return fmt.Sprintf("%s.%d.incr.aof", name, seq)
+}
+
+func aofManifestName(name string) string {
+	return name + ".manifest"
+}
+
+func ParseAOFManifest(r io.Reader) (*AOFManifest, error) {
+	m := &AOFManifest{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields)%2 != 0 {
+			return nil, ErrAOFManifest{line, errors.New("expected key value pairs")}
+		}
+		var info AOFInfo
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.Name = fields[i+1]
+			case "seq":
+				seq, e := strconv.Atoi(fields[i+1])
+				if e != nil {
+					return nil, ErrAOFManifest{line, e}
+				}
+				info.Seq = seq
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, ErrAOFManifest{line, fmt.Errorf("unknown file type %s", fields[i+1])}
+				}
+				info.Type = fields[i+1][0]
+			}
+			// anything else is a field from a newer version, ignore it.
+		}
+		if info.Name == "" || info.Seq == 0 || filepath.Base(info.Name) != info.Name {
+			return nil, ErrAOFManifest{line, errors.New("missing or invalid file name or seq")}
+		}
+		switch info.Type {
+		case AOFBaseType:
+			if m.Base != nil {
+				return nil, ErrAOFManifest{line, errors.New("more than one base file")}
+			}
+			m.Base = &info
+		case AOFIncrType:
+			if len(m.Incrs) > 0 && m.Incrs[len(m.Incrs)-1].Seq >= info.Seq {
+				return nil, ErrAOFManifest{line, errors.New("incr files out of order")}
+			}
+			m.Incrs = append(m.Incrs, info)
+		case AOFHistoryType:
+			m.History = append(m.History, info)
+		default:
+			return nil, ErrAOFManifest{line, fmt.Errorf("unknown file type %c", info.Type)}
+		}
+	}
+	if e := scanner.Err(); e != nil {
+		return nil, e
+	}
+	if m.Base == nil && len(m.Incrs) == 0 {
+		return nil, ErrAOFManifest{line, errors.New("manifest lists no files")}
+	}
+	return m, nil
+}
+
+func LoadAOFManifest(path string) (*AOFManifest, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return ParseAOFManifest(f)
+}
+
+func (m *AOFManifest) Bytes() []byte {
+	var buf bytes.Buffer
+	write := func(info AOFInfo) {
+		fmt.Fprintf(&buf, "file %s seq %d type %c\n", info.Name, info.Seq, info.Type)
+	}
+	if m.Base != nil {
+		write(*m.Base)
+	}
+	for _, h := range m.History {
+		write(h)
+	}
+	for _, i := range m.Incrs {
+		write(i)
+	}
+	return buf.Bytes()
+}
+
+// Files lists the files making up the aof in the order they should be replayed.
+func (m *AOFManifest) Files() []AOFInfo {
+	files := make([]AOFInfo, 0, len(m.Incrs)+1)
+	if m.Base != nil {
+		files = append(files, *m.Base)
+	}
+	return append(files, m.Incrs...)
+}
+
+func (m *AOFManifest) Clone() *AOFManifest {
+	c := &AOFManifest{}
+	if m.Base != nil {
+		base := *m.Base
+		c.Base = &base
+	}
+	c.Incrs = append(c.Incrs, m.Incrs...)
+	c.History = append(c.History, m.History...)
+	return c
+}
+
+func (m *AOFManifest) NextBaseSeq() int {
+	if m.Base == nil {
+		return 1
+	}
+	return m.Base.Seq + 1
+}
+
+func (m *AOFManifest) NextIncrSeq() int {
+	if len(m.Incrs) == 0 {
+		return 1
+	}
+	return m.Incrs[len(m.Incrs)-1].Seq + 1
+}
+
+// writeAOFManifest atomically replaces the manifest in dir.
+func writeAOFManifest(dir string, name string, m *AOFManifest) error {
+	manifest := aofManifestName(name)
+	tmp := filepath.Join(dir, aofTempManifestPrefix+manifest)
+	if e := writeFileSync(tmp, m.Bytes()); e != nil {
+		return e
+	}
+	if e := os.Rename(tmp, filepath.Join(dir, manifest)); e != nil {
+		return e
+	}
+	return syncDir(dir)
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, e := os.Create(path)
+	if e != nil {
+		return e
+	}
+	if _, e := f.Write(data); e != nil {
+		f.Close()
+		return e
+	}
+	if e := f.Sync(); e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// syncDir makes renames and deletes in dir durable.
+func syncDir(dir string) error {
+	d, e := os.Open(dir)
+	if e != nil {
+		return e
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeUnlistedAOFFiles cleans up after a crash or a finished rewrite: old
+// bases and incrs, and temp files that never made it into the manifest.
+func removeUnlistedAOFFiles(dir string, name string, m *AOFManifest) {
+	listed := map[string]bool{}
+	for _, f := range m.Files() {
+		listed[f.Name] = true
+	}
+	ours := regexp.MustCompile("^" + regexp.QuoteMeta(name) + `\.\d+\.(base\.(rdb|aof)|incr\.aof)$`)
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		return
+	}
+	for _, entry := range entries {
+		fname := entry.Name()
+		stale := ours.MatchString(fname) && !listed[fname]
+		temp := strings.HasPrefix(fname, aofTempRewritePrefix) || fname == aofTempManifestPrefix+aofManifestName(name)
+		if stale || temp {
+			if e := os.Remove(filepath.Join(dir, fname)); e == nil {
+				fmt.Println("removed stale aof file", fname)
+			}
+		}
+	}
+}
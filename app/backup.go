@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backups are built from the aof, copied into a directory of their own:
+//
+//	redis-server backup --dir /data --to /backups
+//	redis-server restore --from /backups --at "2024-05-01 14:01:00" --out dump.rdb
+//
+// Each run of backup copies the aof's current base (the first time it sees
+// it) and whatever has been appended to its incr files since the last run, so
+// running it often is cheap. The copies are grouped into generations, one per
+// base, and listed in backup.index:
+//
+//	base 1714572000-appendonly.aof.2.base.rdb source appendonly.aof.2.base.rdb ts 1714572000
+//	segment 1714572000-appendonly.aof.2.incr.aof source appendonly.aof.2.incr.aof
+//
+// Restoring to a time picks the newest generation whose base is older than
+// it, loads the base and replays its segments up to the first #TS annotation
+// past that time (see aof-timestamp-enabled). Anything appended to an incr
+// file after the last backup and before a rewrite deletes it is not in the
+// backup, so backups should run more often than rewrites.
+
+const backupIndexName = "backup.index"
+
+var ErrBackupEmpty = errors.New("the backup directory has no backups in it")
+
+type ErrBackupIndex struct {
+	Line int
+	Err  error
+}
+
+func (e ErrBackupIndex) Error() string {
+	return fmt.Sprintf("invalid backup index at line %d: %s", e.Line, e.Err)
+}
+
+func (e ErrBackupIndex) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoBackupBefore is a restore to a time before the oldest backed up base.
+type ErrNoBackupBefore struct {
+	At     time.Time
+	Oldest time.Time
+}
+
+func (e ErrNoBackupBefore) Error() string {
+	return fmt.Sprintf("nothing was backed up before %s, the oldest backup is from %s", e.At.Format(time.DateTime), e.Oldest.Format(time.DateTime))
+}
+
+// backupFile is a file copied into the backup directory, and the aof file it is a copy of.
+type backupFile struct {
+	Name   string
+	Source string
+}
+
+type backupGeneration struct {
+	Base     backupFile
+	TS       time.Time // when the base was written
+	Segments []backupFile
+}
+
+type BackupIndex struct {
+	Generations []backupGeneration
+}
+
+func LoadBackupIndex(dir string) (*BackupIndex, error) {
+	f, e := os.Open(filepath.Join(dir, backupIndexName))
+	if errors.Is(e, os.ErrNotExist) {
+		return &BackupIndex{}, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	idx := &BackupIndex{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields)%2 != 0 {
+			return nil, ErrBackupIndex{line, errors.New("expected key value pairs")}
+		}
+		values := map[string]string{}
+		for i := 0; i < len(fields); i += 2 {
+			values[fields[i]] = fields[i+1]
+		}
+		file := backupFile{values[fields[0]], values["source"]}
+		if file.Name == "" || filepath.Base(file.Name) != file.Name {
+			return nil, ErrBackupIndex{line, errors.New("missing or invalid file name")}
+		}
+		switch fields[0] {
+		case "base":
+			ts, e := strconv.ParseInt(values["ts"], 10, 64)
+			if e != nil {
+				return nil, ErrBackupIndex{line, e}
+			}
+			idx.Generations = append(idx.Generations, backupGeneration{Base: file, TS: time.Unix(ts, 0)})
+		case "segment":
+			if len(idx.Generations) == 0 {
+				return nil, ErrBackupIndex{line, errors.New("segment before any base")}
+			}
+			gen := &idx.Generations[len(idx.Generations)-1]
+			gen.Segments = append(gen.Segments, file)
+		default:
+			return nil, ErrBackupIndex{line, fmt.Errorf("unknown entry %s", fields[0])}
+		}
+	}
+	return idx, scanner.Err()
+}
+
+func (idx *BackupIndex) Bytes() []byte {
+	var sb strings.Builder
+	for _, gen := range idx.Generations {
+		fmt.Fprintf(&sb, "base %s source %s ts %d\n", gen.Base.Name, gen.Base.Source, gen.TS.Unix())
+		for _, seg := range gen.Segments {
+			fmt.Fprintf(&sb, "segment %s source %s\n", seg.Name, seg.Source)
+		}
+	}
+	return []byte(sb.String())
+}
+
+// Save atomically replaces the index in dir, so a crash mid backup leaves the previous one.
+func (idx *BackupIndex) Save(dir string) error {
+	tmp := filepath.Join(dir, "temp-"+backupIndexName)
+	if e := writeFileSync(tmp, idx.Bytes()); e != nil {
+		return e
+	}
+	if e := os.Rename(tmp, filepath.Join(dir, backupIndexName)); e != nil {
+		return e
+	}
+	return syncDir(dir)
+}
+
+// Covering returns the newest generation whose base was written at or before at.
+func (idx *BackupIndex) Covering(at time.Time) (*backupGeneration, error) {
+	if len(idx.Generations) == 0 {
+		return nil, ErrBackupEmpty
+	}
+	for i := len(idx.Generations) - 1; i >= 0; i-- {
+		if !idx.Generations[i].TS.After(at) {
+			return &idx.Generations[i], nil
+		}
+	}
+	return nil, ErrNoBackupBefore{at, idx.Generations[0].TS}
+}
+
+// BackupAOF copies what is new in the aof in aofDir into backupDir, returning
+// how many bytes it copied.
+func BackupAOF(aofDir string, name string, backupDir string) (int64, error) {
+	m, e := LoadAOFManifest(filepath.Join(aofDir, aofManifestName(name)))
+	if e != nil {
+		return 0, e
+	}
+	if m.Base == nil {
+		return 0, errors.New("the aof has no base file to back up")
+	}
+	if e := os.MkdirAll(backupDir, 0755); e != nil {
+		return 0, e
+	}
+	idx, e := LoadBackupIndex(backupDir)
+	if e != nil {
+		return 0, e
+	}
+
+	var copied int64
+	gens := idx.Generations
+	if len(gens) == 0 || gens[len(gens)-1].Base.Source != m.Base.Name {
+		basePath := filepath.Join(aofDir, m.Base.Name)
+		stat, e := os.Stat(basePath)
+		if e != nil {
+			return 0, e
+		}
+		ts := stat.ModTime()
+		base := backupFile{fmt.Sprintf("%d-%s", ts.Unix(), m.Base.Name), m.Base.Name}
+		n, e := copyFileTail(basePath, filepath.Join(backupDir, base.Name))
+		if e != nil {
+			return copied, e
+		}
+		copied += n
+		idx.Generations = append(idx.Generations, backupGeneration{Base: base, TS: ts})
+	}
+
+	gen := &idx.Generations[len(idx.Generations)-1]
+	prefix := strings.TrimSuffix(gen.Base.Name, gen.Base.Source)
+	for _, incr := range m.Incrs {
+		seg := backupFile{prefix + incr.Name, incr.Name}
+		n, e := copyFileTail(filepath.Join(aofDir, incr.Name), filepath.Join(backupDir, seg.Name))
+		if e != nil {
+			return copied, e
+		}
+		copied += n
+		known := false
+		for _, s := range gen.Segments {
+			known = known || s.Name == seg.Name
+		}
+		if !known {
+			gen.Segments = append(gen.Segments, seg)
+		}
+	}
+	return copied, idx.Save(backupDir)
+}
+
+// copyFileTail brings dst up to date with src, copying only the bytes dst
+// doesn't have yet. A src shorter than dst (a truncated aof) is copied whole.
+func copyFileTail(src string, dst string) (int64, error) {
+	in, e := os.Open(src)
+	if e != nil {
+		return 0, e
+	}
+	defer in.Close()
+
+	var have int64
+	dstStat, e := os.Stat(dst)
+	if e == nil {
+		have = dstStat.Size()
+	}
+	stat, e := in.Stat()
+	if e != nil {
+		return 0, e
+	}
+	if stat.Size() < have {
+		have = 0
+	}
+	if dstStat != nil && stat.Size() == have {
+		return 0, nil
+	}
+
+	out, e := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0644)
+	if e != nil {
+		return 0, e
+	}
+	if e := out.Truncate(have); e != nil {
+		out.Close()
+		return 0, e
+	}
+	if _, e := in.Seek(have, io.SeekStart); e != nil {
+		out.Close()
+		return 0, e
+	}
+	if _, e := out.Seek(have, io.SeekStart); e != nil {
+		out.Close()
+		return 0, e
+	}
+	n, e := io.Copy(out, in)
+	if e == nil {
+		e = out.Sync()
+	}
+	if closeErr := out.Close(); e == nil {
+		e = closeErr
+	}
+	return n, e
+}
+
+// RestoreBackup rebuilds the dataset as it was at the given time from the
+// backups in backupDir.
+func RestoreBackup(backupDir string, at time.Time, keys *KeyRing) (RevivedDB, error) {
+	idx, e := LoadBackupIndex(backupDir)
+	if e != nil {
+		return RevivedDB{}, e
+	}
+	gen, e := idx.Covering(at)
+	if e != nil {
+		return RevivedDB{}, e
+	}
+
+	server := NewServer(NewKVStore(), NewExpiryStore(), NewServerConfig())
+	ctx := NewRequestContext(io.Discard, server).quietContext()
+	replay := &aofReplay{
+		router:   initCommandRouter(NewCommandRouter()),
+		ctx:      ctx,
+		progress: NewLoadingState(),
+		until:    at,
+		keys:     keys,
+		// the last backup may have caught a command half written, it isn't
+		// ours to fix and the next backup will complete it.
+		onTruncated: func(path string, offset int64) error { return nil },
+	}
+	files := append([]backupFile{gen.Base}, gen.Segments...)
+	for _, f := range files {
+		if e := replay.File(filepath.Join(backupDir, f.Name)); e != nil {
+			return RevivedDB{}, e
+		}
+	}
+	return ctx.Dataset(), nil
+}
+
+// parseRestoreTime accepts unix seconds, RFC 3339, or a local date and time.
+func parseRestoreTime(s string) (time.Time, error) {
+	if secs, e := strconv.ParseInt(s, 10, 64); e == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if t, e := time.Parse(time.RFC3339, s); e == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.DateTime, "2006-01-02 15:04", time.DateOnly} {
+		if t, e := time.ParseInLocation(layout, s, time.Local); e == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't read '%s' as a time, use unix seconds, RFC 3339 or YYYY-MM-DD HH:MM:SS", s)
+}
+
+// runBackupTool is main for the backup subcommand.
+func runBackupTool(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", "/tmp/redis-data", "the server's data directory")
+	dirname := flags.String("appenddirname", "appendonlydir", "the directory, inside dir, that holds the append only files")
+	name := flags.String("appendfilename", "appendonly.aof", "the prefix for the names of the append only files")
+	to := flags.String("to", "", "the directory to back up into")
+	if e := flags.Parse(args); e != nil {
+		return 2
+	}
+	if *to == "" {
+		fmt.Fprintln(stderr, "backup needs a directory to back up into, see --to")
+		return 2
+	}
+
+	copied, e := BackupAOF(filepath.Join(*dir, *dirname), *name, *to)
+	if e != nil {
+		fmt.Fprintln(stderr, "backup failed:", e)
+		return 1
+	}
+	fmt.Fprintf(stdout, "backed up %d new bytes into %s\n", copied, *to)
+	return 0
+}
+
+// runRestoreTool is main for the restore subcommand.
+func runRestoreTool(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	from := flags.String("from", "", "the backup directory to restore from")
+	at := flags.String("at", "", "the time to restore to, defaults to the latest backed up write")
+	out := flags.String("out", "dump.rdb", "the rdb file to write the restored dataset to")
+	list := flags.Bool("list", false, "list the backed up generations instead of restoring")
+	keyFile := flags.String("key-file", "", "decrypt the backup with this key, and encrypt the restored rdb file with it")
+	oldKeyFiles := flags.String("old-key-files", "", "comma separated keys the backup may also have been encrypted with")
+	if e := flags.Parse(args); e != nil {
+		return 2
+	}
+	keys, e := keyRingFromFiles(*keyFile, *oldKeyFiles)
+	if e != nil {
+		fmt.Fprintln(stderr, e)
+		return 2
+	}
+	if *from == "" {
+		fmt.Fprintln(stderr, "restore needs a backup directory, see --from")
+		return 2
+	}
+
+	if *list {
+		idx, e := LoadBackupIndex(*from)
+		if e != nil {
+			fmt.Fprintln(stderr, e)
+			return 1
+		}
+		for _, gen := range idx.Generations {
+			fmt.Fprintf(stdout, "%s base %s, %d segments\n", gen.TS.Format(time.DateTime), gen.Base.Source, len(gen.Segments))
+		}
+		return 0
+	}
+
+	target := time.Now()
+	if *at != "" {
+		t, e := parseRestoreTime(*at)
+		if e != nil {
+			fmt.Fprintln(stderr, e)
+			return 2
+		}
+		target = t
+	}
+	db, e := RestoreBackup(*from, target, keys)
+	if e != nil {
+		fmt.Fprintln(stderr, "restore failed:", e)
+		return 1
+	}
+
+	f, e := os.Create(*out)
+	if e == nil {
+		var w io.WriteCloser
+		if w, e = MaybeEncrypt(f, keys); e == nil {
+			e = writeRDBSnapshot(NewRDBFileWriter(w), db)
+		}
+		if e == nil {
+			e = w.Close()
+		}
+		if closeErr := f.Close(); e == nil {
+			e = closeErr
+		}
+	}
+	if e != nil {
+		fmt.Fprintln(stderr, "writing the restored dataset failed:", e)
+		return 1
+	}
+	fmt.Fprintf(stdout, "restored %d keys as of %s to %s\n", db.DB.Len(), target.Format(time.DateTime), *out)
+	return 0
+}
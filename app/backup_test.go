@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRestorePointInTime(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "appendonlydir")
+	aof, _ := NewAppendOnlyFile(dir, "appendonly.aof", AppendFsyncNo)
+	ctx := newTestContext(aof)
+	if e := aof.Open(ctx.Server); e != nil {
+		t.Fatal(e)
+	}
+	aof.Close()
+	m, _ := LoadAOFManifest(aof.manifestPath())
+	os.Chtimes(filepath.Join(dir, m.Base.Name), time.Unix(500, 0), time.Unix(500, 0))
+
+	incr := lastIncr(t, aof)
+	appendRecords := func(records string) {
+		f, _ := os.OpenFile(incr, os.O_APPEND|os.O_WRONLY, 0644)
+		f.WriteString(records)
+		f.Close()
+	}
+	appendRecords("#TS:1000\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n")
+	backups := filepath.Join(t.TempDir(), "backups")
+	if _, e := BackupAOF(dir, "appendonly.aof", backups); e != nil {
+		t.Fatal(e)
+	}
+	later := "#TS:2000\r\n*1\r\n$8\r\nFLUSHALL\r\n#TS:3000\r\n*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n"
+	appendRecords(later)
+	copied, e := BackupAOF(dir, "appendonly.aof", backups)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if copied != int64(len(later)) {
+		t.Fatalf("second backup copied %d bytes, only what was appended should be copied", copied)
+	}
+
+	for _, tc := range []struct {
+		at   int64
+		keys []string
+	}{
+		{1999, []string{"a"}},
+		{2500, nil},
+		{3000, []string{"c"}},
+	} {
+		db, e := RestoreBackup(backups, time.Unix(tc.at, 0), nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		keys := db.DB.Keys()
+		if len(keys) != len(tc.keys) || (len(keys) == 1 && keys[0] != tc.keys[0]) {
+			t.Fatalf("restored to %d: keys %v, want %v", tc.at, keys, tc.keys)
+		}
+	}
+	if _, e := RestoreBackup(backups, time.Unix(100, 0), nil); !errors.As(e, &ErrNoBackupBefore{}) {
+		t.Fatalf("restoring to before the first base: %v", e)
+	}
+}
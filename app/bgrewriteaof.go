@@ -0,0 +1,17 @@
+package main
+
+var BgRewriteAOFCommand = Command{"bgrewriteaof", bgrewriteaof, 0}
+
+// bgrewriteaof doesn't take the write lock, writes only have to be kept out
+// while the rewrite switches incr files, and sharing Exec does that.
+func bgrewriteaof(ctx RequestContext, args []RespValue) {
+	if ctx.AOF == nil {
+		ctx.SendError("ERR Append only file is disabled, set appendonly yes to use BGREWRITEAOF")
+		return
+	}
+	if e := ctx.AOF.StartRewrite(ctx.Dataset()); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	ctx.SendSimpleString("Background append only file rewriting started")
+}
@@ -0,0 +1,48 @@
+package main
+
+// Client is the state of a client connection that carries over from one
+// command to the next. Commands that don't come from a client, like a
+// backup being restored, have none.
+type Client struct {
+	asking bool         // the next command may use a slot we're importing, see ASKING
+	tx     *transaction // the commands queued since MULTI, nil outside of one
+
+	watching map[string]watchState // the keys WATCHed for the next EXEC
+}
+
+func NewClient() *Client {
+	return &Client{}
+}
+
+// transaction is what a client has queued since MULTI, for EXEC to run.
+type transaction struct {
+	commands   []queuedCommand
+	aborted    bool // a command couldn't be queued, EXEC won't run any of them
+	running    bool // EXEC is running the commands
+	propagated bool // a MULTI has gone out ahead of the first write, an EXEC has to follow the last one
+}
+
+type queuedCommand struct {
+	cmd  Command
+	args []RespValue
+}
+
+// takeAsking is whether the client sent ASKING before this command, which
+// only counts for the one command after it.
+func (c *Client) takeAsking() bool {
+	if c == nil {
+		return false
+	}
+	asking := c.asking
+	c.asking = false
+	return asking
+}
+
+// queueing is the client's transaction while it's queuing commands for
+// EXEC, nil when they should run straight away.
+func (c *Client) queueing() *transaction {
+	if c == nil || c.tx == nil || c.tx.running {
+		return nil
+	}
+	return c.tx
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keys are spread over this many slots, and each slot is served by one master.
+const ClusterSlots = 16384
+
+// the bus port is the client port plus this, unless it's in the node config.
+const clusterBusPortOffset = 10000
+
+var ErrClusterCrossSlot = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+var ErrClusterDown = errors.New("CLUSTERDOWN Hash slot not served")
+var ErrClusterIsDown = errors.New("CLUSTERDOWN The cluster is down")
+var ErrClusterInvalidSlot = errors.New("ERR Invalid or out of range slot")
+var ErrClusterTryAgain = errors.New("TRYAGAIN Multiple keys request during rehashing of slot")
+
+// ErrClusterMoved sends the client to the node that serves the slot.
+type ErrClusterMoved struct {
+	slot int
+	addr string
+}
+
+func (e ErrClusterMoved) Error() string {
+	return fmt.Sprintf("MOVED %d %s", e.slot, e.addr)
+}
+
+// ErrClusterAsk sends the client to the node a slot is being moved to, for
+// just the one command. It's sent with ASKING first, so the node serves it
+// even though the slot isn't its yet.
+type ErrClusterAsk struct {
+	slot int
+	addr string
+}
+
+func (e ErrClusterAsk) Error() string {
+	return fmt.Sprintf("ASK %d %s", e.slot, e.addr)
+}
+
+// KeySlot is the slot a key belongs to. When the key has a non empty {hash
+// tag} only that is hashed, so that related keys can be kept together.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(Crc16([]byte(key)) & (ClusterSlots - 1))
+}
+
+// the keys each command works on, a command that isn't here has none and
+// runs wherever it's sent.
+var commandKeys = map[string]func(args []RespValue) []string{
+	"get":            firstKey,
+	"set":            firstKey,
+	"del":            everyKey,
+	"dump":           firstKey,
+	"restore":        firstKey,
+	"restore-asking": firstKey,
+	"migrate":        migrateKeys,
+	"watch":          everyKey,
+	"eval":           scriptKeys,
+	"evalsha":        scriptKeys,
+	"fcall":          scriptKeys,
+	"fcall_ro":       scriptKeys,
+}
+
+func firstKey(args []RespValue) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	return []string{args[0].String()}
+}
+
+func everyKey(args []RespValue) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.String()
+	}
+	return keys
+}
+
+// ClusterNode is a node of the cluster, and what we know about how it's doing.
+type ClusterNode struct {
+	id          string
+	host        string
+	port        string
+	busPort     string
+	master      string // the id of the node we replicate, "" for a master
+	configEpoch int64  // the epoch its slots were last claimed in, masters with higher ones win slots
+	offset      int64  // its replication offset, as of its last message
+
+	created      time.Time
+	handshake    bool // we met it but don't know its id yet, the id is a made up one
+	meet         bool // the first message on our link should be a MEET
+	pfail        bool // it hasn't answered our pings for cluster-node-timeout
+	fail         bool // enough masters agree it's pfail
+	failTime     time.Time
+	failReports  map[string]time.Time // the masters that told us it's pfail, by id
+	link         *clusterLink         // our link to it, we ping it over this
+	dialing      bool
+	pingSent     time.Time // zero once it has answered
+	pongReceived time.Time
+	votedTime    time.Time // when we last voted for one of its replicas to replace it
+}
+
+func newClusterNode(id string, host string, port string, busPort string) *ClusterNode {
+	return &ClusterNode{id: id, host: host, port: port, busPort: busPort, created: time.Now(), failReports: map[string]time.Time{}}
+}
+
+func (n *ClusterNode) Addr() string {
+	return net.JoinHostPort(n.host, n.port)
+}
+
+func (n *ClusterNode) BusAddr() string {
+	return net.JoinHostPort(n.host, n.busPort)
+}
+
+// the states the cluster can be in, as CLUSTER INFO reports them.
+const (
+	ClusterStateOK   = "ok"
+	ClusterStateFail = "fail" // some slot isn't served, or we can't reach most of the masters
+)
+
+// Cluster is the slot table and the nodes serving it, loaded from the node
+// config file (cluster-config-file in dir) when we start with
+// --cluster-enabled. A node without one starts as a master with no slots,
+// and writes one for itself.
+type Cluster struct {
+	path        string
+	config      *SharedRWStore[string]
+	nodeTimeout time.Duration
+	server      *Server // set once the bus is started
+	bus         net.Listener
+	stop        chan struct{}
+
+	lock          sync.Mutex
+	myself        *ClusterNode
+	nodes         map[string]*ClusterNode // by id
+	slots         [ClusterSlots]*ClusterNode
+	currentEpoch  int64
+	lastVoteEpoch int64
+	state         string
+	forgotten     map[string]time.Time  // nodes we were told to FORGET, and until when gossip about them is ignored
+	links         map[*clusterLink]bool // the links other nodes opened to us
+	dirty         bool                  // the node config needs saving
+	election      clusterElection       // our bid to replace our master, while it's failing
+	migrating     map[int]*ClusterNode  // slots of ours we're moving, to the node they're going to
+	importing     map[int]*ClusterNode  // slots we're taking over, from the node they're coming from
+}
+
+func NewCluster(config *SharedRWStore[string]) (*Cluster, error) {
+	dir, _ := config.Get("dir")
+	name, _ := config.Get("cluster-config-file")
+	if name == "" {
+		name = "nodes.conf"
+	}
+	timeout, _ := config.Get("cluster-node-timeout")
+	if timeout == "" {
+		timeout = "15000"
+	}
+	ms, e := strconv.Atoi(timeout)
+	if e != nil || ms <= 0 {
+		return nil, fmt.Errorf("invalid cluster-node-timeout '%s'", timeout)
+	}
+	c := &Cluster{
+		path:        filepath.Join(dir, name),
+		config:      config,
+		nodeTimeout: time.Duration(ms) * time.Millisecond,
+		stop:        make(chan struct{}),
+		nodes:       map[string]*ClusterNode{},
+		forgotten:   map[string]time.Time{},
+		links:       map[*clusterLink]bool{},
+		migrating:   map[int]*ClusterNode{},
+		importing:   map[int]*ClusterNode{},
+	}
+
+	data, e := os.ReadFile(c.path)
+	if errors.Is(e, os.ErrNotExist) {
+		c.myself = newClusterNode(newReplID(), "", "", "")
+		c.nodes[c.myself.id] = c.myself
+		fmt.Println("[cluster] no node config found, starting as a new node", c.myself.id)
+	} else if e != nil {
+		return nil, e
+	} else if e := c.load(string(data)); e != nil {
+		return nil, fmt.Errorf("invalid node config %s: %w", c.path, e)
+	}
+
+	// our own address is whatever we're started with now.
+	port, _ := config.Get("port")
+	c.myself.port = port
+	c.myself.busPort = strconv.Itoa(atoiOr(port, 0) + clusterBusPortOffset)
+	if busPort, _ := config.Get("cluster-port"); busPort != "" && busPort != "0" {
+		c.myself.busPort = busPort
+	}
+	if ip, _ := config.Get("cluster-announce-ip"); ip != "" {
+		c.myself.host = ip
+	} else if c.myself.host == "" {
+		c.myself.host = "127.0.0.1"
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updateState()
+	return c, c.save()
+}
+
+func atoiOr(s string, or int) int {
+	if i, e := strconv.Atoi(s); e == nil {
+		return i
+	}
+	return or
+}
+
+// load parses a node config file, one node a line:
+//
+//	<id> <ip:port@busport> <flags> <master id or -> <ping sent> <pong received> <config epoch> <link state> <slot or range>...
+//
+// and a last "vars currentEpoch <n> lastVoteEpoch <n>" line. Our own line
+// also has the slots we're moving, as [slot->-id] for the ones going to
+// another node and [slot-<-id] for the ones coming from one.
+func (c *Cluster) load(data string) error {
+	owners := map[*ClusterNode][]string{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				v, e := strconv.ParseInt(fields[i+1], 10, 64)
+				if e != nil {
+					return fmt.Errorf("invalid %s '%s'", fields[i], fields[i+1])
+				}
+				switch fields[i] {
+				case "currentEpoch":
+					c.currentEpoch = v
+				case "lastVoteEpoch":
+					c.lastVoteEpoch = v
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("expected at least 8 fields in '%s'", line)
+		}
+
+		n := newClusterNode(fields[0], "", "", "")
+		if len(n.id) != 40 {
+			return fmt.Errorf("invalid node id '%s'", n.id)
+		}
+		// the address can have a ",hostname" after it, which we don't use.
+		addr, _, _ := strings.Cut(fields[1], ",")
+		addr, n.busPort, _ = strings.Cut(addr, "@")
+		host, port, e := net.SplitHostPort(addr)
+		if e != nil {
+			return fmt.Errorf("invalid node address '%s'", fields[1])
+		}
+		n.host, n.port = host, port
+		if n.busPort == "" {
+			n.busPort = strconv.Itoa(atoiOr(port, 0) + clusterBusPortOffset)
+		}
+		flags := strings.Split(fields[2], ",")
+		if slices.Contains(flags, "myself") {
+			if c.myself != nil {
+				return errors.New("more than one node is flagged myself")
+			}
+			c.myself = n
+		}
+		if slices.Contains(flags, "slave") {
+			if fields[3] == "-" {
+				return fmt.Errorf("replica %s has no master", n.id)
+			}
+			n.master = fields[3]
+		}
+		if slices.Contains(flags, "fail") {
+			n.fail, n.failTime = true, time.Now()
+		}
+		if n.configEpoch, e = strconv.ParseInt(fields[6], 10, 64); e != nil {
+			return fmt.Errorf("invalid config epoch '%s'", fields[6])
+		}
+		c.nodes[n.id] = n
+		owners[n] = fields[8:]
+	}
+	if c.myself == nil {
+		return errors.New("no node is flagged myself")
+	}
+
+	for n, ranges := range owners {
+		for _, r := range ranges {
+			if strings.HasPrefix(r, "[") {
+				if e := c.loadMovingSlot(n, r); e != nil {
+					return e
+				}
+				continue
+			}
+			first, last, e := parseSlotRange(r)
+			if e != nil {
+				return e
+			}
+			for slot := first; slot <= last; slot++ {
+				if c.slots[slot] != nil {
+					return fmt.Errorf("slot %d is served by both %s and %s", slot, c.slots[slot].id, n.id)
+				}
+				c.slots[slot] = n
+			}
+		}
+	}
+	return nil
+}
+
+// loadMovingSlot parses a [slot->-id] or [slot-<-id] entry, they're only
+// kept for our own slots, the other nodes track their own.
+func (c *Cluster) loadMovingSlot(n *ClusterNode, r string) error {
+	entry, closed := strings.CutSuffix(strings.TrimPrefix(r, "["), "]")
+	moving := c.migrating
+	from, id, found := strings.Cut(entry, "->-")
+	if !found {
+		moving = c.importing
+		from, id, found = strings.Cut(entry, "-<-")
+	}
+	slot, e := parseSlot(from)
+	if !closed || !found || e != nil {
+		return fmt.Errorf("invalid slot entry '%s'", r)
+	}
+	if n != c.myself {
+		return nil
+	}
+	other := c.nodes[id]
+	if other == nil {
+		return fmt.Errorf("slot %d is being moved to or from the unknown node %s", slot, id)
+	}
+	moving[slot] = other
+	return nil
+}
+
+// parseSlotRange parses "first-last", or a single slot.
+func parseSlotRange(r string) (int, int, error) {
+	from, to, isRange := strings.Cut(r, "-")
+	if !isRange {
+		to = from
+	}
+	first, e1 := parseSlot(from)
+	last, e2 := parseSlot(to)
+	if e1 != nil || e2 != nil || first > last {
+		return 0, 0, fmt.Errorf("invalid slot range '%s'", r)
+	}
+	return first, last, nil
+}
+
+func parseSlot(s string) (int, error) {
+	slot, e := strconv.Atoi(s)
+	if e != nil || slot < 0 || slot >= ClusterSlots {
+		return 0, ErrClusterInvalidSlot
+	}
+	return slot, nil
+}
+
+// save writes the node config file, called with the lock held.
+func (c *Cluster) save() error {
+	c.dirty = false
+	var sb strings.Builder
+	for _, n := range c.sortedNodes() {
+		// nodes we're still meeting are met again if they're still around.
+		if n.handshake {
+			continue
+		}
+		sb.WriteString(c.nodeLine(n) + "\n")
+	}
+	fmt.Fprintf(&sb, "vars currentEpoch %d lastVoteEpoch %d\n", c.currentEpoch, c.lastVoteEpoch)
+
+	tmp := c.path + ".tmp"
+	if e := writeFileSync(tmp, []byte(sb.String())); e != nil {
+		return e
+	}
+	if e := os.Rename(tmp, c.path); e != nil {
+		return e
+	}
+	return syncDir(filepath.Dir(c.path))
+}
+
+// nodeLine is how a node is written in the node config file, and listed
+// by CLUSTER NODES.
+func (c *Cluster) nodeLine(n *ClusterNode) string {
+	var flags []string
+	if n == c.myself {
+		flags = append(flags, "myself")
+	}
+	master := "-"
+	if n.master != "" {
+		flags = append(flags, "slave")
+		master = n.master
+	} else {
+		flags = append(flags, "master")
+	}
+	if n.pfail {
+		flags = append(flags, "fail?")
+	}
+	if n.fail {
+		flags = append(flags, "fail")
+	}
+	if n.handshake {
+		flags = append(flags, "handshake")
+	}
+	linkState := "disconnected"
+	if n == c.myself || n.link != nil {
+		linkState = "connected"
+	}
+	// a replica goes by its master's epoch.
+	epoch := n.configEpoch
+	if m := c.nodes[n.master]; m != nil {
+		epoch = m.configEpoch
+	}
+	line := fmt.Sprintf("%s %s@%s %s %s %d %d %d %s",
+		n.id, n.Addr(), n.busPort, strings.Join(flags, ","), master,
+		unixMilli(n.pingSent), unixMilli(n.pongReceived), epoch, linkState)
+	for _, r := range c.slotRanges(n) {
+		if r[0] == r[1] {
+			line += fmt.Sprintf(" %d", r[0])
+		} else {
+			line += fmt.Sprintf(" %d-%d", r[0], r[1])
+		}
+	}
+	if n == c.myself {
+		for _, slot := range sortedSlots(c.migrating) {
+			line += fmt.Sprintf(" [%d->-%s]", slot, c.migrating[slot].id)
+		}
+		for _, slot := range sortedSlots(c.importing) {
+			line += fmt.Sprintf(" [%d-<-%s]", slot, c.importing[slot].id)
+		}
+	}
+	return line
+}
+
+func sortedSlots(moving map[int]*ClusterNode) []int {
+	slots := make([]int, 0, len(moving))
+	for slot := range moving {
+		slots = append(slots, slot)
+	}
+	slices.Sort(slots)
+	return slots
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// sortedNodes has myself first, then the rest by id. Called with the lock held.
+func (c *Cluster) sortedNodes() []*ClusterNode {
+	nodes := make([]*ClusterNode, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n != c.myself {
+			nodes = append(nodes, n)
+		}
+	}
+	slices.SortFunc(nodes, func(a, b *ClusterNode) int { return strings.Compare(a.id, b.id) })
+	return append([]*ClusterNode{c.myself}, nodes...)
+}
+
+// slotRanges are the runs of slots n serves, as first and last slot.
+// Called with the lock held.
+func (c *Cluster) slotRanges(n *ClusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < ClusterSlots; slot++ {
+		if c.slots[slot] != n {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1][1] == slot-1 {
+			ranges[len(ranges)-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// replicasOf are the nodes replicating n, called with the lock held.
+func (c *Cluster) replicasOf(n *ClusterNode) []*ClusterNode {
+	var replicas []*ClusterNode
+	for _, node := range c.sortedNodes() {
+		if node.master == n.id && !node.fail {
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
+
+// Redirect is the error for a command on keys we don't serve, it's nil when
+// the command can run here. Every key has to be in the same slot.
+//
+// While a slot is being moved its keys are on one node or the other, exists
+// says which ones are still here. Commands on a slot we're moving away run
+// here while all their keys are, and are sent on with ASK once they aren't.
+// The node they go to serves the slot to clients that say they were asked
+// to come (asking), until it's told the slot is its.
+func (c *Cluster) Redirect(keys []string, asking bool, exists func(key string) bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeySlot(key) != slot {
+			return ErrClusterCrossSlot
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	owner := c.slots[slot]
+	if owner == nil {
+		return ErrClusterDown
+	}
+	if c.state != ClusterStateOK {
+		return ErrClusterIsDown
+	}
+
+	migrating, importing := c.migrating[slot], c.importing[slot]
+	if owner != c.myself {
+		migrating = nil
+	}
+	missing := 0
+	if migrating != nil || importing != nil {
+		for _, key := range keys {
+			if !exists(key) {
+				missing++
+			}
+		}
+	}
+	if migrating != nil && missing > 0 {
+		// some of the keys have gone and some haven't, they'll all be on
+		// the same node again soon.
+		if missing < len(keys) {
+			return ErrClusterTryAgain
+		}
+		return ErrClusterAsk{slot, migrating.Addr()}
+	}
+	if importing != nil && asking {
+		if len(keys) > 1 && missing > 0 {
+			return ErrClusterTryAgain
+		}
+		return nil
+	}
+	if owner != c.myself {
+		return ErrClusterMoved{slot, owner.Addr()}
+	}
+	return nil
+}
+
+// updateState works out whether we can serve clients: every slot has to be
+// served by a master that isn't failing, and we have to be able to reach
+// most of the masters. Called with the lock held.
+func (c *Cluster) updateState() {
+	state := ClusterStateOK
+	for _, owner := range c.slots {
+		if owner == nil || owner.fail {
+			state = ClusterStateFail
+			break
+		}
+	}
+	// a master cut off from most of the others is probably being failed
+	// over on the other side, so it stops taking writes.
+	reachable := 0
+	for _, master := range c.sizedMasters() {
+		if master == c.myself || (!master.pfail && !master.fail) {
+			reachable++
+		}
+	}
+	if reachable < c.quorum() {
+		state = ClusterStateFail
+	}
+	if state != c.state {
+		fmt.Println("[cluster] cluster state changed:", state)
+		c.state = state
+	}
+}
+
+// sizedMasters are the masters serving at least one slot, called with the
+// lock held.
+func (c *Cluster) sizedMasters() []*ClusterNode {
+	seen := map[*ClusterNode]bool{}
+	var masters []*ClusterNode
+	for _, owner := range c.slots {
+		if owner != nil && !seen[owner] {
+			seen[owner] = true
+			masters = append(masters, owner)
+		}
+	}
+	return masters
+}
+
+// quorum is how many masters make a majority, for failing nodes and
+// electing replicas. Called with the lock held.
+func (c *Cluster) quorum() int {
+	return len(c.sizedMasters())/2 + 1
+}
+
+// slotCount is how many slots n serves, called with the lock held.
+func (c *Cluster) slotCount(n *ClusterNode) int {
+	count := 0
+	for _, owner := range c.slots {
+		if owner == n {
+			count++
+		}
+	}
+	return count
+}
+
+// MasterAddr is the address of the master we replicate, host is "" when
+// we're a master or don't know where it is.
+func (c *Cluster) MasterAddr() (string, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	master, known := c.nodes[c.myself.master]
+	if c.myself.master == "" || !known {
+		return "", ""
+	}
+	return master.host, master.port
+}
+
+func (c *Cluster) MyID() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.myself.id
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeySlot(t *testing.T) {
+	if crc := Crc16([]byte("123456789")); crc != 0x31c3 {
+		t.Fatalf("expected the xmodem crc16 check value 0x31c3, got %#x", crc)
+	}
+	for key, slot := range map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": KeySlot("user1000"),
+		"foo{}{bar}":           KeySlot("foo{}{bar}"),
+		"foo{{bar}}zap":        KeySlot("{bar"),
+		"foo{bar}{zap}":        KeySlot("bar"),
+	} {
+		if got := KeySlot(key); got != slot {
+			t.Errorf("expected '%s' in slot %d, got %d", key, slot, got)
+		}
+	}
+	if KeySlot("foo{}{bar}") == KeySlot("bar") {
+		t.Error("expected an empty hash tag to hash the whole key")
+	}
+}
+
+const testMyID = "e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca"
+const testOtherID = "67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1"
+const testReplicaID = "292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f"
+
+// startTestClusterNode serves the first half of the slots, a node at port
+// 7001 serves the second half and has a replica at 7002.
+func startTestClusterNode(t *testing.T) RequestContext {
+	ctx := newTestContext(nil)
+	dir := t.TempDir()
+	ctx.Config.Set("dir", dir)
+	ctx.Config.Set("port", "7000")
+	conf := testMyID + " 127.0.0.1:7000@17000 myself,master - 0 0 1 connected 0-8191\n" +
+		testOtherID + " 127.0.0.1:7001@17001 master - 0 0 2 connected 8192-16383\n" +
+		testReplicaID + " 127.0.0.1:7002@17002 slave " + testOtherID + " 0 0 2 connected\n" +
+		"vars currentEpoch 2 lastVoteEpoch 0\n"
+	if e := os.WriteFile(filepath.Join(dir, "nodes.conf"), []byte(conf), 0644); e != nil {
+		t.Fatal(e)
+	}
+	cluster, e := NewCluster(ctx.Config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ctx.Cluster = cluster
+	return ctx
+}
+
+func TestClusterRedirects(t *testing.T) {
+	ctx := startTestClusterNode(t)
+	router := initCommandRouter(NewCommandRouter())
+	var out bytes.Buffer
+	ctx.Connection = &out
+
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "bar", "1"}, "+OK\r\n"},
+		{[]string{"GET", "bar"}, "$1\r\n1\r\n"},
+		{[]string{"GET", "foo"}, "-MOVED 12182 127.0.0.1:7001\r\n"},
+		{[]string{"DEL", "bar", "foo"}, "-CROSSSLOT Keys in request don't hash to the same slot\r\n"},
+		{[]string{"DEL", "{bar}a", "{bar}b"}, ":0\r\n"},
+		{[]string{"CLUSTER", "KEYSLOT", "foo"}, ":12182\r\n"},
+		{[]string{"CLUSTER", "COUNTKEYSINSLOT", "5061"}, ":1\r\n"},
+		{[]string{"CLUSTER", "GETKEYSINSLOT", "5061", "10"}, "*1\r\n$3\r\nbar\r\n"},
+		{[]string{"CLUSTER", "COUNTKEYSINSLOT", "16384"}, "-ERR Invalid or out of range slot\r\n"},
+		{[]string{"REPLICAOF", "127.0.0.1", "7001"}, "-ERR REPLICAOF not allowed in cluster mode.\r\n"},
+	} {
+		out.Reset()
+		router.Route(ctx, bulkStrings(test.args...))
+		if out.String() != test.want {
+			t.Errorf("%v: expected %q, got %q", test.args, test.want, out.String())
+		}
+	}
+
+	// our master pushes whatever it wants, redirects are for clients.
+	out.Reset()
+	master := ctx
+	master.FromMaster = true
+	router.Route(master, bulkStrings("SET", "foo", "1"))
+	if out.String() != "+OK\r\n" {
+		t.Fatalf("expected writes from our master to be applied, got %q", out.String())
+	}
+}
+
+func TestClusterSlots(t *testing.T) {
+	ctx := startTestClusterNode(t)
+	router := initCommandRouter(NewCommandRouter())
+	var out bytes.Buffer
+	ctx.Connection = &out
+
+	router.Route(ctx, bulkStrings("CLUSTER", "SLOTS"))
+	want := "*2\r\n" +
+		"*3\r\n:0\r\n:8191\r\n*3\r\n$9\r\n127.0.0.1\r\n:7000\r\n$40\r\n" + testMyID + "\r\n" +
+		"*4\r\n:8192\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:7001\r\n$40\r\n" + testOtherID + "\r\n" +
+		"*3\r\n$9\r\n127.0.0.1\r\n:7002\r\n$40\r\n" + testReplicaID + "\r\n"
+	if out.String() != want {
+		t.Fatalf("expected %q, got %q", want, out.String())
+	}
+
+	out.Reset()
+	router.Route(ctx, bulkStrings("CLUSTER", "SHARDS"))
+	if shards := out.String(); !strings.HasPrefix(shards, "*2\r\n*4\r\n$5\r\nslots\r\n*2\r\n:0\r\n:8191\r\n") ||
+		!strings.Contains(shards, "$4\r\nrole\r\n$7\r\nreplica\r\n") {
+		t.Fatalf("expected our shard first then the other's with its replica, got %q", shards)
+	}
+
+	// the node config is written back the way it was read.
+	cluster, e := NewCluster(ctx.Config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if cluster.MyID() != testMyID {
+		t.Fatalf("expected to still be %s, got %s", testMyID, cluster.MyID())
+	}
+	if host, port := cluster.MasterAddr(); host != "" || port != "" {
+		t.Fatalf("expected to be a master, got the master %s:%s", host, port)
+	}
+}
+
+func TestClusterNewNode(t *testing.T) {
+	config := NewServerConfig()
+	config.Set("dir", t.TempDir())
+	config.Set("port", "7005")
+	first, e := NewCluster(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	again, e := NewCluster(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if first.MyID() != again.MyID() {
+		t.Fatalf("expected a new node to keep its id across restarts, got %s then %s", first.MyID(), again.MyID())
+	}
+	if e := again.Redirect([]string{"foo"}, false, func(string) bool { return true }); e != ErrClusterDown {
+		t.Fatalf("expected a node with no slots to say the cluster is down, got %v", e)
+	}
+}
+
+// startTestCluster starts n nodes that don't know about each other yet.
+func startTestCluster(t *testing.T, router CommandRouter, n int) []RequestContext {
+	var nodes []RequestContext
+	for i := 0; i < n; i++ {
+		ctx, _ := startTestNode(t, router, "")
+		bus, e := net.Listen("tcp", "127.0.0.1:0")
+		if e != nil {
+			t.Fatal(e)
+		}
+		_, busPort, _ := net.SplitHostPort(bus.Addr().String())
+		ctx.Config.Set("cluster-port", busPort)
+		ctx.Config.Set("cluster-node-timeout", "500")
+		cluster, e := NewCluster(ctx.Config)
+		if e != nil {
+			t.Fatal(e)
+		}
+		ctx.Cluster = cluster
+		cluster.Start(ctx.Server, bus)
+		t.Cleanup(cluster.Stop)
+		nodes = append(nodes, ctx)
+	}
+	return nodes
+}
+
+func clusterDo(router CommandRouter, ctx RequestContext, args ...string) string {
+	var out bytes.Buffer
+	ctx.Connection = &out
+	router.Route(ctx, bulkStrings(args...))
+	return out.String()
+}
+
+func TestClusterBus(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	nodes := startTestCluster(t, router, 6)
+	for _, node := range nodes[1:] {
+		meet := clusterDo(router, node, "CLUSTER", "MEET", "127.0.0.1", nodes[0].Cluster.myself.port, nodes[0].Cluster.myself.busPort)
+		if meet != "+OK\r\n" {
+			t.Fatalf("expected MEET to be accepted, got %q", meet)
+		}
+	}
+	for i, slots := range [][]string{{"0", "5460"}, {"5461", "10922"}, {"10923", "16383"}} {
+		if reply := clusterDo(router, nodes[i], append([]string{"CLUSTER", "ADDSLOTSRANGE"}, slots...)...); reply != "+OK\r\n" {
+			t.Fatalf("expected ADDSLOTSRANGE to be accepted, got %q", reply)
+		}
+	}
+	waitForWithin(t, "every node to meet every other", 10*time.Second, func() bool {
+		for _, node := range nodes {
+			if nodes := node.Cluster.Nodes(); strings.Count(nodes, "\n") != 6 || strings.Contains(nodes, "handshake") {
+				return false
+			}
+		}
+		return true
+	})
+	for i, replica := range nodes[3:] {
+		if reply := clusterDo(router, replica, "CLUSTER", "REPLICATE", nodes[i].Cluster.MyID()); reply != "+OK\r\n" {
+			t.Fatalf("expected REPLICATE to be accepted, got %q", reply)
+		}
+	}
+
+	// every node ends up with the same view of the cluster, of which nodes
+	// serve the slots.
+	converged := func(live []RequestContext) bool {
+		want := clusterDo(router, live[0], "CLUSTER", "SLOTS")
+		for _, node := range live {
+			if !strings.Contains(clusterDo(router, node, "CLUSTER", "INFO"), "cluster_state:ok\r\n") ||
+				clusterDo(router, node, "CLUSTER", "SLOTS") != want {
+				return false
+			}
+		}
+		return strings.Count(want, "127.0.0.1") == len(live)
+	}
+	waitForWithin(t, "the cluster to converge", 10*time.Second, func() bool { return converged(nodes) })
+	waitFor(t, "the replicas to sync", func() bool { return linkUp(nodes[3]) && linkUp(nodes[4]) && linkUp(nodes[5]) })
+
+	if reply := clusterDo(router, nodes[1], "SET", "bar", "1"); reply != "-MOVED 5061 127.0.0.1:"+nodes[0].Cluster.myself.port+"\r\n" {
+		t.Fatalf("expected to be sent to the first master, got %q", reply)
+	}
+	clusterDo(router, nodes[0], "SET", "bar", "1")
+	_, offset := nodes[0].Repl.ReplID()
+	waitFor(t, "the replica to get the write", func() bool { return nodes[3].Repl.Master().Offset() == offset })
+
+	// the first master goes quiet, its replica takes over.
+	nodes[0].Cluster.Stop()
+	live := nodes[1:]
+	waitForWithin(t, "the replica to replace its master", 20*time.Second, func() bool {
+		if !converged(live) {
+			return false
+		}
+		reply := clusterDo(router, live[0], "SET", "bar", "2")
+		return reply == "-MOVED 5061 127.0.0.1:"+nodes[3].Cluster.myself.port+"\r\n"
+	})
+	if nodes[3].Repl.Master() != nil {
+		t.Fatal("expected the promoted replica to stop replicating")
+	}
+	if reply := clusterDo(router, nodes[3], "GET", "bar"); reply != "$1\r\n1\r\n" {
+		t.Fatalf("expected the write to survive the failover, got %q", reply)
+	}
+	if !strings.Contains(nodes[1].Cluster.Nodes(), nodes[0].Cluster.MyID()) || !strings.Contains(nodes[1].Cluster.Nodes(), "master,fail") {
+		t.Fatalf("expected the old master to be flagged failing, got\n%s", nodes[1].Cluster.Nodes())
+	}
+}
+
+func TestClusterMigrate(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	nodes := startTestCluster(t, router, 2)
+	source, target := nodes[0], nodes[1]
+	clusterDo(router, target, "CLUSTER", "MEET", "127.0.0.1", source.Cluster.myself.port, source.Cluster.myself.busPort)
+	clusterDo(router, source, "CLUSTER", "ADDSLOTSRANGE", "0", "16383")
+	waitForWithin(t, "the nodes to meet", 10*time.Second, func() bool {
+		for _, node := range nodes {
+			if !strings.Contains(clusterDo(router, node, "CLUSTER", "INFO"), "cluster_state:ok\r\n") ||
+				clusterDo(router, node, "CLUSTER", "SLOTS") != clusterDo(router, source, "CLUSTER", "SLOTS") {
+				return false
+			}
+		}
+		// and know each other by their ids, not just by their addresses.
+		return strings.Contains(source.Cluster.Nodes(), target.Cluster.MyID()) &&
+			strings.Contains(target.Cluster.Nodes(), source.Cluster.MyID())
+	})
+
+	slot := strconv.Itoa(KeySlot("a"))
+	sourceAddr := "127.0.0.1:" + source.Cluster.myself.port
+	targetPort := target.Cluster.myself.port
+	clusterDo(router, source, "SET", "{a}1", "1")
+	clusterDo(router, source, "SET", "{a}2", "2")
+	clusterDo(router, source, "SET", "{a}3", "3", "PX", "60000")
+	if reply := clusterDo(router, source, "CLUSTER", "SETSLOT", slot, "IMPORTING", target.Cluster.MyID()); reply != "-ERR I'm already the owner of hash slot "+slot+"\r\n" {
+		t.Fatalf("expected the owner to refuse to import its own slot, got %q", reply)
+	}
+	if reply := clusterDo(router, target, "CLUSTER", "SETSLOT", slot, "IMPORTING", source.Cluster.MyID()); reply != "+OK\r\n" {
+		t.Fatalf("expected the target to start importing, got %q", reply)
+	}
+	if reply := clusterDo(router, source, "CLUSTER", "SETSLOT", slot, "MIGRATING", target.Cluster.MyID()); reply != "+OK\r\n" {
+		t.Fatalf("expected the source to start migrating, got %q", reply)
+	}
+	// the move survives a restart.
+	reloaded, e := NewCluster(source.Config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !strings.Contains(reloaded.Nodes(), "["+slot+"->-"+target.Cluster.MyID()+"]") {
+		t.Fatalf("expected the migrating slot in the node config, got\n%s", reloaded.Nodes())
+	}
+
+	for _, test := range []struct {
+		node RequestContext
+		args []string
+		want string
+	}{
+		{source, []string{"MIGRATE", "127.0.0.1", targetPort, "{a}1", "0", "1000", "COPY"}, "+OK\r\n"},
+		{source, []string{"GET", "{a}1"}, "$1\r\n1\r\n"},
+		{source, []string{"MIGRATE", "127.0.0.1", targetPort, "{a}1", "0", "1000"}, "-ERR Target instance replied with error: BUSYKEY Target key name already exists.\r\n"},
+		{source, []string{"GET", "{a}1"}, "$1\r\n1\r\n"},
+		{source, []string{"MIGRATE", "127.0.0.1", targetPort, "{a}1", "0", "1000", "REPLACE"}, "+OK\r\n"},
+		{source, []string{"GET", "{a}1"}, "-ASK " + slot + " 127.0.0.1:" + targetPort + "\r\n"},
+		{source, []string{"SET", "{a}1", "2"}, "-ASK " + slot + " 127.0.0.1:" + targetPort + "\r\n"},
+		{source, []string{"DEL", "{a}1", "{a}2"}, "-TRYAGAIN Multiple keys request during rehashing of slot\r\n"},
+		{source, []string{"GET", "{a}2"}, "$1\r\n2\r\n"},
+		{target, []string{"GET", "{a}1"}, "-MOVED " + slot + " " + sourceAddr + "\r\n"},
+		{source, []string{"MIGRATE", "127.0.0.1", targetPort, "", "0", "1000", "KEYS", "{a}1", "{a}2", "{a}3"}, "+OK\r\n"},
+		{source, []string{"MIGRATE", "127.0.0.1", targetPort, "{a}1", "0", "1000"}, "+NOKEY\r\n"},
+		{source, []string{"CLUSTER", "COUNTKEYSINSLOT", slot}, ":0\r\n"},
+		{target, []string{"CLUSTER", "COUNTKEYSINSLOT", slot}, ":3\r\n"},
+	} {
+		if reply := clusterDo(router, test.node, test.args...); reply != test.want {
+			t.Fatalf("%v: expected %q, got %q", test.args, test.want, reply)
+		}
+	}
+	if ts, expires := target.ExpiryStore.Get("{a}3"); !expires || time.Until(ts.Expiry) < 50*time.Second {
+		t.Fatalf("expected the key's expiry to move with it, got %v", ts.Expiry)
+	}
+
+	// a client sent on with ASK can use the slot, for one command.
+	conn, e := net.Dial("tcp", "127.0.0.1:"+targetPort)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	for _, args := range [][]string{{"ASKING"}, {"GET", "{a}1"}, {"GET", "{a}1"}} {
+		cmd, _ := RespValue{Array, bulkStrings(args...)}.Serialize()
+		conn.Write(cmd)
+	}
+	pr := NewProtocolReader(conn, &RespParser{})
+	for _, want := range []string{"OK", "1", "MOVED " + slot + " " + sourceAddr} {
+		if reply, e := pr.ReadProto(); e != nil || reply.String() != want {
+			t.Fatalf("expected %q, got %q %v", want, reply.String(), e)
+		}
+	}
+
+	// once the slot is the target's, it claims it in a new epoch and the
+	// source sends clients there for good.
+	for _, node := range []RequestContext{target, source} {
+		if reply := clusterDo(router, node, "CLUSTER", "SETSLOT", slot, "NODE", target.Cluster.MyID()); reply != "+OK\r\n" {
+			t.Fatalf("expected the slot to be handed over, got %q", reply)
+		}
+	}
+	for _, node := range nodes {
+		if strings.Contains(node.Cluster.Nodes(), "[") {
+			t.Fatalf("expected the move to be over, got\n%s", node.Cluster.Nodes())
+		}
+	}
+	if reply := clusterDo(router, source, "GET", "{a}1"); reply != "-MOVED "+slot+" 127.0.0.1:"+targetPort+"\r\n" {
+		t.Fatalf("expected to be sent to the new owner, got %q", reply)
+	}
+	if reply := clusterDo(router, target, "GET", "{a}2"); reply != "$1\r\n2\r\n" {
+		t.Fatalf("expected the new owner to serve the slot, got %q", reply)
+	}
+
+	// a slot can't be given away while it still has keys.
+	clusterDo(router, source, "SET", "bar", "1")
+	bar := strconv.Itoa(KeySlot("bar"))
+	if reply := clusterDo(router, source, "CLUSTER", "SETSLOT", bar, "NODE", target.Cluster.MyID()); !strings.HasPrefix(reply, "-ERR Can't assign hashslot "+bar) {
+		t.Fatalf("expected the slot to be kept while it has keys, got %q", reply)
+	}
+}
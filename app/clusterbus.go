@@ -0,0 +1,926 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the cluster bus is a second port where the nodes of a cluster tell each
+// other about themselves and the rest of the cluster. Every message starts
+// with a header saying who sent it, which slots it (or its master) serves and
+// in which epoch, and pings and pongs carry gossip about a few other nodes.
+// It's modelled on redis' cluster bus, but isn't wire compatible with it.
+
+const (
+	clusterTick          = 100 * time.Millisecond
+	clusterPingPeriod    = time.Second      // how often a random node gets pinged, on top of the ones that are due
+	clusterForgetTTL     = time.Minute      // how long a node we forgot stays forgotten
+	clusterMaxMessage    = 1 << 20          // no message is anywhere near this big
+	clusterMinHandshake  = time.Second      // the least time a node gets to answer a MEET
+	clusterGossipEntries = 3                // the fewest nodes gossiped about in a ping
+	clusterLinkBuffer    = 128              // messages queued on a link before we start dropping them
+	clusterFailUndo      = 2                // a failing master that's still serving its slots after this many node timeouts is back
+	clusterReportsTTL    = 2                // failure reports count for this many node timeouts
+	clusterMsgSignature  = "RCmb"           // every message starts with it
+	clusterMsgVersion    = uint16(1)        // bumped when the layout changes
+	clusterIPLen         = 46               // room for any ip, like redis' NET_IP_STR_LEN
+	clusterIDLen         = 40               // node ids are 40 hex characters
+	clusterSlotsLen      = ClusterSlots / 8 // the slots bitmap
+)
+
+// the types of message on the bus.
+const (
+	clusterMsgPing        = uint16(iota)
+	clusterMsgPong        // the reply to a PING or MEET, also sent unasked to spread news fast
+	clusterMsgMeet        // a PING that makes the receiver add us to its cluster
+	clusterMsgFail        // a node is failing, everyone should flag it
+	clusterMsgAuthRequest // a replica asking the masters to vote for it
+	clusterMsgAuthAck     // a master's vote
+	clusterMsgUpdate      // the sender's slots are out of date, here's who really serves them
+)
+
+// node flags, in headers and gossip.
+const (
+	clusterFlagMaster    = uint16(1) << iota
+	clusterFlagSlave     // a replica
+	clusterFlagPFail     // the sender can't reach it
+	clusterFlagFail      // the cluster agrees it's failing
+	clusterFlagHandshake // being met, its id isn't known yet
+	clusterFlagNoAddr    // we don't know its address
+)
+
+var ErrClusterBadMessage = errors.New("invalid cluster bus message")
+
+// clusterMsg is a message on the bus. The header is the same for every type,
+// only one of the parts after it is used.
+type clusterMsg struct {
+	typ          uint16
+	port         uint16 // the sender's client port
+	busPort      uint16
+	flags        uint16
+	currentEpoch int64
+	configEpoch  int64 // the epoch of the slots below, which are its master's when the sender is a replica
+	offset       int64 // the sender's replication offset
+	sender       string
+	master       string // who the sender replicates, "" for a master
+	ip           string // the sender's announced ip, "" means the one it's connecting from
+	slots        [clusterSlotsLen]byte
+
+	gossip  []clusterGossip // PING, PONG and MEET
+	failing string          // FAIL
+	update  *clusterUpdate  // UPDATE
+}
+
+// clusterGossip is what a ping says about some other node.
+type clusterGossip struct {
+	id      string
+	ip      string
+	port    uint16
+	busPort uint16
+	flags   uint16
+}
+
+// clusterUpdate tells a node about a newer owner of slots it thinks it has.
+type clusterUpdate struct {
+	configEpoch int64
+	id          string
+	slots       [clusterSlotsLen]byte
+}
+
+const clusterHeaderLen = 4 + 4 + 2*6 + 8*3 + clusterIDLen*2 + clusterIPLen + clusterSlotsLen
+const clusterGossipLen = clusterIDLen + clusterIPLen + 2*3
+
+func (m *clusterMsg) hasSlot(slot int) bool {
+	return m.slots[slot/8]&(1<<(slot%8)) != 0
+}
+
+func setSlotBit(bitmap *[clusterSlotsLen]byte, slot int) {
+	bitmap[slot/8] |= 1 << (slot % 8)
+}
+
+func appendFixed(b []byte, s string, n int) []byte {
+	field := make([]byte, n)
+	copy(field, s)
+	return append(b, field...)
+}
+
+func readFixed(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+func (m *clusterMsg) Bytes() []byte {
+	b := make([]byte, 0, clusterHeaderLen+len(m.gossip)*clusterGossipLen)
+	b = append(b, clusterMsgSignature...)
+	b = binary.BigEndian.AppendUint32(b, 0) // the length, filled in below
+	b = binary.BigEndian.AppendUint16(b, clusterMsgVersion)
+	b = binary.BigEndian.AppendUint16(b, m.typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.gossip)))
+	b = binary.BigEndian.AppendUint16(b, m.port)
+	b = binary.BigEndian.AppendUint16(b, m.busPort)
+	b = binary.BigEndian.AppendUint16(b, m.flags)
+	b = binary.BigEndian.AppendUint64(b, uint64(m.currentEpoch))
+	b = binary.BigEndian.AppendUint64(b, uint64(m.configEpoch))
+	b = binary.BigEndian.AppendUint64(b, uint64(m.offset))
+	b = appendFixed(b, m.sender, clusterIDLen)
+	b = appendFixed(b, m.master, clusterIDLen)
+	b = appendFixed(b, m.ip, clusterIPLen)
+	b = append(b, m.slots[:]...)
+
+	switch m.typ {
+	case clusterMsgPing, clusterMsgPong, clusterMsgMeet:
+		for _, g := range m.gossip {
+			b = appendFixed(b, g.id, clusterIDLen)
+			b = appendFixed(b, g.ip, clusterIPLen)
+			b = binary.BigEndian.AppendUint16(b, g.port)
+			b = binary.BigEndian.AppendUint16(b, g.busPort)
+			b = binary.BigEndian.AppendUint16(b, g.flags)
+		}
+	case clusterMsgFail:
+		b = appendFixed(b, m.failing, clusterIDLen)
+	case clusterMsgUpdate:
+		b = binary.BigEndian.AppendUint64(b, uint64(m.update.configEpoch))
+		b = appendFixed(b, m.update.id, clusterIDLen)
+		b = append(b, m.update.slots[:]...)
+	}
+	binary.BigEndian.PutUint32(b[4:], uint32(len(b)))
+	return b
+}
+
+// readClusterMsg reads the next message off the bus.
+func readClusterMsg(r io.Reader) (*clusterMsg, error) {
+	start := make([]byte, 8)
+	if _, e := io.ReadFull(r, start); e != nil {
+		return nil, e
+	}
+	length := binary.BigEndian.Uint32(start[4:])
+	if string(start[:4]) != clusterMsgSignature || length < clusterHeaderLen || length > clusterMaxMessage {
+		return nil, ErrClusterBadMessage
+	}
+	b := make([]byte, length)
+	copy(b, start)
+	if _, e := io.ReadFull(r, b[8:]); e != nil {
+		return nil, e
+	}
+	if binary.BigEndian.Uint16(b[8:]) != clusterMsgVersion {
+		return nil, ErrClusterBadMessage
+	}
+
+	m := &clusterMsg{
+		typ:          binary.BigEndian.Uint16(b[10:]),
+		port:         binary.BigEndian.Uint16(b[14:]),
+		busPort:      binary.BigEndian.Uint16(b[16:]),
+		flags:        binary.BigEndian.Uint16(b[18:]),
+		currentEpoch: int64(binary.BigEndian.Uint64(b[20:])),
+		configEpoch:  int64(binary.BigEndian.Uint64(b[28:])),
+		offset:       int64(binary.BigEndian.Uint64(b[36:])),
+	}
+	count := int(binary.BigEndian.Uint16(b[12:]))
+	p := b[44:]
+	m.sender, p = readFixed(p[:clusterIDLen]), p[clusterIDLen:]
+	m.master, p = readFixed(p[:clusterIDLen]), p[clusterIDLen:]
+	m.ip, p = readFixed(p[:clusterIPLen]), p[clusterIPLen:]
+	copy(m.slots[:], p)
+	p = p[clusterSlotsLen:]
+
+	switch m.typ {
+	case clusterMsgPing, clusterMsgPong, clusterMsgMeet:
+		if len(p) != count*clusterGossipLen {
+			return nil, ErrClusterBadMessage
+		}
+		for i := 0; i < count; i++ {
+			g := clusterGossip{id: readFixed(p[:clusterIDLen]), ip: readFixed(p[clusterIDLen : clusterIDLen+clusterIPLen])}
+			p = p[clusterIDLen+clusterIPLen:]
+			g.port = binary.BigEndian.Uint16(p)
+			g.busPort = binary.BigEndian.Uint16(p[2:])
+			g.flags = binary.BigEndian.Uint16(p[4:])
+			p = p[6:]
+			m.gossip = append(m.gossip, g)
+		}
+	case clusterMsgFail:
+		if len(p) != clusterIDLen {
+			return nil, ErrClusterBadMessage
+		}
+		m.failing = readFixed(p)
+	case clusterMsgUpdate:
+		if len(p) != 8+clusterIDLen+clusterSlotsLen {
+			return nil, ErrClusterBadMessage
+		}
+		m.update = &clusterUpdate{configEpoch: int64(binary.BigEndian.Uint64(p)), id: readFixed(p[8 : 8+clusterIDLen])}
+		copy(m.update.slots[:], p[8+clusterIDLen:])
+	}
+	return m, nil
+}
+
+// clusterLink is a connection on the bus. We ping a node over the link we
+// opened to it, and answer its pings over the one it opened to us. Messages
+// are written from a goroutine of the link's own, so a slow node never
+// holds up the cluster.
+type clusterLink struct {
+	conn net.Conn
+	node *ClusterNode // who we opened the link to, nil when they opened it
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func newClusterLink(conn net.Conn, node *ClusterNode, timeout time.Duration) *clusterLink {
+	link := &clusterLink{conn: conn, node: node, out: make(chan []byte, clusterLinkBuffer), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case msg := <-link.out:
+				conn.SetWriteDeadline(time.Now().Add(timeout))
+				if _, e := conn.Write(msg); e != nil {
+					link.Close()
+					return
+				}
+			case <-link.done:
+				return
+			}
+		}
+	}()
+	return link
+}
+
+// send queues a message, it's dropped when the link is backed up. Nothing
+// on the bus relies on any one message getting through.
+func (l *clusterLink) send(msg []byte) {
+	select {
+	case l.out <- msg:
+	default:
+	}
+}
+
+func (l *clusterLink) Close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// Start opens the bus on l and starts talking to the other nodes. server is
+// who we replicate for, when the cluster says we should.
+func (c *Cluster) Start(server *Server, l net.Listener) {
+	c.lock.Lock()
+	c.server = server
+	c.bus = l
+	c.lock.Unlock()
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			link := newClusterLink(conn, nil, c.nodeTimeout)
+			c.lock.Lock()
+			c.links[link] = true
+			c.lock.Unlock()
+			go c.readLink(link)
+		}
+	}()
+	go c.cron()
+}
+
+// Stop closes the bus, we go quiet as far as the other nodes are concerned.
+func (c *Cluster) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.stop:
+		return
+	default:
+	}
+	close(c.stop)
+	if c.bus != nil {
+		c.bus.Close()
+	}
+	for _, n := range c.nodes {
+		if n.link != nil {
+			n.link.Close()
+			n.link = nil
+		}
+	}
+	for link := range c.links {
+		link.Close()
+	}
+}
+
+func (c *Cluster) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Cluster) readLink(link *clusterLink) {
+	defer func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.links, link)
+		if link.node != nil && link.node.link == link {
+			link.node.link = nil
+		}
+		link.Close()
+	}()
+	for {
+		msg, e := readClusterMsg(link.conn)
+		if e != nil {
+			return
+		}
+		c.lock.Lock()
+		if !c.stopped() {
+			c.process(link, msg)
+		}
+		c.lock.Unlock()
+	}
+}
+
+// connect opens our link to n, which starts with a ping (or a meet). A node
+// we can't connect to counts as not answering our ping.
+func (c *Cluster) connect(n *ClusterNode, addr string) {
+	conn, e := net.DialTimeout("tcp", addr, c.nodeTimeout)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n.dialing = false
+	if e != nil || c.stopped() || c.nodes[n.id] != n {
+		if e == nil {
+			conn.Close()
+		} else if n.pingSent.IsZero() {
+			n.pingSent = time.Now()
+		}
+		return
+	}
+	n.link = newClusterLink(conn, n, c.nodeTimeout)
+	go c.readLink(n.link)
+	if n.meet {
+		c.ping(n.link, clusterMsgMeet)
+		n.meet = false
+	} else {
+		c.ping(n.link, clusterMsgPing)
+	}
+}
+
+// cron looks after the links and pings, and works out who's failing.
+func (c *Cluster) cron() {
+	ticker := time.NewTicker(clusterTick)
+	defer ticker.Stop()
+	for tick := 0; ; tick++ {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		c.lock.Lock()
+		c.clusterCron(tick)
+		c.lock.Unlock()
+	}
+}
+
+// clusterCron is called with the lock held.
+func (c *Cluster) clusterCron(tick int) {
+	now := time.Now()
+	handshakeTimeout := max(c.nodeTimeout, clusterMinHandshake)
+	for id, until := range c.forgotten {
+		if now.After(until) {
+			delete(c.forgotten, id)
+		}
+	}
+
+	for _, n := range c.nodes {
+		if n == c.myself {
+			continue
+		}
+		if n.handshake && now.Sub(n.created) > handshakeTimeout {
+			fmt.Println("[cluster] no answer from", n.BusAddr(), "giving up on meeting it")
+			c.delNode(n)
+			continue
+		}
+		if n.link == nil && !n.dialing {
+			n.dialing = true
+			go c.connect(n, n.BusAddr())
+		}
+	}
+
+	// a random node now and then, the one we've heard from least recently
+	// out of a few, so everyone gets gossip about everyone.
+	if tick%int(clusterPingPeriod/clusterTick) == 0 {
+		var oldest *ClusterNode
+		for i, n := range c.shuffledNodes() {
+			if i == 5 {
+				break
+			}
+			if n.link == nil || !n.pingSent.IsZero() || n.handshake {
+				continue
+			}
+			if oldest == nil || n.pongReceived.Before(oldest.pongReceived) {
+				oldest = n
+			}
+		}
+		if oldest != nil {
+			c.ping(oldest.link, clusterMsgPing)
+		}
+	}
+
+	for _, n := range c.nodes {
+		if n == c.myself || n.handshake {
+			continue
+		}
+		// a link that's gone quiet is probably broken, a new one might not be.
+		if n.link != nil && !n.pingSent.IsZero() && now.Sub(n.pingSent) > c.nodeTimeout/2 &&
+			now.Sub(n.pongReceived) > c.nodeTimeout/2 {
+			n.link.Close()
+			n.link = nil
+		}
+		// everyone is pinged at least once in half the node timeout.
+		if n.link != nil && n.pingSent.IsZero() && now.Sub(n.pongReceived) > c.nodeTimeout/2 {
+			c.ping(n.link, clusterMsgPing)
+		}
+		if !n.pingSent.IsZero() && now.Sub(n.pingSent) > c.nodeTimeout && !n.pfail && !n.fail {
+			fmt.Println("[cluster] node", n.id, "is not answering, flagging it pfail")
+			n.pfail = true
+		}
+		if n.pfail {
+			c.markFailing(n)
+		}
+	}
+
+	c.replicaCron(now)
+	c.updateState()
+	if c.dirty {
+		c.saveOrLog()
+	}
+}
+
+func (c *Cluster) saveOrLog() {
+	if e := c.save(); e != nil {
+		fmt.Println("[err] failed to save the cluster node config", e)
+	}
+}
+
+// shuffledNodes are the nodes other than myself in a random order, called
+// with the lock held.
+func (c *Cluster) shuffledNodes() []*ClusterNode {
+	nodes := make([]*ClusterNode, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n != c.myself {
+			nodes = append(nodes, n)
+		}
+	}
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	return nodes
+}
+
+// header fills in the part of a message that says who we are, a replica
+// sends its master's slots. Called with the lock held.
+func (c *Cluster) header(typ uint16) *clusterMsg {
+	m := &clusterMsg{
+		typ:          typ,
+		port:         uint16(atoiOr(c.myself.port, 0)),
+		busPort:      uint16(atoiOr(c.myself.busPort, 0)),
+		flags:        c.flagsOf(c.myself),
+		currentEpoch: c.currentEpoch,
+		sender:       c.myself.id,
+		master:       c.myself.master,
+	}
+	if ip, _ := c.config.Get("cluster-announce-ip"); ip != "" {
+		m.ip = ip
+	}
+	if c.server != nil {
+		_, m.offset = c.server.Repl.ReplID()
+	}
+	master := c.myself
+	if c.myself.master != "" {
+		master = c.nodes[c.myself.master]
+	}
+	if master != nil {
+		m.configEpoch = master.configEpoch
+		for slot, owner := range c.slots {
+			if owner == master {
+				setSlotBit(&m.slots, slot)
+			}
+		}
+	}
+	return m
+}
+
+func (c *Cluster) flagsOf(n *ClusterNode) uint16 {
+	flags := clusterFlagMaster
+	if n.master != "" {
+		flags = clusterFlagSlave
+	}
+	if n.pfail {
+		flags |= clusterFlagPFail
+	}
+	if n.fail {
+		flags |= clusterFlagFail
+	}
+	if n.handshake {
+		flags |= clusterFlagHandshake
+	}
+	if n.host == "" {
+		flags |= clusterFlagNoAddr
+	}
+	return flags
+}
+
+// ping sends a PING, PONG or MEET over link, with gossip about a tenth of
+// the nodes we know (but at least a few), and every node we think is
+// failing so that reports about them spread fast. Called with the lock held.
+func (c *Cluster) ping(link *clusterLink, typ uint16) {
+	m := c.header(typ)
+	wanted := max(clusterGossipEntries, len(c.nodes)/10)
+	for _, n := range c.shuffledNodes() {
+		if n == link.node || n.handshake || n.host == "" {
+			continue
+		}
+		if len(m.gossip) >= wanted && !n.pfail {
+			continue
+		}
+		m.gossip = append(m.gossip, clusterGossip{
+			id: n.id, ip: n.host, port: uint16(atoiOr(n.port, 0)), busPort: uint16(atoiOr(n.busPort, 0)), flags: c.flagsOf(n),
+		})
+	}
+	if typ != clusterMsgPong && link.node != nil && link.node.pingSent.IsZero() {
+		link.node.pingSent = time.Now()
+	}
+	link.send(m.Bytes())
+}
+
+// broadcast sends a message to every node we have a link to, called with
+// the lock held.
+func (c *Cluster) broadcast(m *clusterMsg) {
+	msg := m.Bytes()
+	for _, n := range c.nodes {
+		if n != c.myself && n.link != nil && !n.handshake {
+			n.link.send(msg)
+		}
+	}
+}
+
+// broadcastPong tells everyone about us straight away, after a change
+// they should hear about quickly. Called with the lock held.
+func (c *Cluster) broadcastPong() {
+	for _, n := range c.nodes {
+		if n != c.myself && n.link != nil && !n.handshake {
+			c.ping(n.link, clusterMsgPong)
+		}
+	}
+}
+
+// Meet starts a handshake with the node at host:port, which joins us to its
+// cluster (or it to ours). busPort is the port plus 10000 when it's "". It
+// returns false for an address that isn't an ip and port.
+func (c *Cluster) Meet(host string, port string, busPort string) bool {
+	p, e := strconv.ParseUint(port, 10, 16)
+	if e != nil || net.ParseIP(host) == nil {
+		return false
+	}
+	if busPort == "" {
+		busPort = strconv.Itoa(int(p) + clusterBusPortOffset)
+	} else if _, e := strconv.ParseUint(busPort, 10, 16); e != nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.startHandshake(host, port, busPort)
+	return true
+}
+
+// startHandshake adds a node we only know the address of, under a made up
+// id until it tells us its own. Called with the lock held.
+func (c *Cluster) startHandshake(host string, port string, busPort string) {
+	for _, n := range c.nodes {
+		if n.handshake && n.host == host && n.port == port && n.busPort == busPort {
+			return
+		}
+	}
+	n := newClusterNode(newReplID(), host, port, busPort)
+	n.handshake, n.meet = true, true
+	c.nodes[n.id] = n
+}
+
+// delNode forgets a node, called with the lock held.
+func (c *Cluster) delNode(n *ClusterNode) {
+	if n.link != nil {
+		n.link.Close()
+		n.link = nil
+	}
+	for slot, owner := range c.slots {
+		if owner == n {
+			c.slots[slot] = nil
+		}
+	}
+	for _, other := range c.nodes {
+		delete(other.failReports, n.id)
+	}
+	for _, moving := range []map[int]*ClusterNode{c.migrating, c.importing} {
+		for slot, other := range moving {
+			if other == n {
+				delete(moving, slot)
+			}
+		}
+	}
+	delete(c.nodes, n.id)
+	c.dirty = true
+}
+
+// process handles a message, called with the lock held.
+func (c *Cluster) process(link *clusterLink, m *clusterMsg) {
+	now := time.Now()
+	sender := c.nodes[m.sender]
+	if sender != nil && sender.handshake {
+		sender = nil
+	}
+	if m.currentEpoch > c.currentEpoch {
+		c.currentEpoch = m.currentEpoch
+		c.dirty = true
+	}
+
+	if m.typ == clusterMsgPing || m.typ == clusterMsgMeet {
+		// whoever met us knows where they reached us, which is where
+		// everyone else should reach us too.
+		if ip, _ := c.config.Get("cluster-announce-ip"); ip == "" && m.typ == clusterMsgMeet {
+			if local, _, e := net.SplitHostPort(link.conn.LocalAddr().String()); e == nil && local != c.myself.host {
+				c.myself.host = local
+				c.dirty = true
+			}
+		}
+		if sender == nil && m.typ == clusterMsgMeet {
+			c.startHandshake(c.senderIP(link, m), strconv.Itoa(int(m.port)), strconv.Itoa(int(m.busPort)))
+		}
+		c.ping(link, clusterMsgPong)
+	}
+
+	if m.typ == clusterMsgPong && link.node != nil && link.node.handshake {
+		c.handshaken(link.node, m)
+		sender = c.nodes[m.sender]
+	}
+	if sender == nil {
+		// only nodes that have been met get a say.
+		if m.typ == clusterMsgMeet {
+			c.gossip(nil, m)
+		}
+		return
+	}
+
+	if m.typ == clusterMsgPong && link.node == sender {
+		sender.pingSent = time.Time{}
+		sender.pongReceived = now
+		if sender.pfail {
+			sender.pfail = false
+		}
+		if sender.fail && c.failureUndone(sender, now) {
+			fmt.Println("[cluster] node", sender.id, "is reachable again, clearing its fail flag")
+			sender.fail = false
+			c.dirty = true
+		}
+	}
+	sender.offset = m.offset
+
+	switch m.typ {
+	case clusterMsgPing, clusterMsgPong, clusterMsgMeet:
+		c.senderRole(sender, m)
+		if m.master == "" {
+			c.senderSlots(link, sender, m)
+		}
+		c.gossip(sender, m)
+	case clusterMsgFail:
+		if failing := c.nodes[m.failing]; failing != nil && failing != c.myself && !failing.fail {
+			fmt.Println("[cluster] node", failing.id, "flagged fail by", sender.id)
+			failing.fail, failing.pfail, failing.failTime = true, false, now
+			c.dirty = true
+		}
+	case clusterMsgUpdate:
+		if n := c.nodes[m.update.id]; n != nil && n.configEpoch < m.update.configEpoch {
+			update := &clusterMsg{configEpoch: m.update.configEpoch, slots: m.update.slots}
+			n.configEpoch = m.update.configEpoch
+			c.claimSlots(n, update)
+		}
+	case clusterMsgAuthRequest:
+		c.vote(sender, m)
+	case clusterMsgAuthAck:
+		c.voted(sender, m)
+	}
+}
+
+// senderIP is the ip the sender of a message can be reached on, called with
+// the lock held.
+func (c *Cluster) senderIP(link *clusterLink, m *clusterMsg) string {
+	if m.ip != "" {
+		return m.ip
+	}
+	ip, _, _ := net.SplitHostPort(link.conn.RemoteAddr().String())
+	return ip
+}
+
+// failureUndone is whether a failing node we've heard from again can be
+// trusted again. A master is only given its slots back once nobody has
+// replaced it for a while. Called with the lock held.
+func (c *Cluster) failureUndone(n *ClusterNode, now time.Time) bool {
+	if n.master != "" || c.slotCount(n) == 0 {
+		return true
+	}
+	return now.Sub(n.failTime) > clusterFailUndo*c.nodeTimeout
+}
+
+// handshaken gives a node we've just met its real id, or drops it when it
+// turns out we knew it already. Called with the lock held.
+func (c *Cluster) handshaken(n *ClusterNode, m *clusterMsg) {
+	if c.nodes[m.sender] != nil {
+		c.delNode(n)
+		return
+	}
+	fmt.Println("[cluster] met node", m.sender, "at", n.BusAddr())
+	delete(c.nodes, n.id)
+	n.id = m.sender
+	n.handshake = false
+	n.master = m.master
+	c.nodes[n.id] = n
+	c.dirty = true
+}
+
+// senderRole keeps up with the sender becoming a master or a replica,
+// called with the lock held.
+func (c *Cluster) senderRole(sender *ClusterNode, m *clusterMsg) {
+	if sender.master == m.master {
+		return
+	}
+	if m.master != "" && sender.master == "" {
+		// a master that's become a replica doesn't serve anything any more.
+		for slot, owner := range c.slots {
+			if owner == sender {
+				c.slots[slot] = nil
+			}
+		}
+	}
+	sender.master = m.master
+	c.dirty = true
+}
+
+// senderSlots brings the slot table up to date with the slots a master
+// claims, called with the lock held.
+func (c *Cluster) senderSlots(link *clusterLink, sender *ClusterNode, m *clusterMsg) {
+	if m.configEpoch > sender.configEpoch {
+		sender.configEpoch = m.configEpoch
+		c.dirty = true
+	}
+	changed := false
+	for slot := 0; slot < ClusterSlots; slot++ {
+		if m.hasSlot(slot) != (c.slots[slot] == sender) {
+			changed = true
+			break
+		}
+	}
+	if changed {
+		c.claimSlots(sender, m)
+	}
+
+	// it's claiming slots that a master with a newer epoch has taken over
+	// from it, so it's out of date.
+	for slot := 0; slot < ClusterSlots; slot++ {
+		owner := c.slots[slot]
+		if m.hasSlot(slot) && owner != nil && owner != sender && owner.configEpoch > m.configEpoch {
+			update := c.header(clusterMsgUpdate)
+			update.update = &clusterUpdate{configEpoch: owner.configEpoch, id: owner.id}
+			for s, o := range c.slots {
+				if o == owner {
+					setSlotBit(&update.update.slots, s)
+				}
+			}
+			link.send(update.Bytes())
+			break
+		}
+	}
+
+	// two masters can't have the same epoch, or there'd be no telling which
+	// of them should get a slot they both claim. The one with the lower id
+	// moves on.
+	if c.myself.master == "" && sender.configEpoch == c.myself.configEpoch && sender.id > c.myself.id {
+		c.currentEpoch++
+		c.myself.configEpoch = c.currentEpoch
+		c.dirty = true
+		fmt.Println("[cluster] config epoch collision with", sender.id, "moved on to epoch", c.myself.configEpoch)
+	}
+}
+
+// claimSlots gives n every slot m says it has, unless the slot's owner
+// claimed it in a later epoch, or we're importing it: that's only settled
+// by CLUSTER SETSLOT. When our master (or we) lose every slot to n, n must
+// have replaced it, so we replicate n. Called with the lock held.
+func (c *Cluster) claimSlots(n *ClusterNode, m *clusterMsg) {
+	current := c.myself
+	if c.myself.master != "" {
+		current = c.nodes[c.myself.master]
+	}
+	lostToN := false
+	for slot := 0; slot < ClusterSlots; slot++ {
+		owner := c.slots[slot]
+		if !m.hasSlot(slot) || owner == n {
+			continue
+		}
+		if (owner != nil && owner.configEpoch >= m.configEpoch) || c.importing[slot] != nil {
+			continue
+		}
+		if owner != nil && owner == current {
+			lostToN = true
+		}
+		delete(c.migrating, slot)
+		c.slots[slot] = n
+		c.dirty = true
+	}
+	if lostToN && current != nil && c.slotCount(current) == 0 {
+		fmt.Println("[cluster] our slots were taken over by", n.id, "replicating it")
+		c.setMaster(n)
+	}
+}
+
+// setMaster makes us a replica of n, called with the lock held.
+func (c *Cluster) setMaster(n *ClusterNode) {
+	for slot, owner := range c.slots {
+		if owner == c.myself {
+			c.slots[slot] = nil
+		}
+	}
+	c.myself.master = n.id
+	c.election = clusterElection{}
+	// a replica has no slots of its own to move.
+	clear(c.migrating)
+	clear(c.importing)
+	c.dirty = true
+	if c.server != nil {
+		c.server.Repl.ReplicaOf(c.server, n.host, n.port)
+	}
+}
+
+// gossip takes in what the sender says about other nodes: who it thinks is
+// failing, and nodes we haven't met yet. Called with the lock held.
+func (c *Cluster) gossip(sender *ClusterNode, m *clusterMsg) {
+	now := time.Now()
+	for _, g := range m.gossip {
+		n := c.nodes[g.id]
+		if n == nil {
+			if g.flags&(clusterFlagNoAddr|clusterFlagHandshake) == 0 && c.forgotten[g.id].IsZero() {
+				c.startHandshake(g.ip, strconv.Itoa(int(g.port)), strconv.Itoa(int(g.busPort)))
+			}
+			continue
+		}
+		// only masters get a say in who's failing.
+		if sender == nil || sender.master != "" || n == c.myself {
+			continue
+		}
+		if g.flags&(clusterFlagPFail|clusterFlagFail) != 0 {
+			n.failReports[sender.id] = now
+			c.markFailing(n)
+		} else {
+			delete(n.failReports, sender.id)
+		}
+	}
+}
+
+// markFailing flags n as failing once enough masters agree it's not
+// answering, and tells everyone. Called with the lock held.
+func (c *Cluster) markFailing(n *ClusterNode) {
+	if !n.pfail || n.fail {
+		return
+	}
+	now := time.Now()
+	agree := 0
+	if c.myself.master == "" {
+		agree++
+	}
+	for id, reported := range n.failReports {
+		reporter := c.nodes[id]
+		if reporter == nil || now.Sub(reported) > clusterReportsTTL*c.nodeTimeout {
+			delete(n.failReports, id)
+			continue
+		}
+		if reporter.master == "" {
+			agree++
+		}
+	}
+	if agree < c.quorum() {
+		return
+	}
+	fmt.Println("[cluster] marking node", n.id, "as failing, quorum reached")
+	n.fail, n.pfail, n.failTime = true, false, now
+	c.dirty = true
+	m := c.header(clusterMsgFail)
+	m.failing = n.id
+	c.broadcast(m)
+	c.updateState()
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ClusterCommand = Command{"cluster", clusterCmd, CmdLoading | CmdStale}
+
+// the fewest and most arguments each CLUSTER subcommand takes, -1 is no limit.
+var clusterSubcommandArgs = map[string][2]int{
+	"keyslot": {1, 1}, "countkeysinslot": {1, 1}, "getkeysinslot": {2, 2}, "slots": {0, 0}, "shards": {0, 0},
+	"meet": {2, 3}, "nodes": {0, 0}, "myid": {0, 0}, "forget": {1, 1}, "reset": {0, 1}, "info": {0, 0},
+	"addslots": {1, -1}, "addslotsrange": {2, -1}, "delslots": {1, -1}, "replicate": {1, 1},
+	"setslot": {2, 3},
+}
+
+// clusterCmd is CLUSTER <subcommand>, for clients finding out which node
+// serves which keys, and for setting up the cluster.
+func clusterCmd(ctx RequestContext, args []RespValue) {
+	c := ctx.Cluster
+	if c == nil {
+		ctx.SendError("ERR This instance has cluster support disabled")
+		return
+	}
+	if len(args) == 0 {
+		ctx.SendError("ERR wrong number of arguments for 'cluster' command")
+		return
+	}
+	sub, args := args[0].ToLower(), args[1:]
+	n, known := clusterSubcommandArgs[sub]
+	if !known {
+		ctx.SendError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try CLUSTER HELP.", sub))
+		return
+	}
+	if len(args) < n[0] || (n[1] >= 0 && len(args) > n[1]) {
+		ctx.SendError(fmt.Sprintf("ERR wrong number of arguments for 'cluster|%s' command", sub))
+		return
+	}
+
+	switch sub {
+	case "keyslot":
+		ctx.SendResp(RespValue{Integer, KeySlot(args[0].String())})
+	case "countkeysinslot":
+		slot, e := parseSlot(args[0].String())
+		if e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendResp(RespValue{Integer, len(keysInSlot(ctx, slot, -1))})
+	case "getkeysinslot":
+		slot, e := parseSlot(args[0].String())
+		if e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		count, e := strconv.Atoi(args[1].String())
+		if e != nil || count < 0 {
+			ctx.SendError("ERR Invalid number of keys")
+			return
+		}
+		ctx.SendStringArray(keysInSlot(ctx, slot, count))
+	case "slots":
+		ctx.SendResp(c.Slots())
+	case "shards":
+		_, offset := ctx.Repl.ReplID()
+		ctx.SendResp(c.Shards(offset))
+	case "meet":
+		host, port := args[0].String(), args[1].String()
+		busPort := ""
+		if len(args) == 3 {
+			busPort = args[2].String()
+		}
+		if !c.Meet(host, port, busPort) {
+			ctx.SendError(fmt.Sprintf("ERR Invalid node address specified: %s:%s", host, port))
+			return
+		}
+		ctx.SendSimpleString("OK")
+	case "nodes":
+		ctx.SendResp(RespValue{BulkString, []byte(c.Nodes())})
+	case "myid":
+		ctx.SendResp(RespValue{BulkString, []byte(c.MyID())})
+	case "forget":
+		if e := c.Forget(args[0].String()); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendSimpleString("OK")
+	case "reset":
+		hard := false
+		if len(args) == 1 {
+			if !args[0].EqualAsciiInsensitive("hard") && !args[0].EqualAsciiInsensitive("soft") {
+				ctx.SendError("ERR syntax error")
+				return
+			}
+			hard = args[0].EqualAsciiInsensitive("hard")
+		}
+		// a replica's data is its master's, it goes along with the master.
+		if ctx.Repl.Master() != nil {
+			ctx.KVStore.Clear()
+			ctx.ExpiryStore.Clear()
+			ctx.Watches.TouchAll()
+		} else if ctx.KVStore.Len() > 0 {
+			ctx.SendError("ERR CLUSTER RESET can't be called with master nodes containing keys")
+			return
+		}
+		c.Reset(hard)
+		ctx.SendSimpleString("OK")
+	case "info":
+		ctx.SendResp(RespValue{BulkString, []byte(strings.Join(c.Info(), "\r\n") + "\r\n")})
+	case "addslots", "delslots", "addslotsrange":
+		var slots []int
+		if sub == "addslotsrange" && len(args)%2 != 0 {
+			ctx.SendError("ERR wrong number of arguments for 'cluster|addslotsrange' command")
+			return
+		}
+		for i := 0; i < len(args); i++ {
+			first, e := parseSlot(args[i].String())
+			if e != nil {
+				ctx.SendError(e.Error())
+				return
+			}
+			last := first
+			if sub == "addslotsrange" {
+				i++
+				if last, e = parseSlot(args[i].String()); e != nil {
+					ctx.SendError(e.Error())
+					return
+				}
+				if first > last {
+					ctx.SendError(fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", first, last))
+					return
+				}
+			}
+			for slot := first; slot <= last; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		var e error
+		if sub == "delslots" {
+			e = c.DelSlots(slots)
+		} else {
+			e = c.AddSlots(slots)
+		}
+		if e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendSimpleString("OK")
+	case "replicate":
+		if e := c.Replicate(args[0].String(), ctx.KVStore.Len() > 0); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendSimpleString("OK")
+	case "setslot":
+		slot, e := parseSlot(args[0].String())
+		if e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		action, id := args[1].ToLower(), ""
+		if len(args) == 3 {
+			id = args[2].String()
+		}
+		if (action == "stable") != (len(args) == 2) || !slices.Contains([]string{"importing", "migrating", "node", "stable"}, action) {
+			ctx.SendError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+			return
+		}
+		if e := c.SetSlot(slot, action, id, len(keysInSlot(ctx, slot, 1)) > 0); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendSimpleString("OK")
+	}
+}
+
+// keysInSlot are the live keys in a slot in order, up to count of them, or
+// all of them when count is negative. There's no index of keys by slot, so
+// it's a scan of the whole keyspace.
+func keysInSlot(ctx RequestContext, slot int, count int) []string {
+	var keys []string
+	for _, key := range ctx.KVStore.Keys() {
+		if KeySlot(key) != slot {
+			continue
+		}
+		if expiry, exists := ctx.ExpiryStore.Get(key); exists && expiry.Expired() {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	if count >= 0 && len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// Slots is the reply to CLUSTER SLOTS: each run of slots, with the master
+// that serves it and then its replicas.
+func (c *Cluster) Slots() RespValue {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	type run struct {
+		first, last int
+		owner       *ClusterNode
+	}
+	var runs []run
+	for slot := 0; slot < ClusterSlots; slot++ {
+		owner := c.slots[slot]
+		if owner == nil {
+			continue
+		}
+		if len(runs) > 0 && runs[len(runs)-1].owner == owner && runs[len(runs)-1].last == slot-1 {
+			runs[len(runs)-1].last = slot
+		} else {
+			runs = append(runs, run{slot, slot, owner})
+		}
+	}
+
+	arr := make([]RespValue, 0, len(runs))
+	for _, r := range runs {
+		entry := []RespValue{{Integer, r.first}, {Integer, r.last}, slotsNode(r.owner)}
+		for _, replica := range c.replicasOf(r.owner) {
+			entry = append(entry, slotsNode(replica))
+		}
+		arr = append(arr, RespValue{Array, entry})
+	}
+	return RespValue{Array, arr}
+}
+
+func slotsNode(n *ClusterNode) RespValue {
+	return RespValue{Array, []RespValue{
+		{BulkString, []byte(n.host)},
+		{Integer, atoiOr(n.port, 0)},
+		{BulkString, []byte(n.id)},
+	}}
+}
+
+// Shards is the reply to CLUSTER SHARDS: each master with the slots it
+// serves, and the nodes of its shard. offset is our replication offset, the
+// others' are as of their last message.
+func (c *Cluster) Shards(offset int64) RespValue {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var shards []RespValue
+	for _, master := range c.sortedNodes() {
+		if master.master != "" || master.handshake {
+			continue
+		}
+		var slots []RespValue
+		for _, r := range c.slotRanges(master) {
+			slots = append(slots, RespValue{Integer, r[0]}, RespValue{Integer, r[1]})
+		}
+		nodes := []RespValue{c.shardsNode(master, offset)}
+		for _, replica := range c.replicasOf(master) {
+			nodes = append(nodes, c.shardsNode(replica, offset))
+		}
+		shards = append(shards, RespValue{Array, []RespValue{
+			{BulkString, []byte("slots")}, {Array, slots},
+			{BulkString, []byte("nodes")}, {Array, nodes},
+		}})
+	}
+	return RespValue{Array, shards}
+}
+
+// shardsNode is called with the lock held.
+func (c *Cluster) shardsNode(n *ClusterNode, offset int64) RespValue {
+	role := "master"
+	if n.master != "" {
+		role = "replica"
+	}
+	if n != c.myself {
+		offset = n.offset
+	}
+	health := "online"
+	if n.fail {
+		health = "fail"
+	}
+	return RespValue{Array, []RespValue{
+		{BulkString, []byte("id")}, {BulkString, []byte(n.id)},
+		{BulkString, []byte("port")}, {Integer, atoiOr(n.port, 0)},
+		{BulkString, []byte("ip")}, {BulkString, []byte(n.host)},
+		{BulkString, []byte("endpoint")}, {BulkString, []byte(n.host)},
+		{BulkString, []byte("role")}, {BulkString, []byte(role)},
+		{BulkString, []byte("replication-offset")}, {Integer, int(offset)},
+		{BulkString, []byte("health")}, {BulkString, []byte(health)},
+	}}
+}
+
+// Nodes is the reply to CLUSTER NODES, a line for each node like the ones
+// in the node config file.
+func (c *Cluster) Nodes() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var sb strings.Builder
+	for _, n := range c.sortedNodes() {
+		sb.WriteString(c.nodeLine(n) + "\n")
+	}
+	return sb.String()
+}
+
+// Info is the reply to CLUSTER INFO.
+func (c *Cluster) Info() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	assigned, pfail, fail := 0, 0, 0
+	for _, owner := range c.slots {
+		switch {
+		case owner == nil:
+			continue
+		case owner.fail:
+			fail++
+		case owner.pfail:
+			pfail++
+		}
+		assigned++
+	}
+	return []string{
+		"cluster_enabled:1",
+		"cluster_state:" + c.state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", len(c.nodes)),
+		fmt.Sprintf("cluster_size:%d", len(c.sizedMasters())),
+		fmt.Sprintf("cluster_current_epoch:%d", c.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", c.myself.configEpoch),
+	}
+}
+
+// Forget drops a node from our view of the cluster. It's kept out for a
+// minute, so that gossip from nodes that haven't forgotten it yet doesn't
+// bring it back.
+func (c *Cluster) Forget(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.nodes[id]
+	switch {
+	case n == nil:
+		return fmt.Errorf("ERR Unknown node %s", id)
+	case n == c.myself:
+		return errors.New("ERR I tried hard but I can't forget myself...")
+	case c.myself.master == id:
+		return errors.New("ERR Can't forget my master!")
+	}
+	c.delNode(n)
+	c.forgotten[id] = time.Now().Add(clusterForgetTTL)
+	c.updateState()
+	c.saveOrLog()
+	return nil
+}
+
+// Reset forgets every other node and gives up our slots, we're a master on
+// our own. A hard reset makes us a new node, with a new id.
+func (c *Cluster) Reset(hard bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, n := range c.nodes {
+		if n != c.myself {
+			c.delNode(n)
+		}
+	}
+	for slot := range c.slots {
+		c.slots[slot] = nil
+	}
+	if c.myself.master != "" {
+		c.myself.master = ""
+		if c.server != nil {
+			c.server.Repl.Detach()
+		}
+	}
+	c.election = clusterElection{}
+	clear(c.migrating)
+	clear(c.importing)
+	if hard {
+		delete(c.nodes, c.myself.id)
+		c.myself.id = newReplID()
+		c.nodes[c.myself.id] = c.myself
+		c.currentEpoch, c.lastVoteEpoch, c.myself.configEpoch = 0, 0, 0
+	}
+	fmt.Println("[cluster] reset, we're", c.myself.id, "on our own")
+	c.updateState()
+	c.saveOrLog()
+}
+
+// AddSlots makes us the master of slots nobody serves yet.
+func (c *Cluster) AddSlots(slots []int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	seen := map[int]bool{}
+	for _, slot := range slots {
+		if c.slots[slot] != nil {
+			return fmt.Errorf("ERR Slot %d is already busy", slot)
+		}
+		if seen[slot] {
+			return fmt.Errorf("ERR Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+	for _, slot := range slots {
+		c.slots[slot] = c.myself
+	}
+	c.updateState()
+	c.saveOrLog()
+	return nil
+}
+
+// DelSlots forgets who serves slots, until someone claims them again.
+func (c *Cluster) DelSlots(slots []int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	seen := map[int]bool{}
+	for _, slot := range slots {
+		if c.slots[slot] == nil {
+			return fmt.Errorf("ERR Slot %d is already unassigned", slot)
+		}
+		if seen[slot] {
+			return fmt.Errorf("ERR Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+	for _, slot := range slots {
+		c.slots[slot] = nil
+	}
+	c.updateState()
+	c.saveOrLog()
+	return nil
+}
+
+// Replicate makes us a replica of the master with the given id, we can't
+// have any data or slots of our own when we become one.
+func (c *Cluster) Replicate(id string, hasKeys bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.nodes[id]
+	switch {
+	case n == nil || n.handshake:
+		return fmt.Errorf("ERR Unknown node %s", id)
+	case n == c.myself:
+		return errors.New("ERR Can't replicate myself")
+	case n.master != "":
+		return errors.New("ERR I can only replicate a master, not a replica.")
+	case c.myself.master == "" && (hasKeys || c.slotCount(c.myself) > 0):
+		return errors.New("ERR To set a master the node must be empty and without assigned slots.")
+	}
+	c.setMaster(n)
+	c.updateState()
+	c.saveOrLog()
+	c.broadcastPong()
+	return nil
+}
+
+// SetSlot is how a slot is moved from one master to another, by hand or by
+// a tool doing it for us:
+//
+//  1. SETSLOT <slot> IMPORTING <source> on the target
+//  2. SETSLOT <slot> MIGRATING <target> on the source
+//  3. MIGRATE the slot's keys from the source to the target, until there
+//     are none left (see CLUSTER GETKEYSINSLOT)
+//  4. SETSLOT <slot> NODE <target> on the target, then on the source
+//
+// While it's under way clients are sent from one to the other with ASK for
+// keys that have moved. Once the target is told the slot is its, it claims
+// it in a new epoch so that the rest of the cluster hears about it. STABLE
+// calls off a move. hasKeys is whether we have any keys in the slot.
+func (c *Cluster) SetSlot(slot int, action string, id string, hasKeys bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.myself.master != "" {
+		return errors.New("ERR Please use SETSLOT only with masters.")
+	}
+	var n *ClusterNode
+	if action != "stable" {
+		if n = c.nodes[id]; n == nil || n.handshake {
+			return fmt.Errorf("ERR I don't know about node %s", id)
+		}
+		if n.master != "" {
+			return errors.New("ERR Target node is not a master")
+		}
+	}
+
+	switch action {
+	case "migrating":
+		if c.slots[slot] != c.myself {
+			return fmt.Errorf("ERR I'm not the owner of hash slot %d", slot)
+		}
+		if n == c.myself {
+			return errors.New("ERR Can't migrate a slot to myself")
+		}
+		c.migrating[slot] = n
+	case "importing":
+		if c.slots[slot] == c.myself {
+			return fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+		}
+		if n == c.myself {
+			return errors.New("ERR Can't import a slot from myself")
+		}
+		c.importing[slot] = n
+	case "stable":
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+	case "node":
+		wasMine := c.slots[slot] == c.myself
+		if wasMine && n != c.myself && hasKeys {
+			return fmt.Errorf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		if !hasKeys {
+			delete(c.migrating, slot)
+		}
+		c.slots[slot] = n
+		if wasMine && n != c.myself && c.slotCount(c.myself) == 0 {
+			fmt.Println("[cluster] gave our last slot to", n.id, "replicating it")
+			c.setMaster(n)
+		}
+		if n == c.myself && c.importing[slot] != nil {
+			delete(c.importing, slot)
+			if c.bumpEpoch() {
+				fmt.Println("[cluster] took over slot", slot, "in epoch", c.myself.configEpoch)
+			}
+			c.updateState()
+			c.saveOrLog()
+			c.broadcastPong()
+			return nil
+		}
+	}
+	c.updateState()
+	c.saveOrLog()
+	return nil
+}
+
+// bumpEpoch moves us on to a config epoch newer than any other, without
+// the other masters voting on it like a failover would. It's for slots
+// we're handed with SETSLOT, so that they aren't lost to the node we took
+// them from. It's false when ours is the newest already, and nobody else
+// has it. Called with the lock held.
+func (c *Cluster) bumpEpoch() bool {
+	newest, shared := c.currentEpoch, false
+	for _, n := range c.nodes {
+		if n != c.myself && n.master == "" && n.configEpoch == c.myself.configEpoch {
+			shared = true
+		}
+		newest = max(newest, n.configEpoch)
+	}
+	if c.myself.configEpoch != 0 && c.myself.configEpoch == newest && !shared {
+		return false
+	}
+	c.currentEpoch = newest + 1
+	c.myself.configEpoch = c.currentEpoch
+	return true
+}
+
+// InfoLines is the cluster section of INFO.
+func (c *Cluster) InfoLines() []string {
+	if c == nil {
+		return []string{"cluster_enabled:0"}
+	}
+	return []string{"cluster_enabled:1"}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// a replica whose master is failing asks the other masters to vote for it
+// to take over, and does once most of them have. Each master votes once an
+// epoch, so only one replica can win in an epoch.
+
+const (
+	clusterElectionDelay  = 500 * time.Millisecond // gives the FAIL time to reach everyone before we ask for votes
+	clusterElectionJitter = 500 * time.Millisecond // so replicas of the same master don't ask at the same time
+	clusterRankDelay      = time.Second            // how much longer each replica that's further behind waits
+	clusterMinAuthTimeout = 2 * time.Second
+)
+
+// clusterElection is a replica's bid to replace its failing master.
+type clusterElection struct {
+	authTime  time.Time // when we ask for votes, or asked
+	authSent  bool
+	authEpoch int64 // the epoch we asked in
+	votes     int
+}
+
+// replicaCron runs our election while our master is failing, called with
+// the lock held.
+func (c *Cluster) replicaCron(now time.Time) {
+	if c.myself.master == "" {
+		return
+	}
+	master := c.nodes[c.myself.master]
+	if master == nil || !master.fail || c.slotCount(master) == 0 {
+		return
+	}
+
+	e := &c.election
+	authTimeout := max(2*c.nodeTimeout, clusterMinAuthTimeout)
+	if e.authTime.IsZero() || now.Sub(e.authTime) > 2*authTimeout {
+		// the replica with the most of the master's data goes first.
+		rank := c.rank()
+		delay := clusterElectionDelay + rand.N(clusterElectionJitter) + time.Duration(rank)*clusterRankDelay
+		*e = clusterElection{authTime: now.Add(delay)}
+		fmt.Println("[cluster] our master is failing, asking for votes in", delay, "as rank", rank)
+		return
+	}
+	if now.Before(e.authTime) || now.Sub(e.authTime) > authTimeout {
+		return
+	}
+	if !e.authSent {
+		c.currentEpoch++
+		e.authEpoch, e.authSent = c.currentEpoch, true
+		c.saveOrLog()
+		fmt.Println("[cluster] asking the masters for votes in epoch", e.authEpoch)
+		c.broadcast(c.header(clusterMsgAuthRequest))
+		return
+	}
+	if e.votes >= c.quorum() {
+		c.promote(master)
+	}
+}
+
+// rank is how many of our master's other replicas are further along than
+// us, called with the lock held.
+func (c *Cluster) rank() int {
+	var offset int64
+	if c.server != nil {
+		_, offset = c.server.Repl.ReplID()
+	}
+	rank := 0
+	for _, n := range c.nodes {
+		if n != c.myself && n.master == c.myself.master && !n.fail && n.offset > offset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// promote makes us the master in place of old, with its slots, called with
+// the lock held.
+func (c *Cluster) promote(old *ClusterNode) {
+	fmt.Println("[cluster] won the election in epoch", c.election.authEpoch, "taking over from", old.id)
+	c.myself.master = ""
+	for slot, owner := range c.slots {
+		if owner == old {
+			c.slots[slot] = c.myself
+		}
+	}
+	if c.myself.configEpoch < c.election.authEpoch {
+		c.myself.configEpoch = c.election.authEpoch
+	}
+	c.election = clusterElection{}
+	if c.server != nil {
+		c.server.Repl.Detach()
+	}
+	c.updateState()
+	c.saveOrLog()
+	// everyone should hear about the new owner of the slots straight away.
+	c.broadcastPong()
+}
+
+// vote answers a replica asking to replace its master. We vote once an
+// epoch, only for replicas of masters we think are failing, and only for
+// slots nobody has claimed in a later epoch. Called with the lock held.
+func (c *Cluster) vote(sender *ClusterNode, m *clusterMsg) {
+	if c.myself.master != "" || c.slotCount(c.myself) == 0 {
+		return
+	}
+	if m.currentEpoch < c.currentEpoch || c.lastVoteEpoch == c.currentEpoch {
+		return
+	}
+	master := c.nodes[m.master]
+	if master == nil || !master.fail {
+		return
+	}
+	now := time.Now()
+	if now.Sub(master.votedTime) < 2*c.nodeTimeout {
+		return
+	}
+	for slot := 0; slot < ClusterSlots; slot++ {
+		if owner := c.slots[slot]; m.hasSlot(slot) && owner != nil && owner.configEpoch > m.configEpoch {
+			return
+		}
+	}
+
+	// the vote has to survive a restart, or we could vote twice in an epoch.
+	c.lastVoteEpoch = c.currentEpoch
+	master.votedTime = now
+	c.saveOrLog()
+	fmt.Println("[cluster] voted for", sender.id, "to replace", master.id, "in epoch", c.currentEpoch)
+	if sender.link != nil {
+		sender.link.send(c.header(clusterMsgAuthAck).Bytes())
+	}
+}
+
+// voted counts a master's vote for us, called with the lock held.
+func (c *Cluster) voted(sender *ClusterNode, m *clusterMsg) {
+	e := &c.election
+	if sender.master != "" || c.slotCount(sender) == 0 || !e.authSent || m.currentEpoch < e.authEpoch {
+		return
+	}
+	e.votes++
+}
@@ -28,16 +28,59 @@ func (e ErrNoArgumentSupplied) Error() string {
 	return fmt.Sprintf("no argument provided with request")
 }
 
+type ErrWrongArity string
+
+func (e ErrWrongArity) Error() string {
+	return fmt.Sprintf("ERR wrong number of arguments for '%s' command", string(e))
+}
+
 type Callable func(ctx RequestContext, args []RespValue)
 
+type CommandFlags uint
+
+const (
+	CmdLoading  CommandFlags = 1 << iota // allowed while the dataset is still being loaded
+	CmdWrite                             // modifies the dataset
+	CmdBlocking                          // waits on other clients, so it mustn't hold Exec while it does
+	CmdStale                             // allowed on a replica that has lost its master, even with replica-serve-stale-data off
+	CmdAsking                            // runs as if the client sent ASKING first
+	CmdNoScript                          // scripts can't call it
+)
+
 // will route a given request to the appropriate handler implementation
 type CommandRouter struct {
 	commands map[string]Command
 }
 
 type Command struct {
-	Name string
-	Call Callable
+	Name  string
+	Call  Callable
+	Flags CommandFlags
+}
+
+// how many arguments each command takes, counting its name: n is exactly n
+// and -n is at least n. Commands check their own arguments when they run,
+// this is for knowing up front whether one would run at all.
+var commandArity = map[string]int{
+	"get": 2, "set": -3, "del": -2, "echo": 2, "ping": -1, "keys": 2, "info": -1, "config": -2,
+	"save": 1, "bgsave": -1, "lastsave": 1, "bgrewriteaof": 1, "flushall": -1, "flushdb": -1,
+	"replicaof": 3, "slaveof": 3, "psync": -3, "replconf": -1, "wait": 3, "failover": -1,
+	"cluster": -2, "asking": 1, "dump": 2, "restore": -4, "restore-asking": -4, "migrate": -6,
+	"sentinel": -2, "multi": 1, "exec": 1, "discard": 1, "watch": -2, "unwatch": 1,
+	"eval": -3, "evalsha": -3, "script": -2, "function": -2, "fcall": -3, "fcall_ro": -3, "shutdown": -1,
+}
+
+// checkArity is an error when a command is given the wrong number of
+// arguments, args are the ones after its name.
+func checkArity(name string, args []RespValue) error {
+	arity, known := commandArity[name]
+	if !known {
+		return nil
+	}
+	if (arity >= 0 && len(args)+1 != arity) || (arity < 0 && len(args)+1 < -arity) {
+		return ErrWrongArity(name)
+	}
+	return nil
 }
 
 func NewCommandRouter() CommandRouter {
@@ -51,12 +94,87 @@ func (cr CommandRouter) Route(ctx RequestContext, args []RespValue) error {
 	}
 
 	name := args[0]
+	all := args
 	args = args[1:]
 	if cmd, supported := cr.commands[name.ToLower()]; supported {
+		cmd.Flags |= subcommandFlags(cmd.Name, args)
+		// a script that's been running for too long gets killed or waited
+		// out, it's not queued behind. the commands it runs itself get through.
+		busyOK := busyCommand(cmd.Name, args)
+		if !busyOK && !ctx.InExec && !ctx.FromMaster {
+			if e := ctx.Running.Busy(ctx.Config); e != nil {
+				if tx := ctx.Client.queueing(); tx != nil {
+					tx.aborted = true
+				}
+				ctx.SendError(e.Error())
+				return nil
+			}
+		}
+		// between MULTI and EXEC commands are queued rather than run.
+		if tx := ctx.Client.queueing(); tx != nil && !transactionCommands[cmd.Name] {
+			queue(ctx, tx, cmd, args)
+			return nil
+		}
+		if ctx.Loading.Active() && cmd.Flags&CmdLoading == 0 {
+			ctx.SendError(ErrLoading.Error())
+			return nil
+		}
+		// writes run one at a time so that the order they hit the dataset in is
+		// the order they are logged in, and nobody snapshotting the dataset sees half of one.
+		// whatever our master sends is applied, it's already been checked by the master.
+		if !ctx.FromMaster {
+			if e := ctx.Repl.Allows(ctx.Config, cmd.Flags); e != nil {
+				ctx.SendError(e.Error())
+				return nil
+			}
+		}
+		if ctx.InExec {
+			// the caller has Exec to itself already.
+		} else if cmd.Flags&CmdWrite != 0 {
+			if e := lockExec(ctx, true); e != nil {
+				ctx.SendError(e.Error())
+				return nil
+			}
+			// while a failover is under way clients' writes wait to see which
+			// side of it we end up on, then go through the checks again.
+			if paused := ctx.Repl.WritesPaused(); paused != nil && !ctx.FromMaster {
+				ctx.Exec.Unlock()
+				<-paused
+				return cr.Route(ctx, all)
+			}
+			defer ctx.Exec.Unlock()
+		} else if cmd.Flags&CmdBlocking == 0 && !busyOK {
+			if e := lockExec(ctx, false); e != nil {
+				ctx.SendError(e.Error())
+				return nil
+			}
+			defer ctx.Exec.RUnlock()
+		}
+		asking := ctx.Client.takeAsking() || cmd.Flags&CmdAsking != 0
+		// in cluster mode, keys we don't serve are sent to the node that does.
+		// it's checked with Exec held, so that MIGRATE can't move a key away
+		// between the check and the command.
+		if ctx.Cluster != nil && !ctx.FromMaster {
+			if keysOf, keyed := commandKeys[cmd.Name]; keyed {
+				exists := ctx.liveKey
+				if cmd.Name == "migrate" {
+					// it's the one to say when a key it's moving has already gone.
+					exists = func(string) bool { return true }
+				}
+				if e := ctx.Cluster.Redirect(keysOf(args), asking, exists); e != nil {
+					ctx.SendError(e.Error())
+					return nil
+				}
+			}
+		}
 		cmd.Call(ctx, args)
 		return nil
 	}
 
+	// a transaction with a command we don't know can't be run.
+	if tx := ctx.Client.queueing(); tx != nil {
+		tx.aborted = true
+	}
 	ctx.SendError(ErrRouteNotSupported(name.String()).Error())
 	return nil
 }
@@ -66,7 +184,7 @@ func (cr CommandRouter) Register(cmd Command) {
 }
 
 func NewCommand(name string, caller Callable) Command {
-	return Command{name, caller}
+	return Command{name, caller, 0}
 }
 
 func (cmd Command) Matches(first RespValue) bool {
@@ -1,6 +1,12 @@
 package main
 
-var ConfigCommand = Command{"config", config}
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ConfigCommand = Command{"config", config, CmdLoading | CmdStale}
 
 var ConfigArgsParser = NewArgumentsParser().NumPositionals(2) // eventually this would need to be arbitraility deep
 
@@ -31,3 +37,35 @@ func getKeyValueArray(k string, v string) RespValue {
 	vr := RespValue{BulkString, []byte(v)}
 	return RespValue{Array, []RespValue{kr, vr}}
 }
+
+type ErrInvalidMemorySize string
+
+func (e ErrInvalidMemorySize) Error() string {
+	return fmt.Sprintf("invalid memory size '%s'", string(e))
+}
+
+// memory units as redis.conf reads them, k is 1000 and kb is 1024.
+var memoryUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+	{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+}
+
+// ParseMemorySize reads sizes like "64mb" or "1000" into a number of bytes.
+func ParseMemorySize(s string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, mult = strings.TrimSuffix(lower, unit.suffix), unit.mult
+			break
+		}
+	}
+	n, e := strconv.ParseInt(lower, 10, 64)
+	if e != nil || n < 0 {
+		return 0, ErrInvalidMemorySize(s)
+	}
+	return n * mult, nil
+}
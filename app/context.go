@@ -2,20 +2,91 @@ package main
 
 import (
 	"fmt"
-	"net"
+	"io"
+	"sync"
 )
 
-// tbd: each command workflow will need to have access to a lot of global state,
-// so this will likely exand eventually
-type RequestContext struct {
-	Connection  net.Conn                  // the client connection to write to
+// Server is the global state every command workflow has access to, it is
+// shared by all connections.
+type Server struct {
 	KVStore     *SharedRWStore[RespValue] // a database ref for reading and writing, must not be copied...
 	ExpiryStore *SharedRWStore[Timestamp] // the timestamps for all of the keys
 	Config      *SharedRWStore[string]    // the server's configuration details
+	Loading     *LoadingState             // progress of loading the dataset at startup
+	AOF         *AppendOnlyFile           // where writes are logged, nil when they shouldn't be (e.g. replaying the log)
+	Exec        *sync.RWMutex             // write commands hold this exclusively, everything else shares it
+	RDB         *RDBSaver                 // writes snapshots of the dataset to the rdb file
+	Keys        *KeyRing                  // encrypts the rdb and aof files, nil when they are stored in the clear
+	Router      CommandRouter             // for running commands that don't come from a client connection
+	Repl        *Replication              // the link to our master, when we are a replica
+	Sentinel    *Sentinel                 // set when we're running as a sentinel rather than serving data
+	Cluster     *Cluster                  // which node serves which keys, nil unless cluster mode is enabled
+	Watches     *Watches                  // the versions of the keys clients are WATCHing
+	Scripts     *Scripts                  // the scripts EVALSHA can run
+	Functions   *Functions                // the function libraries FCALL can call
+	Running     *RunningScripts           // the scripts being run, for telling clients when one's busy
 }
 
-func NewRequestContext(conn net.Conn, db *SharedRWStore[RespValue], expiry *SharedRWStore[Timestamp], config *SharedRWStore[string]) RequestContext {
-	return RequestContext{conn, db, expiry, config}
+func NewServer(db *SharedRWStore[RespValue], expiry *SharedRWStore[Timestamp], config *SharedRWStore[string]) *Server {
+	return &Server{db, expiry, config, NewLoadingState(), nil, &sync.RWMutex{}, NewRDBSaver(), nil, CommandRouter{}, NewReplication(), nil, nil, NewWatches(), NewScripts(), NewFunctions(), NewRunningScripts()}
+}
+
+// Dataset is the keyspace the server is serving, take a Snapshot of it (with
+// Exec held) for anything that reads all of it while writes carry on.
+func (s *Server) Dataset() RevivedDB {
+	return RevivedDB{s.KVStore, s.ExpiryStore, s.Functions}
+}
+
+// tbd: each command workflow will need to have access to a lot of global state,
+// so this will likely exand eventually
+type RequestContext struct {
+	Connection io.Writer // the client connection to write to
+	*Server
+	FromMaster bool    // the command came down the replication stream from our master
+	InExec     bool    // the caller already holds Exec exclusively, so Route mustn't take it
+	Client     *Client // the connection's own state, nil when the command isn't from a client
+}
+
+func NewRequestContext(conn io.Writer, server *Server) RequestContext {
+	return RequestContext{conn, server, false, false, nil}
+}
+
+// quietContext is for running commands that are already durable and that
+// nobody is waiting on the reply to, like replaying the aof.
+func (rc RequestContext) quietContext() RequestContext {
+	server := *rc.Server
+	server.AOF = nil
+	server.Loading = NewLoadingState()
+	server.Repl = NewReplication()
+	server.Cluster = nil
+	// transactions in the log are replayed as a whole, or not at all.
+	return RequestContext{io.Discard, &server, false, false, NewClient()}
+}
+
+// Propagate records a write so it survives a restart, and sends it on to our
+// replicas. Commands call it with the form of the write that should be
+// replayed, which isn't always what the client sent (relative expiries become
+// absolute ones for instance). It's also how WATCH hears that a key has been
+// modified.
+func (rc RequestContext) Propagate(args []RespValue) {
+	rc.Watches.touchWritten(args)
+	// a transaction's writes go out between a MULTI and an EXEC, so that
+	// they're applied together wherever they end up.
+	if c := rc.Client; c != nil && c.tx != nil && c.tx.running && !c.tx.propagated {
+		c.tx.propagated = true
+		rc.propagate(bulkStrings("MULTI"))
+	}
+	rc.propagate(args)
+}
+
+func (rc RequestContext) propagate(args []RespValue) {
+	rc.Repl.Feed(args)
+	if rc.AOF == nil {
+		return
+	}
+	if e := rc.AOF.Append(args); e != nil {
+		fmt.Println("[err] failed to append to the aof", e)
+	}
 }
 
 func (rc RequestContext) SendError(msg string) {
@@ -46,6 +117,15 @@ func (rc RequestContext) SendStringArray(arr []string) {
 	return
 }
 
+// bulkStrings builds a command in the form clients send it, an array of bulk strings.
+func bulkStrings(parts ...string) []RespValue {
+	arr := make([]RespValue, 0, len(parts))
+	for _, s := range parts {
+		arr = append(arr, RespValue{BulkString, []byte(s)})
+	}
+	return arr
+}
+
 func (rc RequestContext) SendResp(v RespValue) {
 	payload, err := v.Serialize()
 	if err != nil {
@@ -0,0 +1,32 @@
+package main
+
+// redis cluster hashes keys to slots with the XMODEM crc16: polynomial 0x1021,
+// no reflection, zero initial value and no final xor.
+
+const crc16XmodemPoly = 0x1021
+
+var crc16XmodemTable = makeCrc16Table(crc16XmodemPoly)
+
+func makeCrc16Table(poly uint16) *[256]uint16 {
+	var t [256]uint16
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}
+
+func Crc16(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc = (crc << 8) ^ crc16XmodemTable[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,68 @@
+package main
+
+// redis checksums rdb files with the "Jones" crc64 variant: reflected input and
+// output, zero initial value and no final xor. The stdlib hash/crc64 always
+// inverts the crc before and after each update, so it can't be reused here.
+
+const crc64JonesPoly = 0x95ac9329ac4bc9b5 // 0xad93d23594c935a9 bit reversed
+
+var crc64JonesTable = makeCrc64Table(crc64JonesPoly)
+
+func makeCrc64Table(poly uint64) *[256]uint64 {
+	var t [256]uint64
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}
+
+// Crc64Update folds p into a running checksum, starting from 0.
+func Crc64Update(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64JonesTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// Crc64 is a hash.Hash64 over the redis crc64 variant.
+type Crc64 struct {
+	crc uint64
+}
+
+func NewCrc64() *Crc64 {
+	return &Crc64{}
+}
+
+func (c *Crc64) Write(p []byte) (int, error) {
+	c.crc = Crc64Update(c.crc, p)
+	return len(p), nil
+}
+
+func (c *Crc64) Sum64() uint64 {
+	return c.crc
+}
+
+func (c *Crc64) Sum(b []byte) []byte {
+	s := c.crc
+	return append(b, byte(s>>56), byte(s>>48), byte(s>>40), byte(s>>32), byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+func (c *Crc64) Reset() {
+	c.crc = 0
+}
+
+func (c *Crc64) Size() int {
+	return 8
+}
+
+func (c *Crc64) BlockSize() int {
+	return 1
+}
@@ -5,13 +5,38 @@ import (
 	"time"
 )
 
+// SharedRWStore is a map that is safe for concurrent use and that can be
+// snapshotted in constant time.
+//
+// Without fork() to lean on, snapshots are copy on write: taking one freezes
+// the map (and any layers above it) and sends later writes to a fresh layer on
+// top, so the snapshot can be read for as long as it likes while writes carry
+// on. Reads walk the layers newest first. Once every snapshot is released the
+// layers are folded back into the map in small batches, so neither taking a
+// snapshot nor finishing with one stalls anyone for long.
 type SharedRWStore[T any] struct {
-	lock  sync.RWMutex
-	store map[string]T
+	lock       sync.RWMutex
+	store      map[string]T
+	layers     []map[string]storeEntry[T] // overlays above store, newest last, writes go to the newest
+	size       int
+	snapshots  int               // snapshots still reading store and the frozen layers
+	root       *SharedRWStore[T] // the store a snapshot was taken from, nil for the store itself
+	released   bool
+	compacting bool
 }
 
+// storeEntry is a write recorded in a layer, deletes are kept as tombstones
+// so they hide the key in the layers below.
+type storeEntry[T any] struct {
+	value   T
+	deleted bool
+}
+
+// compactBatch is how many entries are folded down per lock acquisition.
+const compactBatch = 1024
+
 func NewSharedStore[T any]() *SharedRWStore[T] {
-	return &SharedRWStore[T]{sync.RWMutex{}, map[string]T{}}
+	return &SharedRWStore[T]{store: map[string]T{}}
 }
 
 type Timestamp struct {
@@ -21,15 +46,15 @@ type Timestamp struct {
 }
 
 func NewKVStore() *SharedRWStore[RespValue] {
-	return &SharedRWStore[RespValue]{sync.RWMutex{}, map[string]RespValue{}}
+	return NewSharedStore[RespValue]()
 }
 
 func NewExpiryStore() *SharedRWStore[Timestamp] {
-	return &SharedRWStore[Timestamp]{sync.RWMutex{}, map[string]Timestamp{}}
+	return NewSharedStore[Timestamp]()
 }
 
 func NewServerConfig() *SharedRWStore[string] {
-	return &SharedRWStore[string]{sync.RWMutex{}, map[string]string{}}
+	return NewSharedStore[string]()
 }
 
 func NewTimestamp(ttl time.Duration) Timestamp {
@@ -45,26 +70,160 @@ func NewTimestampFromExpiry(expiry time.Time) Timestamp {
 func (db *SharedRWStore[T]) Set(key string, value T) (T, bool) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	v, e := db.store[key]
-	db.store[key] = value
+	v, e := db.lookup(key)
+	db.write(key, storeEntry[T]{value: value})
+	if !e {
+		db.size++
+	}
 	return v, e
 }
 
 func (db *SharedRWStore[T]) Get(key string) (T, bool) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
-	el, exists := db.store[key]
-	return el, exists
+	return db.lookup(key)
 }
 
 func (db *SharedRWStore[T]) Delete(key string) (T, bool) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	v, e := db.store[key]
-	delete(db.store, key)
+	v, e := db.lookup(key)
+	if e {
+		db.write(key, storeEntry[T]{deleted: true})
+		db.size--
+	}
 	return v, e
 }
 
+// Clear drops every key. Snapshots keep what they had, they hold their own
+// references to the maps being dropped.
+func (db *SharedRWStore[T]) Clear() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.store = map[string]T{}
+	db.layers = nil
+	db.size = 0
+}
+
+// Replace swaps in other's keys for ours, all at once, so the store can be
+// replaced without anyone holding on to it noticing it changed hands.
+// other mustn't be used afterwards. Like Clear, snapshots keep what they had.
+func (db *SharedRWStore[T]) Replace(other *SharedRWStore[T]) {
+	other.lock.Lock()
+	store, layers, size := other.store, other.layers, other.size
+	other.lock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.store, db.layers, db.size = store, layers, size
+}
+
+// lookup resolves key through the layers, called with the lock held.
+func (db *SharedRWStore[T]) lookup(key string) (T, bool) {
+	for i := len(db.layers) - 1; i >= 0; i-- {
+		if entry, ok := db.layers[i][key]; ok {
+			return entry.value, !entry.deleted
+		}
+	}
+	v, ok := db.store[key]
+	return v, ok
+}
+
+// write records a write in the newest layer, or straight in the map when
+// nothing is frozen. Called with the lock held.
+func (db *SharedRWStore[T]) write(key string, entry storeEntry[T]) {
+	if len(db.layers) > 0 {
+		db.layers[len(db.layers)-1][key] = entry
+	} else if entry.deleted {
+		delete(db.store, key)
+	} else {
+		db.store[key] = entry.value
+	}
+}
+
+// Snapshot returns a copy of the store as it is right now, in constant time.
+// The copy can be written to without affecting the original (and vice versa),
+// and must be released once it is no longer needed so the original can fold
+// its layers back down.
+func (db *SharedRWStore[T]) Snapshot() *SharedRWStore[T] {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	root := db
+	if db.root != nil {
+		root = db.root
+	}
+	frozen := db.layers
+	db.layers = append(frozen[:len(frozen):len(frozen)], map[string]storeEntry[T]{})
+	snapshot := &SharedRWStore[T]{
+		store:  db.store,
+		layers: append(frozen[:len(frozen):len(frozen)], map[string]storeEntry[T]{}),
+		size:   db.size,
+		root:   root,
+	}
+
+	if root != db {
+		root.lock.Lock()
+		defer root.lock.Unlock()
+	}
+	root.snapshots++
+	return snapshot
+}
+
+// Release tells the store a snapshot was taken from that it is done with,
+// it is a no-op on anything that isn't a snapshot.
+func (db *SharedRWStore[T]) Release() {
+	db.lock.Lock()
+	if db.root == nil || db.released {
+		db.lock.Unlock()
+		return
+	}
+	db.released = true
+	db.lock.Unlock()
+
+	root := db.root
+	root.lock.Lock()
+	defer root.lock.Unlock()
+	root.snapshots--
+	if root.snapshots == 0 && len(root.layers) > 0 && !root.compacting {
+		root.compacting = true
+		go root.compact()
+	}
+}
+
+// compact folds the layers back into the map a batch at a time, letting
+// readers and writers in between batches. Folding an entry into the layer just
+// below it doesn't change what any read sees, so it is safe to stop half way,
+// which is what happens when another snapshot is taken.
+func (db *SharedRWStore[T]) compact() {
+	for {
+		db.lock.Lock()
+		if db.snapshots > 0 || len(db.layers) == 0 {
+			db.compacting = false
+			db.lock.Unlock()
+			return
+		}
+		bottom := db.layers[0]
+		n := 0
+		for key, entry := range bottom {
+			if entry.deleted {
+				delete(db.store, key)
+			} else {
+				db.store[key] = entry.value
+			}
+			delete(bottom, key)
+			if n++; n == compactBatch {
+				break
+			}
+		}
+		if len(bottom) == 0 {
+			db.layers = db.layers[1:]
+			if len(db.layers) == 0 {
+				db.layers = nil
+			}
+		}
+		db.lock.Unlock()
+	}
+}
+
 func (db *SharedRWStore[T]) Lock(key string) {
 	db.lock.Lock()
 }
@@ -84,13 +243,71 @@ func (db *SharedRWStore[T]) RUnlock(key string) {
 func (db *SharedRWStore[T]) Keys() []string {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
-	keys := make([]string, 0, len(db.store))
+	keys := make([]string, 0, db.size)
 	for key := range db.store {
-		keys = append(keys, key)
+		if _, exists := db.lookup(key); exists {
+			keys = append(keys, key)
+		}
+	}
+	// a key only in the layers belongs to the lowest layer that has it, and is
+	// live if the newest layer that has it says so.
+	for i, layer := range db.layers {
+		for key := range layer {
+			if _, inStore := db.store[key]; inStore || db.inLayersBelow(key, i) {
+				continue
+			}
+			if _, exists := db.lookup(key); exists {
+				keys = append(keys, key)
+			}
+		}
 	}
 	return keys
 }
 
+// Sample returns up to n live keys picked in no particular order, which is
+// as random as map iteration makes it.
+func (db *SharedRWStore[T]) Sample(n int) []string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	keys := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	pick := func(key string) bool {
+		if _, exists := db.lookup(key); exists && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+		return len(keys) < n
+	}
+	for i := len(db.layers) - 1; i >= 0; i-- {
+		for key := range db.layers[i] {
+			if !pick(key) {
+				return keys
+			}
+		}
+	}
+	for key := range db.store {
+		if !pick(key) {
+			return keys
+		}
+	}
+	return keys
+}
+
+func (db *SharedRWStore[T]) inLayersBelow(key string, i int) bool {
+	for j := 0; j < i; j++ {
+		if _, ok := db.layers[j][key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *SharedRWStore[T]) Len() int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.size
+}
+
 func (ts Timestamp) Expired() bool {
 	if time.Now().After(ts.Expiry) {
 		return true
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sortedKeys(db *SharedRWStore[string]) []string {
+	keys := db.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	db := NewSharedStore[string]()
+	db.Set("a", "1")
+	db.Set("b", "2")
+
+	snap := db.Snapshot()
+	db.Set("a", "changed")
+	db.Delete("b")
+	db.Set("c", "3")
+	snap.Set("d", "only in the snapshot")
+
+	if v, _ := snap.Get("a"); v != "1" {
+		t.Fatalf("snapshot saw a write made after it: a = %q", v)
+	}
+	if _, exists := snap.Get("b"); !exists {
+		t.Fatal("snapshot saw a delete made after it")
+	}
+	if _, exists := db.Get("d"); exists {
+		t.Fatal("write to the snapshot leaked into the store")
+	}
+	if got := sortedKeys(snap); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "d" {
+		t.Fatalf("snapshot keys %v", got)
+	}
+	if got := sortedKeys(db); len(got) != 2 || got[0] != "a" || got[1] != "c" || db.Len() != 2 {
+		t.Fatalf("store keys %v, len %d", got, db.Len())
+	}
+
+	// snapshots of snapshots, and of a store with layers, stack up.
+	nested := snap.Snapshot()
+	second := db.Snapshot()
+	snap.Delete("a")
+	db.Set("c", "4")
+	if v, _ := nested.Get("a"); v != "1" {
+		t.Fatalf("nested snapshot a = %q", v)
+	}
+	if v, _ := second.Get("c"); v != "3" {
+		t.Fatalf("second snapshot c = %q", v)
+	}
+
+	db.Clear()
+	if v, _ := second.Get("c"); v != "3" || db.Len() != 0 {
+		t.Fatal("clearing the store affected a snapshot")
+	}
+	db.Set("e", "5")
+
+	snap.Release()
+	nested.Release()
+	second.Release()
+	second.Release() // releasing twice is harmless
+	deadline := time.Now().Add(time.Second)
+	for {
+		db.lock.RLock()
+		layers := len(db.layers)
+		db.lock.RUnlock()
+		if layers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("store still has %d layers after every snapshot was released", layers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := sortedKeys(db); len(got) != 1 || got[0] != "e" {
+		t.Fatalf("store keys after compaction %v", got)
+	}
+}
+
+func TestStoreSnapshotWhileWriting(t *testing.T) {
+	db := NewSharedStore[string]()
+	for i := 0; i < 5000; i++ {
+		db.Set(strconv.Itoa(i), "before")
+	}
+	snap := db.Snapshot()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5000; i++ {
+			db.Set(strconv.Itoa(i), "after")
+			db.Delete(strconv.Itoa(i + 5000))
+			db.Set(strconv.Itoa(i+5000), "new")
+		}
+	}()
+	for _, key := range snap.Keys() {
+		if v, _ := snap.Get(key); v != "before" {
+			t.Fatalf("snapshot key %s = %q", key, v)
+		}
+	}
+	if snap.Len() != 5000 {
+		t.Fatalf("snapshot len %d", snap.Len())
+	}
+	wg.Wait()
+	snap.Release()
+	if db.Len() != 10000 {
+		t.Fatalf("store len %d", db.Len())
+	}
+	if v, _ := db.Get("0"); v != "after" {
+		t.Fatalf("store key 0 = %q", v)
+	}
+}
+
+func TestStoreReplace(t *testing.T) {
+	db := NewSharedStore[string]()
+	db.Set("old", "1")
+	snap := db.Snapshot()
+
+	loaded := NewSharedStore[string]()
+	loaded.Set("new", "2")
+	loaded.Set("other", "3")
+	db.Replace(loaded)
+	db.Set("after", "4")
+
+	if got := sortedKeys(db); len(got) != 3 || got[0] != "after" || got[1] != "new" || got[2] != "other" || db.Len() != 3 {
+		t.Fatalf("expected the replacement's keys, got %v", got)
+	}
+	if got := sortedKeys(snap); len(got) != 1 || got[0] != "old" {
+		t.Fatalf("expected the snapshot to keep what it had, got %v", got)
+	}
+	snap.Release()
+	if v, _ := db.Get("new"); v != "2" {
+		t.Fatalf("releasing the snapshot lost a key: new = %q", v)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+var DelCommand = Command{"del", del, CmdWrite}
+
+func del(ctx RequestContext, args []RespValue) {
+	if len(args) == 0 {
+		ctx.SendError(ErrMissingPositional{}.Error())
+		return
+	}
+
+	deleted := []string{"DEL"}
+	for _, arg := range args {
+		key := arg.String()
+		ctx.ExpiryStore.Delete(key)
+		if _, existed := ctx.KVStore.Delete(key); existed {
+			deleted = append(deleted, key)
+		}
+	}
+	// only the keys that were there are propagated, a DEL of nothing is no write at all.
+	if len(deleted) > 1 {
+		ctx.Propagate(bulkStrings(deleted...))
+	}
+	ctx.SendResp(RespValue{Integer, len(deleted) - 1})
+}
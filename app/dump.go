@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// a DUMP payload is a value in its rdb encoding, preceded by its rdb type and
+// followed by a footer: the rdb version it was written with (2 bytes) and a
+// crc64 of everything before the checksum (8 bytes), both little endian.
+const dumpFooterLen = 10
+
+var ErrDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+var ErrDumpBadData = errors.New("ERR Bad data format")
+var ErrBusyKey = errors.New("BUSYKEY Target key name already exists.")
+
+var DumpCommand = Command{"dump", dump, 0}
+var RestoreCommand = Command{"restore", restore, CmdWrite}
+
+// RESTORE-ASKING is what MIGRATE sends, it's RESTORE for a slot the target
+// is still importing.
+var RestoreAskingCommand = Command{"restore-asking", restore, CmdWrite | CmdAsking}
+
+var RestoreArgsParser = NewArgumentsParser().
+	NumPositionals(3).
+	Argument(ArgDef{"REPLACE", false, false}).
+	Argument(ArgDef{"ABSTTL", false, false})
+
+// DumpPayload serializes a value the way DUMP does.
+func DumpPayload(v RespValue, compress bool) ([]byte, error) {
+	var buf bytes.Buffer
+	rw := NewRDBFileWriter(&buf).Compression(compress)
+	rw.w.WriteByte(StringEnc)
+	if e := rw.writeValue(v); e != nil {
+		return nil, e
+	}
+	if e := rw.w.Flush(); e != nil {
+		return nil, e
+	}
+	payload := binary.LittleEndian.AppendUint16(buf.Bytes(), RDBVersion)
+	return binary.LittleEndian.AppendUint64(payload, Crc64Update(0, payload)), nil
+}
+
+// ParseDumpPayload is the value a DUMP payload holds. Payloads from a newer
+// rdb version than ours, or that fail the checksum, are refused.
+func ParseDumpPayload(payload []byte) (RespValue, error) {
+	body, e := dumpBody(payload)
+	if e != nil {
+		return RespValue{}, e
+	}
+
+	p := NewRDBStreamParser(bytes.NewReader(body), nil).Size(int64(len(body)))
+	valEnc, e := p.r.ReadByte()
+	if e != nil || valEnc != StringEnc {
+		return RespValue{}, ErrDumpBadData
+	}
+	value, e := p.parseString()
+	if e != nil || p.Offset() != int64(len(body)) {
+		return RespValue{}, ErrDumpBadData
+	}
+	if value.Type == Integer {
+		value = RespValue{BulkString, []byte(value.String())}
+	}
+	return value, nil
+}
+
+// dumpBody is what a payload holds, once its footer has been checked.
+func dumpBody(payload []byte) ([]byte, error) {
+	if len(payload) < dumpFooterLen {
+		return nil, ErrDumpPayload
+	}
+	body, footer := payload[:len(payload)-dumpFooterLen], payload[len(payload)-dumpFooterLen:]
+	version := binary.LittleEndian.Uint16(footer)
+	sum := binary.LittleEndian.Uint64(footer[2:])
+	if version > RDBVersion || sum != Crc64Update(0, payload[:len(payload)-8]) {
+		return nil, ErrDumpPayload
+	}
+	return body, nil
+}
+
+// dumpPayload is DumpPayload, compressed unless rdbcompression is off.
+func (rc RequestContext) dumpPayload(v RespValue) ([]byte, error) {
+	compress, _ := rc.Config.Get("rdbcompression")
+	return DumpPayload(v, compress != "no")
+}
+
+// liveValue is a key's value, unless it's missing or has expired.
+func (rc RequestContext) liveValue(key string) (RespValue, *time.Time, bool) {
+	value, exists := rc.KVStore.Get(key)
+	if !exists {
+		return RespValue{}, nil, false
+	}
+	ts, expires := rc.ExpiryStore.Get(key)
+	if !expires {
+		return value, nil, true
+	}
+	if ts.Expired() {
+		return RespValue{}, nil, false
+	}
+	return value, &ts.Expiry, true
+}
+
+func (rc RequestContext) liveKey(key string) bool {
+	_, _, exists := rc.liveValue(key)
+	return exists
+}
+
+// dump is DUMP key, the key's value serialized for RESTORE, or nil.
+func dump(ctx RequestContext, args []RespValue) {
+	if len(args) != 1 {
+		ctx.SendError("ERR wrong number of arguments for 'dump' command")
+		return
+	}
+	value, _, exists := ctx.liveValue(args[0].String())
+	if !exists {
+		ctx.SendNullBulkString()
+		return
+	}
+	payload, e := ctx.dumpPayload(value)
+	if e != nil {
+		ctx.SendError("ERR " + e.Error())
+		return
+	}
+	ctx.SendResp(RespValue{BulkString, payload})
+}
+
+// restore is RESTORE key ttl payload [REPLACE] [ABSTTL], it creates a key
+// from a DUMP payload. A ttl of 0 makes a key that doesn't expire, with
+// ABSTTL the ttl is a unix time in milliseconds rather than a duration.
+func restore(ctx RequestContext, args []RespValue) {
+	parsedArgs, e := RestoreArgsParser.Parse(args)
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	key := parsedArgs.GetPos(0).String()
+	ttl, e := strconv.ParseInt(parsedArgs.GetPos(1).String(), 10, 64)
+	if e != nil || ttl < 0 {
+		ctx.SendError("ERR Invalid TTL value, must be >= 0")
+		return
+	}
+	_, replace := parsedArgs.GetArg("REPLACE")
+	_, absTTL := parsedArgs.GetArg("ABSTTL")
+	if !replace && ctx.liveKey(key) {
+		ctx.SendError(ErrBusyKey.Error())
+		return
+	}
+	value, e := ParseDumpPayload([]byte(parsedArgs.GetPos(2).String()))
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+
+	var expiry time.Time
+	switch {
+	case ttl == 0:
+	case absTTL:
+		expiry = time.UnixMilli(ttl)
+	default:
+		expiry = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	if !expiry.IsZero() && !expiry.After(time.Now()) {
+		// it's already expired, so the key it replaces is just gone.
+		ctx.ExpiryStore.Delete(key)
+		if _, existed := ctx.KVStore.Delete(key); existed {
+			ctx.Propagate(bulkStrings("DEL", key))
+		}
+		ctx.SendSimpleString("OK")
+		return
+	}
+
+	ctx.KVStore.Set(key, value)
+	payload := parsedArgs.GetPos(2).String()
+	if expiry.IsZero() {
+		ctx.ExpiryStore.Delete(key)
+		ctx.Propagate(bulkStrings("RESTORE", key, "0", payload, "REPLACE"))
+	} else {
+		ctx.ExpiryStore.Set(key, NewTimestampFromExpiry(expiry))
+		// like SET, relative expiries are propagated as absolute ones.
+		at := strconv.FormatInt(expiry.UnixMilli(), 10)
+		ctx.Propagate(bulkStrings("RESTORE", key, at, payload, "REPLACE", "ABSTTL"))
+	}
+	ctx.SendSimpleString("OK")
+}
@@ -1,6 +1,6 @@
 package main
 
-var EchoCommand = Command{"echo", echo}
+var EchoCommand = Command{"echo", echo, 0}
 
 var EchoArgsParser = NewArgumentsParser().NumPositionals(1)
 
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted rdb and aof files are the plain file cut into chunks, each sealed
+// with AES-256-GCM so large files stream and every chunk is authenticated on
+// its own:
+//
+//	header  "REDISENC" version(1)
+//	chunk   length(4 BE, of the sealed data) key id(8) nonce(12) sealed data
+//
+// The key id is the start of the sha256 of the key, so files (and even single
+// chunks) written under different keys can be read as long as every key is in
+// the ring. Each chunk's position in the file is authenticated along with it,
+// so chunks can't be reordered or dropped from the middle of a file. Files
+// aren't sealed at the end, the rdb format has its own end marker and
+// checksum, and an aof cut short is something we already know how to handle.
+
+const (
+	EncMagic         = "REDISENC"
+	EncVersion       = 1
+	EncKeySize       = 32 // AES-256
+	EncKeyIDSize     = 8
+	EncChunkSize     = 64 << 10 // plaintext buffered before a chunk is sealed
+	encHeaderSize    = len(EncMagic) + 1
+	encChunkOverhead = 4 + EncKeyIDSize + 12
+)
+
+var ErrEncryptedTruncated = errors.New("encrypted file ends part way through a chunk")
+var ErrEncryptedNoKeys = errors.New("file is encrypted but no encryption-key-file is configured")
+
+type ErrEncryptionKey struct {
+	Path string
+	Err  error
+}
+
+func (e ErrEncryptionKey) Error() string {
+	return fmt.Sprintf("can't use encryption key %s: %s", e.Path, e.Err)
+}
+
+func (e ErrEncryptionKey) Unwrap() error {
+	return e.Err
+}
+
+type ErrUnknownEncryptionKey [EncKeyIDSize]byte
+
+func (e ErrUnknownEncryptionKey) Error() string {
+	return fmt.Sprintf("file was encrypted with key %x, which isn't one of the configured keys", e[:])
+}
+
+// ErrEncryptedCorrupt is a chunk that fails authentication, at the file offset it starts at.
+type ErrEncryptedCorrupt struct {
+	Offset int64
+	Err    error
+}
+
+func (e ErrEncryptedCorrupt) Error() string {
+	return fmt.Sprintf("encrypted chunk at offset %d failed to decrypt: %s", e.Offset, e.Err)
+}
+
+func (e ErrEncryptedCorrupt) Unwrap() error {
+	return e.Err
+}
+
+type encKey struct {
+	id   [EncKeyIDSize]byte
+	aead cipher.AEAD
+}
+
+// KeyRing holds the key new files are encrypted with, and every key that
+// files may have been encrypted with, so keys can be rotated without
+// rewriting what is already on disk. A nil ring means encryption is off.
+type KeyRing struct {
+	current *encKey
+	keys    map[[EncKeyIDSize]byte]*encKey
+}
+
+// LoadKeyRing reads the key files, each holding 32 raw bytes or 64 hex
+// characters. current encrypts everything written from now on, old only decrypts.
+func LoadKeyRing(current string, old ...string) (*KeyRing, error) {
+	ring := &KeyRing{keys: map[[EncKeyIDSize]byte]*encKey{}}
+	for i, path := range append([]string{current}, old...) {
+		key, e := loadEncryptionKey(path)
+		if e != nil {
+			return nil, ErrEncryptionKey{path, e}
+		}
+		if i == 0 {
+			ring.current = key
+		}
+		ring.keys[key.id] = key
+	}
+	return ring, nil
+}
+
+func loadEncryptionKey(path string) (*encKey, error) {
+	raw, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	if trimmed := strings.TrimSpace(string(raw)); len(trimmed) == EncKeySize*2 {
+		if decoded, e := hex.DecodeString(trimmed); e == nil {
+			raw = decoded
+		}
+	}
+	if len(raw) != EncKeySize {
+		return nil, fmt.Errorf("expected %d bytes or %d hex characters, found %d bytes", EncKeySize, EncKeySize*2, len(raw))
+	}
+	return newEncKey(raw)
+}
+
+func newEncKey(raw []byte) (*encKey, error) {
+	block, e := aes.NewCipher(raw)
+	if e != nil {
+		return nil, e
+	}
+	aead, e := cipher.NewGCM(block)
+	if e != nil {
+		return nil, e
+	}
+	key := &encKey{aead: aead}
+	sum := sha256.Sum256(raw)
+	copy(key.id[:], sum[:])
+	return key, nil
+}
+
+// chunkAD is the data authenticated alongside a chunk: where it sits in the
+// file and which key sealed it.
+func chunkAD(index uint64, id [EncKeyIDSize]byte) []byte {
+	ad := make([]byte, 8+EncKeyIDSize)
+	binary.BigEndian.PutUint64(ad, index)
+	copy(ad[8:], id[:])
+	return ad
+}
+
+// EncryptWriter seals whatever is written to it in chunks of EncChunkSize,
+// Flush seals what is buffered early and Close seals the rest.
+type EncryptWriter struct {
+	w     io.Writer
+	key   *encKey
+	buf   []byte
+	index uint64 // chunks written to the file so far
+}
+
+// NewEncryptWriter starts a new encrypted file on w.
+func NewEncryptWriter(w io.Writer, ring *KeyRing) (*EncryptWriter, error) {
+	header := append([]byte(EncMagic), EncVersion)
+	if _, e := w.Write(header); e != nil {
+		return nil, e
+	}
+	return &EncryptWriter{w: w, key: ring.current}, nil
+}
+
+// AppendEncryptWriter continues the encrypted file open in f, which must be
+// positioned at its end. A chunk torn by a crash should already have been
+// truncated away (loading the aof does this).
+func AppendEncryptWriter(f *os.File, ring *KeyRing) (*EncryptWriter, error) {
+	stat, e := f.Stat()
+	if e != nil {
+		return nil, e
+	}
+	if stat.Size() == 0 {
+		return NewEncryptWriter(f, ring)
+	}
+	chunks, _, e := countEncryptedChunks(f.Name())
+	if e != nil {
+		return nil, e
+	}
+	return &EncryptWriter{w: f, key: ring.current, index: chunks}, nil
+}
+
+func (ew *EncryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), EncChunkSize-len(ew.buf))
+		ew.buf = append(ew.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(ew.buf) == EncChunkSize {
+			if e := ew.Flush(); e != nil {
+				return written, e
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush seals whatever is buffered into a chunk of its own.
+func (ew *EncryptWriter) Flush() error {
+	if len(ew.buf) == 0 {
+		return nil
+	}
+	e := ew.seal(ew.buf)
+	ew.buf = ew.buf[:0]
+	return e
+}
+
+func (ew *EncryptWriter) Close() error {
+	return ew.Flush()
+}
+
+func (ew *EncryptWriter) seal(plain []byte) error {
+	aead := ew.key.aead
+	chunk := make([]byte, encChunkOverhead, encChunkOverhead+len(plain)+aead.Overhead())
+	nonce := chunk[4+EncKeyIDSize : encChunkOverhead]
+	if _, e := rand.Read(nonce); e != nil {
+		return e
+	}
+	copy(chunk[4:], ew.key.id[:])
+	chunk = aead.Seal(chunk, nonce, plain, chunkAD(ew.index, ew.key.id))
+	binary.BigEndian.PutUint32(chunk, uint32(len(chunk)-encChunkOverhead))
+	if _, e := ew.w.Write(chunk); e != nil {
+		return e
+	}
+	ew.index++
+	return nil
+}
+
+// DecryptReader opens the chunks of an encrypted file as they are read.
+type DecryptReader struct {
+	r     *bufio.Reader
+	ring  *KeyRing
+	plain []byte
+	index uint64
+	valid int64 // file offset just past the last chunk that decrypted
+	err   error
+}
+
+func newDecryptReader(r *bufio.Reader, ring *KeyRing) (*DecryptReader, error) {
+	if ring == nil {
+		return nil, ErrEncryptedNoKeys
+	}
+	header := make([]byte, encHeaderSize)
+	if _, e := io.ReadFull(r, header); e != nil {
+		return nil, ErrEncryptedTruncated
+	}
+	if header[len(EncMagic)] != EncVersion {
+		return nil, fmt.Errorf("unknown encrypted file version %d", header[len(EncMagic)])
+	}
+	return &DecryptReader{r: r, ring: ring, valid: int64(encHeaderSize)}, nil
+}
+
+// Valid is the length of the file up to the end of the last chunk that
+// decrypted, which is where to truncate a file with a torn final chunk.
+func (dr *DecryptReader) Valid() int64 {
+	return dr.valid
+}
+
+func (dr *DecryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		dr.err = dr.open()
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (dr *DecryptReader) open() error {
+	var head [encChunkOverhead]byte
+	n, e := io.ReadFull(dr.r, head[:])
+	if e == io.EOF {
+		return io.EOF
+	}
+	if e != nil {
+		return ErrEncryptedTruncated
+	}
+	size := binary.BigEndian.Uint32(head[:4])
+	var id [EncKeyIDSize]byte
+	copy(id[:], head[4:])
+	key, known := dr.ring.keys[id]
+	if !known {
+		return ErrUnknownEncryptionKey(id)
+	}
+	if size > EncChunkSize+uint32(key.aead.Overhead()) {
+		return ErrEncryptedCorrupt{dr.valid, fmt.Errorf("chunk claims to be %d bytes", size)}
+	}
+	sealed := make([]byte, size)
+	if _, e := io.ReadFull(dr.r, sealed); e != nil {
+		return ErrEncryptedTruncated
+	}
+	plain, e := key.aead.Open(sealed[:0], head[4+EncKeyIDSize:], sealed, chunkAD(dr.index, id))
+	if e != nil {
+		return ErrEncryptedCorrupt{dr.valid, e}
+	}
+	dr.plain = plain
+	dr.index++
+	dr.valid += int64(n) + int64(size)
+	return nil
+}
+
+// isEncrypted peeks at r to see whether it holds an encrypted file.
+func isEncrypted(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(EncMagic))
+	return string(magic) == EncMagic
+}
+
+// MaybeDecrypt returns a reader of the plain contents of r, decrypting it with
+// ring if it turns out to be encrypted. The *DecryptReader is nil for plain files.
+func MaybeDecrypt(r io.Reader, ring *KeyRing) (*bufio.Reader, *DecryptReader, error) {
+	br, buffered := r.(*bufio.Reader)
+	if !buffered {
+		br = bufio.NewReader(r)
+	}
+	if !isEncrypted(br) {
+		return br, nil, nil
+	}
+	dr, e := newDecryptReader(br, ring)
+	if e != nil {
+		return nil, nil, e
+	}
+	return bufio.NewReader(dr), dr, nil
+}
+
+// countEncryptedChunks walks the chunk headers of the file at path without
+// decrypting anything, returning how many chunks it has and where the last
+// whole one ends.
+func countEncryptedChunks(path string) (uint64, int64, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return 0, 0, e
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if _, e := r.Discard(encHeaderSize); e != nil {
+		return 0, 0, ErrEncryptedTruncated
+	}
+	var chunks uint64
+	offset := int64(encHeaderSize)
+	for {
+		var head [encChunkOverhead]byte
+		if _, e := io.ReadFull(r, head[:]); e == io.EOF {
+			return chunks, offset, nil
+		} else if e != nil {
+			return chunks, offset, ErrEncryptedTruncated
+		}
+		size := int(binary.BigEndian.Uint32(head[:4]))
+		if n, _ := r.Discard(size); n != size {
+			return chunks, offset, ErrEncryptedTruncated
+		}
+		chunks++
+		offset += int64(encChunkOverhead + size)
+	}
+}
+
+// fileIsEncrypted reports whether the file at path starts with the encryption magic.
+func fileIsEncrypted(path string) bool {
+	f, e := os.Open(path)
+	if e != nil {
+		return false
+	}
+	defer f.Close()
+	return isEncrypted(bufio.NewReader(f))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// MaybeEncrypt starts an encrypted file on w when ring is set, and passes
+// writes straight through when it isn't. Close must be called to seal the
+// last chunk, it doesn't close w.
+func MaybeEncrypt(w io.Writer, ring *KeyRing) (io.WriteCloser, error) {
+	if ring == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return NewEncryptWriter(w, ring)
+}
+
+// keyRingFromConfig loads the keys named by encryption-key-file and
+// encryption-old-key-files, a nil ring means encryption is off.
+func keyRingFromConfig(config *SharedRWStore[string]) (*KeyRing, error) {
+	current, _ := config.Get("encryption-key-file")
+	old, _ := config.Get("encryption-old-key-files")
+	return keyRingFromFiles(current, old)
+}
+
+// keyRingFromFiles takes the current key file and a comma separated list of old ones.
+func keyRingFromFiles(current string, old string) (*KeyRing, error) {
+	var oldFiles []string
+	for _, f := range strings.Split(old, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			oldFiles = append(oldFiles, f)
+		}
+	}
+	if current == "" {
+		if len(oldFiles) > 0 {
+			return nil, errors.New("encryption-old-key-files needs an encryption-key-file to go with it")
+		}
+		return nil, nil
+	}
+	return LoadKeyRing(current, oldFiles...)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func writeTestKey(t *testing.T, dir string, name string, fill byte) string {
+	path := filepath.Join(dir, name)
+	if e := os.WriteFile(path, bytes.Repeat([]byte{fill}, EncKeySize), 0600); e != nil {
+		t.Fatal(e)
+	}
+	return path
+}
+
+func TestEncryptedRDB(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := writeTestKey(t, dir, "old.key", 1)
+	newKey := writeTestKey(t, dir, "new.key", 2)
+	oldRing, _ := LoadKeyRing(oldKey)
+
+	// big enough to span several chunks.
+	db := NewRevivedDb()
+	for i := 0; i < 5000; i++ {
+		db.DB.Set("key"+strconv.Itoa(i), RespValue{BulkString, []byte(strings.Repeat("v", 50) + strconv.Itoa(i))})
+	}
+	path := filepath.Join(dir, "enc.rdb")
+	f, _ := os.Create(path)
+	w, _ := MaybeEncrypt(f, oldRing)
+	if e := writeRDBSnapshot(NewRDBFileWriter(w).Compression(false), db); e != nil {
+		t.Fatal(e)
+	}
+	w.Close()
+	f.Close()
+
+	raw, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(raw, []byte(EncMagic)) || bytes.Contains(raw, []byte("vvvvvvvv")) {
+		t.Fatal("file isn't encrypted")
+	}
+
+	// after rotating, files written under the old key still load.
+	rotated, e := LoadKeyRing(newKey, oldKey)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p, _ := NewRDBFileParser(path)
+	dbs, e := p.Keys(rotated).Parse()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := dbs[0].DB.Get("key4999"); dbs[0].DB.Len() != 5000 || !strings.HasSuffix(v.String(), "4999") {
+		t.Fatalf("loaded %d keys, key4999 = %q", dbs[0].DB.Len(), v.String())
+	}
+
+	newOnly, _ := LoadKeyRing(newKey)
+	p, _ = NewRDBFileParser(path)
+	if _, e := p.Keys(newOnly).Parse(); !errors.As(e, new(ErrUnknownEncryptionKey)) {
+		t.Fatalf("expected the old key to be missing, got %v", e)
+	}
+	p, _ = NewRDBFileParser(path)
+	if _, e := p.Parse(); e != ErrEncryptedNoKeys {
+		t.Fatalf("expected a missing key error, got %v", e)
+	}
+
+	tampered := filepath.Join(dir, "tampered.rdb")
+	raw[len(raw)/2] ^= 1
+	os.WriteFile(tampered, raw, 0644)
+	p, _ = NewRDBFileParser(tampered)
+	if _, e := p.Keys(rotated).Parse(); !errors.As(e, &ErrEncryptedCorrupt{}) {
+		t.Fatalf("expected tampering to be caught, got %v", e)
+	}
+}
+
+func TestEncryptedAOF(t *testing.T) {
+	dir := t.TempDir()
+	ring, _ := LoadKeyRing(writeTestKey(t, dir, "aof.key", 3))
+	aof, _ := NewAppendOnlyFile(filepath.Join(dir, "appendonlydir"), "appendonly.aof", AppendFsyncAlways)
+	aof.Encryption(ring)
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(aof)
+	ctx.KVStore.Set("seeded", RespValue{BulkString, []byte("from the rdb")})
+	if e := aof.Open(ctx.Server); e != nil {
+		t.Fatal(e)
+	}
+	router.Route(ctx, bulkStrings("SET", "a", "secret"))
+	aof.Close()
+	// reopening carries on with the chunk count where it left off.
+	if e := aof.Open(ctx.Server); e != nil {
+		t.Fatal(e)
+	}
+	router.Route(ctx, bulkStrings("SET", "b", "secret"))
+	aof.Close()
+
+	incr := lastIncr(t, aof)
+	complete, _ := os.Stat(incr)
+	raw, _ := os.ReadFile(incr)
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Fatal("incr file isn't encrypted")
+	}
+	f, _ := os.OpenFile(incr, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(raw[encHeaderSize : encHeaderSize+10]) // a torn chunk
+	f.Close()
+
+	replayed := newTestContext(nil)
+	if _, e := aof.Load(router, replayed, false); !errors.As(e, &ErrAOFCorrupt{}) {
+		t.Fatalf("expected the torn chunk to be rejected, got %v", e)
+	}
+	replayed = newTestContext(nil)
+	if _, e := aof.Load(router, replayed, true); e != nil {
+		t.Fatal(e)
+	}
+	for _, key := range []string{"seeded", "a", "b"} {
+		if _, exists := replayed.KVStore.Get(key); !exists {
+			t.Fatalf("%s wasn't restored", key)
+		}
+	}
+	if truncated, _ := os.Stat(incr); truncated.Size() != complete.Size() {
+		t.Fatalf("incr truncated to %d bytes, want %d", truncated.Size(), complete.Size())
+	}
+}
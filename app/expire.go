@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// keys with a ttl are checked this many at a time, and the check goes again
+// straight away while more than a quarter of them turn out to have expired,
+// like redis' active expire cycle.
+const expireSampleSize = 20
+const expireCycleBudget = 25 * time.Millisecond
+const expireCronInterval = 100 * time.Millisecond
+
+// expireCron deletes keys whose ttl has run out, so the ones nobody reads
+// again don't sit around forever. Replicas leave this to their master, which
+// sends them a DEL for every key it expires.
+func expireCron(server *Server) {
+	ctx := NewRequestContext(io.Discard, server)
+	for range time.Tick(expireCronInterval) {
+		// nor do masters pausing writes for a failover, expiring is writing.
+		if server.Repl.Master() != nil || server.Repl.WritesPaused() != nil {
+			continue
+		}
+		activeExpireCycle(ctx)
+	}
+}
+
+// activeExpireCycle runs one round of sampling, returning how many keys it expired.
+func activeExpireCycle(ctx RequestContext) int {
+	start := time.Now()
+	total := 0
+	for time.Since(start) < expireCycleBudget {
+		ctx.Exec.Lock()
+		sampled := ctx.ExpiryStore.Sample(expireSampleSize)
+		expired := 0
+		for _, key := range sampled {
+			if ts, exists := ctx.ExpiryStore.Get(key); exists && ts.Expired() {
+				expireKey(ctx, key)
+				expired++
+			}
+		}
+		ctx.Exec.Unlock()
+		total += expired
+		if expired*4 <= len(sampled) {
+			break
+		}
+	}
+	return total
+}
+
+// expireKey deletes a key whose ttl has run out. The aof and the replicas get
+// a DEL rather than being left to work it out themselves, so they can never
+// disagree with us about whether the key still exists. Called with Exec held
+// exclusively, like any other write.
+func expireKey(ctx RequestContext, key string) {
+	ctx.KVStore.Delete(key)
+	ctx.ExpiryStore.Delete(key)
+	ctx.Propagate(bulkStrings("DEL", key))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// FAILOVER waits on the target replica catching up, it mustn't hold Exec
+// while it does (it takes it itself to pause writes).
+var FailoverCommand = Command{"failover", failoverCmd, CmdBlocking}
+
+var ErrFailoverInProgress = errors.New("ERR FAILOVER already in progress.")
+
+// the states of a failover, as INFO reports them.
+const (
+	FailoverNone       = "no-failover"
+	FailoverWaitSync   = "waiting-for-sync"     // writes are paused until the target has them all
+	FailoverInProgress = "failover-in-progress" // we're asking the target to take over, as its replica
+)
+
+// failover is a handover of the master role to one of our replicas.
+type failover struct {
+	target *ReplicaConn
+	host   string
+	port   string
+	state  string
+	resume chan struct{} // closed once the failover is over, and clients' writes can carry on
+	link   *MasterLink   // our link to the target, once we've become its replica
+}
+
+// State is one of the Failover constants, f is nil when there's no failover.
+func (f *failover) State() string {
+	if f == nil {
+		return FailoverNone
+	}
+	return f.state
+}
+
+// failoverCmd hands our role over to a replica: writes are paused until it
+// has caught up, then we become its replica and ask it to take over with
+// PSYNC FAILOVER. The reply comes straight away, the failover happens after.
+func failoverCmd(ctx RequestContext, args []RespValue) {
+	var host, port string
+	var timeout time.Duration
+	var force, abort bool
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i].EqualAsciiInsensitive("to") && i+2 < len(args) && host == "":
+			host, port = args[i+1].String(), args[i+2].String()
+			if _, e := strconv.ParseUint(port, 10, 16); e != nil {
+				ctx.SendError("ERR Invalid port")
+				return
+			}
+			i += 2
+		case args[i].EqualAsciiInsensitive("timeout") && i+1 < len(args) && timeout == 0:
+			ms, e := strconv.Atoi(args[i+1].String())
+			if e != nil || ms <= 0 {
+				ctx.SendError("ERR FAILOVER timeout must be greater than 0")
+				return
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case args[i].EqualAsciiInsensitive("force") && !force:
+			force = true
+		case args[i].EqualAsciiInsensitive("abort") && !abort:
+			abort = true
+		default:
+			ctx.SendError("ERR syntax error")
+			return
+		}
+	}
+
+	if abort {
+		if host != "" || timeout != 0 || force {
+			ctx.SendError("ERR syntax error")
+			return
+		}
+		if !ctx.Repl.AbortFailover(ctx.Server, "aborted by the FAILOVER ABORT command") {
+			ctx.SendError("ERR No failover in progress.")
+			return
+		}
+		ctx.SendSimpleString("OK")
+		return
+	}
+	if ctx.Repl.Master() != nil {
+		ctx.SendError("ERR FAILOVER is not valid when server is a replica.")
+		return
+	}
+	if force && (host == "" || timeout == 0) {
+		ctx.SendError("ERR FAILOVER with force option requires both a timeout and target HOST and IP.")
+		return
+	}
+	replicas := ctx.Repl.Replicas()
+	if len(replicas) == 0 {
+		ctx.SendError("ERR FAILOVER requires connected replicas.")
+		return
+	}
+
+	var target *ReplicaConn
+	if host != "" {
+		for _, replica := range replicas {
+			if ip, p := replica.Addr(); p == port && (ip == host || sameHost(ip, host)) {
+				target = replica
+			}
+		}
+		if target == nil {
+			ctx.SendError("ERR FAILOVER target HOST and PORT is not a replica.")
+			return
+		}
+		if !target.Online() {
+			ctx.SendError("ERR FAILOVER target replica is not online.")
+			return
+		}
+	} else {
+		// without a target, the replica furthest along takes over.
+		for _, replica := range replicas {
+			if replica.Online() && (target == nil || replica.AckOffset() > target.AckOffset()) {
+				target = replica
+			}
+		}
+		if target == nil {
+			ctx.SendError("ERR FAILOVER requires connected replicas.")
+			return
+		}
+		host, port = target.Addr()
+	}
+
+	// writes are paused under Exec, so none is half way through when we read
+	// the offset the target has to reach.
+	f := &failover{target: target, host: host, port: port, state: FailoverWaitSync, resume: make(chan struct{})}
+	ctx.Exec.Lock()
+	e := ctx.Repl.startFailover(f)
+	_, offset := ctx.Repl.ReplID()
+	ctx.Exec.Unlock()
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	fmt.Println("[repl] failing over to", net.JoinHostPort(host, port), "once it reaches offset", offset)
+	go ctx.Repl.runFailover(ctx.Server, f, offset, timeout, force)
+	ctx.SendSimpleString("OK")
+}
+
+// sameHost is whether two names for a host resolve to the same address, the
+// target is usually given by name and replicas are listed by address.
+func sameHost(ip string, host string) bool {
+	addrs, e := net.LookupHost(host)
+	return e == nil && slices.Contains(addrs, ip)
+}
+
+// WritesPaused is closed once a failover that's pausing clients' writes is
+// over, it's nil when writes aren't paused.
+func (r *Replication) WritesPaused() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failover == nil {
+		return nil
+	}
+	return r.failover.resume
+}
+
+func (r *Replication) startFailover(f *failover) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failover != nil {
+		return ErrFailoverInProgress
+	}
+	r.failover = f
+	return nil
+}
+
+// runFailover waits for the target to ack everything we've sent it, then
+// becomes its replica. Without force, a target that hasn't caught up by the
+// timeout leaves us as we were.
+func (r *Replication) runFailover(server *Server, f *failover, offset int64, timeout time.Duration, force bool) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for waiting := true; waiting; {
+		acks := r.AckNotify()
+		if f.target.AckOffset() >= offset {
+			break
+		}
+		if !slices.Contains(r.Replicas(), f.target) {
+			r.AbortFailover(server, "the target replica disconnected")
+			return
+		}
+		select {
+		case <-acks:
+		case <-f.resume:
+			return
+		case <-time.After(replAckInterval):
+			// a target that goes away doesn't ack to say so.
+		case <-expired:
+			if !force {
+				r.AbortFailover(server, "the target replica didn't catch up in time")
+				return
+			}
+			waiting = false
+		}
+	}
+
+	r.lock.Lock()
+	if r.failover != f {
+		r.lock.Unlock()
+		return
+	}
+	f.state = FailoverInProgress
+	r.disconnectReplicas()
+	r.link = NewMasterLink(r, server, f.host, f.port)
+	f.link = r.link
+	go r.link.run()
+	r.lock.Unlock()
+	server.Config.Set("replicaof", f.host+" "+f.port)
+}
+
+// failingOverTo is whether link is how we're asking the target of a failover
+// to take over from us.
+func (r *Replication) failingOverTo(link *MasterLink) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.failover != nil && r.failover.link == link
+}
+
+// failoverHandshaken ends a failover once the target has answered our PSYNC
+// FAILOVER. If it didn't take over, we go back to being the master.
+func (r *Replication) failoverHandshaken(link *MasterLink, e error) {
+	if !r.failingOverTo(link) {
+		return
+	}
+	if e != nil {
+		r.AbortFailover(link.server, "the target didn't take over: "+e.Error())
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if f := r.failover; f != nil && f.link == link {
+		r.failover = nil
+		close(f.resume)
+		fmt.Println("[repl] failover to", net.JoinHostPort(f.host, f.port), "complete")
+	}
+}
+
+// AbortFailover calls off the failover under way, it returns false when
+// there isn't one. One that had already made us a replica makes us a master
+// again.
+func (r *Replication) AbortFailover(server *Server, reason string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f := r.failover
+	if f == nil {
+		return false
+	}
+	if f.state == FailoverInProgress && r.link == f.link {
+		r.detach()
+		server.Config.Set("replicaof", "")
+	}
+	r.failover = nil
+	close(f.resume)
+	fmt.Println("[repl] failover to", net.JoinHostPort(f.host, f.port), "aborted,", reason)
+	return true
+}
@@ -0,0 +1,18 @@
+package main
+
+var FlushAllCommand = Command{"flushall", flushall, CmdWrite}
+
+// we only serve db 0, so FLUSHDB and FLUSHALL are the same thing.
+var FlushDBCommand = Command{"flushdb", flushall, CmdWrite}
+
+func flushall(ctx RequestContext, args []RespValue) {
+	// ASYNC and SYNC are accepted, clearing is constant time either way.
+	if len(args) > 1 || (len(args) == 1 && !args[0].EqualAsciiInsensitive("async") && !args[0].EqualAsciiInsensitive("sync")) {
+		ctx.SendError("ERR syntax error")
+		return
+	}
+	ctx.KVStore.Clear()
+	ctx.ExpiryStore.Clear()
+	ctx.Propagate(bulkStrings("FLUSHALL"))
+	ctx.SendSimpleString("OK")
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrFunctionNotFound = errors.New("ERR Function not found")
+var ErrLibraryNotFound = errors.New("ERR Library not found")
+var ErrNoFunctions = errors.New("ERR No functions registered")
+var ErrWriteFunctionRO = errors.New("ERR Can not execute a script with write flag using *_ro command.")
+
+// FUNCTION LIST and DUMP run on a read only replica, the subcommands that
+// change the libraries are writes, see subcommandFlags.
+var FunctionCommand = Command{"function", functionCmd, CmdStale | CmdNoScript}
+
+// FCALL holds Exec throughout like EVAL, FCALL_RO only reads so it shares
+// it, and runs on replicas.
+var FCallCommand = Command{"fcall", fcall, CmdWrite | CmdNoScript}
+var FCallROCommand = Command{"fcall_ro", fcallRO, CmdNoScript}
+
+// the flags redis.register_function takes, we only act on no-writes.
+var functionFlags = map[string]bool{
+	"no-writes": true, "allow-oom": true, "allow-stale": true, "no-cluster": true, "allow-cross-slot-keys": true,
+}
+
+// Functions are the function libraries loaded with FUNCTION LOAD. What a
+// library defines isn't changed once it's been loaded, it's only replaced,
+// so libraries can be shared between a snapshot and the live set.
+type Functions struct {
+	lock      sync.RWMutex
+	libraries map[string]*functionLibrary
+	functions map[string]*functionLibrary // by function name, they're unique across libraries
+}
+
+type functionLibrary struct {
+	name      string
+	code      string
+	functions []*libraryFunction // in the order they were registered
+
+	// the library is run the once, when it's loaded, its functions are the
+	// callbacks it registered, and keep whatever they share through their
+	// upvalues from one call to the next, like redis' do. Calls take turns
+	// with the state, FCALL_ROs would otherwise run in it at once.
+	lock      sync.Mutex
+	L         *LuaState
+	callbacks map[string]any
+	run       *scriptRun // the call being run
+}
+
+type libraryFunction struct {
+	name        string
+	description string
+	flags       []string
+}
+
+func (fn *libraryFunction) noWrites() bool {
+	return slices.Contains(fn.flags, "no-writes")
+}
+
+func NewFunctions() *Functions {
+	return &Functions{libraries: map[string]*functionLibrary{}, functions: map[string]*functionLibrary{}}
+}
+
+// Libraries are the libraries by name.
+func (f *Functions) Libraries() []*functionLibrary {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	libs := make([]*functionLibrary, 0, len(f.libraries))
+	for _, lib := range f.libraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+func (f *Functions) Snapshot() *Functions {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return &Functions{libraries: maps.Clone(f.libraries), functions: maps.Clone(f.functions)}
+}
+
+// Find is the function called name, and the library it's from.
+func (f *Functions) Find(name string) (*functionLibrary, *libraryFunction) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	lib := f.functions[name]
+	if lib == nil {
+		return nil, nil
+	}
+	for _, fn := range lib.functions {
+		if fn.name == name {
+			return lib, fn
+		}
+	}
+	return nil, nil
+}
+
+// Load compiles a library and adds it, replacing the one with the same name
+// if replace is set. It's the library's name.
+func (f *Functions) Load(code string, replace bool) (string, error) {
+	lib, e := compileLibrary(code)
+	if e != nil {
+		return "", e
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.libraries[lib.name] != nil && !replace {
+		return "", fmt.Errorf("ERR Library '%s' already exists", lib.name)
+	}
+	libraries := maps.Clone(f.libraries)
+	libraries[lib.name] = lib
+	return lib.name, f.set(libraries)
+}
+
+func (f *Functions) Delete(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.libraries[name] == nil {
+		return ErrLibraryNotFound
+	}
+	libraries := maps.Clone(f.libraries)
+	delete(libraries, name)
+	return f.set(libraries)
+}
+
+// Replace swaps in other's libraries for ours.
+func (f *Functions) Replace(other *Functions) {
+	other.lock.RLock()
+	libraries := other.libraries
+	other.lock.RUnlock()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.set(libraries)
+}
+
+func (f *Functions) Flush() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.set(map[string]*functionLibrary{})
+}
+
+// set swaps in a new set of libraries, unless two of them have a function
+// with the same name. Called with lock held.
+func (f *Functions) set(libraries map[string]*functionLibrary) error {
+	functions := map[string]*functionLibrary{}
+	for _, lib := range libraries {
+		for _, fn := range lib.functions {
+			if functions[fn.name] != nil {
+				return fmt.Errorf("ERR Function %s already exists", fn.name)
+			}
+			functions[fn.name] = lib
+		}
+	}
+	f.libraries, f.functions = libraries, functions
+	return nil
+}
+
+// Dump is the libraries as FUNCTION DUMP has them: each one's code in its
+// rdb encoding, with the same footer as a DUMP payload.
+func (f *Functions) Dump() []byte {
+	var buf bytes.Buffer
+	rw := NewRDBFileWriter(&buf)
+	for _, lib := range f.Libraries() {
+		rw.WriteFunction(lib.code)
+	}
+	rw.w.Flush()
+	payload := binary.LittleEndian.AppendUint16(buf.Bytes(), RDBVersion)
+	return binary.LittleEndian.AppendUint64(payload, Crc64Update(0, payload))
+}
+
+// Restore loads the libraries in a FUNCTION DUMP payload. policy is what
+// happens to the ones already loaded: flush deletes them first, append
+// refuses to replace any of them and replace replaces them.
+func (f *Functions) Restore(payload []byte, policy string) error {
+	body, e := dumpBody(payload)
+	if e != nil {
+		return e
+	}
+	p := NewRDBStreamParser(bytes.NewReader(body), nil).Size(int64(len(body)))
+	var libs []*functionLibrary
+	for p.Offset() < int64(len(body)) {
+		if op, e := p.r.ReadByte(); e != nil || op != Function2 {
+			return errors.New("ERR given type is not a function")
+		}
+		code, e := p.parseString()
+		if e != nil {
+			return ErrDumpBadData
+		}
+		lib, e := compileLibrary(code.String())
+		if e != nil {
+			return e
+		}
+		libs = append(libs, lib)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	libraries := map[string]*functionLibrary{}
+	if policy != "flush" {
+		libraries = maps.Clone(f.libraries)
+	}
+	for _, lib := range libs {
+		if libraries[lib.name] != nil && policy == "append" {
+			return fmt.Errorf("ERR Library %s already exists", lib.name)
+		}
+		libraries[lib.name] = lib
+	}
+	return f.set(libraries)
+}
+
+// validFunctionName is whether name will do for a library or a function.
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if !isLuaNameChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// libraryName reads the library's name from the #! line its code starts with.
+func libraryName(code string) (string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", errors.New("ERR Missing library metadata")
+	}
+	line, _, _ := strings.Cut(code[2:], "\n")
+	parts := strings.Fields(line)
+	if len(parts) == 0 || parts[0] != "lua" {
+		engine := ""
+		if len(parts) > 0 {
+			engine = parts[0]
+		}
+		return "", fmt.Errorf("ERR Engine '%s' not found", engine)
+	}
+	name := ""
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || key != "name" {
+			return "", fmt.Errorf("ERR Invalid metadata value given: %s", part)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", errors.New("ERR Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+// functionLoadTimeout is how long a library has to register its functions.
+// Nothing can kill it while it's loading, so it's stopped after this, like
+// redis does.
+const functionLoadTimeout = 500 * time.Millisecond
+
+// compileLibrary compiles a library and runs it to find out what functions
+// it registers. It's run with just redis.register_function and redis.log,
+// it can't call commands while it's being loaded, the rest of the redis
+// library is only there once it has been.
+func compileLibrary(code string) (*functionLibrary, error) {
+	name, e := libraryName(code)
+	if e != nil {
+		return nil, e
+	}
+	proto, e := LuaCompile("user_function", code)
+	if e != nil {
+		return nil, fmt.Errorf("ERR Error compiling function: %s", e)
+	}
+
+	reg := &functionRegistry{callbacks: map[string]any{}}
+	lib := NewLuaTable(0, 8)
+	luaRegister(lib, map[string]func(*LuaState, []any) []any{
+		"register_function": reg.register,
+		"log":               luaRedisLog,
+	})
+	luaLogLevels(lib)
+	lib.readonly = true
+	L := NewLuaState()
+	L.OpenLibs()
+	L.Globals.Set("redis", lib)
+	L.Globals.readonly = true
+	L.strict = true
+	started := time.Now()
+	L.Hook = func(L *LuaState) {
+		if time.Since(started) > functionLoadTimeout {
+			L.Kill("FUNCTION LOAD timeout")
+		}
+	}
+	if _, e := L.Run(proto); e != nil {
+		return nil, fmt.Errorf("ERR Error registering functions: %s", e)
+	}
+	if len(reg.functions) == 0 {
+		return nil, ErrNoFunctions
+	}
+
+	l := &functionLibrary{name: name, code: code, functions: reg.functions, L: L, callbacks: reg.callbacks}
+	luaRegister(lib, redisCalls(func() *scriptRun { return l.run }))
+	luaRegister(lib, map[string]func(*LuaState, []any) []any{
+		"register_function": func(L *LuaState, args []any) []any {
+			L.Errorf("redis.register_function can only be called on FUNCTION LOAD command")
+			return nil
+		},
+	})
+	return l, nil
+}
+
+// call calls the function called name for run.
+func (l *functionLibrary) call(run *scriptRun, name string, keys, argv []RespValue) ([]any, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.run = run
+	defer func() { l.run = nil }()
+	l.L.Hook, l.L.killed = run.hook, false
+	return l.L.PCall(l.callbacks[name], luaStringArray(keys), luaStringArray(argv))
+}
+
+// functionRegistry is what a library registers as it's run, the callbacks
+// belong to the lua state it's being run in.
+type functionRegistry struct {
+	functions []*libraryFunction
+	callbacks map[string]any
+}
+
+// register is redis.register_function(name, callback), or the same given
+// as a table along with the function's flags and description.
+func (reg *functionRegistry) register(L *LuaState, args []any) []any {
+	fn := &libraryFunction{}
+	var callback any
+	if t, ok := luaArg(args, 0).(*LuaTable); ok && len(args) == 1 {
+		for k, v, _ := t.Next(nil); k != nil; k, v, _ = t.Next(k) {
+			switch k {
+			case "function_name":
+				fn.name, _ = v.(string)
+			case "callback":
+				callback = v
+			case "description":
+				fn.description, _ = v.(string)
+			case "flags":
+				fn.flags = luaFunctionFlags(L, v)
+			default:
+				L.Errorf("unknown argument given to redis.register_function")
+			}
+		}
+	} else {
+		if len(args) != 2 {
+			L.Errorf("wrong number of arguments to redis.register_function")
+		}
+		fn.name, _ = args[0].(string)
+		callback = args[1]
+	}
+	if !validFunctionName(fn.name) {
+		L.Errorf("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if !luaCallable(callback) {
+		L.Errorf("callback argument given to redis.register_function must be a function")
+	}
+	if reg.callbacks[fn.name] != nil {
+		L.Errorf("Function already exists in the library")
+	}
+	reg.functions = append(reg.functions, fn)
+	reg.callbacks[fn.name] = callback
+	return nil
+}
+
+func luaFunctionFlags(L *LuaState, v any) []string {
+	t, ok := v.(*LuaTable)
+	if !ok {
+		L.Errorf("flags argument to redis.register_function must be a table representing function flags")
+	}
+	var flags []string
+	for i := 1; i <= t.Len(); i++ {
+		flag, ok := t.Get(float64(i)).(string)
+		if !ok || !functionFlags[flag] {
+			L.Errorf("unknown flag given")
+		}
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+// fcall is FCALL function numkeys [key ...] [arg ...].
+func fcall(ctx RequestContext, args []RespValue) {
+	callFunction(ctx, "fcall", args)
+}
+
+// fcallRO is FCALL_RO, for functions flagged no-writes.
+func fcallRO(ctx RequestContext, args []RespValue) {
+	callFunction(ctx, "fcall_ro", args)
+}
+
+// callFunction runs a function the way EVAL runs a script.
+func callFunction(ctx RequestContext, name string, args []RespValue) {
+	if e := checkArity(name, args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	lib, fn := ctx.Functions.Find(args[0].String())
+	if fn == nil {
+		ctx.SendError(ErrFunctionNotFound.Error())
+		return
+	}
+	if name == "fcall_ro" && !fn.noWrites() {
+		ctx.SendError(ErrWriteFunctionRO.Error())
+		return
+	}
+	keys, argv, e := scriptKeysArgs(args[1:])
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+
+	run := newScriptRun(ctx, fn.noWrites(), true)
+	rets, e := lib.call(run, fn.name, keys, argv)
+	run.finish(rets, e, fn.name)
+}
+
+// the fewest and most arguments each FUNCTION subcommand takes.
+var functionSubcommandArgs = map[string][2]int{
+	"load": {1, 2}, "delete": {1, 1}, "flush": {0, 1}, "list": {0, 3}, "dump": {0, 0}, "restore": {1, 2},
+	"kill": {0, 0},
+}
+
+// the FUNCTION subcommands that change the libraries.
+var functionWrites = map[string]bool{"load": true, "delete": true, "flush": true, "restore": true}
+
+// subcommandFlags are the flags a command has on top of its own for the
+// subcommand it's been given, FUNCTION's writes hold Exec to themselves and
+// wait out a failover like any other.
+func subcommandFlags(name string, args []RespValue) CommandFlags {
+	if name == "function" && len(args) > 0 && functionWrites[args[0].ToLower()] {
+		return CmdWrite
+	}
+	return 0
+}
+
+// functionCmd is FUNCTION LOAD, DELETE, FLUSH, LIST, DUMP and RESTORE, for
+// managing the libraries FCALL calls functions from, and KILL. The ones that change
+// them are propagated like any other write.
+func functionCmd(ctx RequestContext, args []RespValue) {
+	if e := checkArity("function", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	all := args
+	sub, args := args[0].ToLower(), args[1:]
+	n, known := functionSubcommandArgs[sub]
+	if !known || len(args) < n[0] || len(args) > n[1] {
+		ctx.SendError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try FUNCTION HELP.", sub))
+		return
+	}
+	switch sub {
+	case "list":
+		functionList(ctx, args)
+		return
+	case "dump":
+		ctx.SendResp(RespValue{BulkString, ctx.Functions.Dump()})
+		return
+	case "kill":
+		if e := ctx.Running.Kill(true); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendSimpleString("OK")
+		return
+	}
+
+	f := ctx.Functions
+	var reply RespValue
+	switch sub {
+	case "load":
+		if len(args) == 2 && !args[0].EqualAsciiInsensitive("replace") {
+			ctx.SendError("ERR Unknown option given: " + args[0].String())
+			return
+		}
+		name, e := f.Load(args[len(args)-1].String(), len(args) == 2)
+		if e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		reply = RespValue{BulkString, []byte(name)}
+	case "delete":
+		if e := f.Delete(args[0].String()); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		reply = RespValue{SimpleString, []byte("OK")}
+	case "flush":
+		if len(args) == 1 && !args[0].EqualAsciiInsensitive("async") && !args[0].EqualAsciiInsensitive("sync") {
+			ctx.SendError("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+			return
+		}
+		f.Flush()
+		reply = RespValue{SimpleString, []byte("OK")}
+	case "restore":
+		policy := "append"
+		if len(args) == 2 {
+			policy = args[1].ToLower()
+			if policy != "append" && policy != "replace" && policy != "flush" {
+				ctx.SendError("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+				return
+			}
+		}
+		if e := f.Restore(args[0].Value.([]byte), policy); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		reply = RespValue{SimpleString, []byte("OK")}
+	}
+	ctx.Propagate(append(bulkStrings("FUNCTION"), all...))
+	ctx.SendResp(reply)
+}
+
+// functionList is FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE].
+func functionList(ctx RequestContext, args []RespValue) {
+	pattern, withCode := "", false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i].EqualAsciiInsensitive("withcode") && !withCode:
+			withCode = true
+		case args[i].EqualAsciiInsensitive("libraryname") && pattern == "" && i+1 < len(args):
+			i++
+			pattern = args[i].String()
+		default:
+			ctx.SendError("ERR Unknown argument " + args[i].String())
+			return
+		}
+	}
+
+	libs := []RespValue{}
+	for _, lib := range ctx.Functions.Libraries() {
+		if pattern != "" {
+			if matched, _ := path.Match(pattern, lib.name); !matched {
+				continue
+			}
+		}
+		functions := make([]RespValue, 0, len(lib.functions))
+		for _, fn := range lib.functions {
+			description := RespValue{NullBulkString, nil}
+			if fn.description != "" {
+				description = RespValue{BulkString, []byte(fn.description)}
+			}
+			functions = append(functions, RespValue{Array, []RespValue{
+				{BulkString, []byte("name")}, {BulkString, []byte(fn.name)},
+				{BulkString, []byte("description")}, description,
+				{BulkString, []byte("flags")}, {Array, bulkStrings(fn.flags...)},
+			}})
+		}
+		entry := []RespValue{
+			{BulkString, []byte("library_name")}, {BulkString, []byte(lib.name)},
+			{BulkString, []byte("engine")}, {BulkString, []byte("LUA")},
+			{BulkString, []byte("functions")}, {Array, functions},
+		}
+		if withCode {
+			entry = append(entry, RespValue{BulkString, []byte("library_code")}, RespValue{BulkString, []byte(lib.code)})
+		}
+		libs = append(libs, RespValue{Array, entry})
+	}
+	ctx.SendResp(RespValue{Array, libs})
+}
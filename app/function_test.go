@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLibrary = `#!lua name=mylib
+local function get(keys, args) return redis.call('GET', keys[1]) end
+redis.register_function('myget', get)
+redis.register_function{function_name = 'myset', callback = function(keys, args) return redis.call('SET', keys[1], args[1]) end}
+redis.register_function{function_name = 'myget_ro', callback = get, flags = {'no-writes'}, description = 'reads'}
+redis.register_function{function_name = 'sneaky', callback = function(keys) return redis.call('DEL', keys[1]) end, flags = {'no-writes'}}
+`
+
+func TestFunction(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(nil)
+	ctx.Router = router
+	ctx.Client = NewClient()
+
+	other := "#!lua name=other\nredis.register_function('ping', function() return 'pong' end)"
+	counter := "#!lua name=counter\nlocal n = 0\nredis.register_function('inc', function() n = n + 1 return n end)\n" +
+		"redis.register_function('late', function() redis.register_function('x', function() end) end)"
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"FUNCTION", "LOAD", "return 1"}, "-ERR Missing library metadata\r\n"},
+		{[]string{"FUNCTION", "LOAD", "#!js name=x\n"}, "-ERR Engine 'js' not found\r\n"},
+		{[]string{"FUNCTION", "LOAD", "#!lua\n"}, "-ERR Library name was not given\r\n"},
+		{[]string{"FUNCTION", "LOAD", "#!lua name=empty\nlocal x = 1"}, "-" + ErrNoFunctions.Error() + "\r\n"},
+		{[]string{"FUNCTION", "LOAD", "#!lua name=loop\nwhile true do end"}, "-ERR Error registering functions: FUNCTION LOAD timeout\r\n"},
+		{[]string{"FUNCTION", "LOAD", "#!lua name=loop\nwhile true do pcall(function() while true do end end) end"}, "-ERR Error registering functions: FUNCTION LOAD timeout\r\n"},
+		{[]string{"FUNCTION", "LOAD", "#!lua name=bad\nredis.call('GET', 'a')"}, "-ERR Error registering functions: user_function:2: attempt to call field 'call' (a nil value)\r\n"},
+		{[]string{"FUNCTION", "LOAD", testLibrary}, "$5\r\nmylib\r\n"},
+		{[]string{"FUNCTION", "LOAD", testLibrary}, "-ERR Library 'mylib' already exists\r\n"},
+		{[]string{"FUNCTION", "LOAD", "REPLACE", testLibrary}, "$5\r\nmylib\r\n"},
+		{[]string{"FUNCTION", "LOAD", "#!lua name=clash\nredis.register_function('myget', function() end)"}, "-ERR Function myget already exists\r\n"},
+		{[]string{"FUNCTION", "LOAD", other}, "$5\r\nother\r\n"},
+
+		{[]string{"FCALL", "myset", "1", "k", "v"}, "+OK\r\n"},
+		{[]string{"FCALL", "myget", "1", "k"}, "$1\r\nv\r\n"},
+		{[]string{"FCALL", "ping", "0"}, "$4\r\npong\r\n"},
+		{[]string{"FCALL", "nosuch", "0"}, "-" + ErrFunctionNotFound.Error() + "\r\n"},
+		{[]string{"FCALL_RO", "myset", "1", "k", "w"}, "-" + ErrWriteFunctionRO.Error() + "\r\n"},
+		{[]string{"FCALL_RO", "myget_ro", "1", "k"}, "$1\r\nv\r\n"},
+		{[]string{"FCALL", "sneaky", "1", "k"}, "-" + ErrWriteFromReadOnly.Error() + "\r\n"},
+
+		// the library's run the once, its functions keep what they share.
+		{[]string{"FUNCTION", "LOAD", counter}, "$7\r\ncounter\r\n"},
+		{[]string{"FCALL", "inc", "0"}, ":1\r\n"},
+		{[]string{"FCALL", "inc", "0"}, ":2\r\n"},
+		{[]string{"FCALL_RO", "inc", "0"}, "-" + ErrWriteFunctionRO.Error() + "\r\n"},
+		{[]string{"FCALL", "inc", "0"}, ":3\r\n"},
+		{[]string{"FCALL", "late", "0"}, "-ERR user_function:4: redis.register_function can only be called on FUNCTION LOAD command script: late\r\n"},
+
+		{[]string{"FUNCTION", "LIST", "LIBRARYNAME", "oth*", "WITHCODE"}, "*1\r\n*8\r\n$12\r\nlibrary_name\r\n$5\r\nother\r\n$6\r\nengine\r\n$3\r\nLUA\r\n" +
+			"$9\r\nfunctions\r\n*1\r\n*6\r\n$4\r\nname\r\n$4\r\nping\r\n$11\r\ndescription\r\n$-1\r\n$5\r\nflags\r\n*0\r\n" +
+			"$12\r\nlibrary_code\r\n$" + strconv.Itoa(len(other)) + "\r\n" + other + "\r\n"},
+		{[]string{"FUNCTION", "LIST", "LIBRARYNAME"}, "-ERR Unknown argument LIBRARYNAME\r\n"},
+		{[]string{"FUNCTION", "DELETE", "nosuch"}, "-" + ErrLibraryNotFound.Error() + "\r\n"},
+		{[]string{"FUNCTION", "DELETE", "other"}, "+OK\r\n"},
+		{[]string{"FCALL", "ping", "0"}, "-" + ErrFunctionNotFound.Error() + "\r\n"},
+		{[]string{"FUNCTION", "NOPE"}, "-ERR unknown subcommand or wrong number of arguments for 'nope'. Try FUNCTION HELP.\r\n"},
+		{[]string{"EVAL", "return redis.call('FUNCTION', 'FLUSH')", "0"}, "-" + ErrNotFromScript.Error() + "\r\n"},
+		{[]string{"FUNCTION", "FLUSH"}, "+OK\r\n"},
+		{[]string{"FUNCTION", "LIST"}, "*0\r\n"},
+	} {
+		if reply := clusterDo(router, ctx, test.args...); reply != test.want {
+			t.Fatalf("%v: expected %q, got %q", test.args, test.want, reply)
+		}
+	}
+}
+
+func TestFunctionWrites(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(nil)
+	ctx.Router = router
+
+	// a failover holds the libraries where they are, like the dataset.
+	ctx.Repl.startFailover(&failover{state: FailoverWaitSync, resume: make(chan struct{})})
+	done := make(chan string)
+	go func() { done <- clusterDo(router, ctx, "FUNCTION", "LOAD", testLibrary) }()
+	select {
+	case reply := <-done:
+		t.Fatalf("expected FUNCTION LOAD to wait out the failover, got %q", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if reply := clusterDo(router, ctx, "FUNCTION", "LIST"); reply != "*0\r\n" {
+		t.Fatalf("expected FUNCTION LIST to run during the failover, got %q", reply)
+	}
+	ctx.Repl.AbortFailover(ctx.Server, "test")
+	if reply := <-done; reply != "$5\r\nmylib\r\n" {
+		t.Fatalf("expected FUNCTION LOAD once the failover was over, got %q", reply)
+	}
+
+	// and a read only replica doesn't change them, but lists them.
+	ctx.Repl.ReplicaOf(ctx.Server, "127.0.0.1", "1")
+	t.Cleanup(ctx.Repl.Detach)
+	if reply := clusterDo(router, ctx, "FUNCTION", "DELETE", "mylib"); reply != "-"+ErrReadOnlyReplica.Error()+"\r\n" {
+		t.Fatalf("expected FUNCTION DELETE to be refused on a replica, got %q", reply)
+	}
+	if reply := clusterDo(router, ctx, "FUNCTION", "LIST"); !strings.Contains(reply, "mylib") {
+		t.Fatalf("expected FUNCTION LIST to run on a replica, got %q", reply)
+	}
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(nil)
+	ctx.Router = router
+	clusterDo(router, ctx, "FUNCTION", "LOAD", testLibrary)
+	dump := ctx.Functions.Dump()
+
+	if e := ctx.Functions.Restore(dump, "append"); e == nil || e.Error() != "ERR Library mylib already exists" {
+		t.Fatalf("append over an existing library: %v", e)
+	}
+	if e := ctx.Functions.Restore(dump, "replace"); e != nil {
+		t.Fatal(e)
+	}
+	corrupt := bytes.Clone(dump)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if e := ctx.Functions.Restore(corrupt, "flush"); e == nil {
+		t.Fatal("a corrupt payload was restored")
+	}
+
+	// flush throws away whatever was there before.
+	clusterDo(router, ctx, "FUNCTION", "LOAD", "#!lua name=other\nredis.register_function('ping', function() return 'pong' end)")
+	if reply := clusterDo(router, ctx, "FUNCTION", "RESTORE", string(dump), "FLUSH"); reply != "+OK\r\n" {
+		t.Fatalf("restore: %q", reply)
+	}
+	if libs := ctx.Functions.Libraries(); len(libs) != 1 || libs[0].name != "mylib" {
+		t.Fatalf("expected just mylib after the restore, got %d libraries", len(libs))
+	}
+	if reply := clusterDo(router, ctx, "FUNCTION", "RESTORE", string(dump), "SOMETIMES"); reply != "-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.\r\n" {
+		t.Fatalf("bad policy: %q", reply)
+	}
+}
+
+func TestFunctionPersistence(t *testing.T) {
+	db := NewRevivedDb()
+	db.DB.Set("k", RespValue{BulkString, []byte("v")})
+	if _, e := db.Functions.Load(testLibrary, false); e != nil {
+		t.Fatal(e)
+	}
+	var buf bytes.Buffer
+	if e := writeRDBSnapshot(NewRDBFileWriter(&buf), db); e != nil {
+		t.Fatal(e)
+	}
+	dbs, e := parseTestRDB(t, buf.Bytes(), false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if lib, fn := dbs[0].Functions.Find("myget_ro"); lib == nil || lib.code != testLibrary || fn.description != "reads" {
+		t.Fatal("the library didn't survive the rdb")
+	}
+
+	// loading a library is logged like a write.
+	dir := filepath.Join(t.TempDir(), "appendonlydir")
+	aof, e := NewAppendOnlyFile(dir, "appendonly.aof", AppendFsyncAlways)
+	if e != nil {
+		t.Fatal(e)
+	}
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(aof)
+	ctx.Router = router
+	if e := aof.Open(ctx.Server); e != nil {
+		t.Fatal(e)
+	}
+	clusterDo(router, ctx, "FUNCTION", "LOAD", testLibrary)
+	clusterDo(router, ctx, "FUNCTION", "LOAD", "nope")
+	aof.Close()
+
+	logged, _ := os.ReadFile(lastIncr(t, aof))
+	want, _ := RespValue{Array, bulkStrings("FUNCTION", "LOAD", testLibrary)}.Serialize()
+	if !bytes.Equal(logged, want) {
+		t.Fatalf("expected just the load that worked to be logged, got %q", logged)
+	}
+}
@@ -1,6 +1,6 @@
 package main
 
-var GetCommand = Command{"get", get}
+var GetCommand = Command{"get", get, 0}
 
 var GetArgsParser = NewArgumentsParser().NumPositionals(1)
 
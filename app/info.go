@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+var InfoCommand = Command{"info", info, CmdLoading | CmdStale}
+
+// each section renders its own "field:value" lines.
+type infoSection struct {
+	name  string
+	lines func(ctx RequestContext) []string
+}
+
+var infoSections = []infoSection{
+	{"server", serverInfo},
+	{"persistence", persistenceInfo},
+	{"replication", replicationInfo},
+	{"keyspace", keyspaceInfo},
+	{"cluster", clusterInfo},
+}
+
+// a sentinel has no data to report on, just what it's watching.
+var sentinelInfoSections = []infoSection{
+	{"server", serverInfo},
+	{"sentinel", sentinelInfo},
+}
+
+func info(ctx RequestContext, args []RespValue) {
+	wanted := map[string]bool{}
+	for _, arg := range args {
+		wanted[arg.ToLower()] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	sections := infoSections
+	if ctx.Sentinel != nil {
+		sections = sentinelInfoSections
+	}
+	var sb strings.Builder
+	for _, section := range sections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+		sb.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, line := range section.lines(ctx) {
+			sb.WriteString(line + "\r\n")
+		}
+	}
+	ctx.SendResp(RespValue{BulkString, []byte(sb.String())})
+}
+
+func serverInfo(ctx RequestContext) []string {
+	port, _ := ctx.Config.Get("port")
+	return []string{
+		"redis_version:7.2.0",
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		fmt.Sprintf("tcp_port:%s", port),
+	}
+}
+
+func persistenceInfo(ctx RequestContext) []string {
+	lines := append(ctx.Loading.InfoLines(), ctx.RDB.InfoLines()...)
+	if ctx.AOF == nil {
+		return append(lines, "aof_enabled:0")
+	}
+	return append(lines, ctx.AOF.InfoLines()...)
+}
+
+func replicationInfo(ctx RequestContext) []string {
+	return ctx.Repl.InfoLines()
+}
+
+func clusterInfo(ctx RequestContext) []string {
+	return ctx.Cluster.InfoLines()
+}
+
+func sentinelInfo(ctx RequestContext) []string {
+	return ctx.Sentinel.InfoLines()
+}
+
+func keyspaceInfo(ctx RequestContext) []string {
+	keys := ctx.KVStore.Len()
+	if keys == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("db0:keys=%d,expires=%d", keys, ctx.ExpiryStore.Len())}
+}
@@ -1,6 +1,6 @@
 package main
 
-var KeysCommand = Command{"keys", keys}
+var KeysCommand = Command{"keys", keys, 0}
 
 var KeysArgsParser = NewArgumentsParser().NumPositionals(1)
 
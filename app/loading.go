@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrLoading = errors.New("LOADING Redis is loading the dataset in memory")
+
+type ErrUnknownCorruptPolicy string
+
+func (e ErrUnknownCorruptPolicy) Error() string {
+	return fmt.Sprintf("unknown rdb-corrupt-policy '%s', expected refuse, empty or truncate", string(e))
+}
+
+// what to do when the rdb file turns out to be corrupt part way through loading.
+const (
+	CorruptPolicyRefuse   = "refuse"   // exit, leave the file for an operator to look at
+	CorruptPolicyEmpty    = "empty"    // throw away whatever was loaded and start with no data
+	CorruptPolicyTruncate = "truncate" // keep every key read before the corruption
+)
+
+// LoadingState tracks an in progress dataset load so that clients can be told
+// to back off, and INFO can report how far along it is.
+type LoadingState struct {
+	active      atomic.Bool
+	loadedBytes atomic.Int64
+	loadedKeys  atomic.Int64
+	lock        sync.RWMutex
+	startTime   time.Time
+	totalBytes  int64
+}
+
+func NewLoadingState() *LoadingState {
+	return &LoadingState{}
+}
+
+// Begin marks a load of totalBytes as started.
+func (ls *LoadingState) Begin(totalBytes int64) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	ls.startTime = time.Now()
+	ls.totalBytes = totalBytes
+	ls.loadedBytes.Store(0)
+	ls.loadedKeys.Store(0)
+	ls.active.Store(true)
+}
+
+func (ls *LoadingState) Finish() {
+	ls.active.Store(false)
+}
+
+func (ls *LoadingState) Active() bool {
+	return ls.active.Load()
+}
+
+// InfoLines reports progress in the same fields as the persistence section of redis' INFO.
+func (ls *LoadingState) InfoLines() []string {
+	if !ls.Active() {
+		return []string{"loading:0"}
+	}
+	ls.lock.RLock()
+	start, total := ls.startTime, ls.totalBytes
+	ls.lock.RUnlock()
+	loaded, keys := ls.loadedBytes.Load(), ls.loadedKeys.Load()
+
+	elapsed := time.Since(start)
+	perc := 0.0
+	eta := int64(1) // redis reports 1 until there is enough data to estimate
+	if total > 0 {
+		perc = float64(loaded) / float64(total) * 100
+	}
+	if loaded > 0 {
+		eta = int64(elapsed.Seconds() * float64(total-loaded) / float64(loaded))
+	}
+	return []string{
+		"loading:1",
+		fmt.Sprintf("loading_start_time:%d", start.Unix()),
+		fmt.Sprintf("loading_total_bytes:%d", total),
+		fmt.Sprintf("loading_loaded_bytes:%d", loaded),
+		fmt.Sprintf("loading_loaded_perc:%.2f", perc),
+		fmt.Sprintf("loading_loaded_keys:%d", keys),
+		fmt.Sprintf("loading_eta_seconds:%d", eta),
+	}
+}
+
+// progressReader counts the bytes pulled through it into the loading state.
+type progressReader struct {
+	r     io.Reader
+	state *LoadingState
+}
+
+func (pr progressReader) Read(p []byte) (int, error) {
+	n, e := pr.r.Read(p)
+	pr.state.loadedBytes.Add(int64(n))
+	return n, e
+}
+
+// progressVisitor counts keys as they are handed to the loader.
+type progressVisitor struct {
+	*RDBLoader
+	state *LoadingState
+}
+
+func (pv progressVisitor) OnKey(entry RDBEntry) error {
+	pv.state.loadedKeys.Add(1)
+	return pv.RDBLoader.OnKey(entry)
+}
+
+// LoadServerDbs loads the dataset into the context's stores, from the append
+// only file when there is one and from the rdb file otherwise, then starts
+// logging writes if aof is enabled. The stores are live while this runs,
+// clients are kept away from them by ctx.Loading until it is done.
+func LoadServerDbs(ctx RequestContext, router CommandRouter) error {
+	defer ctx.Loading.Finish()
+	if ctx.AOF != nil && ctx.AOF.Exists() {
+		allowTruncated, _ := ctx.Config.Get("aof-load-truncated")
+		applied, e := ctx.AOF.Load(router, ctx, allowTruncated == "yes")
+		if e != nil {
+			fmt.Println("err replaying aof, refusing to start", e)
+			return e
+		}
+		fmt.Println("replayed", applied, "commands and keys from", ctx.AOF.Dir())
+	} else if e := loadRDB(ctx.Config, ctx.Keys, ctx.Dataset(), ctx.Loading); e != nil {
+		return e
+	}
+
+	if ctx.AOF != nil {
+		return ctx.AOF.Open(ctx.Server)
+	}
+	return nil
+}
+
+// loadRDB loads the configured rdb file into db, reporting progress to state as it goes.
+func loadRDB(config *SharedRWStore[string], keys *KeyRing, db RevivedDB, state *LoadingState) error {
+	dir, _ := config.Get("dir")               // should always exist
+	dbfilename, _ := config.Get("dbfilename") // should always exist
+	policy, _ := config.Get("rdb-corrupt-policy")
+	switch policy {
+	case CorruptPolicyRefuse, CorruptPolicyEmpty, CorruptPolicyTruncate:
+	default:
+		return ErrUnknownCorruptPolicy(policy)
+	}
+
+	path := filepath.Join(dir, dbfilename)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("rdb file doesn't exist, starting fresh db instance")
+		return nil
+	}
+	if err != nil {
+		fmt.Println("err opening rdb file", err)
+		return err
+	}
+	defer file.Close()
+
+	var size int64
+	if stat, statErr := file.Stat(); statErr == nil {
+		size = stat.Size()
+	}
+	state.Begin(size)
+
+	// we only serve db 0 for now, anything in the other dbs is loaded and dropped.
+	loader := NewRDBLoaderInto(db)
+	plain, _, parseErr := MaybeDecrypt(progressReader{file, state}, keys)
+	if parseErr == nil {
+		skipZero, _ := config.Get("rdb-skip-zero-checksum")
+		parseErr = NewRDBStreamParser(plain, progressVisitor{loader, state}).
+			SkipZeroChecksum(skipZero == "yes").
+			Parse()
+	}
+	if parseErr == nil {
+		fmt.Println("loaded", loader.Keys(), "keys from", path)
+		return nil
+	}
+
+	switch policy {
+	case CorruptPolicyEmpty:
+		fmt.Println("err parsing rdb file, starting fresh db instance", parseErr)
+		db.DB.Clear()
+		db.Expiry.Clear()
+		db.Functions.Flush()
+		return nil
+	case CorruptPolicyTruncate:
+		fmt.Println("err parsing rdb file, keeping the", loader.Keys(), "keys read before it", parseErr)
+		return nil
+	default:
+		fmt.Println("err parsing rdb file, refusing to start", parseErr)
+		return parseErr
+	}
+}
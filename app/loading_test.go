@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadingReplies(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(nil)
+	ctx.Loading.Begin(100)
+	if reply := clusterDo(router, ctx, "GET", "a"); reply != "-"+ErrLoading.Error()+"\r\n" {
+		t.Fatalf("expected GET to be refused while loading, got %q", reply)
+	}
+
+	// progress is counted as the file is read.
+	buf := make([]byte, 40)
+	progressReader{bytes.NewReader(make([]byte, 100)), ctx.Loading}.Read(buf)
+	info := clusterDo(router, ctx, "INFO", "persistence")
+	for _, field := range []string{"loading:1", "loading_total_bytes:100", "loading_loaded_bytes:40", "loading_loaded_perc:40.00"} {
+		if !strings.Contains(info, field+"\r\n") {
+			t.Fatalf("expected %s in INFO while loading, got %q", field, info)
+		}
+	}
+
+	ctx.Loading.Finish()
+	if reply := clusterDo(router, ctx, "GET", "a"); reply != "$-1\r\n" {
+		t.Fatalf("expected GET to run once loaded, got %q", reply)
+	}
+	if info := clusterDo(router, ctx, "INFO", "persistence"); !strings.Contains(info, "loading:0\r\n") || strings.Contains(info, "loading_total_bytes") {
+		t.Fatalf("expected INFO to report the load as done, got %q", info)
+	}
+}
+
+func TestLoadingCorruptPolicy(t *testing.T) {
+	// a and b are whole, c is where the file goes wrong.
+	var buf bytes.Buffer
+	w := NewRDBFileWriter(&buf)
+	w.WriteHeader()
+	w.WriteSelectDB(0)
+	w.WriteKeyValue("a", RespValue{BulkString, []byte("1")}, nil)
+	w.WriteKeyValue("b", RespValue{BulkString, []byte("2")}, nil)
+	w.w.Flush()
+	c := buf.Len()
+	w.WriteKeyValue("c", RespValue{BulkString, []byte("3")}, nil)
+	w.WriteEOF()
+	data := buf.Bytes()
+
+	corrupt := bytes.Clone(data)
+	corrupt[c] = 0x7f // not a value type we know
+	for name, file := range map[string][]byte{"truncated": data[:c+2], "corrupt": corrupt} {
+		for _, test := range []struct {
+			policy string
+			keys   []string
+		}{
+			{CorruptPolicyRefuse, nil},
+			{CorruptPolicyEmpty, []string{}},
+			{CorruptPolicyTruncate, []string{"a", "b"}},
+		} {
+			dir := t.TempDir()
+			if e := os.WriteFile(filepath.Join(dir, "dump.rdb"), file, 0644); e != nil {
+				t.Fatal(e)
+			}
+			ctx := newTestContext(nil)
+			ctx.Config.Set("dir", dir)
+			ctx.Config.Set("dbfilename", "dump.rdb")
+			ctx.Config.Set("rdb-corrupt-policy", test.policy)
+			e := LoadServerDbs(ctx, initCommandRouter(NewCommandRouter()))
+			if ctx.Loading.Active() {
+				t.Fatalf("%s, %s: still loading once it's done", name, test.policy)
+			}
+
+			var corruptErr ErrRDBCorrupt
+			if test.keys == nil {
+				if !errors.As(e, &corruptErr) || errors.Is(e, ErrRDBTruncated) != (name == "truncated") {
+					t.Fatalf("%s, %s: expected the file to be refused, got %v", name, test.policy, e)
+				}
+				continue
+			}
+			if e != nil {
+				t.Fatalf("%s, %s: %v", name, test.policy, e)
+			}
+			keys := ctx.KVStore.Keys()
+			if len(keys) != len(test.keys) {
+				t.Fatalf("%s, %s: expected keys %v, got %v", name, test.policy, test.keys, keys)
+			}
+			for i, key := range test.keys {
+				if v, _ := ctx.KVStore.Get(key); v.String() != string(rune('1'+i)) {
+					t.Fatalf("%s, %s: expected %s to have been loaded, got %q", name, test.policy, key, v.String())
+				}
+			}
+		}
+	}
+
+	ctx := newTestContext(nil)
+	ctx.Config.Set("rdb-corrupt-policy", "ignore")
+	if e := LoadServerDbs(ctx, initCommandRouter(NewCommandRouter())); e != ErrUnknownCorruptPolicy("ignore") {
+		t.Fatalf("expected an unknown policy to be refused, got %v", e)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// runLua runs src and gives back what it returns, as tostring() would have it.
+func runLua(t *testing.T, src string) (string, error) {
+	t.Helper()
+	proto, e := LuaCompile("test", src)
+	if e != nil {
+		return "", e
+	}
+	L := NewLuaState()
+	L.OpenLibs()
+	rets, e := L.Run(proto)
+	if e != nil {
+		return "", e
+	}
+	parts := make([]string, len(rets))
+	for i, v := range rets {
+		parts[i] = luaToString(v)
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func TestLua(t *testing.T) {
+	for _, test := range []struct{ src, want string }{
+		{"return 1 + 2 * 3 ^ 2 / 6", "4"},
+		{"return 7 % 3, -7 % 3, 2^-1, 10 / 4", "1 2 0.5 2.5"},
+		{"return 1 .. 2, 'a' .. 'b' .. 'c'", "12 abc"},
+		{"return '10' + 5, 3 == 3.0, 'a' < 'b', not nil", "15 true true true"},
+		{"return 1 and 2, nil and 1, false or 'x', nil or false", "2 nil x false"},
+		{"return #'hello', #{1, 2, 3}, 0x1F, 1e2", "5 3 31 100"},
+		{"local a, b, c = 1, 2 return a, b, c", "1 2 nil"},
+		{"local a, b = 1, 2 a, b = b, a return a, b", "2 1"},
+		{"local s = 0 for i = 1, 10 do s = s + i end return s", "55"},
+		{"local s = 0 for i = 10, 1, -2 do s = s + i end return s", "30"},
+		{"local i = 0 while true do i = i + 1 if i == 5 then break end end return i", "5"},
+		{"local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", "4"},
+		{"local t = {} for k, v in pairs({a = 1, b = 2}) do t[#t + 1] = k .. v end table.sort(t) return table.concat(t, ',')", "a1,b2"},
+		{"local s = '' for i, v in ipairs({'x', 'y', nil, 'z'}) do s = s .. i .. v end return s", "1x2y"},
+		{"local function f(n) if n < 2 then return n end return f(n - 1) + f(n - 2) end return f(15)", "610"},
+		{"local function counter() local n = 0 return function() n = n + 1 return n end end local c = counter() c() return c()", "2"},
+		{"local fs = {} for i = 1, 3 do fs[i] = function() return i end end return fs[1](), fs[3]()", "1 3"},
+		{"local function f(...) return select('#', ...), ... end return f(1, nil, 3)", "3 1 nil 3"},
+		{"local function f(...) local a, b = ... return b end return f(1, 2)", "2"},
+		{"local t = {f = function(self, x) return self.v + x end, v = 1} return t:f(2)", "3"},
+		{"local t = {1, 2, [10] = 'x', y = {z = 'deep'}} return t[10], t.y.z, #t", "x deep 2"},
+		{"local function f() return 1, 2 end local t = {f(), f()} return #t", "3"},
+		{"return (select(2, 'a', 'b', 'c'))", "b"},
+		{"local t = setmetatable({}, {__index = function(t, k) return k .. '!' end}) return t.hi", "hi!"},
+		{"local t = setmetatable({}, {__add = function(a, b) return 42 end}) return t + 1", "42"},
+		{"local mt = {__eq = function() return true end} return setmetatable({}, mt) == setmetatable({}, mt)", "true"},
+		{"return tostring(setmetatable({}, {__tostring = function() return 'obj' end}))", "obj"},
+		{"return pcall(error, 'boom')", "false boom"},
+		{"local ok, e = pcall(error, {code = 1}) return ok, e.code", "false 1"},
+		{"return select(2, pcall(function() error('x', 0) end))", "x"},
+		{"return select(2, pcall(function() local x = nil; return x.y end))", "test:1: attempt to index local 'x' (a nil value)"},
+		{"return xpcall(function() error('x') end, function(m) return 'handled ' .. m end)", "false handled test:1: x"},
+		{"return tonumber('0x10'), tonumber('  12  '), tonumber('z', 36), tonumber('1e'), tonumber(nil)", "16 12 35 nil nil"},
+		{"return math.floor(3.7), math.ceil(3.2), math.max(1, 5, 3), math.min(2, 0), math.abs(-4), math.fmod(7, 3)", "3 4 5 0 4 1"},
+		{"return math.huge, -math.huge, 1 / 0 ~= 1 / 0", "inf -inf false"},
+		{"return 2^53, 1e15, 0.1, 100000000000000, -0.5", "9.007199254741e+15 1e+15 0.1 1e+14 -0.5"},
+		{"local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return table.concat(t, ' ')", "3 2 1"},
+		{"local t = {1, 2} table.insert(t, 3) table.insert(t, 1, 0) return table.concat(t, ','), table.remove(t), table.remove(t, 1), #t", "0,1,2,3 3 0 2"},
+		{"return unpack({1, 2, 3})", "1 2 3"},
+		{"return rawequal('a', 'a'), rawget({x = 1}, 'x'), type(print), type(nil)", "true 1 nil nil"},
+		{"return string.upper('abc'), ('x'):rep(3), ('hello'):sub(2, -2), ('abc'):byte(1, -1)", "ABC xxx ell 97 98 99"},
+		{"return string.char(72, 105), string.len('\\0ab'), ('%d items'):format(3), #string.reverse('abc')", "Hi 3 3 items 3"},
+		{"return string.format('%5.2f|%-3s|%x|%q|%s', 3.14159, 'a', 255, 'a\"b', 1)", " 3.14|a  |ff|\"a\\\"b\"|1"},
+		{"return string.find('hello world', 'o w'), string.find('hello', 'l+'), string.find('a.b', '.', 1, true)", "5 3 2 2"},
+		{"return string.match('key=value', '(%w+)=(%w+)'), string.match('  trim  ', '^%s*(.-)%s*$')", "key trim"},
+		{"return (string.gsub('hello world', 'o', '0')), string.gsub('abc', '%w', '%0%0')", "hell0 w0rld aabbcc 3"},
+		{"return (string.gsub('$name is $age', '%$(%w+)', {name = 'bob', age = 3}))", "bob is 3"},
+		{"return (string.gsub('abc', '.', function(c) return c:upper() end))", "ABC"},
+		{"local s = '' for w in string.gmatch('one two three', '%a+') do s = s .. w:sub(1, 1) end return s", "ott"},
+		{"return string.match('[[x]]', '%[(%b[])%]'), string.find('THE (quick) fox', '%((%a+)%)')", "[x] 5 11 quick"},
+		{"return [[\nlong\nstring]], [==[a]]b]==]", "long\nstring a]]b"},
+		{"return 'tab\\tnew\\nline\\65\\q'", "tab\tnew\nlineAq"},
+		{"return bit.band(0xff, 0x0f), bit.bor(1, 2), bit.bxor(3, 1), bit.lshift(1, 4), bit.tohex(255), bit.bnot(0)", "15 3 2 16 000000ff -1"},
+		{"return cjson.encode({1, 2, 'x'}), cjson.encode({a = {true, false}}), cjson.encode('a/b')", "[1,2,\"x\"] {\"a\":[true,false]} \"a\\/b\""},
+		{"local t = cjson.decode('{\"a\":[1,2,{\"b\":null}],\"c\":\"d\"}') return t.a[2], t.c, t.a[3].b == cjson.null", "2 d true"},
+		{"local t = {} t[1] = 1 t[2] = 2 t[2] = nil t[3] = 3 return #t", "1"},
+		{"local t = {} for i = 1, 100 do t[i] = i end for i = 1, 100 do t[i] = nil end local n = 0 for k in pairs(t) do n = n + 1 end return n, #t", "0 0"},
+		{"local t = {a = 1, b = 2, c = 3} for k in pairs(t) do t[k] = nil end return next(t)", "nil"},
+	} {
+		got, e := runLua(t, test.src)
+		if e != nil {
+			t.Errorf("%s: %v", test.src, e)
+		} else if got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.src, test.want, got)
+		}
+	}
+}
+
+func TestLuaErrors(t *testing.T) {
+	for _, test := range []struct{ src, want string }{
+		{"return 1 +", "test:1: unexpected symbol near '<eof>'"},
+		{"x = = 1", "test:1: unexpected symbol near '='"},
+		{"for i = 1 do end", "test:1: ',' expected near 'do'"},
+		{"local t = {1, 2", "test:1: '}' expected near '<eof>'"},
+		{"while true do end break", "test:1: no loop to break near 'break'"},
+		{"return 'abc", "test:1: unfinished string near '<eof>'"},
+		{"\n\nreturn nil + 1", "test:3: attempt to perform arithmetic on a nil value"},
+		{"local x = {} return x.y.z", "test:1: attempt to index field 'y' (a nil value)"},
+		{"return undefinedfn()", "test:1: attempt to call global 'undefinedfn' (a nil value)"},
+		{"return {} < {}", "test:1: attempt to compare two table values"},
+		{"return 'a' .. {}", "test:1: attempt to concatenate a table value"},
+		{"error('custom')", "test:1: custom"},
+		{"error('nowhere', 0)", "nowhere"},
+		{"local function f() return f() + 1 end return f()", "test:1: stack overflow"},
+		{"return string.rep()", "test:1: bad argument #1 to 'rep' (string expected, got no value)"},
+		{"return ('x'):bad()", "test:1: attempt to call method 'bad' (a nil value)"},
+		{"math.pi = 3", "test:1: Attempt to modify a readonly table"},
+		{"return cjson.encode({[1] = 1, [100] = 2})", "test:1: Cannot serialise table: excessively sparse array"},
+	} {
+		_, e := runLua(t, test.src)
+		if e == nil {
+			t.Errorf("%q: expected an error", test.src)
+		} else if e.Error() != test.want {
+			t.Errorf("%q: expected %q, got %q", test.src, test.want, e.Error())
+		}
+	}
+}
+
+func TestLuaKill(t *testing.T) {
+	proto, e := LuaCompile("test", "local n = 0 while true do n = n + 1 pcall(function() repeat until false end) end")
+	if e != nil {
+		t.Fatal(e)
+	}
+	L := NewLuaState()
+	L.OpenLibs()
+	hooked := 0
+	L.Hook = func(L *LuaState) {
+		if hooked++; hooked == 10 {
+			L.Kill("killed")
+		}
+	}
+	if _, e := L.Run(proto); e == nil || e.Error() != "killed" {
+		t.Fatalf("expected the script to be killed, got %v", e)
+	}
+}
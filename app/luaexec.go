@@ -0,0 +1,1056 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// a lua value is one of nil, bool, float64, string, *LuaTable, *luaClosure
+// or *LuaGoFunction.
+
+// LuaState is everything a running script has: its globals, and how deep
+// it is in calls. Scripts don't share one, each run gets its own.
+type LuaState struct {
+	Globals    *LuaTable
+	stringMeta *LuaTable // the string library, so that ("x"):upper() works
+	strict     bool      // reading a global that doesn't exist is an error, like redis' scripts
+	depth      int
+	line       int   // the line of the call into the current go function, for errors
+	callLines  []int // the lines the lua functions being run were called from
+	proto      *luaProto
+
+	// Hook is called every luaHookSteps loop iterations and calls, so a
+	// script that never finishes can still be stopped, with Kill.
+	Hook   func(L *LuaState)
+	steps  int
+	killed bool
+}
+
+// luaMaxCallDepth is how deep calls can nest before it's a stack overflow.
+const luaMaxCallDepth = 1000
+
+// luaHookSteps is how often the hook is called, it has to be cheap enough
+// not to slow a busy loop down but often enough to stop one promptly.
+const luaHookSteps = 1000
+
+type luaCell struct{ v any }
+
+type luaClosure struct {
+	proto  *luaProto
+	upvals []*luaCell
+}
+
+// LuaGoFunction is a function written in go. It raises errors with
+// LuaState.Errorf, which panics.
+type LuaGoFunction struct {
+	Name string
+	Fn   func(L *LuaState, args []any) []any
+}
+
+// LuaError is an error raised by a script, Value is what error() was called
+// with: usually a string, but it can be anything.
+type LuaError struct {
+	Value any
+}
+
+func (e *LuaError) Error() string {
+	if s, ok := e.Value.(string); ok {
+		return s
+	}
+	if n, ok := e.Value.(float64); ok {
+		return luaNumberString(n)
+	}
+	return fmt.Sprintf("(error object is a %s value)", luaTypeName(e.Value))
+}
+
+func NewLuaState() *LuaState {
+	return &LuaState{Globals: NewLuaTable(0, 32)}
+}
+
+// Errorf raises an error from a go function, at the line it was called from.
+func (L *LuaState) Errorf(format string, args ...any) {
+	panic(&LuaError{L.where(L.line) + fmt.Sprintf(format, args...)})
+}
+
+// where is the position errors raised at line are given, there's none for
+// line 0, which is a call from go.
+func (L *LuaState) where(line int) string {
+	if L.proto == nil || line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d: ", L.proto.chunk, line)
+}
+
+// Kill stops the script with value as its error. Unlike other errors pcall
+// can't catch it, it unwinds all the way out to the go that ran the script.
+func (L *LuaState) Kill(value any) {
+	L.killed = true
+	panic(&LuaError{value})
+}
+
+// step counts a loop iteration or a call, and calls the hook every so often.
+func (L *LuaState) step() {
+	L.steps++
+	if L.Hook != nil && L.steps%luaHookSteps == 0 {
+		L.Hook(L)
+	}
+}
+
+func (L *LuaState) rtError(line int, format string, args ...any) {
+	L.line = line
+	L.Errorf(format, args...)
+}
+
+// Run runs a compiled chunk with args as its ..., an error it raises is
+// returned.
+func (L *LuaState) Run(proto *luaProto, args ...any) ([]any, error) {
+	return L.PCall(&luaClosure{proto: proto}, args...)
+}
+
+// PCall calls fn, errors raised along the way are returned rather than
+// unwinding any further. Once the script's been killed they're only caught
+// by a PCall from go, outside of any lua function.
+func (L *LuaState) PCall(fn any, args ...any) (rets []any, err error) {
+	depth, line, callLines, proto := L.depth, L.line, len(L.callLines), L.proto
+	defer func() {
+		if r := recover(); r != nil {
+			lerr, ok := r.(*LuaError)
+			if !ok || (L.killed && depth > 0) {
+				panic(r)
+			}
+			L.depth, L.line, L.callLines, L.proto = depth, line, L.callLines[:callLines], proto
+			rets, err = nil, lerr
+		}
+	}()
+	return L.Call(fn, args, 0), nil
+}
+
+// Call calls a function value, line is the line it's being called from.
+func (L *LuaState) Call(fn any, args []any, line int) []any {
+	switch f := fn.(type) {
+	case *luaClosure:
+		return L.callClosure(f, args, line)
+	case *LuaGoFunction:
+		L.line = line
+		return f.Fn(L, args)
+	case *LuaTable:
+		if call := f.metaField("__call"); call != nil {
+			return L.Call(call, append([]any{f}, args...), line)
+		}
+	}
+	L.rtError(line, "attempt to call a %s value", luaTypeName(fn))
+	return nil
+}
+
+func (L *LuaState) callClosure(cl *luaClosure, args []any, line int) []any {
+	if L.depth >= luaMaxCallDepth {
+		L.rtError(line, "stack overflow")
+	}
+	L.step()
+	L.depth++
+	L.callLines = append(L.callLines, line)
+	prevProto := L.proto
+	L.proto = cl.proto
+
+	proto := cl.proto
+	fr := &luaFrame{L: L, cl: cl, slots: make([]any, proto.nslots)}
+	for i, param := range proto.params {
+		var v any
+		if i < len(args) {
+			v = args[i]
+		}
+		fr.setLocal(param, v)
+	}
+	if proto.vararg && len(args) > len(proto.params) {
+		fr.varargs = args[len(proto.params):]
+	}
+	var rets []any
+	if luaExecBlock(fr, proto.body) == flowReturn {
+		rets = fr.ret
+	}
+
+	L.proto = prevProto
+	L.callLines = L.callLines[:len(L.callLines)-1]
+	L.depth--
+	return rets
+}
+
+type luaFrame struct {
+	L       *LuaState
+	cl      *luaClosure
+	slots   []any
+	varargs []any
+	ret     []any
+}
+
+func (fr *luaFrame) setLocal(info *luaLocalInfo, v any) {
+	if info.captured {
+		fr.slots[info.slot] = &luaCell{v}
+	} else {
+		fr.slots[info.slot] = v
+	}
+}
+
+type luaFlow int
+
+const (
+	flowNormal luaFlow = iota
+	flowBreak
+	flowReturn
+)
+
+type luaStmt interface {
+	exec(fr *luaFrame) luaFlow
+}
+
+type luaExpr interface {
+	eval(fr *luaFrame) any
+}
+
+// a call or ..., which can have any number of values.
+type luaMultiExpr interface {
+	luaExpr
+	evalMulti(fr *luaFrame) []any
+}
+
+func luaExecBlock(fr *luaFrame, stmts []luaStmt) luaFlow {
+	for _, s := range stmts {
+		if flow := s.exec(fr); flow != flowNormal {
+			return flow
+		}
+	}
+	return flowNormal
+}
+
+// luaEvalList evaluates exprs, the last one giving all of its values.
+func luaEvalList(fr *luaFrame, exprs []luaExpr) []any {
+	if len(exprs) == 0 {
+		return nil
+	}
+	vals := make([]any, 0, len(exprs))
+	for i, e := range exprs {
+		if m, multi := e.(luaMultiExpr); multi && i == len(exprs)-1 {
+			return append(vals, m.evalMulti(fr)...)
+		}
+		vals = append(vals, e.eval(fr))
+	}
+	return vals
+}
+
+// expressions
+
+type luaConst struct{ v any }
+
+func (e *luaConst) eval(fr *luaFrame) any { return e.v }
+
+type luaVarargExpr struct{}
+
+func (e *luaVarargExpr) eval(fr *luaFrame) any {
+	if len(fr.varargs) == 0 {
+		return nil
+	}
+	return fr.varargs[0]
+}
+
+func (e *luaVarargExpr) evalMulti(fr *luaFrame) []any {
+	return append([]any(nil), fr.varargs...)
+}
+
+type luaLocalExpr struct{ info *luaLocalInfo }
+
+func (e *luaLocalExpr) eval(fr *luaFrame) any {
+	if e.info.captured {
+		return fr.slots[e.info.slot].(*luaCell).v
+	}
+	return fr.slots[e.info.slot]
+}
+
+type luaUpvalExpr struct {
+	idx  int
+	name string
+}
+
+func (e *luaUpvalExpr) eval(fr *luaFrame) any {
+	return fr.cl.upvals[e.idx].v
+}
+
+type luaGlobalExpr struct {
+	name string
+	line int
+}
+
+func (e *luaGlobalExpr) eval(fr *luaFrame) any {
+	v := fr.L.Globals.GetString(e.name)
+	if v == nil && fr.L.strict {
+		fr.L.rtError(e.line, "Script attempted to access nonexistent global variable '%s'", e.name)
+	}
+	return v
+}
+
+type luaIndexExpr struct {
+	obj, key luaExpr
+	line     int
+}
+
+func (e *luaIndexExpr) eval(fr *luaFrame) any {
+	obj := e.obj.eval(fr)
+	return fr.L.index(obj, e.key.eval(fr), e.line, e.obj)
+}
+
+type luaCallExpr struct {
+	fn   luaExpr
+	args []luaExpr
+	line int
+}
+
+func (e *luaCallExpr) eval(fr *luaFrame) any {
+	rets := e.evalMulti(fr)
+	if len(rets) == 0 {
+		return nil
+	}
+	return rets[0]
+}
+
+func (e *luaCallExpr) evalMulti(fr *luaFrame) []any {
+	fn := e.fn.eval(fr)
+	args := luaEvalList(fr, e.args)
+	if !luaCallable(fn) {
+		fr.L.rtError(e.line, "attempt to call %s", luaDescribe(e.fn, fn))
+	}
+	return fr.L.Call(fn, args, e.line)
+}
+
+type luaMethodCallExpr struct {
+	obj  luaExpr
+	name string
+	args []luaExpr
+	line int
+}
+
+func (e *luaMethodCallExpr) eval(fr *luaFrame) any {
+	rets := e.evalMulti(fr)
+	if len(rets) == 0 {
+		return nil
+	}
+	return rets[0]
+}
+
+func (e *luaMethodCallExpr) evalMulti(fr *luaFrame) []any {
+	obj := e.obj.eval(fr)
+	fn := fr.L.index(obj, e.name, e.line, e.obj)
+	if !luaCallable(fn) {
+		fr.L.rtError(e.line, "attempt to call method '%s' (a %s value)", e.name, luaTypeName(fn))
+	}
+	args := append([]any{obj}, luaEvalList(fr, e.args)...)
+	return fr.L.Call(fn, args, e.line)
+}
+
+type luaParenExpr struct{ e luaExpr }
+
+func (e *luaParenExpr) eval(fr *luaFrame) any { return e.e.eval(fr) }
+
+type luaFunctionExpr struct{ proto *luaProto }
+
+func (e *luaFunctionExpr) eval(fr *luaFrame) any {
+	cl := &luaClosure{proto: e.proto, upvals: make([]*luaCell, len(e.proto.upvals))}
+	for i, up := range e.proto.upvals {
+		if up.fromLocal {
+			cl.upvals[i] = fr.slots[up.index].(*luaCell)
+		} else {
+			cl.upvals[i] = fr.cl.upvals[up.index]
+		}
+	}
+	return cl
+}
+
+type luaAndExpr struct{ l, r luaExpr }
+
+func (e *luaAndExpr) eval(fr *luaFrame) any {
+	if l := e.l.eval(fr); !luaTruthy(l) {
+		return l
+	}
+	return e.r.eval(fr)
+}
+
+type luaOrExpr struct{ l, r luaExpr }
+
+func (e *luaOrExpr) eval(fr *luaFrame) any {
+	if l := e.l.eval(fr); luaTruthy(l) {
+		return l
+	}
+	return e.r.eval(fr)
+}
+
+type luaUnExpr struct {
+	op   string
+	e    luaExpr
+	line int
+}
+
+func (e *luaUnExpr) eval(fr *luaFrame) any {
+	v := e.e.eval(fr)
+	switch e.op {
+	case "not":
+		return !luaTruthy(v)
+	case "-":
+		n, ok := luaToNumber(v)
+		if !ok {
+			if r, ok := fr.L.metaOp("__unm", v, v, e.line); ok {
+				return r
+			}
+			fr.L.rtError(e.line, "attempt to perform arithmetic on %s", luaDescribe(e.e, v))
+		}
+		return -n
+	default: // #
+		switch t := v.(type) {
+		case string:
+			return float64(len(t))
+		case *LuaTable:
+			return float64(t.Len())
+		}
+		fr.L.rtError(e.line, "attempt to get length of %s", luaDescribe(e.e, v))
+		return nil
+	}
+}
+
+type luaBinExpr struct {
+	op   string
+	l, r luaExpr
+	line int
+}
+
+func (e *luaBinExpr) eval(fr *luaFrame) any {
+	l, r := e.l.eval(fr), e.r.eval(fr)
+	switch e.op {
+	case "==":
+		return fr.L.equal(l, r, e.line)
+	case "~=":
+		return !fr.L.equal(l, r, e.line)
+	case "<":
+		return fr.L.less(l, r, e.line)
+	case "<=":
+		return fr.L.lessEqual(l, r, e.line)
+	case ">":
+		return fr.L.less(r, l, e.line)
+	case ">=":
+		return fr.L.lessEqual(r, l, e.line)
+	case "..":
+		ls, lok := luaConcatString(l)
+		rs, rok := luaConcatString(r)
+		if lok && rok {
+			return ls + rs
+		}
+		if v, ok := fr.L.metaOp("__concat", l, r, e.line); ok {
+			return v
+		}
+		if !lok {
+			fr.L.rtError(e.line, "attempt to concatenate %s", luaDescribe(e.l, l))
+		}
+		fr.L.rtError(e.line, "attempt to concatenate %s", luaDescribe(e.r, r))
+	}
+	a, aok := luaToNumber(l)
+	b, bok := luaToNumber(r)
+	if !aok || !bok {
+		if v, ok := fr.L.metaOp(luaArithEvents[e.op], l, r, e.line); ok {
+			return v
+		}
+	}
+	if !aok {
+		fr.L.rtError(e.line, "attempt to perform arithmetic on %s", luaDescribe(e.l, l))
+	}
+	if !bok {
+		fr.L.rtError(e.line, "attempt to perform arithmetic on %s", luaDescribe(e.r, r))
+	}
+	return luaArith(e.op, a, b)
+}
+
+var luaArithEvents = map[string]string{
+	"+": "__add", "-": "__sub", "*": "__mul", "/": "__div", "%": "__mod", "^": "__pow",
+}
+
+// metaOp calls the metamethod for event, from a's metatable or failing that
+// b's, ok is false when neither has one.
+func (L *LuaState) metaOp(event string, a, b any, line int) (any, bool) {
+	h := luaMetaField(a, event)
+	if h == nil {
+		h = luaMetaField(b, event)
+	}
+	if h == nil {
+		return nil, false
+	}
+	return luaFirst(L.Call(h, []any{a, b}, line)), true
+}
+
+func luaMetaField(v any, event string) any {
+	if t, ok := v.(*LuaTable); ok {
+		return t.metaField(event)
+	}
+	return nil
+}
+
+func luaFirst(rets []any) any {
+	if len(rets) == 0 {
+		return nil
+	}
+	return rets[0]
+}
+
+func luaArith(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return a - math.Floor(a/b)*b
+	default: // ^
+		return math.Pow(a, b)
+	}
+}
+
+type luaTableItem struct {
+	key luaExpr // nil for the next positional item
+	val luaExpr
+}
+
+type luaTableExpr struct{ items []luaTableItem }
+
+func (e *luaTableExpr) eval(fr *luaFrame) any {
+	t := NewLuaTable(len(e.items), 0)
+	n := 0
+	for i, item := range e.items {
+		if item.key != nil {
+			key := item.key.eval(fr)
+			fr.L.rawSet(t, key, item.val.eval(fr), 0)
+			continue
+		}
+		if m, multi := item.val.(luaMultiExpr); multi && i == len(e.items)-1 {
+			for _, v := range m.evalMulti(fr) {
+				n++
+				t.Set(float64(n), v)
+			}
+			continue
+		}
+		n++
+		t.Set(float64(n), item.val.eval(fr))
+	}
+	return t
+}
+
+// statements
+
+type luaLocalStmt struct {
+	vars  []*luaLocalInfo
+	exprs []luaExpr
+}
+
+func (s *luaLocalStmt) exec(fr *luaFrame) luaFlow {
+	if len(s.vars) == 1 && len(s.exprs) == 1 {
+		fr.setLocal(s.vars[0], s.exprs[0].eval(fr))
+		return flowNormal
+	}
+	vals := luaEvalList(fr, s.exprs)
+	for i, v := range s.vars {
+		var val any
+		if i < len(vals) {
+			val = vals[i]
+		}
+		fr.setLocal(v, val)
+	}
+	return flowNormal
+}
+
+type luaLocalFunctionStmt struct {
+	v     *luaLocalInfo
+	proto *luaProto
+}
+
+func (s *luaLocalFunctionStmt) exec(fr *luaFrame) luaFlow {
+	// the local exists before the closure is made, so it can refer to itself.
+	fr.setLocal(s.v, nil)
+	fn := (&luaFunctionExpr{s.proto}).eval(fr)
+	if s.v.captured {
+		fr.slots[s.v.slot].(*luaCell).v = fn
+	} else {
+		fr.slots[s.v.slot] = fn
+	}
+	return flowNormal
+}
+
+type luaAssignStmt struct {
+	targets []luaExpr
+	exprs   []luaExpr
+	line    int
+}
+
+func (s *luaAssignStmt) exec(fr *luaFrame) luaFlow {
+	if len(s.targets) == 1 && len(s.exprs) == 1 {
+		s.assign(fr, s.targets[0], s.exprs[0].eval(fr))
+		return flowNormal
+	}
+	vals := luaEvalList(fr, s.exprs)
+	for i, t := range s.targets {
+		var v any
+		if i < len(vals) {
+			v = vals[i]
+		}
+		s.assign(fr, t, v)
+	}
+	return flowNormal
+}
+
+func (s *luaAssignStmt) assign(fr *luaFrame, target luaExpr, v any) {
+	switch t := target.(type) {
+	case *luaLocalExpr:
+		if t.info.captured {
+			fr.slots[t.info.slot].(*luaCell).v = v
+		} else {
+			fr.slots[t.info.slot] = v
+		}
+	case *luaUpvalExpr:
+		fr.cl.upvals[t.idx].v = v
+	case *luaGlobalExpr:
+		fr.L.setIndex(fr.L.Globals, t.name, v, s.line, nil)
+	case *luaIndexExpr:
+		obj := t.obj.eval(fr)
+		fr.L.setIndex(obj, t.key.eval(fr), v, t.line, t.obj)
+	}
+}
+
+type luaCallStmt struct{ call luaExpr }
+
+func (s *luaCallStmt) exec(fr *luaFrame) luaFlow {
+	s.call.(luaMultiExpr).evalMulti(fr)
+	return flowNormal
+}
+
+type luaDoStmt struct{ body []luaStmt }
+
+func (s *luaDoStmt) exec(fr *luaFrame) luaFlow {
+	return luaExecBlock(fr, s.body)
+}
+
+type luaWhileStmt struct {
+	cond luaExpr
+	body []luaStmt
+}
+
+func (s *luaWhileStmt) exec(fr *luaFrame) luaFlow {
+	for luaTruthy(s.cond.eval(fr)) {
+		fr.L.step()
+		switch luaExecBlock(fr, s.body) {
+		case flowBreak:
+			return flowNormal
+		case flowReturn:
+			return flowReturn
+		}
+	}
+	return flowNormal
+}
+
+type luaRepeatStmt struct {
+	body []luaStmt
+	cond luaExpr
+}
+
+func (s *luaRepeatStmt) exec(fr *luaFrame) luaFlow {
+	for {
+		fr.L.step()
+		switch luaExecBlock(fr, s.body) {
+		case flowBreak:
+			return flowNormal
+		case flowReturn:
+			return flowReturn
+		}
+		if luaTruthy(s.cond.eval(fr)) {
+			return flowNormal
+		}
+	}
+}
+
+type luaIfStmt struct {
+	conds  []luaExpr
+	blocks [][]luaStmt
+	els    []luaStmt
+}
+
+func (s *luaIfStmt) exec(fr *luaFrame) luaFlow {
+	for i, cond := range s.conds {
+		if luaTruthy(cond.eval(fr)) {
+			return luaExecBlock(fr, s.blocks[i])
+		}
+	}
+	return luaExecBlock(fr, s.els)
+}
+
+type luaNumForStmt struct {
+	v                  *luaLocalInfo
+	start, limit, step luaExpr
+	body               []luaStmt
+	line               int
+}
+
+func (s *luaNumForStmt) exec(fr *luaFrame) luaFlow {
+	start, ok := luaToNumber(s.start.eval(fr))
+	if !ok {
+		fr.L.rtError(s.line, "'for' initial value must be a number")
+	}
+	limit, ok := luaToNumber(s.limit.eval(fr))
+	if !ok {
+		fr.L.rtError(s.line, "'for' limit must be a number")
+	}
+	step, ok := luaToNumber(s.step.eval(fr))
+	if !ok {
+		fr.L.rtError(s.line, "'for' step must be a number")
+	}
+	for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+		fr.L.step()
+		fr.setLocal(s.v, i)
+		switch luaExecBlock(fr, s.body) {
+		case flowBreak:
+			return flowNormal
+		case flowReturn:
+			return flowReturn
+		}
+	}
+	return flowNormal
+}
+
+type luaGenForStmt struct {
+	vars  []*luaLocalInfo
+	exprs []luaExpr
+	body  []luaStmt
+	line  int
+}
+
+func (s *luaGenForStmt) exec(fr *luaFrame) luaFlow {
+	init := luaEvalList(fr, s.exprs)
+	for len(init) < 3 {
+		init = append(init, nil)
+	}
+	fn, state, control := init[0], init[1], init[2]
+	if !luaCallable(fn) {
+		fr.L.rtError(s.line, "attempt to call a %s value", luaTypeName(fn))
+	}
+	for {
+		rets := fr.L.Call(fn, []any{state, control}, s.line)
+		if len(rets) == 0 || rets[0] == nil {
+			return flowNormal
+		}
+		fr.L.step()
+		control = rets[0]
+		for i, v := range s.vars {
+			var val any
+			if i < len(rets) {
+				val = rets[i]
+			}
+			fr.setLocal(v, val)
+		}
+		switch luaExecBlock(fr, s.body) {
+		case flowBreak:
+			return flowNormal
+		case flowReturn:
+			return flowReturn
+		}
+	}
+}
+
+type luaReturnStmt struct{ exprs []luaExpr }
+
+func (s *luaReturnStmt) exec(fr *luaFrame) luaFlow {
+	fr.ret = luaEvalList(fr, s.exprs)
+	return flowReturn
+}
+
+type luaBreakStmt struct{}
+
+func (s *luaBreakStmt) exec(fr *luaFrame) luaFlow { return flowBreak }
+
+// indexing
+
+func (t *LuaTable) metaField(name string) any {
+	if t.meta == nil {
+		return nil
+	}
+	return t.meta.GetString(name)
+}
+
+// index is obj[key], following __index. what is the expression obj came
+// from, for the error when it can't be indexed.
+func (L *LuaState) index(obj, key any, line int, what luaExpr) any {
+	for loop := 0; loop < 100; loop++ {
+		switch o := obj.(type) {
+		case *LuaTable:
+			v := o.Get(key)
+			if v != nil {
+				return v
+			}
+			h := o.metaField("__index")
+			if h == nil {
+				return nil
+			}
+			if luaCallable(h) {
+				rets := L.Call(h, []any{o, key}, line)
+				if len(rets) == 0 {
+					return nil
+				}
+				return rets[0]
+			}
+			obj, what = h, nil
+		case string:
+			if L.stringMeta == nil {
+				return nil
+			}
+			return L.stringMeta.Get(key)
+		default:
+			L.rtError(line, "attempt to index %s", luaDescribe(what, obj))
+		}
+	}
+	L.rtError(line, "loop in gettable")
+	return nil
+}
+
+// setIndex is obj[key] = v, following __newindex.
+func (L *LuaState) setIndex(obj, key, v any, line int, what luaExpr) {
+	for loop := 0; loop < 100; loop++ {
+		t, ok := obj.(*LuaTable)
+		if !ok {
+			L.rtError(line, "attempt to index %s", luaDescribe(what, obj))
+		}
+		h := t.metaField("__newindex")
+		if h == nil || t.Get(key) != nil {
+			L.rawSet(t, key, v, line)
+			return
+		}
+		if luaCallable(h) {
+			L.Call(h, []any{t, key, v}, line)
+			return
+		}
+		obj, what = h, nil
+	}
+	L.rtError(line, "loop in settable")
+}
+
+func (L *LuaState) rawSet(t *LuaTable, key, v any, line int) {
+	if t.readonly {
+		L.rtError(line, "Attempt to modify a readonly table")
+	}
+	switch k := key.(type) {
+	case nil:
+		L.rtError(line, "table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			L.rtError(line, "table index is NaN")
+		}
+	}
+	t.Set(key, v)
+}
+
+func (L *LuaState) less(a, b any, line int) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x < y
+		}
+	}
+	if v, ok := L.compareMeta("__lt", a, b, line); ok {
+		return v
+	}
+	L.compareError(a, b, line)
+	return false
+}
+
+func (L *LuaState) lessEqual(a, b any, line int) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x <= y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x <= y
+		}
+	}
+	if v, ok := L.compareMeta("__le", a, b, line); ok {
+		return v
+	}
+	// without __le, a <= b is not (b < a).
+	if v, ok := L.compareMeta("__lt", b, a, line); ok {
+		return !v
+	}
+	L.compareError(a, b, line)
+	return false
+}
+
+// equal is ==, tables that aren't the same table are still equal when
+// they share an __eq that says so.
+func (L *LuaState) equal(a, b any, line int) bool {
+	if luaRawEqual(a, b) {
+		return true
+	}
+	if _, ok := a.(*LuaTable); !ok {
+		return false
+	}
+	v, ok := L.compareMeta("__eq", a, b, line)
+	return ok && v
+}
+
+// compareMeta is a comparison by metamethod, which lua only does between
+// two tables with the same one.
+func (L *LuaState) compareMeta(event string, a, b any, line int) (bool, bool) {
+	ta, aok := a.(*LuaTable)
+	tb, bok := b.(*LuaTable)
+	if !aok || !bok {
+		return false, false
+	}
+	h := ta.metaField(event)
+	if h == nil || !luaRawEqual(h, tb.metaField(event)) {
+		return false, false
+	}
+	return luaTruthy(luaFirst(L.Call(h, []any{a, b}, line))), true
+}
+
+func (L *LuaState) compareError(a, b any, line int) {
+	ta, tb := luaTypeName(a), luaTypeName(b)
+	if ta == tb {
+		L.rtError(line, "attempt to compare two %s values", ta)
+	}
+	L.rtError(line, "attempt to compare %s with %s", ta, tb)
+}
+
+// conversions
+
+func luaTruthy(v any) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	}
+	return true
+}
+
+func luaCallable(v any) bool {
+	switch f := v.(type) {
+	case *luaClosure, *LuaGoFunction:
+		return true
+	case *LuaTable:
+		return f.metaField("__call") != nil
+	}
+	return false
+}
+
+func luaRawEqual(a, b any) bool {
+	return a == b
+}
+
+func luaTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *LuaTable:
+		return "table"
+	case *luaClosure, *LuaGoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+// luaDescribe names a value for an error, the way lua does: "global 'x' (a
+// nil value)", or just "a nil value" when it didn't come from a variable.
+func luaDescribe(e luaExpr, v any) string {
+	kind := ""
+	switch x := e.(type) {
+	case *luaGlobalExpr:
+		kind = "global '" + x.name + "'"
+	case *luaLocalExpr:
+		kind = "local '" + x.info.name + "'"
+	case *luaUpvalExpr:
+		kind = "upvalue '" + x.name + "'"
+	case *luaIndexExpr:
+		if c, ok := x.key.(*luaConst); ok {
+			if s, ok := c.v.(string); ok {
+				kind = "field '" + s + "'"
+			}
+		}
+	}
+	if kind == "" {
+		return "a " + luaTypeName(v) + " value"
+	}
+	return kind + " (a " + luaTypeName(v) + " value)"
+}
+
+// luaToNumber converts the way arithmetic does, strings that look like
+// numbers count.
+func luaToNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		return luaParseNumber(n)
+	}
+	return 0, false
+}
+
+func luaConcatString(v any) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case float64:
+		return luaNumberString(s), true
+	}
+	return "", false
+}
+
+// luaNumberString formats a number like lua's %.14g.
+func luaNumberString(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	case n == math.Trunc(n) && math.Abs(n) < 1e14:
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+// luaToString is tostring() without __tostring.
+func luaToString(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return luaNumberString(x)
+	case string:
+		return x
+	case *LuaTable:
+		return fmt.Sprintf("table: %p", x)
+	case *luaClosure:
+		return fmt.Sprintf("function: %p", x)
+	case *LuaGoFunction:
+		return fmt.Sprintf("function: builtin: %p", x)
+	case *luaUserdata:
+		return fmt.Sprintf("userdata: %p", x)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// cjson, the json library redis gives scripts.
+
+// luaUserdata is an opaque value, the only one is cjson.null.
+type luaUserdata struct{ name string }
+
+// luaJSONNull is what json's null decodes to, nil can't be stored in a table.
+var luaJSONNull = &luaUserdata{"null"}
+
+// luaJSONMaxDepth is how deeply nested a table can be before encoding it
+// gives up, it's most likely a table that contains itself.
+const luaJSONMaxDepth = 1000
+
+func luaJSONEncode(L *LuaState, args []any) []any {
+	var sb strings.Builder
+	luaJSONEncodeValue(L, &sb, L.checkAny(args, 0, "encode"), 0)
+	return []any{sb.String()}
+}
+
+func luaJSONEncodeValue(L *LuaState, sb *strings.Builder, v any, depth int) {
+	switch x := v.(type) {
+	case nil:
+		sb.WriteString("null")
+	case *luaUserdata:
+		if x != luaJSONNull {
+			L.Errorf("Cannot serialise userdata: type not supported")
+		}
+		sb.WriteString("null")
+	case bool:
+		sb.WriteString(strconv.FormatBool(x))
+	case float64:
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			L.Errorf("Cannot serialise number: must not be NaN or Inf")
+		}
+		sb.WriteString(luaNumberString(x))
+	case string:
+		luaJSONQuote(sb, x)
+	case *LuaTable:
+		if depth >= luaJSONMaxDepth {
+			L.Errorf("Cannot serialise, excessive nesting (%d)", depth+1)
+		}
+		if n, isArray := luaJSONArrayLen(L, x); isArray {
+			sb.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					sb.WriteByte(',')
+				}
+				luaJSONEncodeValue(L, sb, x.Get(float64(i)), depth+1)
+			}
+			sb.WriteByte(']')
+			return
+		}
+		sb.WriteByte('{')
+		first := true
+		for k, val, _ := x.Next(nil); k != nil; k, val, _ = x.Next(k) {
+			var key string
+			switch kk := k.(type) {
+			case string:
+				key = kk
+			case float64:
+				key = luaNumberString(kk)
+			default:
+				L.Errorf("Cannot serialise table: table key must be a number or string")
+			}
+			if !first {
+				sb.WriteByte(',')
+			}
+			first = false
+			luaJSONQuote(sb, key)
+			sb.WriteByte(':')
+			luaJSONEncodeValue(L, sb, val, depth+1)
+		}
+		sb.WriteByte('}')
+	default:
+		L.Errorf("Cannot serialise %s: type not supported", luaTypeName(v))
+	}
+}
+
+// luaJSONArrayLen is whether a table is encoded as an array, and how long
+// it is: it has to have only positive whole number keys, and not be too
+// sparse. The empty table is an object, like cjson has it.
+func luaJSONArrayLen(L *LuaState, t *LuaTable) (int, bool) {
+	n, items := 0, 0
+	for k, _, _ := t.Next(nil); k != nil; k, _, _ = t.Next(k) {
+		i, ok := luaArrayIndex(k)
+		if !ok {
+			return 0, false
+		}
+		n = max(n, i)
+		items++
+	}
+	if items == 0 {
+		return 0, false
+	}
+	if n > 10 && n > items*2 {
+		L.Errorf("Cannot serialise table: excessively sparse array")
+	}
+	return n, true
+}
+
+func luaJSONQuote(sb *strings.Builder, s string) {
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '/':
+			sb.WriteString(`\/`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(sb, `\u%04x`, c)
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+}
+
+func luaJSONDecode(L *LuaState, args []any) []any {
+	s := L.checkString(args, 0, "decode")
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	v := luaJSONDecodeValue(L, d, 0)
+	if _, e := d.Token(); e != io.EOF {
+		L.Errorf("Expected the end but found invalid token at character %d", d.InputOffset()+1)
+	}
+	return []any{v}
+}
+
+func luaJSONDecodeValue(L *LuaState, d *json.Decoder, depth int) any {
+	tok, e := d.Token()
+	if e != nil {
+		L.Errorf("Expected value but found invalid token at character %d", d.InputOffset()+1)
+	}
+	if depth >= luaJSONMaxDepth {
+		L.Errorf("Found too many nested data structures (%d) at character %d", depth+1, d.InputOffset())
+	}
+	switch t := tok.(type) {
+	case nil:
+		return luaJSONNull
+	case bool, string:
+		return t
+	case json.Number:
+		n, e := strconv.ParseFloat(string(t), 64)
+		if e != nil {
+			L.Errorf("Expected value but found invalid number at character %d", d.InputOffset())
+		}
+		return n
+	case json.Delim:
+		table := NewLuaTable(0, 0)
+		if t == '[' {
+			for d.More() {
+				table.Append(luaJSONDecodeValue(L, d, depth+1))
+			}
+		} else if t == '{' {
+			for d.More() {
+				key, e := d.Token()
+				if e != nil {
+					L.Errorf("Expected object key string but found invalid token at character %d", d.InputOffset()+1)
+				}
+				table.Set(key.(string), luaJSONDecodeValue(L, d, depth+1))
+			}
+		}
+		if _, e := d.Token(); e != nil {
+			L.Errorf("Expected comma or end but found invalid token at character %d", d.InputOffset()+1)
+		}
+		return table
+	}
+	return nil
+}
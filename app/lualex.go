@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the lua in here is lua 5.1, the version redis embeds, so scripts written
+// for redis run unchanged.
+
+type luaToken int
+
+const (
+	tokEOF luaToken = iota
+	tokName
+	tokNumber
+	tokString
+	// keywords
+	tokAnd
+	tokBreak
+	tokDo
+	tokElse
+	tokElseif
+	tokEnd
+	tokFalse
+	tokFor
+	tokFunction
+	tokIf
+	tokIn
+	tokLocal
+	tokNil
+	tokNot
+	tokOr
+	tokRepeat
+	tokReturn
+	tokThen
+	tokTrue
+	tokUntil
+	tokWhile
+	// everything else, spelled out in luaSymbols
+	tokSymbol
+)
+
+var luaKeywords = map[string]luaToken{
+	"and": tokAnd, "break": tokBreak, "do": tokDo, "else": tokElse, "elseif": tokElseif,
+	"end": tokEnd, "false": tokFalse, "for": tokFor, "function": tokFunction, "if": tokIf,
+	"in": tokIn, "local": tokLocal, "nil": tokNil, "not": tokNot, "or": tokOr,
+	"repeat": tokRepeat, "return": tokReturn, "then": tokThen, "true": tokTrue,
+	"until": tokUntil, "while": tokWhile,
+}
+
+// the symbols, longest first so that the lexer is greedy.
+var luaSymbols = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+type luaLexeme struct {
+	tok  luaToken
+	text string  // the name, the symbol, or the string's contents
+	num  float64 // for tokNumber
+	line int
+}
+
+// LuaSyntaxError is a script that doesn't compile.
+type LuaSyntaxError struct {
+	Chunk string
+	Line  int
+	Msg   string
+}
+
+func (e LuaSyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Chunk, e.Line, e.Msg)
+}
+
+type luaLexer struct {
+	src   string
+	pos   int
+	line  int
+	chunk string
+}
+
+// luaLex splits src into tokens up front, scripts are small.
+func luaLex(chunk, src string) ([]luaLexeme, error) {
+	lx := &luaLexer{src: src, line: 1, chunk: chunk}
+	// a leading #! line is skipped, like lua does.
+	if strings.HasPrefix(src, "#") {
+		for lx.pos < len(src) && src[lx.pos] != '\n' {
+			lx.pos++
+		}
+	}
+	var out []luaLexeme
+	for {
+		lexeme, e := lx.next()
+		if e != nil {
+			return nil, e
+		}
+		out = append(out, lexeme)
+		if lexeme.tok == tokEOF {
+			return out, nil
+		}
+	}
+}
+
+func (lx *luaLexer) errorf(format string, args ...any) error {
+	return LuaSyntaxError{lx.chunk, lx.line, fmt.Sprintf(format, args...)}
+}
+
+func (lx *luaLexer) next() (luaLexeme, error) {
+	if e := lx.skipSpace(); e != nil {
+		return luaLexeme{}, e
+	}
+	if lx.pos >= len(lx.src) {
+		return luaLexeme{tok: tokEOF, text: "<eof>", line: lx.line}, nil
+	}
+	line := lx.line
+	c := lx.src[lx.pos]
+	switch {
+	case isLuaNameStart(c):
+		start := lx.pos
+		for lx.pos < len(lx.src) && isLuaNameChar(lx.src[lx.pos]) {
+			lx.pos++
+		}
+		word := lx.src[start:lx.pos]
+		if tok, keyword := luaKeywords[word]; keyword {
+			return luaLexeme{tok: tok, text: word, line: line}, nil
+		}
+		return luaLexeme{tok: tokName, text: word, line: line}, nil
+	case isDigit(c) || (c == '.' && lx.pos+1 < len(lx.src) && isDigit(lx.src[lx.pos+1])):
+		return lx.number()
+	case c == '"' || c == '\'':
+		s, e := lx.quoted(c)
+		return luaLexeme{tok: tokString, text: s, line: line}, e
+	case c == '[' && lx.longBracketLevel() >= 0:
+		s, e := lx.longString()
+		return luaLexeme{tok: tokString, text: s, line: line}, e
+	}
+	for _, sym := range luaSymbols {
+		if strings.HasPrefix(lx.src[lx.pos:], sym) {
+			lx.pos += len(sym)
+			return luaLexeme{tok: tokSymbol, text: sym, line: line}, nil
+		}
+	}
+	return luaLexeme{}, lx.errorf("unexpected symbol near '%c'", c)
+}
+
+func (lx *luaLexer) skipSpace() error {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			lx.pos++
+		case strings.HasPrefix(lx.src[lx.pos:], "--"):
+			lx.pos += 2
+			if lx.pos < len(lx.src) && lx.src[lx.pos] == '[' && lx.longBracketLevel() >= 0 {
+				if _, e := lx.longString(); e != nil {
+					return e
+				}
+				continue
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (lx *luaLexer) number() (luaLexeme, error) {
+	start := lx.pos
+	if strings.HasPrefix(lx.src[lx.pos:], "0x") || strings.HasPrefix(lx.src[lx.pos:], "0X") {
+		lx.pos += 2
+		for lx.pos < len(lx.src) && isHexDigit(lx.src[lx.pos]) {
+			lx.pos++
+		}
+	} else {
+		for lx.pos < len(lx.src) && (isDigit(lx.src[lx.pos]) || lx.src[lx.pos] == '.') {
+			lx.pos++
+		}
+		if lx.pos < len(lx.src) && (lx.src[lx.pos] == 'e' || lx.src[lx.pos] == 'E') {
+			lx.pos++
+			if lx.pos < len(lx.src) && (lx.src[lx.pos] == '+' || lx.src[lx.pos] == '-') {
+				lx.pos++
+			}
+			for lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]) {
+				lx.pos++
+			}
+		}
+	}
+	// like lua, 3x is a malformed number rather than 3 followed by x.
+	for lx.pos < len(lx.src) && isLuaNameChar(lx.src[lx.pos]) {
+		lx.pos++
+	}
+	text := lx.src[start:lx.pos]
+	n, ok := luaParseNumber(text)
+	if !ok {
+		return luaLexeme{}, lx.errorf("malformed number near '%s'", text)
+	}
+	return luaLexeme{tok: tokNumber, text: text, num: n, line: lx.line}, nil
+}
+
+func (lx *luaLexer) quoted(quote byte) (string, error) {
+	lx.pos++
+	var sb strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			return "", lx.errorf("unfinished string near '<eof>'")
+		}
+		c := lx.src[lx.pos]
+		switch c {
+		case quote:
+			lx.pos++
+			return sb.String(), nil
+		case '\n':
+			return "", lx.errorf("unfinished string")
+		case '\\':
+			lx.pos++
+			if lx.pos >= len(lx.src) {
+				return "", lx.errorf("unfinished string near '<eof>'")
+			}
+			esc := lx.src[lx.pos]
+			lx.pos++
+			switch esc {
+			case 'a':
+				sb.WriteByte('\a')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'v':
+				sb.WriteByte('\v')
+			case '\n':
+				lx.line++
+				sb.WriteByte('\n')
+			default:
+				if !isDigit(esc) {
+					// \\, \", \' and anything else stand for themselves.
+					sb.WriteByte(esc)
+					continue
+				}
+				n := int(esc - '0')
+				for i := 0; i < 2 && lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]); i++ {
+					n = n*10 + int(lx.src[lx.pos]-'0')
+					lx.pos++
+				}
+				if n > 255 {
+					return "", lx.errorf("escape sequence too large")
+				}
+				sb.WriteByte(byte(n))
+			}
+		default:
+			sb.WriteByte(c)
+			lx.pos++
+		}
+	}
+}
+
+// longBracketLevel is the number of ='s in a [==[ starting at pos, or -1
+// when it isn't one.
+func (lx *luaLexer) longBracketLevel() int {
+	i := lx.pos + 1
+	for i < len(lx.src) && lx.src[i] == '=' {
+		i++
+	}
+	if i < len(lx.src) && lx.src[i] == '[' {
+		return i - lx.pos - 1
+	}
+	return -1
+}
+
+func (lx *luaLexer) longString() (string, error) {
+	level := lx.longBracketLevel()
+	lx.pos += level + 2
+	// a newline straight after the opening bracket isn't part of the string.
+	if strings.HasPrefix(lx.src[lx.pos:], "\r\n") {
+		lx.pos += 2
+		lx.line++
+	} else if lx.pos < len(lx.src) && lx.src[lx.pos] == '\n' {
+		lx.pos++
+		lx.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		return "", lx.errorf("unfinished long string near '<eof>'")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s, nil
+}
+
+// luaParseNumber converts the way tonumber does: decimal, with an optional
+// exponent, or hex, surrounded by any amount of space.
+func luaParseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	neg := false
+	body := s
+	if strings.HasPrefix(body, "-") {
+		neg, body = true, body[1:]
+	} else if strings.HasPrefix(body, "+") {
+		body = body[1:]
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		n, e := strconv.ParseUint(body[2:], 16, 64)
+		if e != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	if body == "" || !(isDigit(body[0]) || body[0] == '.') {
+		// strconv also takes inf, nan and friends, lua doesn't.
+		return 0, false
+	}
+	for i := 0; i < len(body); i++ {
+		if c := body[i]; !isDigit(c) && c != '.' && c != 'e' && c != 'E' && c != '+' && c != '-' {
+			return 0, false
+		}
+	}
+	n, e := strconv.ParseFloat(s, 64)
+	if e != nil {
+		if ne, ok := e.(*strconv.NumError); !ok || ne.Err != strconv.ErrRange {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+func isLuaNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isLuaNameChar(c byte) bool {
+	return isLuaNameStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OpenLibs loads the parts of lua's standard library that redis gives
+// scripts: the base functions, string, table and math, plus the bit and
+// cjson libraries redis bundles. Nothing that touches files, the os or
+// loads code is there.
+func (L *LuaState) OpenLibs() {
+	g := L.Globals
+	luaRegister(g, map[string]func(*LuaState, []any) []any{
+		"assert":       luaAssert,
+		"error":        luaErrorFn,
+		"getmetatable": luaGetmetatable,
+		"ipairs":       luaIpairs,
+		"next":         luaNext,
+		"pairs":        luaPairs,
+		"pcall":        luaPcall,
+		"rawequal":     luaRawequal,
+		"rawget":       luaRawget,
+		"rawset":       luaRawset,
+		"select":       luaSelect,
+		"setmetatable": luaSetmetatable,
+		"tonumber":     luaTonumber,
+		"tostring":     luaTostring,
+		"type":         luaType,
+		"unpack":       luaUnpack,
+		"xpcall":       luaXpcall,
+	})
+	g.Set("_G", g)
+	g.Set("_VERSION", "Lua 5.1")
+
+	tbl := NewLuaTable(0, 8)
+	luaRegister(tbl, map[string]func(*LuaState, []any) []any{
+		"concat": luaTableConcat,
+		"getn":   luaTableGetn,
+		"insert": luaTableInsert,
+		"maxn":   luaTableMaxn,
+		"remove": luaTableRemove,
+		"sort":   luaTableSort,
+	})
+	g.Set("table", tbl)
+
+	m := NewLuaTable(0, 32)
+	luaRegister(m, luaMathFuncs())
+	m.Set("pi", math.Pi)
+	m.Set("huge", math.Inf(1))
+	g.Set("math", m)
+
+	str := NewLuaTable(0, 16)
+	luaRegister(str, luaStringFuncs())
+	g.Set("string", str)
+	L.stringMeta = str
+
+	bit := NewLuaTable(0, 12)
+	luaRegister(bit, luaBitFuncs())
+	g.Set("bit", bit)
+
+	cjson := NewLuaTable(0, 4)
+	luaRegister(cjson, map[string]func(*LuaState, []any) []any{
+		"encode": luaJSONEncode,
+		"decode": luaJSONDecode,
+	})
+	cjson.Set("null", luaJSONNull)
+	g.Set("cjson", cjson)
+
+	for _, lib := range []*LuaTable{tbl, m, str, bit, cjson} {
+		lib.readonly = true
+	}
+}
+
+func luaRegister(t *LuaTable, funcs map[string]func(*LuaState, []any) []any) {
+	for name, fn := range funcs {
+		t.Set(name, &LuaGoFunction{name, fn})
+	}
+}
+
+// argument checks, with lua's messages.
+
+func luaArg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func (L *LuaState) argError(i int, fname, msg string) {
+	L.Errorf("bad argument #%d to '%s' (%s)", i+1, fname, msg)
+}
+
+func (L *LuaState) typeError(args []any, i int, fname, want string) {
+	got := "no value"
+	if i < len(args) {
+		got = luaTypeName(args[i])
+	}
+	L.argError(i, fname, want+" expected, got "+got)
+}
+
+func (L *LuaState) checkAny(args []any, i int, fname string) any {
+	if i >= len(args) {
+		L.argError(i, fname, "value expected")
+	}
+	return args[i]
+}
+
+func (L *LuaState) checkNumber(args []any, i int, fname string) float64 {
+	n, ok := luaToNumber(luaArg(args, i))
+	if !ok {
+		L.typeError(args, i, fname, "number")
+	}
+	return n
+}
+
+func (L *LuaState) optNumber(args []any, i int, fname string, def float64) float64 {
+	if luaArg(args, i) == nil {
+		return def
+	}
+	return L.checkNumber(args, i, fname)
+}
+
+func (L *LuaState) checkInt(args []any, i int, fname string) int {
+	n := L.checkNumber(args, i, fname)
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	return int(n)
+}
+
+func (L *LuaState) optInt(args []any, i int, fname string, def int) int {
+	if luaArg(args, i) == nil {
+		return def
+	}
+	return L.checkInt(args, i, fname)
+}
+
+func (L *LuaState) checkString(args []any, i int, fname string) string {
+	s, ok := luaConcatString(luaArg(args, i))
+	if !ok {
+		L.typeError(args, i, fname, "string")
+	}
+	return s
+}
+
+func (L *LuaState) optString(args []any, i int, fname string, def string) string {
+	if luaArg(args, i) == nil {
+		return def
+	}
+	return L.checkString(args, i, fname)
+}
+
+func (L *LuaState) checkTable(args []any, i int, fname string) *LuaTable {
+	t, ok := luaArg(args, i).(*LuaTable)
+	if !ok {
+		L.typeError(args, i, fname, "table")
+	}
+	return t
+}
+
+// base
+
+func luaAssert(L *LuaState, args []any) []any {
+	if !luaTruthy(luaArg(args, 0)) {
+		if len(args) > 1 {
+			panic(&LuaError{args[1]})
+		}
+		panic(&LuaError{"assertion failed!"})
+	}
+	return args
+}
+
+func luaErrorFn(L *LuaState, args []any) []any {
+	v := luaArg(args, 0)
+	level := L.optInt(args, 1, "error", 1)
+	if s, ok := v.(string); ok && level > 0 {
+		// level 1 is where error was called, 2 where that function was called.
+		line := L.line
+		if level > 1 && len(L.callLines) > 0 {
+			line = L.callLines[len(L.callLines)-1]
+		}
+		v = L.where(line) + s
+	}
+	panic(&LuaError{v})
+}
+
+func luaGetmetatable(L *LuaState, args []any) []any {
+	t, ok := luaArg(args, 0).(*LuaTable)
+	if !ok || t.meta == nil {
+		return []any{nil}
+	}
+	if protected := t.meta.GetString("__metatable"); protected != nil {
+		return []any{protected}
+	}
+	return []any{t.meta}
+}
+
+func luaSetmetatable(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "setmetatable")
+	mt, ok := luaArg(args, 1).(*LuaTable)
+	if !ok && luaArg(args, 1) != nil {
+		L.typeError(args, 1, "setmetatable", "nil or table")
+	}
+	if t.meta != nil && t.meta.GetString("__metatable") != nil {
+		L.Errorf("cannot change a protected metatable")
+	}
+	if t.readonly {
+		L.Errorf("Attempt to modify a readonly table")
+	}
+	t.meta = mt
+	return []any{t}
+}
+
+var luaIpairsIter = &LuaGoFunction{"ipairs_iter", func(L *LuaState, args []any) []any {
+	i := L.checkInt(args, 1, "ipairs") + 1
+	v := L.checkTable(args, 0, "ipairs").Get(float64(i))
+	if v == nil {
+		return []any{nil}
+	}
+	return []any{float64(i), v}
+}}
+
+func luaIpairs(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "ipairs")
+	return []any{luaIpairsIter, t, float64(0)}
+}
+
+var luaNextFn = &LuaGoFunction{"next", luaNext}
+
+func luaNext(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "next")
+	k, v, ok := t.Next(luaArg(args, 1))
+	if !ok {
+		L.Errorf("invalid key to 'next'")
+	}
+	if k == nil {
+		return []any{nil}
+	}
+	return []any{k, v}
+}
+
+func luaPairs(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "pairs")
+	return []any{luaNextFn, t, nil}
+}
+
+func luaPcall(L *LuaState, args []any) []any {
+	fn := L.checkAny(args, 0, "pcall")
+	rets, e := L.PCall(fn, args[1:]...)
+	if e != nil {
+		return []any{false, e.(*LuaError).Value}
+	}
+	return append([]any{true}, rets...)
+}
+
+func luaXpcall(L *LuaState, args []any) []any {
+	fn := L.checkAny(args, 0, "xpcall")
+	handler := luaArg(args, 1)
+	rets, e := L.PCall(fn)
+	if e != nil {
+		return append([]any{false}, L.Call(handler, []any{e.(*LuaError).Value}, L.line)...)
+	}
+	return append([]any{true}, rets...)
+}
+
+func luaRawequal(L *LuaState, args []any) []any {
+	return []any{luaRawEqual(L.checkAny(args, 0, "rawequal"), L.checkAny(args, 1, "rawequal"))}
+}
+
+func luaRawget(L *LuaState, args []any) []any {
+	return []any{L.checkTable(args, 0, "rawget").Get(luaArg(args, 1))}
+}
+
+func luaRawset(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "rawset")
+	L.rawSet(t, luaArg(args, 1), luaArg(args, 2), L.line)
+	return []any{t}
+}
+
+func luaSelect(L *LuaState, args []any) []any {
+	if s, ok := luaArg(args, 0).(string); ok && s == "#" {
+		return []any{float64(len(args) - 1)}
+	}
+	n := L.checkInt(args, 0, "select")
+	if n < 0 {
+		n = len(args) + n
+	}
+	if n < 1 {
+		L.argError(0, "select", "index out of range")
+	}
+	if n >= len(args) {
+		return nil
+	}
+	return args[n:]
+}
+
+func luaTonumber(L *LuaState, args []any) []any {
+	v := L.checkAny(args, 0, "tonumber")
+	base := L.optInt(args, 1, "tonumber", 10)
+	if base == 10 {
+		n, ok := luaToNumber(v)
+		if !ok {
+			return []any{nil}
+		}
+		return []any{n}
+	}
+	if base < 2 || base > 36 {
+		L.argError(1, "tonumber", "base out of range")
+	}
+	s, _ := luaConcatString(v)
+	n, e := strconv.ParseInt(strings.ToLower(strings.TrimSpace(s)), base, 64)
+	if e != nil {
+		return []any{nil}
+	}
+	return []any{float64(n)}
+}
+
+func luaTostring(L *LuaState, args []any) []any {
+	return []any{L.tostring(L.checkAny(args, 0, "tostring"))}
+}
+
+// tostring is tostring(), which uses __tostring when there is one.
+func (L *LuaState) tostring(v any) string {
+	if t, ok := v.(*LuaTable); ok {
+		if h := t.metaField("__tostring"); h != nil {
+			rets := L.Call(h, []any{t}, L.line)
+			if s, ok := luaArg(rets, 0).(string); ok {
+				return s
+			}
+			L.Errorf("'__tostring' must return a string")
+		}
+	}
+	return luaToString(v)
+}
+
+func luaType(L *LuaState, args []any) []any {
+	return []any{luaTypeName(L.checkAny(args, 0, "type"))}
+}
+
+func luaUnpack(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "unpack")
+	i := L.optInt(args, 1, "unpack", 1)
+	j := L.optInt(args, 2, "unpack", t.Len())
+	if i > j {
+		return nil
+	}
+	if j-i >= 8000 {
+		L.Errorf("too many results to unpack")
+	}
+	rets := make([]any, 0, j-i+1)
+	for k := i; k <= j; k++ {
+		rets = append(rets, t.Get(float64(k)))
+	}
+	return rets
+}
+
+// table
+
+func luaTableConcat(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "concat")
+	sep := L.optString(args, 1, "concat", "")
+	i := L.optInt(args, 2, "concat", 1)
+	j := L.optInt(args, 3, "concat", t.Len())
+	var sb strings.Builder
+	for k := i; k <= j; k++ {
+		s, ok := luaConcatString(t.Get(float64(k)))
+		if !ok {
+			L.Errorf("invalid value (at index %d) in table for 'concat'", k)
+		}
+		sb.WriteString(s)
+		if k < j {
+			sb.WriteString(sep)
+		}
+	}
+	return []any{sb.String()}
+}
+
+func luaTableGetn(L *LuaState, args []any) []any {
+	return []any{float64(L.checkTable(args, 0, "getn").Len())}
+}
+
+func luaTableMaxn(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "maxn")
+	max := 0.0
+	for k, _, _ := t.Next(nil); k != nil; k, _, _ = t.Next(k) {
+		if n, ok := k.(float64); ok && n > max {
+			max = n
+		}
+	}
+	return []any{max}
+}
+
+func luaTableInsert(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "insert")
+	if t.readonly {
+		L.Errorf("Attempt to modify a readonly table")
+	}
+	n := t.Len()
+	switch len(args) {
+	case 2:
+		t.Set(float64(n+1), args[1])
+	case 3:
+		pos := L.checkInt(args, 1, "insert")
+		for k := n; k >= pos; k-- {
+			t.Set(float64(k+1), t.Get(float64(k)))
+		}
+		L.rawSet(t, float64(pos), args[2], L.line)
+	default:
+		L.Errorf("wrong number of arguments to 'insert'")
+	}
+	return nil
+}
+
+func luaTableRemove(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "remove")
+	if t.readonly {
+		L.Errorf("Attempt to modify a readonly table")
+	}
+	n := t.Len()
+	pos := L.optInt(args, 1, "remove", n)
+	if n == 0 {
+		return []any{nil}
+	}
+	v := t.Get(float64(pos))
+	for k := pos; k < n; k++ {
+		t.Set(float64(k), t.Get(float64(k+1)))
+	}
+	t.Set(float64(n), nil)
+	return []any{v}
+}
+
+func luaTableSort(L *LuaState, args []any) []any {
+	t := L.checkTable(args, 0, "sort")
+	if t.readonly {
+		L.Errorf("Attempt to modify a readonly table")
+	}
+	comp := luaArg(args, 1)
+	if comp != nil && !luaCallable(comp) {
+		L.typeError(args, 1, "sort", "function")
+	}
+	n := t.Len()
+	vals := make([]any, n)
+	for i := range vals {
+		vals[i] = t.Get(float64(i + 1))
+	}
+	line := L.line
+	sort.SliceStable(vals, func(i, j int) bool {
+		if comp != nil {
+			return luaTruthy(luaArg(L.Call(comp, []any{vals[i], vals[j]}, line), 0))
+		}
+		return L.less(vals[i], vals[j], line)
+	})
+	for i, v := range vals {
+		t.Set(float64(i+1), v)
+	}
+	return nil
+}
+
+// math
+
+func luaMathFuncs() map[string]func(*LuaState, []any) []any {
+	unary := func(name string, f func(float64) float64) func(*LuaState, []any) []any {
+		return func(L *LuaState, args []any) []any {
+			return []any{f(L.checkNumber(args, 0, name))}
+		}
+	}
+	// scripts have to be deterministic, so every one starts from the same seed.
+	var seed uint64 = 0x2545f4914f6cdd1d
+	random := func() float64 {
+		seed ^= seed << 13
+		seed ^= seed >> 7
+		seed ^= seed << 17
+		return float64(seed>>11) / (1 << 53)
+	}
+	return map[string]func(*LuaState, []any) []any{
+		"abs":   unary("abs", math.Abs),
+		"acos":  unary("acos", math.Acos),
+		"asin":  unary("asin", math.Asin),
+		"atan":  unary("atan", math.Atan),
+		"ceil":  unary("ceil", math.Ceil),
+		"cos":   unary("cos", math.Cos),
+		"cosh":  unary("cosh", math.Cosh),
+		"deg":   unary("deg", func(x float64) float64 { return x * 180 / math.Pi }),
+		"exp":   unary("exp", math.Exp),
+		"floor": unary("floor", math.Floor),
+		"log":   unary("log", math.Log),
+		"log10": unary("log10", math.Log10),
+		"rad":   unary("rad", func(x float64) float64 { return x * math.Pi / 180 }),
+		"sin":   unary("sin", math.Sin),
+		"sinh":  unary("sinh", math.Sinh),
+		"sqrt":  unary("sqrt", math.Sqrt),
+		"tan":   unary("tan", math.Tan),
+		"tanh":  unary("tanh", math.Tanh),
+		"atan2": func(L *LuaState, args []any) []any {
+			return []any{math.Atan2(L.checkNumber(args, 0, "atan2"), L.checkNumber(args, 1, "atan2"))}
+		},
+		"fmod": func(L *LuaState, args []any) []any {
+			return []any{math.Mod(L.checkNumber(args, 0, "fmod"), L.checkNumber(args, 1, "fmod"))}
+		},
+		"pow": func(L *LuaState, args []any) []any {
+			return []any{math.Pow(L.checkNumber(args, 0, "pow"), L.checkNumber(args, 1, "pow"))}
+		},
+		"ldexp": func(L *LuaState, args []any) []any {
+			return []any{math.Ldexp(L.checkNumber(args, 0, "ldexp"), L.checkInt(args, 1, "ldexp"))}
+		},
+		"frexp": func(L *LuaState, args []any) []any {
+			frac, exp := math.Frexp(L.checkNumber(args, 0, "frexp"))
+			return []any{frac, float64(exp)}
+		},
+		"modf": func(L *LuaState, args []any) []any {
+			i, frac := math.Modf(L.checkNumber(args, 0, "modf"))
+			return []any{i, frac}
+		},
+		"max": func(L *LuaState, args []any) []any {
+			m := L.checkNumber(args, 0, "max")
+			for i := 1; i < len(args); i++ {
+				m = math.Max(m, L.checkNumber(args, i, "max"))
+			}
+			return []any{m}
+		},
+		"min": func(L *LuaState, args []any) []any {
+			m := L.checkNumber(args, 0, "min")
+			for i := 1; i < len(args); i++ {
+				m = math.Min(m, L.checkNumber(args, i, "min"))
+			}
+			return []any{m}
+		},
+		"random": func(L *LuaState, args []any) []any {
+			r := random()
+			switch len(args) {
+			case 0:
+				return []any{r}
+			case 1:
+				u := L.checkInt(args, 0, "random")
+				if u < 1 {
+					L.argError(0, "random", "interval is empty")
+				}
+				return []any{math.Floor(r*float64(u)) + 1}
+			default:
+				l, u := L.checkInt(args, 0, "random"), L.checkInt(args, 1, "random")
+				if l > u {
+					L.argError(1, "random", "interval is empty")
+				}
+				return []any{math.Floor(r*float64(u-l+1)) + float64(l)}
+			}
+		},
+		"randomseed": func(L *LuaState, args []any) []any {
+			seed = uint64(L.checkInt(args, 0, "randomseed")) | 1
+			return nil
+		},
+	}
+}
+
+// bit, the bitop library: operations on numbers as 32 bit integers.
+
+func luaBitFuncs() map[string]func(*LuaState, []any) []any {
+	tobit := func(L *LuaState, args []any, i int, name string) int32 {
+		n := L.checkNumber(args, i, name)
+		return int32(uint32(int64(math.Mod(n, 1<<32))))
+	}
+	fold := func(name string, op func(a, b int32) int32) func(*LuaState, []any) []any {
+		return func(L *LuaState, args []any) []any {
+			r := tobit(L, args, 0, name)
+			for i := 1; i < len(args); i++ {
+				r = op(r, tobit(L, args, i, name))
+			}
+			return []any{float64(r)}
+		}
+	}
+	shift := func(name string, op func(a int32, n uint) int32) func(*LuaState, []any) []any {
+		return func(L *LuaState, args []any) []any {
+			return []any{float64(op(tobit(L, args, 0, name), uint(tobit(L, args, 1, name)&31)))}
+		}
+	}
+	return map[string]func(*LuaState, []any) []any{
+		"tobit": func(L *LuaState, args []any) []any { return []any{float64(tobit(L, args, 0, "tobit"))} },
+		"bnot":  func(L *LuaState, args []any) []any { return []any{float64(^tobit(L, args, 0, "bnot"))} },
+		"band":  fold("band", func(a, b int32) int32 { return a & b }),
+		"bor":   fold("bor", func(a, b int32) int32 { return a | b }),
+		"bxor":  fold("bxor", func(a, b int32) int32 { return a ^ b }),
+		"lshift": shift("lshift", func(a int32, n uint) int32 {
+			return int32(uint32(a) << n)
+		}),
+		"rshift": shift("rshift", func(a int32, n uint) int32 {
+			return int32(uint32(a) >> n)
+		}),
+		"arshift": shift("arshift", func(a int32, n uint) int32 {
+			return a >> n
+		}),
+		"tohex": func(L *LuaState, args []any) []any {
+			n := L.optInt(args, 1, "tohex", 8)
+			digits := "0123456789abcdef"
+			if n < 0 {
+				n, digits = -n, "0123456789ABCDEF"
+			}
+			n = min(n, 8)
+			x := uint32(tobit(L, args, 0, "tohex"))
+			buf := make([]byte, n)
+			for i := n - 1; i >= 0; i-- {
+				buf[i] = digits[x&15]
+				x >>= 4
+			}
+			return []any{string(buf)}
+		},
+	}
+}
@@ -0,0 +1,734 @@
+package main
+
+import "fmt"
+
+// luaProto is a compiled function: its body, and where its locals and
+// upvalues live. Locals each get a slot in the function's frame, the ones a
+// closure captures are kept in a luaCell there so they can outlive it.
+type luaProto struct {
+	name    string
+	chunk   string
+	line    int
+	params  []*luaLocalInfo
+	vararg  bool
+	nslots  int
+	upvals  []luaUpvalDesc
+	body    []luaStmt
+	maxLine int
+}
+
+type luaLocalInfo struct {
+	name     string
+	slot     int
+	captured bool // a closure refers to it, so it lives in a luaCell
+}
+
+// luaUpvalDesc is where a closure finds an upvalue when it's created: in a
+// local of the function creating it, or in one of that function's upvalues.
+type luaUpvalDesc struct {
+	name      string
+	fromLocal bool
+	index     int // the local's slot, or the upvalue's index
+}
+
+type luaFuncState struct {
+	parent *luaFuncState
+	proto  *luaProto
+	locals []*luaLocalInfo // the ones in scope, innermost last
+	blocks []int           // len(locals) as each enclosing block started
+	nslots int
+	loops  int // how many loops we're inside, for break
+}
+
+type luaParser struct {
+	toks  []luaLexeme
+	pos   int
+	chunk string
+	fs    *luaFuncState
+}
+
+// LuaCompile parses a chunk into the function that runs it.
+func LuaCompile(chunk, src string) (*luaProto, error) {
+	toks, e := luaLex(chunk, src)
+	if e != nil {
+		return nil, e
+	}
+	p := &luaParser{toks: toks, chunk: chunk}
+	proto, e := p.parseMain()
+	if e != nil {
+		return nil, e
+	}
+	return proto, nil
+}
+
+// syntax errors are raised as panics and recovered in parseMain, the parser
+// is recursive enough that threading errors through would double its size.
+type luaParsePanic struct{ err error }
+
+func (p *luaParser) parseMain() (proto *luaProto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pp, ok := r.(luaParsePanic)
+			if !ok {
+				panic(r)
+			}
+			err = pp.err
+		}
+	}()
+	p.openFunction("main chunk", 0)
+	p.fs.proto.vararg = true
+	body := p.block()
+	p.check(tokEOF, "")
+	return p.closeFunction(body), nil
+}
+
+func (p *luaParser) peek() luaLexeme {
+	return p.toks[p.pos]
+}
+
+func (p *luaParser) advance() luaLexeme {
+	t := p.toks[p.pos]
+	if t.tok != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *luaParser) errorf(format string, args ...any) {
+	panic(luaParsePanic{LuaSyntaxError{p.chunk, p.peek().line, fmt.Sprintf(format, args...)}})
+}
+
+func (p *luaParser) near() string {
+	t := p.peek()
+	if t.tok == tokEOF {
+		return "<eof>"
+	}
+	return t.text
+}
+
+func (p *luaParser) isSymbol(sym string) bool {
+	t := p.peek()
+	return t.tok == tokSymbol && t.text == sym
+}
+
+func (p *luaParser) acceptSymbol(sym string) bool {
+	if p.isSymbol(sym) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) expectSymbol(sym string) {
+	if !p.acceptSymbol(sym) {
+		p.errorf("'%s' expected near '%s'", sym, p.near())
+	}
+}
+
+func (p *luaParser) accept(tok luaToken) bool {
+	if p.peek().tok == tok {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+// check consumes a keyword that has to come next, what names it for the error.
+func (p *luaParser) check(tok luaToken, what string) {
+	if p.accept(tok) {
+		return
+	}
+	if tok == tokEOF {
+		p.errorf("'<eof>' expected near '%s'", p.near())
+	}
+	p.errorf("'%s' expected near '%s'", what, p.near())
+}
+
+// checkMatch is check for the keyword that closes a construct opened at line.
+func (p *luaParser) checkMatch(tok luaToken, what, opener string, line int) {
+	if p.accept(tok) {
+		return
+	}
+	if line == p.peek().line {
+		p.errorf("'%s' expected near '%s'", what, p.near())
+	}
+	p.errorf("'%s' expected (to close '%s' at line %d) near '%s'", what, opener, line, p.near())
+}
+
+func (p *luaParser) name() string {
+	t := p.peek()
+	if t.tok != tokName {
+		p.errorf("<name> expected near '%s'", p.near())
+	}
+	p.advance()
+	return t.text
+}
+
+// scopes
+
+func (p *luaParser) openFunction(name string, line int) {
+	p.fs = &luaFuncState{parent: p.fs, proto: &luaProto{name: name, chunk: p.chunk, line: line}}
+}
+
+func (p *luaParser) closeFunction(body []luaStmt) *luaProto {
+	proto := p.fs.proto
+	proto.body = body
+	proto.maxLine = p.peek().line
+	p.fs = p.fs.parent
+	return proto
+}
+
+func (p *luaParser) openBlock() {
+	p.fs.blocks = append(p.fs.blocks, len(p.fs.locals))
+}
+
+func (p *luaParser) closeBlock() {
+	fs := p.fs
+	n := fs.blocks[len(fs.blocks)-1]
+	fs.blocks = fs.blocks[:len(fs.blocks)-1]
+	fs.locals = fs.locals[:n]
+	fs.nslots = n
+}
+
+// declare makes a new local, it isn't in scope until activate.
+func (p *luaParser) declare(name string) *luaLocalInfo {
+	fs := p.fs
+	info := &luaLocalInfo{name: name, slot: fs.nslots}
+	fs.nslots++
+	if fs.nslots > fs.proto.nslots {
+		fs.proto.nslots = fs.nslots
+	}
+	if fs.nslots > 200 {
+		p.errorf("too many local variables")
+	}
+	return info
+}
+
+func (p *luaParser) activate(infos ...*luaLocalInfo) {
+	p.fs.locals = append(p.fs.locals, infos...)
+}
+
+// resolve finds what a name refers to: a local, an upvalue, or a global.
+func (p *luaParser) resolve(name string, line int) luaExpr {
+	if info := p.fs.findLocal(name); info != nil {
+		return &luaLocalExpr{info}
+	}
+	if idx := p.fs.findUpval(name); idx >= 0 {
+		return &luaUpvalExpr{idx, name}
+	}
+	return &luaGlobalExpr{name, line}
+}
+
+func (fs *luaFuncState) findLocal(name string) *luaLocalInfo {
+	for i := len(fs.locals) - 1; i >= 0; i-- {
+		if fs.locals[i].name == name {
+			return fs.locals[i]
+		}
+	}
+	return nil
+}
+
+// findUpval is the index of name among fs's upvalues, adding it when it's a
+// local of an enclosing function. -1 when it's a global.
+func (fs *luaFuncState) findUpval(name string) int {
+	for i, up := range fs.proto.upvals {
+		if up.name == name {
+			return i
+		}
+	}
+	if fs.parent == nil {
+		return -1
+	}
+	if info := fs.parent.findLocal(name); info != nil {
+		info.captured = true
+		fs.proto.upvals = append(fs.proto.upvals, luaUpvalDesc{name, true, info.slot})
+		return len(fs.proto.upvals) - 1
+	}
+	idx := fs.parent.findUpval(name)
+	if idx < 0 {
+		return -1
+	}
+	fs.proto.upvals = append(fs.proto.upvals, luaUpvalDesc{name, false, idx})
+	return len(fs.proto.upvals) - 1
+}
+
+// statements
+
+func (p *luaParser) blockFollows() bool {
+	switch p.peek().tok {
+	case tokElse, tokElseif, tokEnd, tokUntil, tokEOF:
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) block() []luaStmt {
+	var stmts []luaStmt
+	for !p.blockFollows() {
+		if p.peek().tok == tokReturn {
+			stmts = append(stmts, p.returnStmt())
+			break
+		}
+		if p.peek().tok == tokBreak {
+			line := p.advance().line
+			if p.fs.loops == 0 {
+				panic(luaParsePanic{LuaSyntaxError{p.chunk, line, "no loop to break near 'break'"}})
+			}
+			p.acceptSymbol(";")
+			stmts = append(stmts, &luaBreakStmt{})
+			// like return, break ends the block.
+			break
+		}
+		if s := p.statement(); s != nil {
+			stmts = append(stmts, s)
+		}
+		p.acceptSymbol(";")
+	}
+	return stmts
+}
+
+func (p *luaParser) scopedBlock() []luaStmt {
+	p.openBlock()
+	body := p.block()
+	p.closeBlock()
+	return body
+}
+
+func (p *luaParser) returnStmt() luaStmt {
+	p.advance()
+	var exprs []luaExpr
+	if !p.blockFollows() && !p.isSymbol(";") {
+		exprs = p.exprList()
+	}
+	p.acceptSymbol(";")
+	if !p.blockFollows() {
+		p.errorf("'<eof>' expected near '%s'", p.near())
+	}
+	return &luaReturnStmt{exprs}
+}
+
+func (p *luaParser) statement() luaStmt {
+	t := p.peek()
+	switch t.tok {
+	case tokIf:
+		return p.ifStmt()
+	case tokWhile:
+		p.advance()
+		cond := p.expr()
+		p.check(tokDo, "do")
+		p.fs.loops++
+		body := p.scopedBlock()
+		p.fs.loops--
+		p.checkMatch(tokEnd, "end", "while", t.line)
+		return &luaWhileStmt{cond, body}
+	case tokDo:
+		p.advance()
+		body := p.scopedBlock()
+		p.checkMatch(tokEnd, "end", "do", t.line)
+		return &luaDoStmt{body}
+	case tokFor:
+		return p.forStmt()
+	case tokRepeat:
+		p.advance()
+		p.fs.loops++
+		// the condition can see the body's locals.
+		p.openBlock()
+		body := p.block()
+		p.checkMatch(tokUntil, "until", "repeat", t.line)
+		cond := p.expr()
+		p.closeBlock()
+		p.fs.loops--
+		return &luaRepeatStmt{body, cond}
+	case tokFunction:
+		return p.functionStmt()
+	case tokLocal:
+		p.advance()
+		if p.accept(tokFunction) {
+			name := p.name()
+			info := p.declare(name)
+			// declared before the body, so it can call itself.
+			p.activate(info)
+			proto := p.functionBody(name, false, t.line)
+			return &luaLocalFunctionStmt{info, proto}
+		}
+		return p.localStmt()
+	}
+	return p.exprStmt()
+}
+
+func (p *luaParser) ifStmt() luaStmt {
+	line := p.advance().line
+	s := &luaIfStmt{}
+	cond := p.expr()
+	p.check(tokThen, "then")
+	s.conds = append(s.conds, cond)
+	s.blocks = append(s.blocks, p.scopedBlock())
+	for p.accept(tokElseif) {
+		cond := p.expr()
+		p.check(tokThen, "then")
+		s.conds = append(s.conds, cond)
+		s.blocks = append(s.blocks, p.scopedBlock())
+	}
+	if p.accept(tokElse) {
+		s.els = p.scopedBlock()
+	}
+	p.checkMatch(tokEnd, "end", "if", line)
+	return s
+}
+
+func (p *luaParser) forStmt() luaStmt {
+	line := p.advance().line
+	first := p.name()
+	p.openBlock()
+	defer p.closeBlock()
+	if p.acceptSymbol("=") {
+		start := p.expr()
+		p.expectSymbol(",")
+		limit := p.expr()
+		var step luaExpr = &luaConst{float64(1)}
+		if p.acceptSymbol(",") {
+			step = p.expr()
+		}
+		p.check(tokDo, "do")
+		info := p.declare(first)
+		p.activate(info)
+		p.fs.loops++
+		body := p.scopedBlock()
+		p.fs.loops--
+		p.checkMatch(tokEnd, "end", "for", line)
+		return &luaNumForStmt{info, start, limit, step, body, line}
+	}
+	names := []string{first}
+	for p.acceptSymbol(",") {
+		names = append(names, p.name())
+	}
+	if !p.accept(tokIn) {
+		p.errorf("'=' or 'in' expected near '%s'", p.near())
+	}
+	exprs := p.exprList()
+	p.check(tokDo, "do")
+	var infos []*luaLocalInfo
+	for _, name := range names {
+		infos = append(infos, p.declare(name))
+	}
+	p.activate(infos...)
+	p.fs.loops++
+	body := p.scopedBlock()
+	p.fs.loops--
+	p.checkMatch(tokEnd, "end", "for", line)
+	return &luaGenForStmt{infos, exprs, body, line}
+}
+
+func (p *luaParser) functionStmt() luaStmt {
+	line := p.advance().line
+	name := p.name()
+	target := p.resolve(name, line)
+	fullName := name
+	method := false
+	for p.isSymbol(".") || p.isSymbol(":") {
+		method = p.advance().text == ":"
+		key := p.name()
+		fullName += "." + key
+		target = &luaIndexExpr{target, &luaConst{key}, line}
+		if method {
+			break
+		}
+	}
+	proto := p.functionBody(fullName, method, line)
+	return &luaAssignStmt{[]luaExpr{target}, []luaExpr{&luaFunctionExpr{proto}}, line}
+}
+
+func (p *luaParser) localStmt() luaStmt {
+	var names []string
+	names = append(names, p.name())
+	for p.acceptSymbol(",") {
+		names = append(names, p.name())
+	}
+	var exprs []luaExpr
+	if p.acceptSymbol("=") {
+		exprs = p.exprList()
+	}
+	// the new locals aren't in scope in their own initializers.
+	var infos []*luaLocalInfo
+	for _, name := range names {
+		infos = append(infos, p.declare(name))
+	}
+	p.activate(infos...)
+	return &luaLocalStmt{infos, exprs}
+}
+
+func (p *luaParser) exprStmt() luaStmt {
+	line := p.peek().line
+	e := p.suffixedExpr()
+	if p.isSymbol("=") || p.isSymbol(",") {
+		targets := []luaExpr{e}
+		for p.acceptSymbol(",") {
+			targets = append(targets, p.suffixedExpr())
+		}
+		p.expectSymbol("=")
+		for _, t := range targets {
+			switch t.(type) {
+			case *luaLocalExpr, *luaUpvalExpr, *luaGlobalExpr, *luaIndexExpr:
+			default:
+				p.errorf("syntax error near '%s'", p.near())
+			}
+		}
+		return &luaAssignStmt{targets, p.exprList(), line}
+	}
+	switch e.(type) {
+	case *luaCallExpr, *luaMethodCallExpr:
+		return &luaCallStmt{e}
+	}
+	p.errorf("syntax error near '%s'", p.near())
+	return nil
+}
+
+// functionBody parses (params) body end, the function keyword and name
+// have already been read.
+func (p *luaParser) functionBody(name string, method bool, line int) *luaProto {
+	p.openFunction(name, line)
+	fs := p.fs
+	if method {
+		self := p.declare("self")
+		p.activate(self)
+		fs.proto.params = append(fs.proto.params, self)
+	}
+	p.expectSymbol("(")
+	if !p.isSymbol(")") {
+		for {
+			if p.acceptSymbol("...") {
+				fs.proto.vararg = true
+				break
+			}
+			info := p.declare(p.name())
+			p.activate(info)
+			fs.proto.params = append(fs.proto.params, info)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	p.expectSymbol(")")
+	body := p.block()
+	p.checkMatch(tokEnd, "end", "function", line)
+	return p.closeFunction(body)
+}
+
+// expressions
+
+func (p *luaParser) exprList() []luaExpr {
+	exprs := []luaExpr{p.expr()}
+	for p.acceptSymbol(",") {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+func (p *luaParser) expr() luaExpr {
+	return p.subExpr(0)
+}
+
+// binary operators' left and right priorities, as in lua's parser.
+var luaBinaryPriority = map[string][2]int{
+	"+": {6, 6}, "-": {6, 6}, "*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9}, "..": {5, 4},
+	"==": {3, 3}, "~=": {3, 3}, "<": {3, 3}, "<=": {3, 3}, ">": {3, 3}, ">=": {3, 3},
+	"and": {2, 2}, "or": {1, 1},
+}
+
+const luaUnaryPriority = 8
+
+func (p *luaParser) binaryOp() (string, bool) {
+	t := p.peek()
+	switch t.tok {
+	case tokAnd:
+		return "and", true
+	case tokOr:
+		return "or", true
+	case tokSymbol:
+		if _, ok := luaBinaryPriority[t.text]; ok {
+			return t.text, true
+		}
+	}
+	return "", false
+}
+
+func (p *luaParser) subExpr(limit int) luaExpr {
+	var left luaExpr
+	t := p.peek()
+	if t.tok == tokNot || (t.tok == tokSymbol && (t.text == "-" || t.text == "#")) {
+		p.advance()
+		operand := p.subExpr(luaUnaryPriority)
+		left = foldUnary(t.text, operand, t.line)
+	} else {
+		left = p.simpleExpr()
+	}
+	for {
+		op, ok := p.binaryOp()
+		if !ok || luaBinaryPriority[op][0] <= limit {
+			return left
+		}
+		line := p.advance().line
+		right := p.subExpr(luaBinaryPriority[op][1])
+		switch op {
+		case "and":
+			left = &luaAndExpr{left, right}
+		case "or":
+			left = &luaOrExpr{left, right}
+		default:
+			left = &luaBinExpr{op, left, right, line}
+		}
+	}
+}
+
+// foldUnary builds a unary expression, folding -<number> into a constant.
+func foldUnary(op string, operand luaExpr, line int) luaExpr {
+	if c, ok := operand.(*luaConst); ok && op == "-" {
+		if n, ok := c.v.(float64); ok {
+			return &luaConst{-n}
+		}
+	}
+	return &luaUnExpr{op, operand, line}
+}
+
+func (p *luaParser) simpleExpr() luaExpr {
+	t := p.peek()
+	switch t.tok {
+	case tokNumber:
+		p.advance()
+		return &luaConst{t.num}
+	case tokString:
+		p.advance()
+		return &luaConst{t.text}
+	case tokNil:
+		p.advance()
+		return &luaConst{nil}
+	case tokTrue:
+		p.advance()
+		return &luaConst{true}
+	case tokFalse:
+		p.advance()
+		return &luaConst{false}
+	case tokFunction:
+		p.advance()
+		return &luaFunctionExpr{p.functionBody("anonymous", false, t.line)}
+	case tokSymbol:
+		switch t.text {
+		case "...":
+			if !p.fs.proto.vararg {
+				p.errorf("cannot use '...' outside a vararg function near '...'")
+			}
+			p.advance()
+			return &luaVarargExpr{}
+		case "{":
+			return p.tableConstructor()
+		}
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() luaExpr {
+	t := p.peek()
+	switch {
+	case t.tok == tokName:
+		p.advance()
+		return p.resolve(t.text, t.line)
+	case t.tok == tokSymbol && t.text == "(":
+		p.advance()
+		e := p.expr()
+		p.expectSymbol(")")
+		// parentheses cut a call or ... down to its first value.
+		switch e.(type) {
+		case *luaCallExpr, *luaMethodCallExpr, *luaVarargExpr:
+			return &luaParenExpr{e}
+		}
+		return e
+	}
+	p.errorf("unexpected symbol near '%s'", p.near())
+	return nil
+}
+
+func (p *luaParser) suffixedExpr() luaExpr {
+	e := p.primaryExpr()
+	for {
+		t := p.peek()
+		if t.tok == tokString {
+			e = &luaCallExpr{e, []luaExpr{p.simpleExpr()}, t.line}
+			continue
+		}
+		if t.tok != tokSymbol {
+			return e
+		}
+		switch t.text {
+		case ".":
+			p.advance()
+			e = &luaIndexExpr{e, &luaConst{p.name()}, t.line}
+		case "[":
+			p.advance()
+			key := p.expr()
+			p.expectSymbol("]")
+			e = &luaIndexExpr{e, key, t.line}
+		case ":":
+			p.advance()
+			name := p.name()
+			e = &luaMethodCallExpr{e, name, p.callArgs(), t.line}
+		case "(", "{":
+			e = &luaCallExpr{e, p.callArgs(), t.line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *luaParser) callArgs() []luaExpr {
+	t := p.peek()
+	switch {
+	case t.tok == tokString:
+		p.advance()
+		return []luaExpr{&luaConst{t.text}}
+	case t.tok == tokSymbol && t.text == "{":
+		return []luaExpr{p.tableConstructor()}
+	case t.tok == tokSymbol && t.text == "(":
+		p.advance()
+		if p.acceptSymbol(")") {
+			return nil
+		}
+		args := p.exprList()
+		p.expectSymbol(")")
+		return args
+	}
+	p.errorf("function arguments expected near '%s'", p.near())
+	return nil
+}
+
+func (p *luaParser) tableConstructor() luaExpr {
+	line := p.peek().line
+	p.expectSymbol("{")
+	t := &luaTableExpr{}
+	for !p.isSymbol("}") {
+		switch {
+		case p.isSymbol("["):
+			p.advance()
+			key := p.expr()
+			p.expectSymbol("]")
+			p.expectSymbol("=")
+			t.items = append(t.items, luaTableItem{key, p.expr()})
+		case p.peek().tok == tokName && p.pos+1 < len(p.toks) && p.toks[p.pos+1].tok == tokSymbol && p.toks[p.pos+1].text == "=":
+			key := p.name()
+			p.advance()
+			t.items = append(t.items, luaTableItem{&luaConst{key}, p.expr()})
+		default:
+			t.items = append(t.items, luaTableItem{nil, p.expr()})
+		}
+		if !p.acceptSymbol(",") && !p.acceptSymbol(";") {
+			break
+		}
+	}
+	if !p.acceptSymbol("}") {
+		if line == p.peek().line {
+			p.errorf("'}' expected near '%s'", p.near())
+		}
+		p.errorf("'}' expected (to close '{' at line %d) near '%s'", line, p.near())
+	}
+	return t
+}
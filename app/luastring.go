@@ -0,0 +1,710 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// luaMaxStringSize is the most string.rep and friends will build, so that a
+// script can't take all of our memory in one go.
+const luaMaxStringSize = 512 << 20
+
+func luaStringFuncs() map[string]func(*LuaState, []any) []any {
+	return map[string]func(*LuaState, []any) []any{
+		"byte":    luaStrByte,
+		"char":    luaStrChar,
+		"find":    func(L *LuaState, args []any) []any { return luaStrFind(L, args, true) },
+		"format":  luaStrFormat,
+		"gmatch":  luaStrGmatch,
+		"gsub":    luaStrGsub,
+		"len":     func(L *LuaState, args []any) []any { return []any{float64(len(L.checkString(args, 0, "len")))} },
+		"lower":   func(L *LuaState, args []any) []any { return []any{strings.ToLower(L.checkString(args, 0, "lower"))} },
+		"match":   func(L *LuaState, args []any) []any { return luaStrFind(L, args, false) },
+		"rep":     luaStrRep,
+		"reverse": luaStrReverse,
+		"sub":     luaStrSub,
+		"upper":   func(L *LuaState, args []any) []any { return []any{strings.ToUpper(L.checkString(args, 0, "upper"))} },
+	}
+}
+
+// luaStrPos turns a possibly negative string position into a 1 based one.
+func luaStrPos(pos, n int) int {
+	if pos < 0 {
+		pos += n + 1
+	}
+	if pos < 0 {
+		return 0
+	}
+	return pos
+}
+
+func luaStrSub(L *LuaState, args []any) []any {
+	s := L.checkString(args, 0, "sub")
+	i := luaStrPos(L.optInt(args, 1, "sub", 1), len(s))
+	j := luaStrPos(L.optInt(args, 2, "sub", -1), len(s))
+	i = max(i, 1)
+	j = min(j, len(s))
+	if i > j {
+		return []any{""}
+	}
+	return []any{s[i-1 : j]}
+}
+
+func luaStrByte(L *LuaState, args []any) []any {
+	s := L.checkString(args, 0, "byte")
+	i := luaStrPos(L.optInt(args, 1, "byte", 1), len(s))
+	j := luaStrPos(L.optInt(args, 2, "byte", i), len(s))
+	i = max(i, 1)
+	j = min(j, len(s))
+	var rets []any
+	for k := i; k <= j; k++ {
+		rets = append(rets, float64(s[k-1]))
+	}
+	return rets
+}
+
+func luaStrChar(L *LuaState, args []any) []any {
+	buf := make([]byte, len(args))
+	for i := range args {
+		c := L.checkInt(args, i, "char")
+		if c < 0 || c > 255 {
+			L.argError(i, "char", "invalid value")
+		}
+		buf[i] = byte(c)
+	}
+	return []any{string(buf)}
+}
+
+func luaStrRep(L *LuaState, args []any) []any {
+	s := L.checkString(args, 0, "rep")
+	n := L.checkInt(args, 1, "rep")
+	if n <= 0 || s == "" {
+		return []any{""}
+	}
+	if len(s)*n > luaMaxStringSize || len(s)*n/n != len(s) {
+		L.Errorf("resulting string too large")
+	}
+	return []any{strings.Repeat(s, n)}
+}
+
+func luaStrReverse(L *LuaState, args []any) []any {
+	s := []byte(L.checkString(args, 0, "reverse"))
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+	return []any{string(s)}
+}
+
+// format
+
+func luaStrFormat(L *LuaState, args []any) []any {
+	format := L.checkString(args, 0, "format")
+	var sb strings.Builder
+	arg := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(format) {
+			L.Errorf("invalid option '%%' to 'format'")
+		}
+		if format[i] == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		// flags, width and precision are the same as C's, and go's fmt
+		// understands them.
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && isDigit(format[i]) {
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			for i < len(format) && isDigit(format[i]) {
+				i++
+			}
+		}
+		if i >= len(format) || i-start > 6 {
+			L.Errorf("invalid format (repeated flags)")
+		}
+		spec := "%" + format[start:i]
+		arg++
+		switch conv := format[i]; conv {
+		case 'd', 'i':
+			n := L.checkNumber(args, arg, "format")
+			sb.WriteString(fmt.Sprintf(spec+"d", int64(n)))
+		case 'u':
+			n := L.checkNumber(args, arg, "format")
+			sb.WriteString(fmt.Sprintf(spec+"d", uint64(int64(n))))
+		case 'c':
+			sb.WriteByte(byte(L.checkInt(args, arg, "format")))
+		case 'o', 'x', 'X':
+			n := L.checkNumber(args, arg, "format")
+			sb.WriteString(fmt.Sprintf(spec+string(conv), uint64(int64(n))))
+		case 'e', 'E', 'f':
+			n := L.checkNumber(args, arg, "format")
+			sb.WriteString(luaFormatFloat(spec, conv, n))
+		case 'g', 'G':
+			n := L.checkNumber(args, arg, "format")
+			if !strings.Contains(spec, ".") {
+				// C's %g has a precision of 6, go's is as many as it takes.
+				spec += ".6"
+			}
+			sb.WriteString(luaFormatFloat(spec, conv, n))
+		case 'q':
+			sb.WriteString(luaQuote(L.checkString(args, arg, "format")))
+		case 's':
+			sb.WriteString(fmt.Sprintf(spec+"s", L.checkString(args, arg, "format")))
+		default:
+			L.Errorf("invalid option '%%%c' to 'format'", conv)
+		}
+	}
+	return []any{sb.String()}
+}
+
+func luaFormatFloat(spec string, conv byte, n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return fmt.Sprintf(strings.TrimRight(spec, ".0123456789")+"s", "inf")
+	case math.IsInf(n, -1):
+		return fmt.Sprintf(strings.TrimRight(spec, ".0123456789")+"s", "-inf")
+	case math.IsNaN(n):
+		return fmt.Sprintf(strings.TrimRight(spec, ".0123456789")+"s", "nan")
+	}
+	return fmt.Sprintf(spec+string(conv), n)
+}
+
+// luaQuote is %q, a string as a lua literal that reads back the same.
+func luaQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString("\\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case 0:
+			sb.WriteString("\\000")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// patterns, lua's own flavour of regular expressions. This follows lstrlib.c.
+
+const luaMaxCaptures = 32
+
+const (
+	capUnfinished = -1
+	capPosition   = -2
+)
+
+type luaMatchState struct {
+	L       *LuaState
+	src     string
+	pat     string
+	level   int
+	capture [luaMaxCaptures]struct{ start, len int }
+	depth   int
+}
+
+func (ms *luaMatchState) classEnd(p int) int {
+	if p >= len(ms.pat) {
+		ms.L.Errorf("malformed pattern (ends with '%%')")
+	}
+	c := ms.pat[p]
+	p++
+	if c == '%' {
+		if p >= len(ms.pat) {
+			ms.L.Errorf("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		for {
+			if p >= len(ms.pat) {
+				ms.L.Errorf("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' {
+				p++
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1
+			}
+			if p >= len(ms.pat) {
+				ms.L.Errorf("malformed pattern (missing ']')")
+			}
+		}
+	}
+	return p
+}
+
+func luaSingleClass(c byte, class byte) bool {
+	var res bool
+	switch class | 0x20 {
+	case 'a':
+		res = (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	case 'c':
+		res = c < 32 || c == 127
+	case 'd':
+		res = isDigit(c)
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = (c >= 33 && c <= 47) || (c >= 58 && c <= 64) || (c >= 91 && c <= 96) || (c >= 123 && c <= 126)
+	case 's':
+		res = c == ' ' || (c >= '\t' && c <= '\r')
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	case 'x':
+		res = isHexDigit(c)
+	case 'z':
+		res = c == 0
+	default:
+		return class == c
+	}
+	if class >= 'A' && class <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+// matchBracketClass matches c against the set [...] that runs from p (the
+// '[') to ec (the ']').
+func (ms *luaMatchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	p++
+	if ms.pat[p] == '^' {
+		sig = false
+		p++
+	}
+	for ; p < ec; p++ {
+		switch {
+		case ms.pat[p] == '%':
+			p++
+			if luaSingleClass(c, ms.pat[p]) {
+				return sig
+			}
+		case p+2 < ec && ms.pat[p+1] == '-':
+			if ms.pat[p] <= c && c <= ms.pat[p+2] {
+				return sig
+			}
+			p += 2
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+func (ms *luaMatchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return luaSingleClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+// match is where the pattern from p matches the source from s, -1 when it
+// doesn't.
+func (ms *luaMatchState) match(s, p int) int {
+	ms.depth++
+	if ms.depth > 200 {
+		ms.L.Errorf("pattern too complex")
+	}
+	defer func() { ms.depth-- }()
+	for {
+		if p >= len(ms.pat) {
+			return s
+		}
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			if p+1 < len(ms.pat) {
+				switch ms.pat[p+1] {
+				case 'b':
+					s = ms.matchBalance(s, p+2)
+					if s == -1 {
+						return -1
+					}
+					p += 4
+					continue
+				case 'f':
+					p += 2
+					if p >= len(ms.pat) || ms.pat[p] != '[' {
+						ms.L.Errorf("missing '[' after '%%f' in pattern")
+					}
+					ep := ms.classEnd(p)
+					var prev, cur byte
+					if s > 0 {
+						prev = ms.src[s-1]
+					}
+					if s < len(ms.src) {
+						cur = ms.src[s]
+					}
+					if ms.matchBracketClass(prev, p, ep-1) || !ms.matchBracketClass(cur, p, ep-1) {
+						return -1
+					}
+					p = ep
+					continue
+				default:
+					if isDigit(ms.pat[p+1]) {
+						s = ms.matchCapture(s, ms.pat[p+1])
+						if s == -1 {
+							return -1
+						}
+						p += 2
+						continue
+					}
+				}
+			}
+		}
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		if ep < len(ms.pat) {
+			switch ms.pat[ep] {
+			case '?':
+				if m {
+					if res := ms.match(s+1, ep+1); res != -1 {
+						return res
+					}
+				}
+				p = ep + 1
+				continue
+			case '*':
+				return ms.maxExpand(s, p, ep)
+			case '+':
+				if !m {
+					return -1
+				}
+				return ms.maxExpand(s+1, p, ep)
+			case '-':
+				return ms.minExpand(s, p, ep)
+			}
+		}
+		if !m {
+			return -1
+		}
+		s++
+		p = ep
+	}
+}
+
+func (ms *luaMatchState) maxExpand(s, p, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if res := ms.match(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (ms *luaMatchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res != -1 {
+			return res
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *luaMatchState) startCapture(s, p, what int) int {
+	if ms.level >= luaMaxCaptures {
+		ms.L.Errorf("too many captures")
+	}
+	ms.capture[ms.level].start = s
+	ms.capture[ms.level].len = what
+	ms.level++
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.level--
+	}
+	return res
+}
+
+func (ms *luaMatchState) endCapture(s, p int) int {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].len == capUnfinished {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		ms.L.Errorf("invalid pattern capture")
+	}
+	ms.capture[l].len = s - ms.capture[l].start
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.capture[l].len = capUnfinished
+	}
+	return res
+}
+
+func (ms *luaMatchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pat) {
+		ms.L.Errorf("unbalanced pattern")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for i := s + 1; i < len(ms.src); i++ {
+		switch ms.src[i] {
+		case e:
+			cont--
+			if cont == 0 {
+				return i + 1
+			}
+		case b:
+			cont++
+		}
+	}
+	return -1
+}
+
+func (ms *luaMatchState) matchCapture(s int, l byte) int {
+	idx := int(l - '1')
+	if idx < 0 || idx >= ms.level || ms.capture[idx].len == capUnfinished {
+		ms.L.Errorf("invalid capture index")
+	}
+	c := ms.src[ms.capture[idx].start : ms.capture[idx].start+ms.capture[idx].len]
+	if strings.HasPrefix(ms.src[s:], c) {
+		return s + len(c)
+	}
+	return -1
+}
+
+// getCapture is capture i, or the whole match when there are none.
+func (ms *luaMatchState) getCapture(i, s, e int) any {
+	if i >= ms.level {
+		if i == 0 {
+			return ms.src[s:e]
+		}
+		ms.L.Errorf("invalid capture index")
+	}
+	c := ms.capture[i]
+	if c.len == capUnfinished {
+		ms.L.Errorf("unfinished capture")
+	}
+	if c.len == capPosition {
+		return float64(c.start + 1)
+	}
+	return ms.src[c.start : c.start+c.len]
+}
+
+func (ms *luaMatchState) captures(s, e int, wholeIfNone bool) []any {
+	n := ms.level
+	if n == 0 && wholeIfNone {
+		n = 1
+	}
+	caps := make([]any, n)
+	for i := range caps {
+		caps[i] = ms.getCapture(i, s, e)
+	}
+	return caps
+}
+
+// luaStrFind is string.find, or string.match when find is false.
+func luaStrFind(L *LuaState, args []any, find bool) []any {
+	fname := "match"
+	if find {
+		fname = "find"
+	}
+	s := L.checkString(args, 0, fname)
+	pat := L.checkString(args, 1, fname)
+	init := luaStrPos(L.optInt(args, 2, fname, 1), len(s))
+	if init < 1 {
+		init = 1
+	}
+	if init > len(s)+1 {
+		return []any{nil}
+	}
+	plain := luaTruthy(luaArg(args, 3))
+	if find && (plain || !strings.ContainsAny(pat, "^$*+?.([%-")) {
+		idx := strings.Index(s[init-1:], pat)
+		if idx < 0 {
+			return []any{nil}
+		}
+		start := init - 1 + idx
+		return []any{float64(start + 1), float64(start + len(pat))}
+	}
+	ms := &luaMatchState{L: L, src: s, pat: pat}
+	anchor := strings.HasPrefix(pat, "^")
+	p := 0
+	if anchor {
+		p = 1
+	}
+	for si := init - 1; si <= len(s); si++ {
+		ms.level = 0
+		if e := ms.match(si, p); e != -1 {
+			if find {
+				return append([]any{float64(si + 1), float64(e)}, ms.captures(-1, 0, false)...)
+			}
+			return ms.captures(si, e, true)
+		}
+		if anchor {
+			break
+		}
+	}
+	return []any{nil}
+}
+
+func luaStrGmatch(L *LuaState, args []any) []any {
+	s := L.checkString(args, 0, "gmatch")
+	pat := L.checkString(args, 1, "gmatch")
+	pos := 0
+	iter := &LuaGoFunction{"gmatch_iter", func(L *LuaState, _ []any) []any {
+		ms := &luaMatchState{L: L, src: s, pat: pat}
+		for ; pos <= len(s); pos++ {
+			ms.level = 0
+			if e := ms.match(pos, 0); e != -1 {
+				start := pos
+				pos = e
+				if e == start {
+					// an empty match, move on so we don't match it again.
+					pos++
+				}
+				return ms.captures(start, e, true)
+			}
+		}
+		return []any{nil}
+	}}
+	return []any{iter}
+}
+
+func luaStrGsub(L *LuaState, args []any) []any {
+	src := L.checkString(args, 0, "gsub")
+	pat := L.checkString(args, 1, "gsub")
+	repl := luaArg(args, 2)
+	switch repl.(type) {
+	case string, float64, *LuaTable, *luaClosure, *LuaGoFunction:
+	default:
+		L.typeError(args, 2, "gsub", "string/function/table")
+	}
+	maxN := L.optInt(args, 3, "gsub", len(src)+1)
+	anchor := strings.HasPrefix(pat, "^")
+	p := 0
+	if anchor {
+		p = 1
+	}
+	ms := &luaMatchState{L: L, src: src, pat: pat}
+	var sb strings.Builder
+	s, n := 0, 0
+	for n < maxN {
+		ms.level = 0
+		e := ms.match(s, p)
+		if e != -1 {
+			n++
+			ms.addValue(&sb, s, e, repl)
+		}
+		switch {
+		case e != -1 && e > s:
+			s = e
+		case s < len(src):
+			sb.WriteByte(src[s])
+			s++
+		default:
+			s = len(src) + 1
+		}
+		if s > len(src) || anchor {
+			break
+		}
+	}
+	if s < len(src) {
+		sb.WriteString(src[s:])
+	}
+	return []any{sb.String(), float64(n)}
+}
+
+// addValue adds the replacement for the match from s to e.
+func (ms *luaMatchState) addValue(sb *strings.Builder, s, e int, repl any) {
+	var v any
+	switch r := repl.(type) {
+	case float64:
+		sb.WriteString(luaNumberString(r))
+		return
+	case string:
+		for i := 0; i < len(r); i++ {
+			c := r[i]
+			if c != '%' || i+1 >= len(r) {
+				sb.WriteByte(c)
+				continue
+			}
+			i++
+			switch {
+			case r[i] == '0':
+				sb.WriteString(ms.src[s:e])
+			case isDigit(r[i]):
+				capture, _ := luaConcatString(ms.getCapture(int(r[i]-'1'), s, e))
+				sb.WriteString(capture)
+			default:
+				sb.WriteByte(r[i])
+			}
+		}
+		return
+	case *LuaTable:
+		v = ms.L.index(r, ms.getCapture(0, s, e), ms.L.line, nil)
+	default:
+		v = luaArg(ms.L.Call(r, ms.captures(s, e, true), ms.L.line), 0)
+	}
+	if !luaTruthy(v) {
+		sb.WriteString(ms.src[s:e])
+		return
+	}
+	str, ok := luaConcatString(v)
+	if !ok {
+		ms.L.Errorf("invalid replacement value (a %s)", luaTypeName(v))
+	}
+	sb.WriteString(str)
+}
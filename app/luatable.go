@@ -0,0 +1,185 @@
+package main
+
+import "math"
+
+// LuaTable is lua's table. Keys 1..n live in an array, the rest in a hash
+// that remembers insertion order, so next() can carry on from any key even
+// after fields have been cleared during the traversal.
+type LuaTable struct {
+	arr   []any
+	index map[any]int // key to its position in keys and vals
+	keys  []any
+	vals  []any // nil for a key that's been cleared
+	dead  int   // how many of vals are nil
+	meta  *LuaTable
+
+	readonly bool // scripts can't change it, like the globals and the libraries in redis
+}
+
+func NewLuaTable(narr, nhash int) *LuaTable {
+	t := &LuaTable{}
+	if narr > 0 {
+		t.arr = make([]any, 0, narr)
+	}
+	if nhash > 0 {
+		t.index = make(map[any]int, nhash)
+	}
+	return t
+}
+
+// luaArrayIndex is the array position of key, when it's a whole number.
+func luaArrayIndex(key any) (int, bool) {
+	n, ok := key.(float64)
+	if !ok || n < 1 || n != math.Trunc(n) || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func (t *LuaTable) Get(key any) any {
+	if i, ok := luaArrayIndex(key); ok && i <= len(t.arr) {
+		return t.arr[i-1]
+	}
+	if s, ok := key.(string); ok {
+		return t.GetString(s)
+	}
+	if pos, ok := t.index[key]; ok {
+		return t.vals[pos]
+	}
+	return nil
+}
+
+func (t *LuaTable) GetString(key string) any {
+	if pos, ok := t.index[key]; ok {
+		return t.vals[pos]
+	}
+	return nil
+}
+
+// Set sets a field, the caller has already checked that key isn't nil or NaN.
+func (t *LuaTable) Set(key, value any) {
+	if i, ok := luaArrayIndex(key); ok {
+		if i <= len(t.arr) {
+			t.arr[i-1] = value
+			if i == len(t.arr) && value == nil {
+				t.trimArray()
+			}
+			return
+		}
+		if i == len(t.arr)+1 && value != nil {
+			t.arr = append(t.arr, value)
+			t.delHash(key)
+			t.migrate()
+			return
+		}
+	}
+	if value == nil {
+		t.delHash(key)
+		return
+	}
+	if t.index == nil {
+		t.index = map[any]int{}
+	}
+	if pos, ok := t.index[key]; ok {
+		if t.vals[pos] == nil {
+			t.dead--
+		}
+		t.vals[pos] = value
+		return
+	}
+	if t.dead > 8 && t.dead > len(t.keys)/2 {
+		t.compact()
+	}
+	t.index[key] = len(t.keys)
+	t.keys = append(t.keys, key)
+	t.vals = append(t.vals, value)
+}
+
+func (t *LuaTable) delHash(key any) {
+	if pos, ok := t.index[key]; ok && t.vals[pos] != nil {
+		t.vals[pos] = nil
+		t.dead++
+	}
+}
+
+// migrate moves the keys that follow on from the array out of the hash.
+func (t *LuaTable) migrate() {
+	for len(t.index) > 0 {
+		key := float64(len(t.arr) + 1)
+		pos, ok := t.index[key]
+		if !ok || t.vals[pos] == nil {
+			return
+		}
+		t.arr = append(t.arr, t.vals[pos])
+		t.vals[pos] = nil
+		t.dead++
+	}
+}
+
+func (t *LuaTable) trimArray() {
+	n := len(t.arr)
+	for n > 0 && t.arr[n-1] == nil {
+		n--
+	}
+	t.arr = t.arr[:n]
+}
+
+// compact drops the cleared keys. It's only done when adding a key, which lua
+// says mustn't be done part way through a traversal.
+func (t *LuaTable) compact() {
+	keys, vals := t.keys[:0], t.vals[:0]
+	clear(t.index)
+	for i, k := range t.keys {
+		if t.vals[i] != nil {
+			t.index[k] = len(keys)
+			keys = append(keys, k)
+			vals = append(vals, t.vals[i])
+		}
+	}
+	clear(t.keys[len(keys):])
+	clear(t.vals[len(vals):])
+	t.keys, t.vals, t.dead = keys, vals, 0
+}
+
+// Len is the length operator, # in lua.
+func (t *LuaTable) Len() int {
+	return len(t.arr)
+}
+
+// Next is the key and value after key, in the order next() goes through
+// them, or a nil key at the end. ok is false when key isn't in the table.
+func (t *LuaTable) Next(key any) (any, any, bool) {
+	i := 0
+	if key != nil {
+		n, isArr := luaArrayIndex(key)
+		pos, inHash := t.index[key]
+		switch {
+		case isArr && n <= len(t.arr):
+			i = n
+		case inHash:
+			i = len(t.arr) + pos + 1
+		case isArr:
+			// the end of the array, cleared during the traversal and
+			// trimmed off since.
+			i = len(t.arr)
+		default:
+			return nil, nil, false
+		}
+	}
+	for ; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	for pos := i - len(t.arr); pos < len(t.keys); pos++ {
+		if t.vals[pos] != nil {
+			return t.keys[pos], t.vals[pos], true
+		}
+	}
+	return nil, nil, true
+}
+
+// Append adds value at #t+1.
+func (t *LuaTable) Append(value any) {
+	t.Set(float64(len(t.arr)+1), value)
+}
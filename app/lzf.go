@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// LZF is the compression format redis uses for long strings in rdb files. The
+// compressed stream is a sequence of chunks, each introduced by a control byte:
+//
+//	000LLLLL <L+1 literal bytes>              literal run
+//	LLLooooo oooooooo                         back reference, length L+2
+//	111ooooo LLLLLLLL oooooooo                back reference, length L+9
+//
+// where the offset (o) is the distance back from the current output position minus one.
+
+const (
+	lzfMaxLiteral = 1 << 5  // longest literal run a single control byte can describe
+	lzfMaxOffset  = 1 << 13 // furthest a back reference can reach
+	lzfMaxRef     = 264     // longest back reference (255 + 7 + 2)
+	lzfHashLog    = 14
+	lzfHashSize   = 1 << lzfHashLog
+	// the most a compressed byte can stand for, a back reference of the
+	// longest length is 3 bytes long.
+	lzfMaxExpansion = lzfMaxRef/3 + 1
+)
+
+var ErrLZFOutputTooSmall = errors.New("lzf: output does not fit in the expected length")
+var ErrLZFOutputLength = errors.New("lzf: expected length is more than the input could decompress to")
+
+type ErrLZFCorrupt int
+
+func (e ErrLZFCorrupt) Error() string {
+	return fmt.Sprintf("lzf: corrupt input at compressed offset %d", int(e))
+}
+
+// LZFDecompress inflates src, which must decompress to exactly outLen bytes.
+// An outLen that's negative, or longer than src could possibly decompress to,
+// is refused before anything is allocated for it.
+func LZFDecompress(src []byte, outLen int) ([]byte, error) {
+	if outLen < 0 || outLen > len(src)*lzfMaxExpansion {
+		return nil, ErrLZFOutputLength
+	}
+	out := make([]byte, 0, outLen)
+	ip := 0
+	for ip < len(src) {
+		ctrl := int(src[ip])
+		ip++
+
+		if ctrl < lzfMaxLiteral {
+			// literal run
+			run := ctrl + 1
+			if ip+run > len(src) {
+				return nil, ErrLZFCorrupt(ip - 1)
+			}
+			if len(out)+run > outLen {
+				return nil, ErrLZFOutputTooSmall
+			}
+			out = append(out, src[ip:ip+run]...)
+			ip += run
+			continue
+		}
+
+		// back reference
+		start := ip - 1
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(src) {
+				return nil, ErrLZFCorrupt(start)
+			}
+			length += int(src[ip])
+			ip++
+		}
+		length += 2
+		if ip >= len(src) {
+			return nil, ErrLZFCorrupt(start)
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - 1 - int(src[ip])
+		ip++
+		if ref < 0 {
+			return nil, ErrLZFCorrupt(start)
+		}
+		if len(out)+length > outLen {
+			return nil, ErrLZFOutputTooSmall
+		}
+		// the reference may overlap what we're writing, so copy byte by byte.
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != outLen {
+		return nil, ErrLZFCorrupt(len(src))
+	}
+	return out, nil
+}
+
+// LZFCompress deflates src. The second return value is false when the data
+// doesn't compress to fewer than len(src) bytes, in which case callers should
+// store it uncompressed.
+func LZFCompress(src []byte) ([]byte, bool) {
+	if len(src) < 4 {
+		return nil, false
+	}
+	var table [lzfHashSize]int // positions+1 of the last time we saw each 3 byte sequence
+	out := make([]byte, 0, len(src))
+	lit := 0      // length of the literal run currently being built
+	litStart := 0 // index of its control byte in out
+	out = append(out, 0)
+
+	emitLiteral := func(b byte) {
+		out = append(out, b)
+		lit++
+		if lit == lzfMaxLiteral {
+			out[litStart] = byte(lit - 1)
+			lit = 0
+			litStart = len(out)
+			out = append(out, 0)
+		}
+	}
+
+	ip := 0
+	for ip+2 < len(src) {
+		h := lzfHash(src[ip:])
+		ref := table[h] - 1
+		table[h] = ip + 1
+
+		off := ip - ref - 1
+		if ref < 0 || off >= lzfMaxOffset || src[ref] != src[ip] || src[ref+1] != src[ip+1] || src[ref+2] != src[ip+2] {
+			emitLiteral(src[ip])
+			ip++
+			continue
+		}
+
+		length := 3
+		maxLen := len(src) - ip
+		if maxLen > lzfMaxRef {
+			maxLen = lzfMaxRef
+		}
+		for length < maxLen && src[ref+length] == src[ip+length] {
+			length++
+		}
+
+		// close off the pending literal run, or drop its unused control byte
+		if lit > 0 {
+			out[litStart] = byte(lit - 1)
+		} else {
+			out = out[:len(out)-1]
+		}
+
+		l := length - 2
+		if l < 7 {
+			out = append(out, byte(l<<5|off>>8))
+		} else {
+			out = append(out, byte(7<<5|off>>8), byte(l-7))
+		}
+		out = append(out, byte(off))
+
+		for i := 1; i < length && ip+i+2 < len(src); i++ {
+			table[lzfHash(src[ip+i:])] = ip + i + 1
+		}
+		ip += length
+
+		lit = 0
+		litStart = len(out)
+		out = append(out, 0)
+
+		if len(out) >= len(src) {
+			return nil, false
+		}
+	}
+
+	for ; ip < len(src); ip++ {
+		emitLiteral(src[ip])
+	}
+
+	if lit > 0 {
+		out[litStart] = byte(lit - 1)
+	} else {
+		out = out[:len(out)-1]
+	}
+
+	if len(out) >= len(src) {
+		return nil, false
+	}
+	return out, true
+}
+
+func lzfHash(b []byte) int {
+	v := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	return int((v * 2654435761) >> (32 - lzfHashLog))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+var MigrateCommand = Command{"migrate", migrate, CmdWrite}
+var AskingCommand = Command{"asking", asking, CmdLoading | CmdStale}
+
+// migrateArgs is MIGRATE host port key|"" destination-db timeout [COPY]
+// [REPLACE] [AUTH password | AUTH2 username password] [KEYS key...]
+type migrateArgs struct {
+	addr    string
+	keys    []string
+	timeout time.Duration
+	copy    bool     // leave our keys where they are
+	replace bool     // overwrite the keys on the target
+	auth    []string // sent to the target before the keys, when it wants a password
+}
+
+func parseMigrate(args []RespValue) (migrateArgs, error) {
+	var m migrateArgs
+	if len(args) < 5 {
+		return m, errors.New("ERR wrong number of arguments for 'migrate' command")
+	}
+	m.addr = net.JoinHostPort(args[0].String(), args[1].String())
+	// there's only the one database, on both ends.
+	if db, e := strconv.Atoi(args[3].String()); e != nil || db != 0 {
+		return m, errors.New("ERR DB index is out of range")
+	}
+	ms, e := strconv.Atoi(args[4].String())
+	if e != nil {
+		return m, errors.New("ERR value is not an integer or out of range")
+	}
+	if ms <= 0 {
+		ms = 1000
+	}
+	m.timeout = time.Duration(ms) * time.Millisecond
+
+	for i := 5; i < len(args); i++ {
+		switch opt := args[i].ToLower(); {
+		case opt == "copy":
+			m.copy = true
+		case opt == "replace":
+			m.replace = true
+		case opt == "auth" && i+1 < len(args):
+			m.auth = []string{"AUTH", args[i+1].String()}
+			i++
+		case opt == "auth2" && i+2 < len(args):
+			m.auth = []string{"AUTH", args[i+1].String(), args[i+2].String()}
+			i += 2
+		case opt == "keys":
+			if args[2].String() != "" {
+				return m, errors.New("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			m.keys = everyKey(args[i+1:])
+			i = len(args)
+		default:
+			return m, errors.New("ERR syntax error")
+		}
+	}
+	if m.keys == nil {
+		m.keys = []string{args[2].String()}
+	}
+	return m, nil
+}
+
+func migrateKeys(args []RespValue) []string {
+	m, e := parseMigrate(args)
+	if e != nil {
+		return nil
+	}
+	return m.keys
+}
+
+// migrate moves keys to another node: they're restored there from their
+// DUMP payload, and only once it says it has them are they deleted here.
+// Exec is held throughout, so nobody sees a key on both nodes or on
+// neither, and nobody writes to one that's on its way.
+func migrate(ctx RequestContext, args []RespValue) {
+	m, e := parseMigrate(args)
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	restoreCmd := "RESTORE"
+	if ctx.Cluster != nil {
+		// the target is still importing the slot, it won't take it otherwise.
+		restoreCmd = "RESTORE-ASKING"
+	}
+
+	// the keys that have already gone, or expired, are left out.
+	var keys []string
+	var pipeline []byte
+	if m.auth != nil {
+		pipeline, _ = RespValue{Array, bulkStrings(m.auth...)}.Serialize()
+	}
+	for _, key := range m.keys {
+		value, expiry, exists := ctx.liveValue(key)
+		if !exists {
+			continue
+		}
+		payload, e := ctx.dumpPayload(value)
+		if e != nil {
+			ctx.SendError("ERR " + e.Error())
+			return
+		}
+		ttl := int64(0)
+		if expiry != nil {
+			ttl = max(time.Until(*expiry).Milliseconds(), 1)
+		}
+		restore := bulkStrings(restoreCmd, key, strconv.FormatInt(ttl, 10), string(payload))
+		if m.replace {
+			restore = append(restore, RespValue{BulkString, []byte("REPLACE")})
+		}
+		cmd, _ := RespValue{Array, restore}.Serialize()
+		pipeline = append(pipeline, cmd...)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		ctx.SendSimpleString("NOKEY")
+		return
+	}
+
+	conn, e := net.DialTimeout("tcp", m.addr, m.timeout)
+	if e != nil {
+		ctx.SendError("IOERR error or timeout connecting to the client")
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(m.timeout))
+	if _, e := conn.Write(pipeline); e != nil {
+		ctx.SendError("IOERR error or timeout writing to target instance")
+		return
+	}
+
+	pr := NewProtocolReader(conn, &RespParser{})
+	if m.auth != nil {
+		reply, e := pr.ReadProto()
+		if e != nil {
+			ctx.SendError("IOERR error or timeout reading to target instance")
+			return
+		}
+		if reply.Type == SimpleError {
+			ctx.SendError("ERR Target instance replied with error: " + reply.String())
+			return
+		}
+	}
+	// each key the target has is deleted as soon as we know it has it, if
+	// the rest never answer they're still here.
+	var targetErr, ioErr string
+	moved := []string{"DEL"}
+	for _, key := range keys {
+		conn.SetDeadline(time.Now().Add(m.timeout))
+		reply, e := pr.ReadProto()
+		if e != nil {
+			ioErr = "IOERR error or timeout reading to target instance"
+			break
+		}
+		if reply.Type == SimpleError {
+			if targetErr == "" {
+				targetErr = "ERR Target instance replied with error: " + reply.String()
+			}
+			continue
+		}
+		if !m.copy {
+			ctx.ExpiryStore.Delete(key)
+			ctx.KVStore.Delete(key)
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) > 1 {
+		ctx.Propagate(bulkStrings(moved...))
+	}
+
+	switch {
+	case ioErr != "":
+		ctx.SendError(ioErr)
+	case targetErr != "":
+		ctx.SendError(targetErr)
+	default:
+		ctx.SendSimpleString("OK")
+	}
+}
+
+// asking is ASKING, sent by a client that's been redirected with ASK. The
+// command after it is run here even if its slot is still being imported.
+func asking(ctx RequestContext, args []RespValue) {
+	if ctx.Cluster == nil {
+		ctx.SendError("ERR This instance has cluster support disabled")
+		return
+	}
+	if len(args) != 0 {
+		ctx.SendError("ERR wrong number of arguments for 'asking' command")
+		return
+	}
+	if ctx.Client != nil {
+		ctx.Client.asking = true
+	}
+	ctx.SendSimpleString("OK")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var ErrNestedMulti = errors.New("ERR MULTI calls can not be nested")
+var ErrExecAbort = errors.New("EXECABORT Transaction discarded because of previous errors.")
+var ErrNotInMulti = errors.New("ERR Command not allowed inside a transaction")
+
+var MultiCommand = Command{"multi", multi, CmdLoading | CmdStale | CmdNoScript}
+
+// EXEC takes Exec itself, once it knows whether the transaction writes.
+var ExecCommand = Command{"exec", exec, CmdLoading | CmdStale | CmdBlocking | CmdNoScript}
+var DiscardCommand = Command{"discard", discard, CmdLoading | CmdStale | CmdNoScript}
+
+// the commands that act on a transaction rather than being queued in it.
+var transactionCommands = map[string]bool{"multi": true, "exec": true, "discard": true, "watch": true}
+
+// multi is MULTI, the client's commands are queued from now on, and run
+// together by EXEC with nobody else's in between.
+func multi(ctx RequestContext, args []RespValue) {
+	if e := checkArity("multi", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	if ctx.Client == nil {
+		ctx.SendError(ErrNotInMulti.Error())
+		return
+	}
+	if ctx.Client.tx != nil {
+		ctx.SendError(ErrNestedMulti.Error())
+		return
+	}
+	ctx.Client.tx = &transaction{}
+	ctx.SendSimpleString("OK")
+}
+
+// queue adds a command to a transaction. Whatever can be checked without
+// running it is checked now, and a command that would be refused whatever
+// the data is refuses the whole transaction.
+func queue(ctx RequestContext, tx *transaction, cmd Command, args []RespValue) {
+	ctx.Client.takeAsking()
+	e := checkArity(cmd.Name, args)
+	if e == nil && cmd.Flags&CmdBlocking != 0 {
+		e = ErrNotInMulti
+	}
+	if e == nil && ctx.Loading.Active() && cmd.Flags&CmdLoading == 0 {
+		e = ErrLoading
+	}
+	if e == nil && !ctx.FromMaster {
+		e = ctx.Repl.Allows(ctx.Config, cmd.Flags)
+	}
+	if e != nil {
+		tx.aborted = true
+		ctx.SendError(e.Error())
+		return
+	}
+	tx.commands = append(tx.commands, queuedCommand{cmd, args})
+	ctx.SendSimpleString("QUEUED")
+}
+
+// exec is EXEC, it runs the queued commands with Exec held throughout and
+// replies with an array of their replies. Their writes are propagated
+// between a MULTI and an EXEC, so replicas and the aof apply all of them
+// or none. If a key the client WATCHed has changed none of them run, and
+// the reply is a null array.
+func exec(ctx RequestContext, args []RespValue) {
+	if e := checkArity("exec", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	tx := ctx.Client.queueing()
+	if tx == nil {
+		ctx.SendError("ERR EXEC without MULTI")
+		return
+	}
+	ctx.Client.tx = nil
+	// whether it runs or not, the watches were for this EXEC.
+	defer ctx.unwatchAll()
+	if tx.aborted {
+		ctx.SendError(ErrExecAbort.Error())
+		return
+	}
+
+	writes := false
+	var keys []string
+	for _, q := range tx.commands {
+		writes = writes || q.cmd.Flags&CmdWrite != 0
+		if keysOf, keyed := commandKeys[q.cmd.Name]; keyed {
+			keys = append(keys, keysOf(q.args)...)
+		}
+	}
+	if !ctx.InExec {
+		if e := lockExec(ctx, true); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		// like any other write, it waits to see which side of a failover
+		// we end up on.
+		for writes && !ctx.FromMaster {
+			paused := ctx.Repl.WritesPaused()
+			if paused == nil {
+				break
+			}
+			ctx.Exec.Unlock()
+			<-paused
+			if e := lockExec(ctx, true); e != nil {
+				ctx.SendError(e.Error())
+				return
+			}
+		}
+		defer ctx.Exec.Unlock()
+	}
+	// things may have changed since the commands were queued, and they run
+	// as a whole or not at all.
+	if !ctx.FromMaster {
+		for _, q := range tx.commands {
+			if e := ctx.Repl.Allows(ctx.Config, q.cmd.Flags); e != nil {
+				ctx.SendError("EXECABORT Transaction discarded because of: " + e.Error())
+				return
+			}
+		}
+		if ctx.Cluster != nil {
+			if e := ctx.Cluster.Redirect(keys, false, ctx.liveKey); e != nil {
+				ctx.SendError(e.Error())
+				return
+			}
+		}
+	}
+	if ctx.watchedKeyChanged() {
+		ctx.SendResp(RespValue{NullArray, nil})
+		return
+	}
+
+	var out bytes.Buffer
+	inner := ctx
+	inner.Connection, inner.InExec = &out, true
+	tx.running = true
+	ctx.Client.tx = tx
+	for _, q := range tx.commands {
+		q.cmd.Call(inner, q.args)
+	}
+	ctx.Client.tx = nil
+	if tx.propagated {
+		ctx.Propagate(bulkStrings("EXEC"))
+	}
+	reply := fmt.Appendf(nil, "*%d\r\n", len(tx.commands))
+	ctx.Connection.Write(append(reply, out.Bytes()...))
+}
+
+// discard is DISCARD, it drops the queued commands.
+func discard(ctx RequestContext, args []RespValue) {
+	if e := checkArity("discard", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	if ctx.Client.queueing() == nil {
+		ctx.SendError("ERR DISCARD without MULTI")
+		return
+	}
+	ctx.Client.tx = nil
+	ctx.unwatchAll()
+	ctx.SendSimpleString("OK")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMulti(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(nil)
+	ctx.Client = NewClient()
+
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"EXEC"}, "-ERR EXEC without MULTI\r\n"},
+		{[]string{"DISCARD"}, "-ERR DISCARD without MULTI\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"MULTI"}, "-ERR MULTI calls can not be nested\r\n"},
+		{[]string{"SET", "a", "1"}, "+QUEUED\r\n"},
+		{[]string{"GET", "a"}, "+QUEUED\r\n"},
+		{[]string{"DEL", "a", "b"}, "+QUEUED\r\n"},
+		{[]string{"SET", "b", "2"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*4\r\n+OK\r\n$1\r\n1\r\n:1\r\n+OK\r\n"},
+
+		// errors at run time don't stop the rest.
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "a", "1", "PX", "soon"}, "+QUEUED\r\n"},
+		{[]string{"SET", "a", "3"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*2\r\n-strconv.Atoi: parsing \"soon\": invalid syntax\r\n+OK\r\n"},
+
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "a", "x"}, "+QUEUED\r\n"},
+		{[]string{"DISCARD"}, "+OK\r\n"},
+		{[]string{"GET", "a"}, "$1\r\n3\r\n"},
+
+		// ones that can't be queued throw the whole transaction away.
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "a", "x"}, "+QUEUED\r\n"},
+		{[]string{"NOSUCHCOMMAND"}, "-" + ErrRouteNotSupported("NOSUCHCOMMAND").Error() + "\r\n"},
+		{[]string{"EXEC"}, "-" + ErrExecAbort.Error() + "\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{[]string{"WAIT", "0", "0"}, "-" + ErrNotInMulti.Error() + "\r\n"},
+		{[]string{"EXEC"}, "-" + ErrExecAbort.Error() + "\r\n"},
+		{[]string{"GET", "a"}, "$1\r\n3\r\n"},
+	} {
+		if reply := clusterDo(router, ctx, test.args...); reply != test.want {
+			t.Fatalf("%v: expected %q, got %q", test.args, test.want, reply)
+		}
+	}
+}
+
+func TestMultiPropagation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "appendonlydir")
+	aof, e := NewAppendOnlyFile(dir, "appendonly.aof", AppendFsyncAlways)
+	if e != nil {
+		t.Fatal(e)
+	}
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(aof)
+	ctx.Client = NewClient()
+	if e := aof.Open(ctx.Server); e != nil {
+		t.Fatal(e)
+	}
+	for _, args := range [][]string{{"MULTI"}, {"GET", "a"}, {"SET", "a", "1"}, {"SET", "a", "2"}, {"EXEC"}} {
+		clusterDo(router, ctx, args...)
+	}
+	// a transaction that doesn't write leaves nothing behind.
+	for _, args := range [][]string{{"MULTI"}, {"GET", "a"}, {"EXEC"}} {
+		clusterDo(router, ctx, args...)
+	}
+	aof.Close()
+
+	path := lastIncr(t, aof)
+	logged, _ := os.ReadFile(path)
+	want := "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n2\r\n*1\r\n$4\r\nEXEC\r\n"
+	if string(logged) != want {
+		t.Fatalf("expected the writes between MULTI and EXEC, got %q", logged)
+	}
+
+	// a crash part way through logging one leaves it out.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n1\r\n")
+	f.Close()
+	if _, e := aof.Load(router, newTestContext(nil), false); e == nil {
+		t.Fatal("expected the unfinished transaction to be refused")
+	}
+	replayed := newTestContext(aof)
+	if _, e := aof.Load(router, replayed, true); e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := replayed.KVStore.Get("a"); v.String() != "2" {
+		t.Fatalf("expected a=2, got %q", v.String())
+	}
+	if _, exists := replayed.KVStore.Get("b"); exists {
+		t.Fatal("expected the unfinished transaction to be left out")
+	}
+
+	// and it's closed off, so what's appended after it isn't taken as part of it.
+	replayed.Loading.Finish()
+	if e := aof.Open(replayed.Server); e != nil {
+		t.Fatal(e)
+	}
+	router.Route(replayed, bulkStrings("SET", "c", "1"))
+	aof.Close()
+	again := newTestContext(nil)
+	if _, e := aof.Load(router, again, false); e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := again.KVStore.Get("c"); v.String() != "1" {
+		t.Fatalf("expected c=1 after the discarded transaction, got %q", v.String())
+	}
+	if logged, _ := os.ReadFile(lastIncr(t, aof)); !strings.Contains(string(logged), "DISCARD") {
+		t.Fatal("expected the transaction to be discarded in the log")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(nil)
+	ctx.Client = NewClient()
+	other := ctx
+	other.Client = NewClient()
+
+	for _, test := range []struct {
+		ctx  RequestContext
+		args []string
+		want string
+	}{
+		{ctx, []string{"SET", "a", "1"}, "+OK\r\n"},
+		{ctx, []string{"WATCH", "a", "b"}, "+OK\r\n"},
+		{ctx, []string{"MULTI"}, "+OK\r\n"},
+		{ctx, []string{"WATCH", "c"}, "-" + ErrWatchInMulti.Error() + "\r\n"},
+		{ctx, []string{"SET", "a", "2"}, "+QUEUED\r\n"},
+		{other, []string{"SET", "b", "x"}, "+OK\r\n"},
+		{ctx, []string{"EXEC"}, "*-1\r\n"},
+		{ctx, []string{"GET", "a"}, "$1\r\n1\r\n"},
+
+		// EXEC released the watches.
+		{ctx, []string{"MULTI"}, "+OK\r\n"},
+		{ctx, []string{"SET", "a", "2"}, "+QUEUED\r\n"},
+		{other, []string{"SET", "b", "y"}, "+OK\r\n"},
+		{ctx, []string{"EXEC"}, "*1\r\n+OK\r\n"},
+
+		// as do UNWATCH and DISCARD.
+		{ctx, []string{"WATCH", "a"}, "+OK\r\n"},
+		{ctx, []string{"UNWATCH"}, "+OK\r\n"},
+		{other, []string{"SET", "a", "3"}, "+OK\r\n"},
+		{ctx, []string{"MULTI"}, "+OK\r\n"},
+		{ctx, []string{"GET", "a"}, "+QUEUED\r\n"},
+		{ctx, []string{"EXEC"}, "*1\r\n$1\r\n3\r\n"},
+		{ctx, []string{"WATCH", "a"}, "+OK\r\n"},
+		{ctx, []string{"MULTI"}, "+OK\r\n"},
+		{ctx, []string{"DISCARD"}, "+OK\r\n"},
+		{other, []string{"DEL", "a"}, ":1\r\n"},
+		{ctx, []string{"MULTI"}, "+OK\r\n"},
+		{ctx, []string{"EXEC"}, "*0\r\n"},
+
+		// a write that changes nothing isn't a change.
+		{ctx, []string{"WATCH", "a"}, "+OK\r\n"},
+		{other, []string{"DEL", "a"}, ":0\r\n"},
+		{ctx, []string{"MULTI"}, "+OK\r\n"},
+		{ctx, []string{"EXEC"}, "*0\r\n"},
+
+		// a flush is.
+		{ctx, []string{"WATCH", "nothing"}, "+OK\r\n"},
+		{other, []string{"FLUSHALL"}, "+OK\r\n"},
+		{ctx, []string{"MULTI"}, "+OK\r\n"},
+		{ctx, []string{"EXEC"}, "*-1\r\n"},
+	} {
+		if reply := clusterDo(router, test.ctx, test.args...); reply != test.want {
+			t.Fatalf("%v: expected %q, got %q", test.args, test.want, reply)
+		}
+	}
+
+	// a key that expires while it's watched has changed, even if nobody has
+	// noticed it expire.
+	router.Route(ctx, bulkStrings("SET", "e", "1", "PX", "10"))
+	clusterDo(router, ctx, "WATCH", "e")
+	time.Sleep(20 * time.Millisecond)
+	clusterDo(router, ctx, "MULTI")
+	if reply := clusterDo(router, ctx, "EXEC"); reply != "*-1\r\n" {
+		t.Fatalf("expected the expiry to fail the transaction, got %q", reply)
+	}
+	if n := len(ctx.Watches.keys); n != 0 {
+		t.Fatalf("expected every watch to be released, %d are left", n)
+	}
+
+	// and so does disconnecting.
+	ctx.Router = router
+	port := startTestServer(t, ctx)
+	conn, e := net.Dial("tcp", "127.0.0.1:"+port)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cmd, _ := RespValue{Array, bulkStrings("WATCH", "a")}.Serialize()
+	conn.Write(cmd)
+	if reply, e := NewProtocolReader(conn, &RespParser{}).ReadProto(); e != nil || reply.String() != "OK" {
+		t.Fatalf("expected OK, got %q %v", reply.String(), e)
+	}
+	conn.Close()
+	waitFor(t, "the watch to be released", func() bool {
+		ctx.Watches.lock.Lock()
+		defer ctx.Watches.lock.Unlock()
+		return len(ctx.Watches.keys) == 0
+	})
+}
@@ -22,11 +22,14 @@ const ReadChunkSize = 4096 // Amount of data to read each time from the io.Reade
 // ProtocolReader wraps an io.Reader and uses a ProtoParser to extract complete messages.
 // It internally uses a bytes.Buffer to accumulate data between reads.
 type ProtocolReader[T any] struct {
-	r    io.Reader
-	pp   ProtoParser[T]
-	buf  []byte
-	head int
-	err  error // persistent error from the underlying reader (if any)
+	r        io.Reader
+	pp       ProtoParser[T]
+	buf      []byte
+	head     int
+	err      error // persistent error from the underlying reader (if any)
+	consumed int64 // total bytes handed out as parsed messages
+	keepRaw  bool
+	raw      []byte // the bytes of the last message, when keepRaw is set
 }
 
 // NewProtocolReader returns a new ProtocolReader.
@@ -40,6 +43,24 @@ func NewProtocolReader[T any](r io.Reader, pp ProtoParser[T]) *ProtocolReader[T]
 	}
 }
 
+// Consumed is the number of bytes making up the messages returned so far.
+func (pr *ProtocolReader[T]) Consumed() int64 {
+	return pr.consumed
+}
+
+// KeepRaw makes the reader hold on to the bytes of each message it returns,
+// for callers that pass messages on exactly as they came.
+func (pr *ProtocolReader[T]) KeepRaw() *ProtocolReader[T] {
+	pr.keepRaw = true
+	return pr
+}
+
+// Raw is the bytes the last message was parsed from, it's only valid until
+// the next ReadProto.
+func (pr *ProtocolReader[T]) Raw() []byte {
+	return pr.raw
+}
+
 // ReadProto attempts to parse and return a complete message of type T from the stream.
 func (pr *ProtocolReader[T]) ReadProto() (T, error) {
 	var none T
@@ -54,18 +75,27 @@ func (pr *ProtocolReader[T]) ReadProto() (T, error) {
 		msg, size, parseErr := pr.pp.TryParse(pr.buf[:pr.head])
 		if parseErr == nil {
 			// Successfully parsed a message.
+			if pr.keepRaw {
+				pr.raw = append(pr.raw[:0], pr.buf[:size]...)
+			}
 			// Remove the consumed bytes from the buffer.
 			left := pr.head - size
 			if left != 0 {
 				copy(pr.buf, pr.buf[size:pr.head])
 			}
 			pr.head = left
+			pr.consumed += int64(size)
 			return msg, nil
 		} else if parseErr != ErrIncompleteStream {
 			// A genuine parsing error occurred.
 			return none, parseErr
 		}
 
+		// The stream has ended part way through a message, it will never complete.
+		if pr.err != nil {
+			return none, ErrStreamClosed
+		}
+
 		// expand if needed
 		if pr.head == len(pr.buf) {
 			tmp := make([]byte, (len(pr.buf)*2)+1)
@@ -1,6 +1,6 @@
 package main
 
-var PingCommand = Command{"ping", ping}
+var PingCommand = Command{"ping", ping, 0}
 
 func ping(ctx RequestContext, args []RespValue) {
 	ctx.SendSimpleString("PONG")
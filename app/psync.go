@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var PsyncCommand = Command{"psync", psync, 0}
+var ReplConfCommand = Command{"replconf", replconf, CmdLoading | CmdStale}
+
+// a replica asks with FAILOVER to hand us its role, see the FAILOVER command.
+var PsyncArgsParser = NewArgumentsParser().NumPositionals(2).Argument(ArgDef{"failover", false, false})
+
+// a replica that falls this far behind is dropped, it will have to resync.
+const replicaBufferLimit = 256 << 20
+
+// the states of a replica, as INFO reports them.
+const (
+	ReplicaStateWaitBgsave = "wait_bgsave" // we're writing the rdb it will be sent
+	ReplicaStateSendBulk   = "send_bulk"   // the rdb is being sent
+	ReplicaStateOnline     = "online"      // it's being streamed writes
+)
+
+// psync doesn't take the write lock, sharing Exec is enough to keep writes
+// out while the replica is attached and the snapshot for it is taken.
+func psync(ctx RequestContext, args []RespValue) {
+	parsedArgs, e := PsyncArgsParser.Parse(args)
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	conn, isConn := ctx.Connection.(net.Conn)
+	if !isConn {
+		ctx.SendError("ERR PSYNC needs a client connection")
+		return
+	}
+	replid := parsedArgs.GetPos(0).String()
+	offset, e := strconv.ParseInt(parsedArgs.GetPos(1).String(), 10, 64)
+	if e != nil {
+		offset = -1
+	}
+	if _, failover := parsedArgs.GetArg("failover"); failover {
+		// our master is handing over to us, it carries on as our replica.
+		if ourID, _ := ctx.Repl.ReplID(); replid != ourID {
+			ctx.SendError("ERR PSYNC FAILOVER replid must match my replid.")
+			return
+		}
+		fmt.Println("[repl] failover requested by", conn.RemoteAddr(), "taking over as master")
+		ctx.Repl.Detach()
+		ctx.Config.Set("replicaof", "")
+	}
+	// replicas of replicas get their master's stream, which only makes sense while it's coming.
+	if link := ctx.Repl.Master(); link != nil && link.State() != ReplStateConnected {
+		ctx.SendError("NOMASTERLINK Can't SYNC while not connected with my master")
+		return
+	}
+
+	replica, at, partial := ctx.Repl.Attach(conn, replid, offset, replBacklogSize(ctx.Config))
+	ourID, _ := ctx.Repl.ReplID()
+	if partial {
+		fmt.Println("[repl] partial resync of", conn.RemoteAddr(), "from offset", offset)
+		ctx.SendSimpleString("CONTINUE " + ourID)
+		go replica.run(ctx.Repl, ctx.Config, nil)
+		return
+	}
+
+	// streamed transfers reply once they start, with the offset they start from.
+	if disklessSyncEnabled(ctx.Config) {
+		fmt.Println("[repl] full resync of", conn.RemoteAddr(), "queued for a transfer over the socket")
+		ctx.Repl.QueueDiskless(ctx.Server, replica)
+		return
+	}
+	fmt.Println("[repl] full resync of", conn.RemoteAddr(), "at offset", at)
+	ctx.SendSimpleString(fmt.Sprintf("FULLRESYNC %s %d", ourID, at))
+	snapshot := ctx.Dataset().Snapshot()
+	go replica.run(ctx.Repl, ctx.Config, func() error {
+		return replica.sendRDB(ctx.Config, snapshot, ourID, at)
+	})
+}
+
+// replconf is how replicas tell us about themselves during the handshake,
+// and, once they're attached, how far they've got.
+func replconf(ctx RequestContext, args []RespValue) {
+	if len(args)%2 != 0 {
+		ctx.SendError("ERR syntax error")
+		return
+	}
+	for i := 0; i < len(args); i += 2 {
+		option, value := args[i].ToLower(), args[i+1].String()
+		switch option {
+		case "listening-port":
+			if _, e := strconv.ParseUint(value, 10, 16); e != nil {
+				ctx.SendError("ERR value is not an integer or out of range")
+				return
+			}
+			ctx.Repl.Handshake(ctx.Connection, value)
+		case "capa", "ip-address":
+			// we can only stream one rdb format, and report addresses as we see them.
+		case "ack":
+			// acks are never replied to, the reply would end up in the replica's stream.
+			if offset, e := strconv.ParseInt(value, 10, 64); e == nil {
+				ctx.Repl.Ack(ctx.Connection, offset)
+			}
+			return
+		default:
+			ctx.SendError(fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", args[i].String()))
+			return
+		}
+	}
+	ctx.SendSimpleString("OK")
+}
+
+// ReplicaConn is a replica as the master sees it. Writes are queued by Send
+// and written out by the replica's own goroutine, so one slow replica never
+// holds up the master.
+type ReplicaConn struct {
+	conn net.Conn
+	port string
+
+	lock      sync.Mutex
+	wake      *sync.Cond
+	pending   []byte
+	closed    bool
+	held      bool // not fed writes yet, its snapshot hasn't been taken
+	waitAck   bool // loading what it was sent, the stream starts once it acks
+	state     string
+	ackOffset int64
+	ackTime   time.Time
+}
+
+func NewReplicaConn(conn net.Conn, port string, offset int64) *ReplicaConn {
+	rc := &ReplicaConn{conn: conn, port: port, state: ReplicaStateWaitBgsave, ackOffset: offset, ackTime: time.Now()}
+	rc.wake = sync.NewCond(&rc.lock)
+	return rc
+}
+
+// Send queues p to be written to the replica.
+func (rc *ReplicaConn) Send(p []byte) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.closed || rc.held {
+		return
+	}
+	if len(rc.pending)+len(p) > replicaBufferLimit {
+		fmt.Println("[repl] dropping replica", rc.conn.RemoteAddr(), "it's too far behind")
+		rc.close()
+		return
+	}
+	rc.pending = append(rc.pending, p...)
+	rc.wake.Signal()
+}
+
+// Ack records how much of the stream the replica has applied.
+func (rc *ReplicaConn) Ack(offset int64) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.ackOffset, rc.ackTime = offset, time.Now()
+	if rc.waitAck {
+		rc.waitAck = false
+		rc.wake.Broadcast()
+	}
+}
+
+// Hold stops the replica being fed writes until Resume.
+func (rc *ReplicaConn) Hold() {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.held = true
+}
+
+// Resume feeds the replica writes from offset on. An rdb streamed over the
+// socket has no length, so the replica can't tell where it ends and the
+// stream begins, with waitAck the stream waits until it acks having loaded it.
+func (rc *ReplicaConn) Resume(offset int64, waitAck bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.held, rc.waitAck = false, waitAck
+	rc.ackOffset, rc.ackTime = offset, time.Now()
+	rc.state = ReplicaStateSendBulk
+}
+
+func (rc *ReplicaConn) AckOffset() int64 {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.ackOffset
+}
+
+// Online is whether the replica has been sent the dataset and is being streamed writes.
+func (rc *ReplicaConn) Online() bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.state == ReplicaStateOnline
+}
+
+// Good is whether the replica is online and has acked within maxLag.
+func (rc *ReplicaConn) Good(maxLag time.Duration) bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.state == ReplicaStateOnline && time.Since(rc.ackTime) <= maxLag
+}
+
+func (rc *ReplicaConn) Close() {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.close()
+}
+
+func (rc *ReplicaConn) close() {
+	if rc.closed {
+		return
+	}
+	rc.closed = true
+	rc.conn.Close()
+	rc.wake.Broadcast()
+}
+
+func (rc *ReplicaConn) setState(state string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.state = state
+}
+
+// Addr is where the replica serves clients, its outgoing port is only used
+// when it didn't tell us its listening port.
+func (rc *ReplicaConn) Addr() (string, string) {
+	ip, port, _ := net.SplitHostPort(rc.conn.RemoteAddr().String())
+	if rc.port != "" {
+		port = rc.port
+	}
+	return ip, port
+}
+
+// Info is the replica's line in INFO replication.
+func (rc *ReplicaConn) Info() string {
+	ip, port := rc.Addr()
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return fmt.Sprintf("ip=%s,port=%s,state=%s,offset=%d,lag=%d",
+		ip, port, rc.state, rc.ackOffset, int(time.Since(rc.ackTime).Seconds()))
+}
+
+// run sends the replica the dataset when it needs a full sync, then streams
+// it writes until it goes away.
+func (rc *ReplicaConn) run(repl *Replication, config *SharedRWStore[string], fullSync func() error) {
+	defer repl.remove(rc)
+	if fullSync != nil {
+		if e := fullSync(); e != nil {
+			fmt.Println("[repl] full sync of", rc.conn.RemoteAddr(), "failed", e)
+			return
+		}
+	}
+	rc.setState(ReplicaStateOnline)
+	for {
+		rc.lock.Lock()
+		for (len(rc.pending) == 0 || rc.waitAck) && !rc.closed {
+			rc.wake.Wait()
+		}
+		if rc.closed {
+			rc.lock.Unlock()
+			return
+		}
+		out := rc.pending
+		rc.pending = nil
+		rc.lock.Unlock()
+
+		rc.conn.SetWriteDeadline(time.Now().Add(replTimeout(config)))
+		if _, e := rc.conn.Write(out); e != nil {
+			fmt.Println("[repl] lost replica", rc.conn.RemoteAddr(), e)
+			return
+		}
+	}
+}
+
+// sendRDB writes snapshot to a temp rdb file and sends it to the replica as
+// a bulk string. Writing the file can take a while, the replica is sent
+// newlines meanwhile so it knows we're still here.
+func (rc *ReplicaConn) sendRDB(config *SharedRWStore[string], snapshot RevivedDB, replid string, offset int64) error {
+	dir, _ := config.Get("dir")
+	compression, _ := config.Get("rdbcompression")
+	checksum, _ := config.Get("rdbchecksum")
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		snapshot.Release()
+		return e
+	}
+	f, e := os.CreateTemp(dir, "temp-repl-*.rdb")
+	if e != nil {
+		snapshot.Release()
+		return e
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		defer snapshot.Release()
+		rw := NewRDBFileWriter(f).Compression(compression == "yes").Checksum(checksum == "yes")
+		written <- writeRDBSnapshot(rw, snapshot, "repl-id", replid, "repl-offset", strconv.FormatInt(offset, 10))
+	}()
+	keepalive := time.NewTicker(time.Second)
+	defer keepalive.Stop()
+	for waiting := true; waiting; {
+		select {
+		case e = <-written:
+			waiting = false
+		case <-keepalive.C:
+			if _, writeErr := rc.conn.Write([]byte("\n")); writeErr != nil {
+				<-written
+				return writeErr
+			}
+		}
+	}
+	if e != nil {
+		return e
+	}
+
+	rc.setState(ReplicaStateSendBulk)
+	stat, e := f.Stat()
+	if e != nil {
+		return e
+	}
+	if _, e := f.Seek(0, io.SeekStart); e != nil {
+		return e
+	}
+	rc.conn.SetWriteDeadline(time.Now().Add(replTimeout(config)))
+	if _, e := rc.conn.Write([]byte(fmt.Sprintf("$%d\r\n", stat.Size()))); e != nil {
+		return e
+	}
+	_, e = io.Copy(deadlineWriter{rc.conn, replTimeout(config)}, f)
+	return e
+}
+
+// deadlineWriter pushes the connection's write deadline back on every write,
+// so a big transfer only times out when the other end stops reading.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (dw deadlineWriter) Write(p []byte) (int, error) {
+	dw.conn.SetWriteDeadline(time.Now().Add(dw.timeout))
+	return dw.conn.Write(p)
+}
+
+// replBacklogSize is repl-backlog-size in bytes.
+func replBacklogSize(config *SharedRWStore[string]) int {
+	size, _ := config.Get("repl-backlog-size")
+	bytes, e := ParseMemorySize(size)
+	if e != nil || bytes <= 0 {
+		bytes = 1 << 20
+	}
+	return int(bytes)
+}
+
+// replTimeout is how long either end of a replication link waits on the other.
+func replTimeout(config *SharedRWStore[string]) time.Duration {
+	timeout, _ := config.Get("repl-timeout")
+	seconds, e := strconv.Atoi(timeout)
+	if e != nil || seconds <= 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"regexp"
+	"strconv"
 	"time"
 )
 
@@ -17,6 +16,9 @@ import (
 // 0xFC	EXPIRETIMEMS	Expire time in milliseconds, see Key Expiry Timestamp
 // 0xFB	RESIZEDB		Hash table sizes for the main keyspace and expires, see Resizedb information
 // 0xFA	AUX				Auxiliary fields. Arbitrary key-value settings, see Auxiliary fields
+// 0xF9	FREQ			LFU access frequency of the key that follows
+// 0xF8	IDLE			LRU idle time in seconds of the key that follows
+// 0xF5	FUNCTION2		The code of a function library, see FUNCTION LOAD
 //
 // Value Encodings
 // 0x00 = String Encoding
@@ -30,6 +32,9 @@ import (
 // 0x0C = Sorted Set in Ziplist Encoding
 // 0x0D = Hashmap in Ziplist Encoding (Introduced in RDB version 4)
 // 0x0E = List in Quicklist encoding (Introduced in RDB version 7)
+//
+// Files from version 5 onwards end with an 8 byte little endian crc64 of
+// everything before it, a checksum of 0 means the writer had checksums disabled.
 
 const (
 	// op codes
@@ -39,6 +44,9 @@ const (
 	ExpireTimeMilli = 0xfc
 	ResizeDb        = 0xfb
 	Aux             = 0xfa
+	Freq            = 0xf9
+	Idle            = 0xf8
+	Function2       = 0xf5
 	// value types
 	StringEnc = 0x00
 	// todo: encode the other complex value types...
@@ -46,29 +54,65 @@ const (
 	LenEnc6Bit    = 0x00 // 00000000
 	LenEnc14Bit   = 0x40 // 01000000
 	LenEnc32Bit   = 0x80 // 10000000
+	LenEnc64Bit   = 0x81 // 10000001
 	LenEncSpecial = 0xc0 // 11000000
+	// special string encodings (the insignificant bits of a special length)
+	StrEncInt8  = 0
+	StrEncInt16 = 1
+	StrEncInt32 = 2
+	StrEncLZF   = 3
 	// Magic
 	MagicString   = "REDIS"
 	VersionStrLen = 4
+	// the first version to carry a checksum footer
+	ChecksumVersion = 5
 )
 
 var InvalidHead = errors.New("invlaid header trying to parse rdb dump file")
 var ExpectedStringKey = errors.New("encountered unexpected encoding, expected string key")
 
+// ErrRDBCorrupt pins a parse failure to the byte offset in the file where the
+// offending element begins.
+type ErrRDBCorrupt struct {
+	Offset int64
+	Err    error
+}
+
+func (e ErrRDBCorrupt) Error() string {
+	return fmt.Sprintf("corrupt rdb file at offset %d: %s", e.Offset, e.Err)
+}
+
+func (e ErrRDBCorrupt) Unwrap() error {
+	return e.Err
+}
+
+type ErrRDBChecksum struct {
+	Expected uint64
+	Computed uint64
+}
+
+func (e ErrRDBChecksum) Error() string {
+	return fmt.Sprintf("checksum mismatch, file says %016x but content hashes to %016x", e.Expected, e.Computed)
+}
+
 func isSpecial(l byte) bool {
 	return l&LenEncSpecial == LenEncSpecial
 }
 
 func is6BitLen(l byte) bool {
-	return l&LenEnc6Bit == LenEnc6Bit
+	return SigBits(l) == LenEnc6Bit
 }
 
 func is14BitLen(l byte) bool {
-	return l&LenEnc14Bit == LenEnc14Bit
+	return SigBits(l) == LenEnc14Bit
 }
 
 func is32BitLen(l byte) bool {
-	return l&LenEnc32Bit == LenEnc32Bit
+	return l == LenEnc32Bit
+}
+
+func is64BitLen(l byte) bool {
+	return l == LenEnc64Bit
 }
 
 func SigBits(l byte) byte {
@@ -81,13 +125,7 @@ func InsigBits(l byte) byte {
 
 func isOpCode(n byte) bool {
 	switch n {
-	case EOF:
-	case SelectDB:
-	case ExpireTimeSec:
-
-	case ExpireTimeMilli:
-	case ResizeDb:
-	case Aux:
+	case EOF, SelectDB, ExpireTimeSec, ExpireTimeMilli, ResizeDb, Aux, Freq, Idle:
 		return true
 	}
 	return false
@@ -95,356 +133,193 @@ func isOpCode(n byte) bool {
 
 func isExpiry(n byte) bool {
 	switch n {
-	case ExpireTimeSec:
-	case ExpireTimeMilli:
+	case ExpireTimeSec, ExpireTimeMilli:
 		return true
 	}
 	return false
 }
 
-type RDBFileParser struct {
-	handle   *os.File
-	r        *bufio.Reader
-	dbs      []RevivedDB
-	selector *RevivedDB
-}
-
 type RevivedDB struct {
-	DB     *SharedRWStore[RespValue]
-	Expiry *SharedRWStore[Timestamp]
+	DB        *SharedRWStore[RespValue]
+	Expiry    *SharedRWStore[Timestamp]
+	Functions *Functions // the function libraries, saved along with the keys
 }
 
 func NewRevivedDb() RevivedDB {
-	return RevivedDB{NewKVStore(), NewExpiryStore()}
+	return RevivedDB{NewKVStore(), NewExpiryStore(), NewFunctions()}
 }
 
-func NewRDBFileParser(path string) (*RDBFileParser, error) {
-	file, e := os.Open(path)
-	if e != nil {
-		return nil, e
-	}
-	dbs := make([]RevivedDB, 0)
-	return &RDBFileParser{file, bufio.NewReader(file), dbs, nil}, nil
+// Snapshot takes a copy on write snapshot of both stores, and a copy of the
+// function libraries. They are separate snapshots, so the caller has to keep
+// writes out while taking them if they need to agree with each other (the
+// server's Exec lock does this).
+func (db RevivedDB) Snapshot() RevivedDB {
+	return RevivedDB{db.DB.Snapshot(), db.Expiry.Snapshot(), db.Functions.Snapshot()}
 }
 
-func (rdb *RDBFileParser) Parse() ([]RevivedDB, error) {
-	headerErr, auxErr := rdb.parseHeader(), rdb.parseAuxFields()
-	if headerErr != nil {
-		fmt.Println(headerErr)
-		return nil, headerErr
-	}
-
-	if auxErr != nil {
-		fmt.Println(auxErr)
-		return nil, auxErr
-	}
-	rdb.parseBody()
-	return rdb.dbs, nil
+// Release lets go of a db returned by Snapshot.
+func (db RevivedDB) Release() {
+	db.DB.Release()
+	db.Expiry.Release()
 }
 
-// considered a noop, this will just print some info as it goes for now.
-func (rdb *RDBFileParser) parseHeader() error {
-	var b [len(MagicString) + VersionStrLen]byte
-	_, e := rdb.r.Read(b[:])
-	if e != nil {
-		fmt.Println(e)
-		return e
-	}
-	fmt.Printf("Header: %s\n", b)
-	if !validHeader(b[:]) {
-		return InvalidHead
-	}
-	return nil
+// RDBLoader is the visitor that turns a parsed rdb stream into dbs.
+type RDBLoader struct {
+	aux      map[string]string
+	dbs      []RevivedDB
+	selector *RevivedDB
+	keys     int64
 }
 
-func (rdb *RDBFileParser) parseAuxFields() error {
-	fmt.Println("Aux Fields Begin")
-	for {
-		next, err := rdb.r.ReadByte()
-		if err != nil {
-			return err
-		}
-		if next != Aux {
-			rdb.r.UnreadByte()
-			fmt.Println("Aux Fields End")
-			return nil
-		}
-		key, keyOk := rdb.parseString()
-		value, valueOk := rdb.parseString()
-
-		if keyOk != nil {
-			return keyOk
-		}
-
-		if valueOk != nil {
-			return valueOk
-		}
-
-		fmt.Println(key.String(), "=", value.String())
-	}
+func NewRDBLoader() *RDBLoader {
+	return &RDBLoader{map[string]string{}, make([]RevivedDB, 0), nil, 0}
 }
 
-func (rdb *RDBFileParser) parseBody() error {
-	for {
-		opCode, e := rdb.r.ReadByte()
-		if e != nil {
-			return e
-		}
-		switch opCode {
-		case EOF:
-			fmt.Println("eof encountered")
-			break
-		case SelectDB:
-			e := rdb.parseDbSelector()
-			if e != nil {
-				return e
-			}
-		case ExpireTimeSec:
-			e := rdb.parseExpirySec()
-			if e != nil {
-				return e
-			}
-		case ExpireTimeMilli:
-			e := rdb.parseExpiryMilliSec()
-			if e != nil {
-				return e
-			}
-		case ResizeDb:
-			e := rdb.parseResizeDb()
-			if e != nil {
-				return e
-			}
-		case Aux:
-			return nil
-		default:
-			k, v, e := rdb.parseKeyValue(opCode)
-			if e != nil {
-				return e
-			}
-			rdb.selector.DB.Set(k, v)
-		}
-	}
+// NewRDBLoaderInto loads into existing dbs, dbs[i] receives db number i.
+func NewRDBLoaderInto(dbs ...RevivedDB) *RDBLoader {
+	return &RDBLoader{map[string]string{}, dbs, nil, 0}
 }
 
-func (rdb *RDBFileParser) parseExpirySec() error {
-	expirySecs, expiryErr := rdb.readUint32(binary.LittleEndian)
-	if expiryErr != nil {
-		return expiryErr
-	}
-	expiryTime := time.Unix(int64(expirySecs), 0)
-	return rdb.parseExpiryWithTime(expiryTime)
+// Dbs returns the loaded dbs indexed by their db number, numbers that weren't
+// present in the stream are left as empty dbs.
+func (l *RDBLoader) Dbs() []RevivedDB {
+	return l.dbs
 }
 
-func (rdb *RDBFileParser) parseExpiryMilliSec() error {
-	expiryMilli, expiryErr := rdb.readUint64(binary.LittleEndian)
-	if expiryErr != nil {
-		return expiryErr
-	}
-	expirySecs := int64(expiryMilli / 1000)
-	expiryTime := time.Unix(expirySecs, 0)
+// Aux returns the auxiliary fields read so far.
+func (l *RDBLoader) Aux() map[string]string {
+	return l.aux
+}
 
-	return rdb.parseExpiryWithTime(expiryTime)
+// Keys is the number of keys stored so far.
+func (l *RDBLoader) Keys() int64 {
+	return l.keys
 }
 
-func (rdb *RDBFileParser) parseExpiryWithTime(expiryTime time.Time) error {
-	valEnc, valEncErr := rdb.r.ReadByte()
-	if valEncErr != nil {
-		return valEncErr
-	}
-	key, value, kvErr := rdb.parseKeyValue(valEnc)
-	if kvErr != nil {
-		return kvErr
-	}
-	rdb.selector.Expiry.Set(key, NewTimestampFromExpiry(expiryTime))
-	rdb.selector.DB.Set(key, value)
+func (l *RDBLoader) OnAux(key string, value string) error {
+	fmt.Println(key, "=", value)
+	l.aux[key] = value
 	return nil
 }
 
-func (rdb *RDBFileParser) parseKeyValue(valEnc byte) (string, RespValue, error) {
-	none := func(e error) (string, RespValue, error) { return "", RespValue{}, e }
-	switch valEnc {
-	case StringEnc:
-		key, keyErr := rdb.parseString()
-		if keyErr != nil {
-			return none(keyErr)
-		}
-		value, valErr := rdb.parseString()
-		if valErr != nil {
-			return none(valErr)
-		}
-		return key.String(), value, nil
-	default:
-		return none(errors.New(fmt.Sprintln("unsupported value type:", valEnc)))
-	}
+func (l *RDBLoader) OnSelectDB(index int) error {
+	fmt.Println("select db#", index)
+	l.selectDb(index)
+	return nil
 }
 
-func (rdb *RDBFileParser) parseDbSelector() error {
-	lenEnc, e := rdb.r.ReadByte()
-	if e != nil {
-		return e
-	}
-	// the only reason this should error is if its special encoding.
-	selector, specErr := rdb.readLengthEncodedInt(lenEnc)
-	if specErr != nil {
-		return specErr
-	}
-	fmt.Println("select db#", selector)
-	rdb.selectNewDb()
+func (l *RDBLoader) OnResizeDB(dbSize int, expirySize int) error {
+	fmt.Println("skipping db resize, would have made hash", dbSize, "and expiry", expirySize)
 	return nil
 }
 
-func (rdb *RDBFileParser) parseResizeDb() error {
-	n1, e1 := rdb.r.ReadByte()
-	if e1 != nil {
-		return e1
-	}
-	hashLen, hashLenErr := rdb.readLengthEncodedInt(n1)
-	if hashLenErr != nil {
-		return hashLenErr
+func (l *RDBLoader) OnKey(entry RDBEntry) error {
+	if entry.Expiry == nil {
+		l.selector.DB.Set(entry.Key, entry.Value)
+		l.keys++
+		return nil
 	}
 
-	n2, e2 := rdb.r.ReadByte()
-	if e2 != nil {
-		return e1
-	}
-	expiryLen, expiryLenErr := rdb.readLengthEncodedInt(n2)
-	if expiryLenErr != nil {
-		return expiryLenErr
+	ts := l.timestampFor(*entry.Expiry, entry.Idle)
+	if ts.Expired() {
+		// no point resurrecting keys that would never be readable.
+		return nil
 	}
-	fmt.Println("skipping db resize, would have made hash", hashLen, "and expiry", expiryLen)
+	l.selector.Expiry.Set(entry.Key, ts)
+	l.selector.DB.Set(entry.Key, entry.Value)
+	l.keys++
 	return nil
 }
 
-func (rdb *RDBFileParser) parseString() (RespValue, error) {
-	lenEnc, lenErr := rdb.r.ReadByte()
-	if lenErr != nil {
-		return RespValue{}, lenErr
+// OnFunction loads a library into the dataset, they aren't kept per db so
+// they go with db 0.
+func (l *RDBLoader) OnFunction(code string) error {
+	if len(l.dbs) == 0 {
+		l.selectDb(0)
 	}
-
-	if isSpecial(lenEnc) {
-		// handle integer types.
-		flag := InsigBits(lenEnc)
-		return rdb.parseSpecialString(flag)
-	}
-
-	return rdb.parseLengthPrefixedString(lenEnc)
-}
-
-func (rdb *RDBFileParser) parseLengthPrefixedString(lenEnc byte) (RespValue, error) {
-	decodedLen, _ := rdb.readLengthEncodedInt(lenEnc)
-	buf := make([]byte, decodedLen)
-	_, e := rdb.r.Read(buf)
-	return RespValue{BulkString, buf}, e
-}
-
-func (rdb *RDBFileParser) parseSpecialString(flag byte) (RespValue, error) {
-	// single byte if 6 bits is 0
-	var value int
-	var err error
-	switch flag {
-	case 0:
-		value, err = rdb.readInt8()
-	case 1:
-		value, err = rdb.readInt16(binary.LittleEndian)
-	case 2:
-		value, err = rdb.readInt32(binary.LittleEndian)
-	case 3:
-	default:
-		return RespValue{}, errors.New("compressed strings not implemented yet")
-	}
-	return RespValue{Integer, value}, err
+	_, e := l.dbs[0].Functions.Load(code, true)
+	return e
 }
 
-func (rdb *RDBFileParser) readInt8() (int, error) {
-	// single byte if 6 bits is 0
-	b, e := rdb.r.ReadByte()
-	return int(b), e
+func (l *RDBLoader) OnEnd(checksum uint64) error {
+	if checksum == 0 {
+		fmt.Println("rdb checksum is zero or missing, skipped verification")
+	}
+	fmt.Println("eof encountered")
+	return nil
 }
 
-func (rdb *RDBFileParser) readInt16(order binary.ByteOrder) (int, error) {
-	// single byte if 6 bits is 0
-	var buf [2]byte
-	_, e := rdb.r.Read(buf[:])
-	if e != nil {
-		return 0, e
+// the file doesn't record when keys were created, the best we know is that they
+// existed when the snapshot was taken (the ctime aux field), unless an idle time
+// tells us when they were last touched.
+func (l *RDBLoader) timestampFor(expiry time.Time, idle *time.Duration) Timestamp {
+	var snapshotTime time.Time
+	if ctime, e := strconv.ParseInt(l.aux["ctime"], 10, 64); e == nil {
+		snapshotTime = time.Unix(ctime, 0)
 	}
-	var b1, b2 int
-	if order == binary.LittleEndian {
-		b1, b2 = int(buf[1]), int(buf[0])
-	} else {
-		b1, b2 = int(buf[0]), int(buf[1])
+	lastTouched := snapshotTime
+	if idle != nil && !snapshotTime.IsZero() {
+		lastTouched = snapshotTime.Add(-*idle)
 	}
-	return b1<<8 | b2, nil
+	return Timestamp{snapshotTime, lastTouched, expiry}
 }
 
-func (rdb *RDBFileParser) readInt32(order binary.ByteOrder) (int, error) {
-	var buf [4]byte
-	_, e := rdb.r.Read(buf[:])
-	if e != nil {
-		return 0, e
-	}
-	var b1, b2, b3, b4 int
-	if order == binary.LittleEndian {
-		b1, b2, b3, b4 = int(buf[3]), int(buf[2]), int(buf[1]), int(buf[0])
-	} else {
-		b1, b2, b3, b4 = int(buf[0]), int(buf[1]), int(buf[2]), int(buf[3])
+// selectDb points the loader at db n, growing the list of dbs to fit it. The
+// parser has already refused numbers past RDBMaxDatabases.
+func (l *RDBLoader) selectDb(n int) {
+	for len(l.dbs) <= n {
+		l.dbs = append(l.dbs, NewRevivedDb())
 	}
-	return b1<<24 | b2<<16 | b3<<8 | b4, nil
+	l.selector = &l.dbs[n]
 }
 
-func (rdb *RDBFileParser) readInt64(order binary.ByteOrder) (int64, error) {
-	var buf [8]byte
-	_, e := rdb.r.Read(buf[:])
+// RDBFileParser loads an rdb file from disk into memory, decrypting it on the
+// way if it was written with encryption on.
+type RDBFileParser struct {
+	handle   *os.File
+	loader   *RDBLoader
+	keys     *KeyRing
+	skipZero bool
+}
+
+func NewRDBFileParser(path string) (*RDBFileParser, error) {
+	file, e := os.Open(path)
 	if e != nil {
-		return 0, e
-	}
-	var b1, b2, b3, b4, b5, b6, b7, b8 int64
-	if order == binary.LittleEndian {
-		b1, b2, b3, b4, b5, b6, b7, b8 = int64(buf[7]), int64(buf[6]), int64(buf[5]), int64(buf[4]), int64(buf[3]), int64(buf[2]), int64(buf[1]), int64(buf[0])
-	} else {
-		b1, b2, b3, b4, b5, b6, b7, b8 = int64(buf[0]), int64(buf[1]), int64(buf[2]), int64(buf[3]), int64(buf[4]), int64(buf[5]), int64(buf[6]), int64(buf[7])
+		return nil, e
 	}
-	return b1<<56 | b2<<48 | b3<<40 | b4<<32 | b5<<24 | b6<<16 | b7<<8 | b8, nil
+	return &RDBFileParser{file, NewRDBLoader(), nil, true}, nil
 }
 
-func (rdb *RDBFileParser) readUint32(order binary.ByteOrder) (uint, error) {
-	v, e := rdb.readInt32(order)
-	return uint(v), e
+// SkipZeroChecksum controls whether a zeroed checksum footer, which is what redis
+// writes with rdbchecksum disabled, is accepted without verification. On by default.
+func (rdb *RDBFileParser) SkipZeroChecksum(skip bool) *RDBFileParser {
+	rdb.skipZero = skip
+	return rdb
 }
 
-func (rdb *RDBFileParser) readUint64(order binary.ByteOrder) (uint64, error) {
-	v, e := rdb.readInt64(order)
-	return uint64(v), e
+// Keys is the ring to decrypt the file with, if it turns out to be encrypted.
+func (rdb *RDBFileParser) Keys(ring *KeyRing) *RDBFileParser {
+	rdb.keys = ring
+	return rdb
 }
 
-func (rdb *RDBFileParser) readLengthEncodedInt(lenEnc byte) (int, error) {
-	if is6BitLen(lenEnc) {
-		return int(InsigBits(lenEnc)), nil
-	}
-
-	if is14BitLen(lenEnc) {
-		rest := int(InsigBits(lenEnc))
-		nextByte, err := rdb.readInt8()
-		if err != nil {
-			return 0, err
-		}
-		return rest<<8 | nextByte, nil
+// Parse returns the dbs in the file indexed by their db number, numbers that
+// weren't present in the file are left as empty dbs.
+func (rdb *RDBFileParser) Parse() ([]RevivedDB, error) {
+	defer rdb.handle.Close()
+	plain, _, e := MaybeDecrypt(rdb.handle, rdb.keys)
+	if e != nil {
+		return nil, e
 	}
-
-	if is32BitLen(lenEnc) {
-		i, err := rdb.readInt32(binary.BigEndian)
-		if err != nil {
-			return 0, err
-		}
-		return i, nil
+	if e := NewRDBStreamParser(plain, rdb.loader).SkipZeroChecksum(rdb.skipZero).Parse(); e != nil {
+		return nil, e
 	}
-
-	return 0, errors.New(fmt.Sprintln("parse error, invalid length encoded value", lenEnc))
+	return rdb.loader.Dbs(), nil
 }
 
-func (rdb *RDBFileParser) selectNewDb() {
-	rdb.dbs = append(rdb.dbs, NewRevivedDb())
-	rdb.selector = &rdb.dbs[len(rdb.dbs)-1]
+// Aux returns the auxiliary fields read so far.
+func (rdb *RDBFileParser) Aux() map[string]string {
+	return rdb.loader.Aux()
 }
 
 func validHeader(header []byte) bool {
@@ -1,16 +1,406 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
 func TestRDBFile(t *testing.T) {
 	rdbParser, fileErr := NewRDBFileParser("../dump.rdb")
 	if fileErr != nil {
 		t.Fatal(fileErr)
 	}
-	_, parseErr := rdbParser.Parse()
+	dbs, parseErr := rdbParser.Parse()
 	if parseErr != nil {
 		t.Fatal(parseErr)
 	}
+	long, _ := dbs[0].DB.Get("long")
+	if long.String() != strings.Repeat("a", 30) {
+		t.Fatalf("lzf string decoded as %q", long.String())
+	}
+}
+
+func TestCrc64(t *testing.T) {
+	// the check value from redis' own crc64 test
+	if sum := Crc64Update(0, []byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("crc64 = %016x", sum)
+	}
+}
+
+func TestLZFRoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		[]byte(strings.Repeat("a", 30)),
+		[]byte(strings.Repeat("hello world, ", 200)),
+		bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7}, 5000),
+	}
+	for _, in := range inputs {
+		compressed, ok := LZFCompress(in)
+		if !ok {
+			t.Fatalf("expected %q... to compress", in[:10])
+		}
+		out, e := LZFDecompress(compressed, len(in))
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !bytes.Equal(in, out) {
+			t.Fatalf("round trip mismatch for %q...", in[:10])
+		}
+	}
+
+	if _, ok := LZFCompress([]byte("abcdefghijklmnopqrstuvwxyz")); ok {
+		t.Fatal("incompressible input should be reported as such")
+	}
+
+	// 'a' followed by a back reference of 29 bytes at distance 1
+	out, e := LZFDecompress([]byte{0x00, 'a', 0xe0, 0x14, 0x00}, 30)
+	if e != nil || string(out) != strings.Repeat("a", 30) {
+		t.Fatalf("decompress = %q, %v", out, e)
+	}
+}
+
+func writeTestRDB(t *testing.T, checksum bool) []byte {
+	var buf bytes.Buffer
+	w := NewRDBFileWriter(&buf).Checksum(checksum)
+	db := NewRevivedDb()
+	db.DB.Set("short", RespValue{BulkString, []byte("v")})
+	db.DB.Set("number", RespValue{BulkString, []byte("-42")})
+	db.DB.Set("long", RespValue{BulkString, []byte(strings.Repeat("compress me ", 20))})
+	db.DB.Set("ttl", RespValue{BulkString, []byte("soon")})
+	db.Expiry.Set("ttl", NewTimestamp(time.Hour))
+	w.WriteHeader()
+	w.WriteAux("redis-ver", "7.2.0")
+	w.WriteDB(0, db)
+	if e := w.WriteEOF(); e != nil {
+		t.Fatal(e)
+	}
+	return buf.Bytes()
+}
+
+func parseTestRDB(t *testing.T, data []byte, skipZero bool) ([]RevivedDB, error) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if e := os.WriteFile(path, data, 0644); e != nil {
+		t.Fatal(e)
+	}
+	p, e := NewRDBFileParser(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return p.SkipZeroChecksum(skipZero).Parse()
+}
+
+func TestRDBWriterRoundTrip(t *testing.T) {
+	dbs, e := parseTestRDB(t, writeTestRDB(t, true), true)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for k, want := range map[string]string{"short": "v", "number": "-42", "long": strings.Repeat("compress me ", 20), "ttl": "soon"} {
+		got, _ := dbs[0].DB.Get(k)
+		if got.String() != want {
+			t.Fatalf("%s = %q, want %q", k, got.String(), want)
+		}
+	}
+	if _, exists := dbs[0].Expiry.Get("ttl"); !exists {
+		t.Fatal("expiry was not written")
+	}
+}
+
+func TestRDBChecksum(t *testing.T) {
+	data := writeTestRDB(t, true)
+
+	// flip a byte in the middle of the long value
+	corrupt := bytes.Clone(data)
+	idx := bytes.Index(corrupt, []byte("long")) + 8
+	corrupt[idx] ^= 0xff
+	_, e := parseTestRDB(t, corrupt, true)
+	var corruptErr ErrRDBCorrupt
+	if !errors.As(e, &corruptErr) {
+		t.Fatalf("expected corruption to be detected, got %v", e)
+	}
+
+	// a bad checksum is reported at the footer
+	badSum := bytes.Clone(data)
+	badSum[len(badSum)-1] ^= 0xff
+	_, e = parseTestRDB(t, badSum, true)
+	var sumErr ErrRDBChecksum
+	if !errors.As(e, &corruptErr) || !errors.As(e, &sumErr) || corruptErr.Offset != int64(len(data)-8) {
+		t.Fatalf("expected checksum mismatch at offset %d, got %v", len(data)-8, e)
+	}
+
+	// zeroed checksums are only accepted when asked to
+	zeroed := writeTestRDB(t, false)
+	if _, e = parseTestRDB(t, zeroed, true); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = parseTestRDB(t, zeroed, false); !errors.As(e, &sumErr) {
+		t.Fatalf("expected zero checksum to be verified, got %v", e)
+	}
+
+	// truncated files report where they ran out
+	_, e = parseTestRDB(t, data[:len(data)-20], true)
+	if !errors.As(e, &corruptErr) || corruptErr.Offset != int64(len(data)-20) {
+		t.Fatalf("expected truncation to be reported, got %v", e)
+	}
+}
+
+// dumpDbs renders parsed dbs in a stable, human readable form for golden files.
+func dumpDbs(dbs []RevivedDB) string {
+	var sb strings.Builder
+	for i, db := range dbs {
+		keys := db.DB.Keys()
+		sort.Strings(keys)
+		fmt.Fprintf(&sb, "db %d (%d keys)\n", i, len(keys))
+		for _, k := range keys {
+			v, _ := db.DB.Get(k)
+			fmt.Fprintf(&sb, "  %q = %q", k, v.String())
+			if ts, exists := db.Expiry.Get(k); exists {
+				fmt.Fprintf(&sb, " expires=%s", ts.Expiry.UTC().Format(time.RFC3339Nano))
+				if !ts.Created.IsZero() {
+					fmt.Fprintf(&sb, " created=%s", ts.Created.UTC().Format(time.RFC3339))
+				}
+				if !ts.LastTouched.IsZero() {
+					fmt.Fprintf(&sb, " touched=%s", ts.LastTouched.UTC().Format(time.RFC3339))
+				}
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// every testdata/rdb/<case>.rdb is loaded and compared against <case>.golden,
+// run with -update to regenerate the expectations.
+func TestRDBGolden(t *testing.T) {
+	files, _ := filepath.Glob("testdata/rdb/*.rdb")
+	if len(files) == 0 {
+		t.Fatal("no golden rdb files found")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".rdb")
+		t.Run(name, func(t *testing.T) {
+			p, e := NewRDBFileParser(file)
+			if e != nil {
+				t.Fatal(e)
+			}
+			dbs, e := p.Parse()
+			if e != nil {
+				t.Fatal(e)
+			}
+			got := dumpDbs(dbs)
+			goldenPath := strings.TrimSuffix(file, ".rdb") + ".golden"
+			if *updateGolden {
+				if e := os.WriteFile(goldenPath, []byte(got), 0644); e != nil {
+					t.Fatal(e)
+				}
+			}
+			want, e := os.ReadFile(goldenPath)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if got != string(want) {
+				t.Fatalf("mismatch against %s\ngot:\n%s\nwant:\n%s", goldenPath, got, want)
+			}
+		})
+	}
+}
+
+// recordingVisitor notes every callback so tests can check what the stream parser emitted.
+type recordingVisitor struct {
+	events []string
+}
+
+func (v *recordingVisitor) OnAux(key string, value string) error {
+	v.events = append(v.events, fmt.Sprintf("aux %s=%s", key, value))
+	return nil
+}
+
+func (v *recordingVisitor) OnFunction(code string) error {
+	v.events = append(v.events, fmt.Sprintf("function %s", code))
+	return nil
+}
+
+func (v *recordingVisitor) OnSelectDB(index int) error {
+	v.events = append(v.events, fmt.Sprintf("select %d", index))
+	return nil
+}
+
+func (v *recordingVisitor) OnResizeDB(dbSize int, expirySize int) error {
+	v.events = append(v.events, fmt.Sprintf("resize %d %d", dbSize, expirySize))
+	return nil
+}
+
+func (v *recordingVisitor) OnKey(entry RDBEntry) error {
+	v.events = append(v.events, fmt.Sprintf("key %d %s=%s expires=%v", entry.DB, entry.Key, entry.Value.String(), entry.Expiry != nil))
+	return nil
+}
+
+func (v *recordingVisitor) OnEnd(checksum uint64) error {
+	v.events = append(v.events, fmt.Sprintf("end %v", checksum != 0))
+	return nil
+}
+
+func TestRDBStreamFromSocket(t *testing.T) {
+	data, e := os.ReadFile("testdata/rdb/ms_expiry.rdb")
+	if e != nil {
+		t.Fatal(e)
+	}
+	server, client := net.Pipe()
+	go func() {
+		// anything after the payload must be left for the caller to read.
+		server.Write(append(bytes.Clone(data), "+PING\r\n"...))
+		server.Close()
+	}()
+
+	r := bufio.NewReader(client)
+	v := &recordingVisitor{}
+	if e := NewRDBStreamParser(r, v).Parse(); e != nil {
+		t.Fatal(e)
+	}
+	want := []string{
+		"aux redis-ver=7.2.0",
+		"select 0",
+		"resize 2 2",
+		"key 0 precise=ms expires=true",
+		"key 0 seconds=s expires=true",
+		"end true",
+	}
+	if strings.Join(v.events, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got events:\n%s", strings.Join(v.events, "\n"))
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "+PING\r\n" {
+		t.Fatalf("parser consumed past the end of the payload, left %q", rest)
+	}
+}
+
+func TestRDBStreamTruncated(t *testing.T) {
+	data, e := os.ReadFile("testdata/rdb/ms_expiry.rdb")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, cut := range []int{3, 20, len(data) - 9, len(data) - 1} {
+		e := NewRDBStreamParser(bytes.NewReader(data[:cut]), &recordingVisitor{}).Parse()
+		if !errors.Is(e, ErrRDBTruncated) {
+			t.Fatalf("cut at %d: expected truncation error, got %v", cut, e)
+		}
+	}
+
+	// corruption is not truncation
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)-1] ^= 0xff
+	e = NewRDBStreamParser(bytes.NewReader(corrupt), &recordingVisitor{}).Parse()
+	if e == nil || errors.Is(e, ErrRDBTruncated) {
+		t.Fatalf("expected a checksum error, got %v", e)
+	}
+}
+
+func TestRDBStreamBadLengths(t *testing.T) {
+	header := "REDIS0011" + string([]byte{Aux, 1, 'k'})
+	for _, test := range []struct {
+		name      string
+		value     []byte
+		truncated bool
+	}{
+		{"64 bit length", []byte{LenEnc64Bit, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false},
+		{"length over the limit", []byte{LenEnc64Bit, 0, 0, 0, 1, 0, 0, 0, 0}, false},
+		{"length longer than the stream", []byte{LenEnc32Bit, 0x10, 0, 0, 0, 'a'}, true},
+		{"lzf longer than the stream", []byte{LenEncSpecial | StrEncLZF, LenEnc32Bit, 0x10, 0, 0, 0, 0x04, 'a'}, true},
+		{"db number out of range", []byte{0, SelectDB, LenEnc32Bit, 0x80, 0, 0, 0}, false},
+		{"lzf expanding too far", []byte{LenEncSpecial | StrEncLZF, 2, LenEnc32Bit, 0x10, 0, 0, 0, 0x01, 'a', 'b'}, false},
+	} {
+		data := append([]byte(header), test.value...)
+		e := NewRDBStreamParser(bytes.NewReader(data), &recordingVisitor{}).Parse()
+		var corrupt ErrRDBCorrupt
+		if !errors.As(e, &corrupt) || errors.Is(e, ErrRDBTruncated) != test.truncated {
+			t.Fatalf("%s: expected it to be corrupt (truncated %v), got %v", test.name, test.truncated, e)
+		}
+	}
+	if _, e := LZFDecompress([]byte{0x00, 'a'}, -1); e != ErrLZFOutputLength {
+		t.Fatalf("expected a negative length to be refused, got %v", e)
+	}
+}
+
+func TestDumpPayloadBadLengths(t *testing.T) {
+	for _, body := range [][]byte{
+		{StringEnc, LenEnc64Bit, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{StringEnc, LenEnc32Bit, 0x10, 0, 0, 0, 'a'},
+		{StringEnc, LenEncSpecial | StrEncLZF, LenEnc32Bit, 0x10, 0, 0, 0, 0x10, 0x00, 'a'},
+	} {
+		// the checksum is right, it's the lengths that aren't.
+		payload := binary.LittleEndian.AppendUint16(body, RDBVersion)
+		payload = binary.LittleEndian.AppendUint64(payload, Crc64Update(0, payload))
+		if _, e := ParseDumpPayload(payload); e != ErrDumpBadData {
+			t.Fatalf("%q: expected the payload to be refused, got %v", body, e)
+		}
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	// DUMP of "10" in the redis docs, written by an older rdb version.
+	value, e := ParseDumpPayload([]byte("\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"))
+	if e != nil || value.String() != "10" {
+		t.Fatalf("expected redis' payload to hold 10, got %q %v", value.String(), e)
+	}
+
+	ctx := newTestContext(nil)
+	router := initCommandRouter(NewCommandRouter())
+	var out bytes.Buffer
+	ctx.Connection = &out
+	long := strings.Repeat("abc", 100)
+	router.Route(ctx, bulkStrings("SET", "long", long))
+	router.Route(ctx, bulkStrings("SET", "short", "1"))
+	payloads := map[string]string{}
+	for _, key := range []string{"long", "short"} {
+		out.Reset()
+		router.Route(ctx, bulkStrings("DUMP", key))
+		reply, _, e := Deserialize(out.Bytes())
+		if e != nil || reply.Type != BulkString {
+			t.Fatalf("expected a payload for %s, got %q", key, out.String())
+		}
+		payloads[key] = reply.String()
+	}
+	if len(payloads["long"]) >= len(long) {
+		t.Fatalf("expected a long value to be compressed, got %d bytes", len(payloads["long"]))
+	}
+
+	corrupt := []byte(payloads["short"])
+	corrupt[1] ^= 1
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"DUMP", "missing"}, "$-1\r\n"},
+		{[]string{"RESTORE", "copy", "0", payloads["long"]}, "+OK\r\n"},
+		{[]string{"GET", "copy"}, "$300\r\n" + long + "\r\n"},
+		{[]string{"RESTORE", "copy", "0", payloads["short"]}, "-BUSYKEY Target key name already exists.\r\n"},
+		{[]string{"RESTORE", "copy", "0", payloads["short"], "REPLACE"}, "+OK\r\n"},
+		{[]string{"GET", "copy"}, "$1\r\n1\r\n"},
+		{[]string{"RESTORE", "other", "0", string(corrupt)}, "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{[]string{"RESTORE", "other", "-1", payloads["short"]}, "-ERR Invalid TTL value, must be >= 0\r\n"},
+		{[]string{"RESTORE", "expiring", "60000", payloads["short"]}, "+OK\r\n"},
+		{[]string{"RESTORE", "expired", "1000", payloads["short"], "ABSTTL"}, "+OK\r\n"},
+		{[]string{"GET", "expired"}, "$-1\r\n"},
+	} {
+		out.Reset()
+		router.Route(ctx, bulkStrings(test.args...))
+		if out.String() != test.want {
+			t.Errorf("%v: expected %q, got %q", test.args[:2], test.want, out.String())
+		}
+	}
+	if ts, expires := ctx.ExpiryStore.Get("expiring"); !expires || time.Until(ts.Expiry) < 50*time.Second {
+		t.Fatalf("expected the restored key to expire in a minute, got %v", ts.Expiry)
+	}
 }
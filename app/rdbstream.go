@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ErrRDBTruncated is what a stream that ends before the EOF opcode (and checksum) unwraps to.
+var ErrRDBTruncated = errors.New("rdb stream ended before the end of file marker")
+
+const (
+	// the longest string we'll read, same as redis' proto-max-bulk-len. A
+	// length over it can only come from a corrupt file.
+	RDBMaxStringLen = 512 << 20
+	// strings up to this long are read straight into a buffer of their
+	// length, longer ones as they arrive.
+	rdbReadChunk = 64 << 10
+	// how many dbs a file can have, redis' default for databases.
+	RDBMaxDatabases = 16
+)
+
+// RDBVisitor receives the contents of an rdb stream as it is parsed, in file
+// order. Returning an error from any callback stops the parse with that error.
+type RDBVisitor interface {
+	OnAux(key string, value string) error
+	OnSelectDB(index int) error
+	OnResizeDB(dbSize int, expirySize int) error
+	OnKey(entry RDBEntry) error
+	// OnFunction is a function library's code, as FUNCTION LOAD was given it.
+	OnFunction(code string) error
+	// OnEnd is called once the EOF opcode is reached, checksum is the footer as
+	// written in the file (already verified), or 0 for files that predate it.
+	OnEnd(checksum uint64) error
+}
+
+// RDBEntry is a single key read from the stream, along with the metadata
+// opcodes that preceded it.
+type RDBEntry struct {
+	DB     int
+	Key    string
+	Value  RespValue
+	Expiry *time.Time
+	Idle   *time.Duration
+}
+
+// rdbReader keeps track of how far into the file we are, and of the running
+// checksum of everything read so far.
+type rdbReader struct {
+	r      *bufio.Reader
+	offset int64
+	crc    uint64
+}
+
+// newRdbReader reuses r when it is already buffered, so the caller can keep
+// reading from it once the rdb payload is done (e.g. a replication stream).
+func newRdbReader(r io.Reader) *rdbReader {
+	br, buffered := r.(*bufio.Reader)
+	if !buffered {
+		br = bufio.NewReader(r)
+	}
+	return &rdbReader{br, 0, 0}
+}
+
+func (rr *rdbReader) ReadByte() (byte, error) {
+	b, e := rr.r.ReadByte()
+	if e != nil {
+		return 0, e
+	}
+	rr.offset++
+	rr.crc = Crc64Update(rr.crc, []byte{b})
+	return b, nil
+}
+
+func (rr *rdbReader) PeekByte() (byte, error) {
+	b, e := rr.r.Peek(1)
+	if e != nil {
+		return 0, e
+	}
+	return b[0], nil
+}
+
+func (rr *rdbReader) ReadFull(buf []byte) error {
+	n, e := io.ReadFull(rr.r, buf)
+	rr.offset += int64(n)
+	rr.crc = Crc64Update(rr.crc, buf[:n])
+	return e
+}
+
+// ReadN reads n bytes. Long reads grow their buffer as the bytes arrive
+// rather than allocating all n up front, so a corrupt length runs into the
+// end of the stream instead of into memory it said it needed.
+func (rr *rdbReader) ReadN(n int) ([]byte, error) {
+	if n <= rdbReadChunk {
+		buf := make([]byte, n)
+		return buf, rr.ReadFull(buf)
+	}
+	var buf bytes.Buffer
+	read, e := io.CopyN(&buf, rr.r, int64(n))
+	rr.offset += read
+	rr.crc = Crc64Update(rr.crc, buf.Bytes())
+	if e == io.EOF {
+		e = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), e
+}
+
+// RDBStreamParser walks an rdb payload from any io.Reader and hands what it
+// finds to a visitor, without building anything in memory itself.
+type RDBStreamParser struct {
+	r                *rdbReader
+	v                RDBVisitor
+	version          int
+	skipZeroChecksum bool
+	db               int
+	pending          keyMeta // expiry/idle opcodes seen since the last key
+	size             int64   // how long the payload is, when that's known up front
+}
+
+// keyMeta holds the opcodes that may precede a key and describe it.
+type keyMeta struct {
+	expiry *time.Time
+	idle   *time.Duration
+}
+
+func NewRDBStreamParser(r io.Reader, v RDBVisitor) *RDBStreamParser {
+	return &RDBStreamParser{newRdbReader(r), v, 0, true, -1, keyMeta{}, 0}
+}
+
+// SkipZeroChecksum controls whether a zeroed checksum footer, which is what redis
+// writes with rdbchecksum disabled, is accepted without verification. On by default.
+func (p *RDBStreamParser) SkipZeroChecksum(skip bool) *RDBStreamParser {
+	p.skipZeroChecksum = skip
+	return p
+}
+
+// Size says how long the payload is, so a string that claims to be longer
+// than what's left of it is corrupt, before anything is read into it.
+func (p *RDBStreamParser) Size(n int64) *RDBStreamParser {
+	p.size = n
+	return p
+}
+
+// Offset is the number of bytes consumed so far.
+func (p *RDBStreamParser) Offset() int64 {
+	return p.r.offset
+}
+
+// Version is the rdb version from the header, 0 until it has been read.
+func (p *RDBStreamParser) Version() int {
+	return p.version
+}
+
+// Parse reads the whole payload. Errors about the content are ErrRDBCorrupt
+// carrying the offset of the offending element, streams that end early unwrap
+// to ErrRDBTruncated and errors returned by the visitor are passed through as is.
+func (p *RDBStreamParser) Parse() error {
+	if headerErr := p.parseHeader(); headerErr != nil {
+		return p.corrupt(0, headerErr)
+	}
+
+	if bodyErr := p.parseBody(); bodyErr != nil {
+		return p.corrupt(p.r.offset, bodyErr)
+	}
+	return nil
+}
+
+// visitorErr marks errors that came from the visitor rather than the stream.
+type visitorErr struct {
+	err error
+}
+
+func (e visitorErr) Error() string {
+	return e.err.Error()
+}
+
+func (p *RDBStreamParser) visit(e error) error {
+	if e != nil {
+		return visitorErr{e}
+	}
+	return nil
+}
+
+// corrupt attaches an offset to err, unless a more precise one was already attached further down.
+func (p *RDBStreamParser) corrupt(offset int64, err error) error {
+	var fromVisitor visitorErr
+	if errors.As(err, &fromVisitor) {
+		return fromVisitor.err
+	}
+	var withOffset ErrRDBCorrupt
+	if errors.As(err, &withOffset) {
+		return err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrRDBTruncated
+	}
+	return ErrRDBCorrupt{offset, err}
+}
+
+func (p *RDBStreamParser) parseHeader() error {
+	var b [len(MagicString) + VersionStrLen]byte
+	e := p.r.ReadFull(b[:])
+	if e != nil {
+		return e
+	}
+	if !validHeader(b[:]) {
+		return InvalidHead
+	}
+	p.version, _ = strconv.Atoi(string(b[len(MagicString):]))
+	return nil
+}
+
+func (p *RDBStreamParser) parseBody() error {
+	for {
+		opStart := p.r.offset
+		opCode, e := p.r.ReadByte()
+		if e != nil {
+			return e
+		}
+		switch opCode {
+		case EOF:
+			return p.parseChecksum()
+		case SelectDB:
+			e := p.parseDbSelector()
+			if e != nil {
+				return e
+			}
+		case ExpireTimeSec:
+			e := p.parseExpirySec()
+			if e != nil {
+				return e
+			}
+		case ExpireTimeMilli:
+			e := p.parseExpiryMilliSec()
+			if e != nil {
+				return e
+			}
+		case ResizeDb:
+			e := p.parseResizeDb()
+			if e != nil {
+				return e
+			}
+		case Aux:
+			e := p.parseAux()
+			if e != nil {
+				return e
+			}
+		case Idle:
+			e := p.parseIdle()
+			if e != nil {
+				return e
+			}
+		case Function2:
+			code, e := p.parseString()
+			if e != nil {
+				return e
+			}
+			if e := p.visit(p.v.OnFunction(code.String())); e != nil {
+				return e
+			}
+		case Freq:
+			// we don't track access frequency, skip over it.
+			_, e := p.r.ReadByte()
+			if e != nil {
+				return e
+			}
+		default:
+			e := p.parseKey(opStart, opCode)
+			if e != nil {
+				return e
+			}
+		}
+	}
+}
+
+func (p *RDBStreamParser) parseAux() error {
+	key, keyOk := p.parseString()
+	if keyOk != nil {
+		return keyOk
+	}
+
+	value, valueOk := p.parseString()
+	if valueOk != nil {
+		return valueOk
+	}
+
+	return p.visit(p.v.OnAux(key.String(), value.String()))
+}
+
+// parseKey reads a key and its value then hands it to the visitor along with
+// whatever metadata opcodes came before it.
+func (p *RDBStreamParser) parseKey(start int64, valEnc byte) error {
+	meta := p.pending
+	p.pending = keyMeta{}
+	k, v, e := p.parseKeyValue(start, valEnc)
+	if e != nil {
+		return e
+	}
+	if p.db < 0 {
+		return ErrRDBCorrupt{start, errors.New("key found before any db was selected")}
+	}
+	return p.visit(p.v.OnKey(RDBEntry{p.db, k, v, meta.expiry, meta.idle}))
+}
+
+// parseChecksum verifies the footer that follows the EOF opcode against
+// everything read up to and including that opcode.
+func (p *RDBStreamParser) parseChecksum() error {
+	if p.version < ChecksumVersion {
+		return p.visit(p.v.OnEnd(0))
+	}
+	computed := p.r.crc
+	footerStart := p.r.offset
+	var footer [8]byte
+	if e := p.r.ReadFull(footer[:]); e != nil {
+		return ErrRDBCorrupt{footerStart, fmt.Errorf("reading checksum: %w", ErrRDBTruncated)}
+	}
+	expected := binary.LittleEndian.Uint64(footer[:])
+	if expected != computed && !(expected == 0 && p.skipZeroChecksum) {
+		return ErrRDBCorrupt{footerStart, ErrRDBChecksum{expected, computed}}
+	}
+	return p.visit(p.v.OnEnd(expected))
+}
+
+func (p *RDBStreamParser) parseExpirySec() error {
+	expirySecs, expiryErr := p.readUint32(binary.LittleEndian)
+	if expiryErr != nil {
+		return expiryErr
+	}
+	expiryTime := time.Unix(int64(expirySecs), 0)
+	p.pending.expiry = &expiryTime
+	return nil
+}
+
+func (p *RDBStreamParser) parseExpiryMilliSec() error {
+	expiryMilli, expiryErr := p.readUint64(binary.LittleEndian)
+	if expiryErr != nil {
+		return expiryErr
+	}
+	expiryTime := time.UnixMilli(int64(expiryMilli))
+	p.pending.expiry = &expiryTime
+	return nil
+}
+
+func (p *RDBStreamParser) parseIdle() error {
+	idleSecs, idleErr := p.readLength()
+	if idleErr != nil {
+		return idleErr
+	}
+	idle := time.Duration(idleSecs) * time.Second
+	p.pending.idle = &idle
+	return nil
+}
+
+func (p *RDBStreamParser) parseKeyValue(start int64, valEnc byte) (string, RespValue, error) {
+	none := func(e error) (string, RespValue, error) { return "", RespValue{}, e }
+	switch valEnc {
+	case StringEnc:
+		key, keyErr := p.parseString()
+		if keyErr != nil {
+			return none(keyErr)
+		}
+		value, valErr := p.parseString()
+		if valErr != nil {
+			return none(valErr)
+		}
+		// integer encoding is a storage detail, clients wrote (and expect back) a string.
+		if value.Type == Integer {
+			value = RespValue{BulkString, []byte(value.String())}
+		}
+		return key.String(), value, nil
+	default:
+		return none(ErrRDBCorrupt{start, fmt.Errorf("unsupported value type: %d", valEnc)})
+	}
+}
+
+func (p *RDBStreamParser) parseDbSelector() error {
+	start := p.r.offset - 1
+	selector, specErr := p.readLength()
+	if specErr != nil {
+		return specErr
+	}
+	if selector >= RDBMaxDatabases {
+		return ErrRDBCorrupt{start, fmt.Errorf("db number %d is out of range", selector)}
+	}
+	p.db = selector
+	return p.visit(p.v.OnSelectDB(selector))
+}
+
+func (p *RDBStreamParser) parseResizeDb() error {
+	hashLen, hashLenErr := p.readLength()
+	if hashLenErr != nil {
+		return hashLenErr
+	}
+	expiryLen, expiryLenErr := p.readLength()
+	if expiryLenErr != nil {
+		return expiryLenErr
+	}
+	return p.visit(p.v.OnResizeDB(hashLen, expiryLen))
+}
+
+func (p *RDBStreamParser) parseString() (RespValue, error) {
+	start := p.r.offset
+	lenEnc, lenErr := p.r.ReadByte()
+	if lenErr != nil {
+		return RespValue{}, lenErr
+	}
+
+	if isSpecial(lenEnc) {
+		// handle integer types.
+		flag := InsigBits(lenEnc)
+		return p.parseSpecialString(start, flag)
+	}
+
+	return p.parseLengthPrefixedString(start, lenEnc)
+}
+
+func (p *RDBStreamParser) parseLengthPrefixedString(start int64, lenEnc byte) (RespValue, error) {
+	decodedLen, lenErr := p.readLengthEncodedInt(lenEnc)
+	if lenErr != nil {
+		return RespValue{}, lenErr
+	}
+	if e := p.checkStringLen(start, decodedLen); e != nil {
+		return RespValue{}, e
+	}
+	buf, e := p.r.ReadN(decodedLen)
+	return RespValue{BulkString, buf}, e
+}
+
+// checkStringLen refuses a string length no valid file would have.
+func (p *RDBStreamParser) checkStringLen(start int64, n int) error {
+	if n > RDBMaxStringLen {
+		return ErrRDBCorrupt{start, fmt.Errorf("string length %d is too long", n)}
+	}
+	if p.size > 0 && int64(n) > p.size-p.r.offset {
+		return ErrRDBCorrupt{start, fmt.Errorf("string length %d is past the end of the payload", n)}
+	}
+	return nil
+}
+
+func (p *RDBStreamParser) parseSpecialString(start int64, flag byte) (RespValue, error) {
+	var value int
+	var err error
+	switch flag {
+	case StrEncInt8:
+		value, err = p.readInt8()
+	case StrEncInt16:
+		value, err = p.readInt16(binary.LittleEndian)
+	case StrEncInt32:
+		value, err = p.readInt32(binary.LittleEndian)
+	case StrEncLZF:
+		return p.parseCompressedString(start)
+	default:
+		return RespValue{}, ErrRDBCorrupt{start, fmt.Errorf("unknown special string encoding %d", flag)}
+	}
+	return RespValue{Integer, value}, err
+}
+
+// compressed strings are stored as <compressed len><uncompressed len><lzf data>
+func (p *RDBStreamParser) parseCompressedString(start int64) (RespValue, error) {
+	clen, clenErr := p.readLength()
+	if clenErr != nil {
+		return RespValue{}, clenErr
+	}
+	ulen, ulenErr := p.readLength()
+	if ulenErr != nil {
+		return RespValue{}, ulenErr
+	}
+	if e := p.checkStringLen(start, clen); e != nil {
+		return RespValue{}, e
+	}
+	if ulen > RDBMaxStringLen {
+		return RespValue{}, ErrRDBCorrupt{start, fmt.Errorf("string length %d is too long", ulen)}
+	}
+	dataStart := p.r.offset
+	compressed, e := p.r.ReadN(clen)
+	if e != nil {
+		return RespValue{}, e
+	}
+	data, e := LZFDecompress(compressed, ulen)
+	if e != nil {
+		var at ErrLZFCorrupt
+		if errors.As(e, &at) {
+			return RespValue{}, ErrRDBCorrupt{dataStart + int64(at), e}
+		}
+		return RespValue{}, ErrRDBCorrupt{start, e}
+	}
+	return RespValue{BulkString, data}, nil
+}
+
+func (p *RDBStreamParser) readInt8() (int, error) {
+	b, e := p.r.ReadByte()
+	return int(int8(b)), e
+}
+
+func (p *RDBStreamParser) readInt16(order binary.ByteOrder) (int, error) {
+	var buf [2]byte
+	e := p.r.ReadFull(buf[:])
+	if e != nil {
+		return 0, e
+	}
+	return int(int16(order.Uint16(buf[:]))), nil
+}
+
+func (p *RDBStreamParser) readInt32(order binary.ByteOrder) (int, error) {
+	var buf [4]byte
+	e := p.r.ReadFull(buf[:])
+	if e != nil {
+		return 0, e
+	}
+	return int(int32(order.Uint32(buf[:]))), nil
+}
+
+func (p *RDBStreamParser) readInt64(order binary.ByteOrder) (int64, error) {
+	var buf [8]byte
+	e := p.r.ReadFull(buf[:])
+	if e != nil {
+		return 0, e
+	}
+	return int64(order.Uint64(buf[:])), nil
+}
+
+func (p *RDBStreamParser) readUint32(order binary.ByteOrder) (uint, error) {
+	v, e := p.readInt32(order)
+	return uint(uint32(v)), e
+}
+
+func (p *RDBStreamParser) readUint64(order binary.ByteOrder) (uint64, error) {
+	v, e := p.readInt64(order)
+	return uint64(v), e
+}
+
+// readLength reads a length encoded int, including its leading byte.
+func (p *RDBStreamParser) readLength() (int, error) {
+	lenEnc, e := p.r.ReadByte()
+	if e != nil {
+		return 0, e
+	}
+	return p.readLengthEncodedInt(lenEnc)
+}
+
+// readLengthEncodedInt reads the rest of a length, one that doesn't fit in
+// an int is corrupt.
+func (p *RDBStreamParser) readLengthEncodedInt(lenEnc byte) (int, error) {
+	if is6BitLen(lenEnc) {
+		return int(InsigBits(lenEnc)), nil
+	}
+
+	if is14BitLen(lenEnc) {
+		rest := int(InsigBits(lenEnc))
+		nextByte, err := p.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		return rest<<8 | int(nextByte), nil
+	}
+
+	if is32BitLen(lenEnc) {
+		start := p.r.offset - 1
+		i, err := p.readUint32(binary.BigEndian)
+		if err != nil {
+			return 0, err
+		}
+		if uint64(i) > math.MaxInt {
+			return 0, ErrRDBCorrupt{start, fmt.Errorf("length %d is out of range", i)}
+		}
+		return int(i), nil
+	}
+
+	if is64BitLen(lenEnc) {
+		start := p.r.offset - 1
+		i, err := p.readUint64(binary.BigEndian)
+		if err != nil {
+			return 0, err
+		}
+		if i > math.MaxInt {
+			return 0, ErrRDBCorrupt{start, fmt.Errorf("length %d is out of range", i)}
+		}
+		return int(i), nil
+	}
+
+	return 0, ErrRDBCorrupt{p.r.offset - 1, fmt.Errorf("invalid length encoded value %d", lenEnc)}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The rdb subcommand inspects rdb files offline, without starting a server:
+//
+//	redis-server rdb [--format json|resp|stats] [--stats] [--top n] [--check] file.rdb
+//
+// json writes a JSON object per key, resp writes the commands that recreate the
+// dataset (ready to pipe into redis-cli --pipe), and stats only prints the
+// report: key counts per db, type and size histograms and the biggest keys.
+// --check validates the structure and checksum, reporting like redis-check-rdb.
+
+const (
+	RDBToolFormatJSON  = "json"
+	RDBToolFormatRESP  = "resp"
+	RDBToolFormatStats = "stats"
+)
+
+// runRDBTool is main for the rdb subcommand, it returns the exit status.
+func runRDBTool(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("rdb", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", RDBToolFormatJSON, "how to dump the keys: json, resp or stats (no dump, just the report)")
+	stats := flags.Bool("stats", false, "print the report to stderr after the dump")
+	top := flags.Int("top", 10, "how many of the biggest keys to report")
+	check := flags.Bool("check", false, "only validate the file's structure and checksum, like redis-check-rdb")
+	skipZero := flags.Bool("skip-zero-checksum", true, "accept files whose checksum is zero without verifying them")
+	keyFiles := flags.String("key-file", "", "comma separated key files to decrypt an encrypted file with")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: rdb [flags] <file.rdb>")
+		flags.PrintDefaults()
+	}
+	if e := flags.Parse(args); e != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	var keys *KeyRing
+	if *keyFiles != "" {
+		first, rest, _ := strings.Cut(*keyFiles, ",")
+		ring, e := keyRingFromFiles(first, rest)
+		if e != nil {
+			fmt.Fprintln(stderr, e)
+			return 2
+		}
+		keys = ring
+	}
+
+	if *check {
+		return checkRDBFile(path, *skipZero, keys, stdout)
+	}
+
+	var dumper rdbDumper
+	switch *format {
+	case RDBToolFormatJSON:
+		dumper = &jsonDumper{enc: json.NewEncoder(stdout)}
+	case RDBToolFormatRESP:
+		dumper = &respDumper{w: stdout, db: -1}
+	case RDBToolFormatStats:
+		*stats = false
+	default:
+		fmt.Fprintf(stderr, "unknown format '%s', expected json, resp or stats\n", *format)
+		return 2
+	}
+
+	file, e := os.Open(path)
+	if e != nil {
+		fmt.Fprintln(stderr, e)
+		return 1
+	}
+	defer file.Close()
+
+	inspector := &rdbInspector{dumper: dumper, stats: newRDBStats(*top), now: time.Now()}
+	plain, _, parseErr := MaybeDecrypt(file, keys)
+	if parseErr == nil {
+		parseErr = NewRDBStreamParser(plain, inspector).SkipZeroChecksum(*skipZero).Parse()
+	}
+	if dumper == nil {
+		inspector.stats.Report(stdout)
+	} else if *stats {
+		inspector.stats.Report(stderr)
+	}
+	if parseErr != nil {
+		fmt.Fprintln(stderr, parseErr)
+		return 1
+	}
+	return 0
+}
+
+// rdbDumper writes out each key as the file is parsed.
+type rdbDumper interface {
+	Dump(entry RDBEntry) error
+}
+
+type jsonKey struct {
+	DB          int    `json:"db"`
+	Key         string `json:"key"`
+	Type        string `json:"type"`
+	Value       string `json:"value"`
+	Encoding    string `json:"encoding,omitempty"` // base64 when the key or value isn't valid utf8
+	ExpiresAtMs *int64 `json:"expires_at_ms,omitempty"`
+	IdleSeconds *int64 `json:"idle_seconds,omitempty"`
+}
+
+type jsonDumper struct {
+	enc *json.Encoder
+}
+
+func (d *jsonDumper) Dump(entry RDBEntry) error {
+	row := jsonKey{DB: entry.DB, Key: entry.Key, Type: rdbTypeName(entry.Value), Value: entry.Value.String()}
+	if !utf8.ValidString(row.Key) || !utf8.ValidString(row.Value) {
+		row.Encoding = "base64"
+		row.Key = base64.StdEncoding.EncodeToString([]byte(row.Key))
+		row.Value = base64.StdEncoding.EncodeToString([]byte(row.Value))
+	}
+	if entry.Expiry != nil {
+		ms := entry.Expiry.UnixMilli()
+		row.ExpiresAtMs = &ms
+	}
+	if entry.Idle != nil {
+		secs := int64(entry.Idle.Seconds())
+		row.IdleSeconds = &secs
+	}
+	return d.enc.Encode(row)
+}
+
+// respDumper writes the commands that recreate the file, keys that have
+// already expired are left out since replaying them would do nothing.
+type respDumper struct {
+	w  io.Writer
+	db int
+}
+
+func (d *respDumper) Dump(entry RDBEntry) error {
+	if entry.Expiry != nil && time.Now().After(*entry.Expiry) {
+		return nil
+	}
+	if entry.DB != d.db {
+		if e := d.write(bulkStrings("SELECT", strconv.Itoa(entry.DB))); e != nil {
+			return e
+		}
+		d.db = entry.DB
+	}
+	cmd := bulkStrings("SET", entry.Key, entry.Value.String())
+	if entry.Expiry != nil {
+		cmd = append(cmd, bulkStrings("PXAT", strconv.FormatInt(entry.Expiry.UnixMilli(), 10))...)
+	}
+	return d.write(cmd)
+}
+
+func (d *respDumper) write(cmd []RespValue) error {
+	payload, e := RespValue{Array, cmd}.Serialize()
+	if e != nil {
+		return e
+	}
+	_, e = d.w.Write(payload)
+	return e
+}
+
+// rdbTypeName is the name TYPE would report for a value.
+func rdbTypeName(v RespValue) string {
+	switch v.Type {
+	case BulkString, SimpleString, Integer:
+		return "string"
+	}
+	return "unknown"
+}
+
+// rdbInspector is the visitor behind the subcommand, it feeds every key to the
+// dumper and the stats.
+type rdbInspector struct {
+	dumper rdbDumper
+	stats  *rdbStats
+	now    time.Time
+}
+
+func (ri *rdbInspector) OnAux(key string, value string) error {
+	ri.stats.aux = append(ri.stats.aux, [2]string{key, value})
+	return nil
+}
+
+func (ri *rdbInspector) OnFunction(code string) error {
+	ri.stats.functions++
+	return nil
+}
+
+func (ri *rdbInspector) OnSelectDB(index int) error {
+	ri.stats.db(index)
+	return nil
+}
+
+func (ri *rdbInspector) OnResizeDB(dbSize int, expirySize int) error {
+	return nil
+}
+
+func (ri *rdbInspector) OnKey(entry RDBEntry) error {
+	ri.stats.Add(entry, ri.now)
+	if ri.dumper == nil {
+		return nil
+	}
+	return ri.dumper.Dump(entry)
+}
+
+func (ri *rdbInspector) OnEnd(checksum uint64) error {
+	ri.stats.checksum = checksum
+	return nil
+}
+
+type rdbDBStats struct {
+	keys    int
+	expires int
+	expired int // keys whose expiry had already passed
+}
+
+// rdbSizeBuckets are the upper bounds of the size histogram, in bytes.
+var rdbSizeBuckets = []int{16, 64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+type rdbStats struct {
+	aux       [][2]string
+	functions int // how many function libraries there are
+	dbs       map[int]*rdbDBStats
+	types     map[string]int
+	sizes     []int // counts per rdbSizeBuckets, plus one for anything bigger
+	biggest   bigKeyHeap
+	top       int
+	checksum  uint64
+}
+
+func newRDBStats(top int) *rdbStats {
+	return &rdbStats{
+		dbs:   map[int]*rdbDBStats{},
+		types: map[string]int{},
+		sizes: make([]int, len(rdbSizeBuckets)+1),
+		top:   top,
+	}
+}
+
+func (s *rdbStats) db(index int) *rdbDBStats {
+	if s.dbs[index] == nil {
+		s.dbs[index] = &rdbDBStats{}
+	}
+	return s.dbs[index]
+}
+
+func (s *rdbStats) Add(entry RDBEntry, now time.Time) {
+	db := s.db(entry.DB)
+	db.keys++
+	if entry.Expiry != nil {
+		db.expires++
+		if now.After(*entry.Expiry) {
+			db.expired++
+		}
+	}
+	s.types[rdbTypeName(entry.Value)]++
+
+	size := len(entry.Value.String())
+	bucket := sort.SearchInts(rdbSizeBuckets, size)
+	s.sizes[bucket]++
+
+	if s.top <= 0 {
+		return
+	}
+	key := bigKey{entry.DB, entry.Key, rdbTypeName(entry.Value), size}
+	if s.biggest.Len() < s.top {
+		heap.Push(&s.biggest, key)
+	} else if s.biggest[0].size < size {
+		s.biggest[0] = key
+		heap.Fix(&s.biggest, 0)
+	}
+}
+
+func (s *rdbStats) Report(w io.Writer) {
+	for _, kv := range s.aux {
+		fmt.Fprintf(w, "aux %s = %s\n", kv[0], kv[1])
+	}
+	if s.functions > 0 {
+		fmt.Fprintf(w, "function libraries = %d\n", s.functions)
+	}
+
+	indices := make([]int, 0, len(s.dbs))
+	for i := range s.dbs {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	fmt.Fprintln(w, "# keyspace")
+	for _, i := range indices {
+		db := s.dbs[i]
+		fmt.Fprintf(w, "db%d:keys=%d,expires=%d,already_expired=%d\n", i, db.keys, db.expires, db.expired)
+	}
+
+	fmt.Fprintln(w, "# types")
+	types := make([]string, 0, len(s.types))
+	for t := range s.types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(w, "%s:%d\n", t, s.types[t])
+	}
+
+	fmt.Fprintln(w, "# value sizes")
+	for i, count := range s.sizes {
+		if i < len(rdbSizeBuckets) {
+			fmt.Fprintf(w, "<=%s:%d\n", formatBytes(rdbSizeBuckets[i]), count)
+		} else {
+			fmt.Fprintf(w, ">%s:%d\n", formatBytes(rdbSizeBuckets[i-1]), count)
+		}
+	}
+
+	fmt.Fprintf(w, "# biggest keys\n")
+	biggest := append(bigKeyHeap{}, s.biggest...)
+	sort.Slice(biggest, func(i, j int) bool { return biggest[i].size > biggest[j].size })
+	for _, k := range biggest {
+		fmt.Fprintf(w, "db%d %s %q %d bytes\n", k.db, k.typ, k.key, k.size)
+	}
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dmb", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dkb", n>>10)
+	}
+	return fmt.Sprintf("%db", n)
+}
+
+type bigKey struct {
+	db   int
+	key  string
+	typ  string
+	size int
+}
+
+// bigKeyHeap is a min heap on size, so the smallest of the biggest keys is the one to evict.
+type bigKeyHeap []bigKey
+
+func (h bigKeyHeap) Len() int           { return len(h) }
+func (h bigKeyHeap) Less(i, j int) bool { return h[i].size < h[j].size }
+func (h bigKeyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *bigKeyHeap) Push(x any)        { *h = append(*h, x.(bigKey)) }
+func (h *bigKeyHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// rdbChecker logs what it finds as it goes, in the style of redis-check-rdb.
+type rdbChecker struct {
+	w       io.Writer
+	parser  *RDBStreamParser
+	keys    int
+	expires int
+	expired int
+	now     time.Time
+}
+
+func (c *rdbChecker) log(format string, args ...any) {
+	fmt.Fprintf(c.w, "[offset %d] %s\n", c.parser.Offset(), fmt.Sprintf(format, args...))
+}
+
+func (c *rdbChecker) OnAux(key string, value string) error {
+	c.log("AUX FIELD %s = '%s'", key, value)
+	return nil
+}
+
+func (c *rdbChecker) OnFunction(code string) error {
+	c.log("FUNCTION LIBRARY %d bytes", len(code))
+	return nil
+}
+
+func (c *rdbChecker) OnSelectDB(index int) error {
+	c.log("Selecting DB ID %d", index)
+	return nil
+}
+
+func (c *rdbChecker) OnResizeDB(dbSize int, expirySize int) error {
+	return nil
+}
+
+func (c *rdbChecker) OnKey(entry RDBEntry) error {
+	c.keys++
+	if entry.Expiry != nil {
+		c.expires++
+		if c.now.After(*entry.Expiry) {
+			c.expired++
+		}
+	}
+	return nil
+}
+
+func (c *rdbChecker) OnEnd(checksum uint64) error {
+	if checksum == 0 {
+		c.log("RDB file was saved with checksum disabled: no check performed.")
+	} else {
+		c.log("Checksum OK")
+	}
+	return nil
+}
+
+func checkRDBFile(path string, skipZero bool, keys *KeyRing, w io.Writer) int {
+	fmt.Fprintf(w, "[offset 0] Checking RDB file %s\n", path)
+	file, e := os.Open(path)
+	if e != nil {
+		fmt.Fprintf(w, "Cannot check RDB file %s: %s\n", path, e)
+		return 1
+	}
+	defer file.Close()
+
+	plain, decrypter, e := MaybeDecrypt(file, keys)
+	if e != nil {
+		fmt.Fprintln(w, "--- RDB ERROR DETECTED ---")
+		fmt.Fprintln(w, e)
+		return 1
+	}
+	if decrypter != nil {
+		fmt.Fprintln(w, "[info] file is encrypted, checking the decrypted contents")
+	}
+	checker := &rdbChecker{w: w, now: time.Now()}
+	checker.parser = NewRDBStreamParser(plain, checker).SkipZeroChecksum(skipZero)
+	parseErr := checker.parser.Parse()
+	if version := checker.parser.Version(); version > 0 {
+		fmt.Fprintf(w, "[info] RDB version %d\n", version)
+	}
+	fmt.Fprintf(w, "[info] %d keys read\n", checker.keys)
+	fmt.Fprintf(w, "[info] %d expires\n", checker.expires)
+	fmt.Fprintf(w, "[info] %d already expired\n", checker.expired)
+	if parseErr == nil {
+		checker.log("\\o/ RDB looks OK! \\o/")
+		return 0
+	}
+
+	fmt.Fprintln(w, "--- RDB ERROR DETECTED ---")
+	var corrupt ErrRDBCorrupt
+	if errors.As(parseErr, &corrupt) {
+		fmt.Fprintf(w, "[offset %d] %s\n", corrupt.Offset, corrupt.Err)
+	} else {
+		fmt.Fprintln(w, parseErr)
+	}
+	if errors.Is(parseErr, ErrRDBTruncated) {
+		fmt.Fprintln(w, "[additional info] the file is truncated, it may have been cut short while being written or copied")
+	}
+	return 1
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRDBTool(t *testing.T) {
+	var out, errOut bytes.Buffer
+	if status := runRDBTool([]string{"--format", "json", "../dump.rdb"}, &out, &errOut); status != 0 {
+		t.Fatalf("exit %d: %s", status, errOut.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a line per key, got %q", out.String())
+	}
+	var row jsonKey
+	if e := json.Unmarshal([]byte(lines[2]), &row); e != nil || row.Key != "long" || row.Value != strings.Repeat("a", 30) {
+		t.Fatalf("row %q decoded to %+v (%v)", lines[2], row, e)
+	}
+
+	out.Reset()
+	if status := runRDBTool([]string{"--format", "stats", "--top", "1", "../dump.rdb"}, &out, &errOut); status != 0 {
+		t.Fatalf("exit %d: %s", status, errOut.String())
+	}
+	for _, want := range []string{"db0:keys=4,expires=1,already_expired=0", "string:4", `db0 string "long" 30 bytes`} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("report is missing %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if status := runRDBTool([]string{"--check", "../dump.rdb"}, &out, &errOut); status != 0 {
+		t.Fatalf("check failed on a good file:\n%s", out.String())
+	}
+
+	data, _ := os.ReadFile("../dump.rdb")
+	truncated := filepath.Join(t.TempDir(), "truncated.rdb")
+	os.WriteFile(truncated, data[:len(data)-20], 0644)
+	out.Reset()
+	if status := runRDBTool([]string{"--check", truncated}, &out, &errOut); status != 1 || !strings.Contains(out.String(), "RDB ERROR DETECTED") {
+		t.Fatalf("check passed a truncated file (exit %d):\n%s", status, out.String())
+	}
+}
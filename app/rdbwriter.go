@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	RDBVersion = 11 // the version we write, matches redis 7.x
+	// strings shorter than this aren't worth trying to compress, same cut off as redis.
+	LZFMinLength = 20
+)
+
+// RDBFileWriter is the counterpart to RDBFileParser, it emits the same subset of
+// the format that we know how to read back.
+type RDBFileWriter struct {
+	w        *bufio.Writer
+	crc      *Crc64
+	compress bool
+	checksum bool
+}
+
+func NewRDBFileWriter(w io.Writer) *RDBFileWriter {
+	crc := NewCrc64()
+	return &RDBFileWriter{bufio.NewWriter(io.MultiWriter(w, crc)), crc, true, true}
+}
+
+// Compression toggles lzf compression of long strings, on by default.
+func (rw *RDBFileWriter) Compression(on bool) *RDBFileWriter {
+	rw.compress = on
+	return rw
+}
+
+// Checksum toggles the crc64 footer, when off the footer is written as zero.
+func (rw *RDBFileWriter) Checksum(on bool) *RDBFileWriter {
+	rw.checksum = on
+	return rw
+}
+
+func (rw *RDBFileWriter) WriteHeader() error {
+	_, e := fmt.Fprintf(rw.w, "%s%04d", MagicString, RDBVersion)
+	return e
+}
+
+func (rw *RDBFileWriter) WriteAux(key string, value string) error {
+	rw.w.WriteByte(Aux)
+	rw.writeString([]byte(key))
+	return rw.writeString([]byte(value))
+}
+
+func (rw *RDBFileWriter) WriteSelectDB(n int) error {
+	rw.w.WriteByte(SelectDB)
+	return rw.writeLength(n)
+}
+
+func (rw *RDBFileWriter) WriteResizeDB(dbSize int, expirySize int) error {
+	rw.w.WriteByte(ResizeDb)
+	rw.writeLength(dbSize)
+	return rw.writeLength(expirySize)
+}
+
+// WriteFunction writes a function library, as the code it was loaded from.
+func (rw *RDBFileWriter) WriteFunction(code string) error {
+	rw.w.WriteByte(Function2)
+	return rw.writeString([]byte(code))
+}
+
+// WriteKeyValue writes a string key, preceded by its expiry when it has one.
+func (rw *RDBFileWriter) WriteKeyValue(key string, value RespValue, expiry *time.Time) error {
+	if expiry != nil {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(expiry.UnixMilli()))
+		rw.w.WriteByte(ExpireTimeMilli)
+		rw.w.Write(buf[:])
+	}
+	rw.w.WriteByte(StringEnc)
+	rw.writeString([]byte(key))
+	return rw.writeValue(value)
+}
+
+// WriteDB writes a full db section: selector, resize hint and every live key.
+func (rw *RDBFileWriter) WriteDB(index int, db RevivedDB) error {
+	keys := db.DB.Keys()
+	expiring := 0
+	for _, k := range keys {
+		if _, exists := db.Expiry.Get(k); exists {
+			expiring++
+		}
+	}
+	rw.WriteSelectDB(index)
+	rw.WriteResizeDB(len(keys), expiring)
+	for _, k := range keys {
+		v, exists := db.DB.Get(k)
+		if !exists {
+			continue
+		}
+		var expiry *time.Time
+		if ts, hasExpiry := db.Expiry.Get(k); hasExpiry {
+			expiry = &ts.Expiry
+		}
+		if e := rw.WriteKeyValue(k, v, expiry); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// WriteEOF terminates the file with the EOF opcode and checksum, then flushes.
+func (rw *RDBFileWriter) WriteEOF() error {
+	rw.w.WriteByte(EOF)
+	if e := rw.w.Flush(); e != nil {
+		return e
+	}
+	var sum uint64
+	if rw.checksum {
+		sum = rw.crc.Sum64()
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], sum)
+	rw.w.Write(buf[:])
+	return rw.w.Flush()
+}
+
+func (rw *RDBFileWriter) writeValue(v RespValue) error {
+	if v.Type == Integer {
+		return rw.writeString([]byte(v.String()))
+	}
+	b, ok := v.Value.([]byte)
+	if !ok {
+		return fmt.Errorf("rdb writer can't encode value of type %d", v.Type)
+	}
+	return rw.writeString(b)
+}
+
+func (rw *RDBFileWriter) writeString(s []byte) error {
+	if rw.writeIntString(s) {
+		return nil
+	}
+
+	if rw.compress && len(s) > LZFMinLength {
+		if compressed, ok := LZFCompress(s); ok {
+			rw.w.WriteByte(LenEncSpecial | StrEncLZF)
+			rw.writeLength(len(compressed))
+			rw.writeLength(len(s))
+			_, e := rw.w.Write(compressed)
+			return e
+		}
+	}
+
+	rw.writeLength(len(s))
+	_, e := rw.w.Write(s)
+	return e
+}
+
+// strings that are the canonical form of a small integer get stored as that integer.
+func (rw *RDBFileWriter) writeIntString(s []byte) bool {
+	if len(s) == 0 || len(s) > 11 {
+		return false
+	}
+	i, e := strconv.ParseInt(string(s), 10, 32)
+	if e != nil || strconv.FormatInt(i, 10) != string(s) {
+		return false
+	}
+	switch {
+	case i >= -1<<7 && i < 1<<7:
+		rw.w.Write([]byte{LenEncSpecial | StrEncInt8, byte(int8(i))})
+	case i >= -1<<15 && i < 1<<15:
+		var buf [2]byte
+		binary.LittleEndian.PutUint16(buf[:], uint16(int16(i)))
+		rw.w.WriteByte(LenEncSpecial | StrEncInt16)
+		rw.w.Write(buf[:])
+	default:
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], uint32(int32(i)))
+		rw.w.WriteByte(LenEncSpecial | StrEncInt32)
+		rw.w.Write(buf[:])
+	}
+	return true
+}
+
+func (rw *RDBFileWriter) writeLength(n int) error {
+	switch {
+	case n < 1<<6:
+		return rw.w.WriteByte(byte(n))
+	case n < 1<<14:
+		_, e := rw.w.Write([]byte{LenEnc14Bit | byte(n>>8), byte(n)})
+		return e
+	case n <= 1<<32-1:
+		var buf [5]byte
+		buf[0] = LenEnc32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		_, e := rw.w.Write(buf[:])
+		return e
+	default:
+		var buf [9]byte
+		buf[0] = LenEnc64Bit
+		binary.BigEndian.PutUint64(buf[1:], uint64(n))
+		_, e := rw.w.Write(buf[:])
+		return e
+	}
+}
+
+// writeRDBSnapshot writes db as a complete rdb file, with any extra aux fields
+// given as key value pairs after the usual ones. The function libraries go
+// ahead of the keys, like redis has them.
+func writeRDBSnapshot(rw *RDBFileWriter, db RevivedDB, aux ...string) error {
+	rw.WriteHeader()
+	rw.WriteAux("redis-ver", "7.2.0")
+	rw.WriteAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	rw.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	for i := 0; i+1 < len(aux); i += 2 {
+		rw.WriteAux(aux[i], aux[i+1])
+	}
+	for _, lib := range db.Functions.Libraries() {
+		rw.WriteFunction(lib.code)
+	}
+	if e := rw.WriteDB(0, db); e != nil {
+		return e
+	}
+	return rw.WriteEOF()
+}
@@ -0,0 +1,58 @@
+package main
+
+// ReplBacklog keeps the tail of the replication stream in a circular buffer,
+// so a replica that drops off for a moment can be sent just what it missed
+// instead of the whole dataset.
+type ReplBacklog struct {
+	buf     []byte
+	next    int   // where the next byte goes in buf
+	histlen int   // how much of buf holds stream data
+	end     int64 // the master offset of the newest byte held
+}
+
+func NewReplBacklog(size int, offset int64) *ReplBacklog {
+	return &ReplBacklog{buf: make([]byte, max(size, 1)), end: offset}
+}
+
+func (b *ReplBacklog) Write(p []byte) {
+	b.end += int64(len(p))
+	// only the tail of a write bigger than the whole backlog can be kept.
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	n := copy(b.buf[b.next:], p)
+	copy(b.buf, p[n:])
+	b.next = (b.next + len(p)) % len(b.buf)
+	b.histlen = min(b.histlen+len(p), len(b.buf))
+}
+
+// FirstOffset is the master offset of the oldest byte held, bytes are
+// numbered from 1 the way redis numbers them.
+func (b *ReplBacklog) FirstOffset() int64 {
+	return b.end - int64(b.histlen) + 1
+}
+
+func (b *ReplBacklog) Size() int {
+	return len(b.buf)
+}
+
+func (b *ReplBacklog) Histlen() int {
+	return b.histlen
+}
+
+// From copies out the stream from offset onwards, offset being the first
+// byte the caller doesn't have yet. It returns false when those bytes have
+// already been overwritten (or haven't been written).
+func (b *ReplBacklog) From(offset int64) ([]byte, bool) {
+	if offset < b.FirstOffset() || offset > b.end+1 {
+		return nil, false
+	}
+	n := int(b.end - offset + 1)
+	start := (b.next - n + len(b.buf)) % len(b.buf)
+	out := make([]byte, n)
+	copied := copy(out, b.buf[start:])
+	if copied < n {
+		copy(out[copied:], b.buf[:n-copied])
+	}
+	return out, true
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// how a replica loads the rdb its master sends, the values of repl-diskless-load.
+const (
+	DisklessLoadDisabled  = "disabled"    // save it to a temp file first, and keep serving the old dataset meanwhile
+	DisklessLoadOnEmptyDB = "on-empty-db" // load it straight off the socket, when there's nothing to lose if the sync fails
+	DisklessLoadSwapDB    = "swapdb"      // load it straight off the socket into a second dataset, swapped in once it has all arrived
+)
+
+// the mark that ends an rdb streamed over the socket is 40 random characters,
+// a master streaming the rdb doesn't know how long it's going to be.
+const replEOFMarkLen = 40
+
+// disklessSync is a transfer waiting for replicas to join it before it starts.
+type disklessSync struct {
+	replicas []*ReplicaConn
+	full     chan struct{} // closed once enough replicas have joined to start early
+}
+
+// QueueDiskless adds a replica to the next transfer of the rdb over the
+// socket, starting one if none is waiting. Transfers wait for
+// repl-diskless-sync-delay seconds first, so replicas that turn up together
+// share one snapshot. Called with Exec held, like Attach.
+func (r *Replication) QueueDiskless(server *Server, replica *ReplicaConn) {
+	delay, _ := server.Config.Get("repl-diskless-sync-delay")
+	maxReplicas, _ := server.Config.Get("repl-diskless-sync-max-replicas")
+	seconds, e := strconv.Atoi(delay)
+	if e != nil || seconds < 0 {
+		seconds = 5
+	}
+	max, e := strconv.Atoi(maxReplicas)
+	if e != nil {
+		max = 0
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// the replica is only fed writes from the moment the snapshot is taken.
+	replica.Hold()
+	if r.diskless == nil {
+		r.diskless = &disklessSync{full: make(chan struct{})}
+		go r.runDiskless(server, r.diskless, time.Duration(seconds)*time.Second)
+	}
+	r.diskless.replicas = append(r.diskless.replicas, replica)
+	if max > 0 && len(r.diskless.replicas) == max {
+		close(r.diskless.full)
+		r.diskless = nil
+	}
+}
+
+// runDiskless waits out the delay, sending the replicas newlines so they know
+// we're still here, then snapshots the dataset and streams it to all of them.
+func (r *Replication) runDiskless(server *Server, ds *disklessSync, delay time.Duration) {
+	keepalive := time.NewTicker(time.Second)
+	defer keepalive.Stop()
+	start := time.NewTimer(delay)
+	defer start.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-start.C:
+			waiting = false
+		case <-ds.full:
+			waiting = false
+		case <-keepalive.C:
+			r.lock.Lock()
+			for _, replica := range ds.replicas {
+				replica.conn.Write([]byte("\n"))
+			}
+			r.lock.Unlock()
+		}
+	}
+
+	// the replies, the snapshot and the point in the stream each replica
+	// picks up from all have to agree, so no write can land in between them.
+	server.Exec.Lock()
+	r.lock.Lock()
+	if r.diskless == ds {
+		r.diskless = nil
+	}
+	replid, offset := r.replid, r.offset
+	snapshot := server.Dataset().Snapshot()
+	timeout := replTimeout(server.Config)
+	var replicas []*ReplicaConn
+	for _, replica := range ds.replicas {
+		replica.conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, e := fmt.Fprintf(replica.conn, "+FULLRESYNC %s %d\r\n", replid, offset); e != nil {
+			replica.Close()
+			continue
+		}
+		replica.Resume(offset, true)
+		replicas = append(replicas, replica)
+	}
+	r.lock.Unlock()
+	server.Exec.Unlock()
+
+	fmt.Println("[repl] streaming the rdb to", len(replicas), "replicas at offset", offset)
+	fanout := &replicaFanout{replicas: replicas, timeout: timeout}
+	mark := []byte(newReplID())
+	compression, _ := server.Config.Get("rdbcompression")
+	fmt.Fprintf(fanout, "$EOF:%s\r\n", mark)
+	rw := NewRDBFileWriter(fanout).Compression(compression == "yes")
+	writeRDBSnapshot(rw, snapshot, "repl-id", replid, "repl-offset", strconv.FormatInt(offset, 10))
+	fanout.Write(mark)
+	snapshot.Release()
+
+	for i, replica := range replicas {
+		if fanout.failed[i] {
+			r.remove(replica)
+			continue
+		}
+		go replica.run(r, server.Config, nil)
+	}
+}
+
+// replicaFanout writes the same stream to several replicas, a replica that
+// can't keep up is dropped from it rather than failing the others.
+type replicaFanout struct {
+	replicas []*ReplicaConn
+	failed   map[int]bool
+	timeout  time.Duration
+}
+
+func (rf *replicaFanout) Write(p []byte) (int, error) {
+	if rf.failed == nil {
+		rf.failed = map[int]bool{}
+	}
+	for i, replica := range rf.replicas {
+		if rf.failed[i] {
+			continue
+		}
+		if _, e := (deadlineWriter{replica.conn, rf.timeout}).Write(p); e != nil {
+			fmt.Println("[repl] dropping replica", replica.conn.RemoteAddr(), "from the rdb transfer", e)
+			rf.failed[i] = true
+		}
+	}
+	return len(p), nil
+}
+
+// eofMarkReader reads an rdb streamed with "$EOF:<mark>" framing, stopping at
+// the mark. Bytes are only handed out once they can't be the start of it.
+type eofMarkReader struct {
+	r    io.Reader
+	mark []byte
+	held []byte
+	done bool
+}
+
+func newEOFMarkReader(r io.Reader, mark []byte) *eofMarkReader {
+	return &eofMarkReader{r: r, mark: mark}
+}
+
+func (er *eofMarkReader) Read(p []byte) (int, error) {
+	for !er.done && len(er.held) <= len(er.mark) {
+		var chunk [ReadChunkSize]byte
+		n, e := er.r.Read(chunk[:])
+		er.held = append(er.held, chunk[:n]...)
+		if bytes.HasSuffix(er.held, er.mark) {
+			er.held = er.held[:len(er.held)-len(er.mark)]
+			er.done = true
+		} else if e == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if e != nil {
+			return 0, e
+		}
+	}
+	ready := len(er.held)
+	if !er.done {
+		ready -= len(er.mark)
+	}
+	if ready == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, er.held[:ready])
+	er.held = er.held[n:]
+	return n, nil
+}
+
+// disklessSyncEnabled is whether replicas get the rdb over the socket rather than
+// from a temp file.
+func disklessSyncEnabled(config *SharedRWStore[string]) bool {
+	enabled, _ := config.Get("repl-diskless-sync")
+	return enabled == "yes"
+}
@@ -0,0 +1,41 @@
+package main
+
+import "strconv"
+
+var ReplicaOfCommand = Command{"replicaof", replicaOf, CmdStale}
+
+// SLAVEOF is the old name of REPLICAOF, still used by plenty of tooling.
+var SlaveOfCommand = Command{"slaveof", replicaOf, CmdStale}
+
+var ReplicaOfArgsParser = NewArgumentsParser().NumPositionals(2)
+
+func replicaOf(ctx RequestContext, args []RespValue) {
+	parsedArgs, e := ReplicaOfArgsParser.Parse(args)
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+
+	if ctx.Cluster != nil {
+		ctx.SendError("ERR REPLICAOF not allowed in cluster mode.")
+		return
+	}
+	host, port := parsedArgs.GetPos(0), parsedArgs.GetPos(1)
+	if host.EqualAsciiInsensitive("no") && port.EqualAsciiInsensitive("one") {
+		ctx.Repl.Detach()
+		ctx.Config.Set("replicaof", "")
+		ctx.SendSimpleString("OK")
+		return
+	}
+
+	if _, e := strconv.ParseUint(port.String(), 10, 16); e != nil {
+		ctx.SendError("ERR Invalid master port")
+		return
+	}
+	if !ctx.Repl.ReplicaOf(ctx.Server, host.String(), port.String()) {
+		ctx.SendSimpleString("OK Already connected to specified master")
+		return
+	}
+	ctx.Config.Set("replicaof", host.String()+" "+port.String())
+	ctx.SendSimpleString("OK")
+}
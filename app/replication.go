@@ -0,0 +1,925 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrReplLinkStopped = errors.New("replication link was stopped")
+var ErrNoReplicas = errors.New("NOREPLICAS Not enough good replicas to write.")
+var ErrReadOnlyReplica = errors.New("READONLY You can't write against a read only replica.")
+var ErrMasterDown = errors.New("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+
+// ErrReplHandshake is a reply from the master that we can't carry on from.
+type ErrReplHandshake struct {
+	Step  string
+	Reply string
+}
+
+func (e ErrReplHandshake) Error() string {
+	return fmt.Sprintf("unexpected reply to %s from master: '%s'", e.Step, e.Reply)
+}
+
+// the states of the link to our master, as reported by INFO.
+const (
+	ReplStateConnecting = "connecting" // dialing, or waiting to retry
+	ReplStateHandshake  = "handshake"  // exchanging PING / REPLCONF / PSYNC
+	ReplStateTransfer   = "transfer"   // receiving the rdb payload
+	ReplStateConnected  = "connected"  // applying the command stream
+)
+
+const replHandshakeTimeout = 5 * time.Second
+const replRetryInterval = time.Second
+const replAckInterval = time.Second
+
+// Replication is the server's place in a replication setup: the link to the
+// master when we are a replica, the replicas and the backlog of the stream we
+// send them. Replicas pass their master's stream on to replicas of their
+// own unchanged, so everyone in a chain shares the master's id and offsets.
+type Replication struct {
+	lock         sync.Mutex
+	link         *MasterLink // nil when we are a master
+	replid       string      // names the history of the dataset, replicas only resync partially within one
+	offset       int64       // how many bytes of stream we have produced, or been sent by our master
+	replid2      string      // the history we followed before the current one, "" when there wasn't one
+	secondOffset int64       // the last offset replid2 is good for, -1 without a replid2
+	backlog      *ReplBacklog
+	replicas     []*ReplicaConn
+	ports        map[io.Writer]string // listening ports sent with REPLCONF, until the connection sends PSYNC
+	acks         chan struct{}        // closed, and replaced, whenever a replica acks
+	diskless     *disklessSync        // the rdb transfer replicas can still join
+	failover     *failover            // the FAILOVER under way, nil when there isn't one
+}
+
+func NewReplication() *Replication {
+	return &Replication{replid: newReplID(), secondOffset: -1, ports: map[io.Writer]string{}, acks: make(chan struct{})}
+}
+
+// newReplID is 40 random hex characters, like redis' replication ids.
+func newReplID() string {
+	id := make([]byte, 20)
+	if _, e := rand.Read(id); e != nil {
+		panic(e)
+	}
+	return hex.EncodeToString(id)
+}
+
+// ReplicaOf points the server at a new master, dropping the link to the old
+// one. It returns false when we were already replicating host:port.
+func (r *Replication) ReplicaOf(server *Server, host string, port string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.link != nil {
+		if r.link.host == host && r.link.port == port {
+			return false
+		}
+		r.link.Stop()
+	}
+	// our replicas come back once we're connected, with luck they carry on from
+	// where they were, they find out about the new master's id when they do.
+	r.disconnectReplicas()
+	r.link = NewMasterLink(r, server, host, port)
+	go r.link.run()
+	return true
+}
+
+// Detach stops replicating, the dataset is kept as it is and we become a
+// master. It gets a history of its own, but replicas that followed the same
+// master as us can still carry on from the old one.
+func (r *Replication) Detach() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.detach()
+}
+
+func (r *Replication) detach() {
+	if r.link == nil {
+		return
+	}
+	r.link.Stop()
+	r.link = nil
+	r.replid2, r.secondOffset = r.replid, r.offset+1
+	r.replid = newReplID()
+	// our replicas resync to find out about the new id.
+	r.disconnectReplicas()
+	fmt.Println("[repl] promoted to master with replid", r.replid, "at offset", r.offset)
+}
+
+func (r *Replication) disconnectReplicas() {
+	for _, replica := range r.replicas {
+		replica.Close()
+	}
+	r.replicas = nil
+}
+
+// Master is the link to our master, nil when we are a master.
+func (r *Replication) Master() *MasterLink {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.link
+}
+
+// Feed sends a write to every replica and keeps it in the backlog. It is
+// called with Exec held exclusively, so the stream is in the order the
+// writes were applied in. Replicas only pass on what their master sends.
+func (r *Replication) Feed(args []RespValue) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.link != nil || r.backlog == nil {
+		return
+	}
+	payload, e := RespValue{Array, args}.Serialize()
+	if e != nil {
+		fmt.Println("[err] failed to serialize a write for replicas", e)
+		return
+	}
+	r.feedRaw(payload)
+}
+
+// feedRaw adds payload to the stream, called with the lock held.
+func (r *Replication) feedRaw(payload []byte) {
+	r.backlog.Write(payload)
+	r.offset += int64(len(payload))
+	for _, replica := range r.replicas {
+		replica.Send(payload)
+	}
+}
+
+// proxy passes on a chunk of the stream from our master, as long as link is
+// still the link to it. Called with Exec held, like Feed.
+func (r *Replication) proxy(link *MasterLink, payload []byte) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.link != link {
+		return false
+	}
+	r.feedRaw(payload)
+	return true
+}
+
+// psyncFrom is what we ask our master for: where we are in the history we
+// have, or a full sync ("? -1") when we don't have one worth continuing.
+func (r *Replication) psyncFrom() (string, int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.backlog == nil {
+		return "?", -1
+	}
+	return r.replid, r.offset + 1
+}
+
+// fullSyncStarted drops our history, the dataset is about to be replaced
+// and, should the transfer fail, there's nothing left to continue from.
+func (r *Replication) fullSyncStarted() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.backlog = nil
+	r.replid2, r.secondOffset = "", -1
+	r.disconnectReplicas()
+}
+
+// fullSynced takes on the history of the dataset our master just sent.
+func (r *Replication) fullSynced(replid string, offset int64, backlogSize int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.replid, r.offset = replid, offset
+	r.backlog = NewReplBacklog(backlogSize, offset)
+}
+
+// continued follows our master to a new id when it has changed it, after a
+// failover say. The offsets carry on, and our replicas can carry on from the
+// old id as much as we could.
+func (r *Replication) continued(replid string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if replid == "" || replid == r.replid {
+		return
+	}
+	r.replid2, r.secondOffset = r.replid, r.offset+1
+	r.replid = replid
+	r.disconnectReplicas()
+}
+
+// Handshake remembers the port a connection says it will serve on once it is
+// a replica, which is what INFO reports rather than its outgoing port.
+func (r *Replication) Handshake(conn io.Writer, port string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ports[conn] = port
+}
+
+// Attach turns a connection that sent PSYNC into a replica. When replid and
+// offset name a point still in the backlog it gets what it missed from there
+// and Attach returns true, otherwise the caller has to send it the dataset
+// as of Attach's returned offset. Called with Exec held, so that no write
+// lands between the offset being read and the replica being listed.
+func (r *Replication) Attach(conn net.Conn, replid string, offset int64, backlogSize int) (*ReplicaConn, int64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	port := r.ports[conn]
+	delete(r.ports, conn)
+
+	sameHistory := replid == r.replid || (replid == r.replid2 && offset <= r.secondOffset)
+	if r.backlog != nil && sameHistory {
+		if missed, ok := r.backlog.From(offset); ok {
+			replica := NewReplicaConn(conn, port, offset-1)
+			replica.Send(missed)
+			r.replicas = append(r.replicas, replica)
+			return replica, r.offset, true
+		}
+	}
+	if r.backlog == nil {
+		r.backlog = NewReplBacklog(backlogSize, r.offset)
+	}
+	replica := NewReplicaConn(conn, port, r.offset)
+	r.replicas = append(r.replicas, replica)
+	return replica, r.offset, false
+}
+
+// Disconnected forgets about a connection that closed, whatever part of the
+// replication handshake it had got to.
+func (r *Replication) Disconnected(conn io.Writer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.ports, conn)
+	for i, replica := range r.replicas {
+		if replica.conn == conn {
+			replica.Close()
+			r.replicas = append(r.replicas[:i], r.replicas[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *Replication) remove(replica *ReplicaConn) {
+	r.Disconnected(replica.conn)
+}
+
+// Ack records that the replica on conn has applied the stream up to offset,
+// and wakes anyone WAITing on it.
+func (r *Replication) Ack(conn io.Writer, offset int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, replica := range r.replicas {
+		if replica.conn == conn {
+			replica.Ack(offset)
+		}
+	}
+	close(r.acks)
+	r.acks = make(chan struct{})
+}
+
+// AckNotify is closed the next time a replica acks. Take it before
+// counting acks, so an ack in between the two isn't missed.
+func (r *Replication) AckNotify() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.acks
+}
+
+// Acked counts the replicas that have applied the stream up to offset.
+func (r *Replication) Acked(offset int64) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for _, replica := range r.replicas {
+		if replica.AckOffset() >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// Allows decides whether our role lets a client run a command with flags.
+// Replicas keep clients' writes off the master's dataset, and can refuse to
+// serve data they know is stale, masters refuse writes they can't replicate.
+func (r *Replication) Allows(config *SharedRWStore[string], flags CommandFlags) error {
+	link := r.Master()
+	if link == nil {
+		if flags&CmdWrite != 0 && !r.EnoughReplicas(config) {
+			return ErrNoReplicas
+		}
+		return nil
+	}
+	if readOnly, _ := config.Get("replica-read-only"); flags&CmdWrite != 0 && readOnly != "no" {
+		return ErrReadOnlyReplica
+	}
+	if serveStale, _ := config.Get("replica-serve-stale-data"); flags&CmdStale == 0 && serveStale == "no" && link.State() != ReplStateConnected {
+		return ErrMasterDown
+	}
+	return nil
+}
+
+// EnoughReplicas is whether min-replicas-to-write replicas have acked within
+// the last min-replicas-max-lag seconds, masters refuse writes when they
+// haven't, so that a partitioned master can't take writes nobody will see.
+func (r *Replication) EnoughReplicas(config *SharedRWStore[string]) bool {
+	minReplicas, _ := config.Get("min-replicas-to-write")
+	maxLag, _ := config.Get("min-replicas-max-lag")
+	want, e := strconv.Atoi(minReplicas)
+	if e != nil || want <= 0 {
+		return true
+	}
+	lag, e := strconv.Atoi(maxLag)
+	if e != nil || lag <= 0 {
+		return true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.link != nil {
+		return true
+	}
+	good := 0
+	for _, replica := range r.replicas {
+		if replica.Good(time.Duration(lag) * time.Second) {
+			good++
+		}
+	}
+	return good >= want
+}
+
+// ReplID is the id and offset a replica would resync from.
+func (r *Replication) ReplID() (string, int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.replid, r.offset
+}
+
+// Replicas lists the replicas attached to us.
+func (r *Replication) Replicas() []*ReplicaConn {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*ReplicaConn(nil), r.replicas...)
+}
+
+// cron pings the replicas now and then, so that a quiet master isn't
+// mistaken for a dead one.
+func (r *Replication) cron(server *Server) {
+	lastPing := time.Now()
+	for range time.Tick(time.Second) {
+		period, _ := server.Config.Get("repl-ping-replica-period")
+		seconds, e := strconv.Atoi(period)
+		if e != nil || seconds <= 0 {
+			seconds = 10
+		}
+		if time.Since(lastPing) < time.Duration(seconds)*time.Second {
+			continue
+		}
+		lastPing = time.Now()
+		if len(r.Replicas()) == 0 || r.WritesPaused() != nil {
+			continue
+		}
+		// the ping is part of the stream, so it's written under Exec like any other write.
+		server.Exec.Lock()
+		r.Feed(bulkStrings("PING"))
+		server.Exec.Unlock()
+	}
+}
+
+// InfoLines reports the same fields as the replication section of redis' INFO.
+func (r *Replication) InfoLines() []string {
+	lines := []string{"role:master"}
+	if link := r.Master(); link != nil {
+		lines = append([]string{"role:slave"}, link.InfoLines()...)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(r.replicas)))
+	for i, replica := range r.replicas {
+		lines = append(lines, fmt.Sprintf("slave%d:%s", i, replica.Info()))
+	}
+	replid2 := r.replid2
+	if replid2 == "" {
+		replid2 = strings.Repeat("0", 40)
+	}
+	lines = append(lines,
+		fmt.Sprintf("master_failover_state:%s", r.failover.State()),
+		fmt.Sprintf("master_replid:%s", r.replid),
+		fmt.Sprintf("master_replid2:%s", replid2),
+		fmt.Sprintf("master_repl_offset:%d", r.offset),
+		fmt.Sprintf("second_repl_offset:%d", r.secondOffset),
+	)
+	if r.backlog == nil {
+		return append(lines, "repl_backlog_active:0")
+	}
+	return append(lines,
+		"repl_backlog_active:1",
+		fmt.Sprintf("repl_backlog_size:%d", r.backlog.Size()),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", r.backlog.FirstOffset()),
+		fmt.Sprintf("repl_backlog_histlen:%d", r.backlog.Histlen()),
+	)
+}
+
+// MasterLink is a replica's connection to its master. It syncs on every
+// connect, then applies the writes the master streams to it. Where we are in
+// the master's history is kept by repl, which passes the stream on.
+type MasterLink struct {
+	host   string
+	port   string
+	repl   *Replication
+	server *Server
+	stop   chan struct{}
+
+	writeLock sync.Mutex // acks are written from two goroutines
+
+	lock      sync.Mutex
+	conn      net.Conn
+	state     string
+	lastIO    time.Time
+	downSince time.Time
+}
+
+func NewMasterLink(repl *Replication, server *Server, host string, port string) *MasterLink {
+	return &MasterLink{
+		host:      host,
+		port:      port,
+		repl:      repl,
+		server:    server,
+		stop:      make(chan struct{}),
+		state:     ReplStateConnecting,
+		downSince: time.Now(),
+	}
+}
+
+// Stop closes the link, it doesn't wait for a command being applied to finish.
+func (ml *MasterLink) Stop() {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	select {
+	case <-ml.stop:
+		return
+	default:
+	}
+	close(ml.stop)
+	if ml.conn != nil {
+		ml.conn.Close()
+	}
+}
+
+func (ml *MasterLink) stopped() bool {
+	select {
+	case <-ml.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// State is one of the ReplState constants.
+func (ml *MasterLink) State() string {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	return ml.state
+}
+
+// Offset is how far into the master's replication stream we are.
+func (ml *MasterLink) Offset() int64 {
+	_, offset := ml.repl.ReplID()
+	return offset
+}
+
+func (ml *MasterLink) setState(state string) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if ml.state == ReplStateConnected && state != ReplStateConnected {
+		ml.downSince = time.Now()
+	}
+	ml.state = state
+}
+
+// attach makes conn the link's connection, so Stop can interrupt it.
+func (ml *MasterLink) attach(conn net.Conn) bool {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if ml.stopped() {
+		return false
+	}
+	ml.conn = conn
+	ml.lastIO = time.Now()
+	return true
+}
+
+// touch notes that we've heard from the master.
+func (ml *MasterLink) touch() {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	ml.lastIO = time.Now()
+}
+
+func (ml *MasterLink) run() {
+	fmt.Println("[repl] replicating", net.JoinHostPort(ml.host, ml.port))
+	for {
+		e := ml.connectAndSync()
+		ml.setState(ReplStateConnecting)
+		if ml.stopped() {
+			fmt.Println("[repl] stopped replicating", net.JoinHostPort(ml.host, ml.port))
+			return
+		}
+		fmt.Println("[repl] lost the link to the master, retrying", e)
+		select {
+		case <-ml.stop:
+		case <-time.After(replRetryInterval):
+		}
+	}
+}
+
+func (ml *MasterLink) connectAndSync() error {
+	conn, e := net.DialTimeout("tcp", net.JoinHostPort(ml.host, ml.port), replHandshakeTimeout)
+	if e != nil {
+		ml.repl.failoverHandshaken(ml, e)
+		return e
+	}
+	defer conn.Close()
+	if !ml.attach(conn) {
+		return ErrReplLinkStopped
+	}
+
+	ml.setState(ReplStateHandshake)
+	conn.SetDeadline(time.Now().Add(replHandshakeTimeout))
+	br := bufio.NewReader(conn)
+	replid, offset, full, e := ml.handshake(conn, br)
+	// a FAILOVER that made us a replica of its target is over either way.
+	ml.repl.failoverHandshaken(ml, e)
+	if e != nil {
+		return e
+	}
+	if full {
+		ml.setState(ReplStateTransfer)
+		conn.SetDeadline(time.Now().Add(ml.timeout()))
+		if e := ml.loadPayload(conn, br); e != nil {
+			return e
+		}
+		ml.repl.fullSynced(replid, offset, replBacklogSize(ml.server.Config))
+	}
+	ml.setState(ReplStateConnected)
+	fmt.Println("[repl] master link is up at offset", ml.Offset())
+	done := make(chan struct{})
+	defer close(done)
+	go ml.ackLoop(conn, done)
+	return ml.stream(conn, br)
+}
+
+// handshake tells the master about us and asks for the stream. When the
+// master is going to send a full copy of the dataset first, it returns the
+// id and offset that copy is as of.
+func (ml *MasterLink) handshake(conn net.Conn, br *bufio.Reader) (string, int64, bool, error) {
+	reply, e := ml.command(conn, br, "PING")
+	if e != nil {
+		return "", 0, false, e
+	}
+	if reply != "+PONG" {
+		return "", 0, false, ErrReplHandshake{"PING", reply}
+	}
+
+	// errors to REPLCONF are ignored, masters that don't know it can still sync us.
+	port, _ := ml.server.Config.Get("port")
+	if _, e := ml.command(conn, br, "REPLCONF", "listening-port", port); e != nil {
+		return "", 0, false, e
+	}
+	if _, e := ml.command(conn, br, "REPLCONF", "capa", "eof", "capa", "psync2"); e != nil {
+		return "", 0, false, e
+	}
+
+	replid, offset := ml.repl.psyncFrom()
+	psync := []string{"PSYNC", replid, strconv.FormatInt(offset, 10)}
+	// the target of our FAILOVER takes this as its cue to become the master.
+	if ml.repl.failingOverTo(ml) {
+		psync = append(psync, "FAILOVER")
+	}
+	// a master streaming the rdb may hold the reply back while more replicas turn up.
+	conn.SetDeadline(time.Now().Add(ml.timeout()))
+	reply, e = ml.command(conn, br, psync...)
+	if e != nil {
+		return "", 0, false, e
+	}
+
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, e := strconv.ParseInt(fields[2], 10, 64)
+		if e != nil {
+			return "", 0, false, ErrReplHandshake{"PSYNC", reply}
+		}
+		ml.repl.fullSyncStarted()
+		return fields[1], offset, true, nil
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		// the master may have changed its id (after a failover), the offsets carry on.
+		if len(fields) == 2 {
+			ml.repl.continued(fields[1])
+		}
+		return "", 0, false, nil
+	}
+	return "", 0, false, ErrReplHandshake{"PSYNC", reply}
+}
+
+// command sends a command to the master and reads its one line reply,
+// skipping the bare newlines a master sends to keep us waiting on it.
+func (ml *MasterLink) command(conn net.Conn, br *bufio.Reader, parts ...string) (string, error) {
+	payload, e := RespValue{Array, bulkStrings(parts...)}.Serialize()
+	if e != nil {
+		return "", e
+	}
+	if _, e := conn.Write(payload); e != nil {
+		return "", e
+	}
+	return ml.readLine(conn, br)
+}
+
+func (ml *MasterLink) readLine(conn net.Conn, br *bufio.Reader) (string, error) {
+	for {
+		line, e := br.ReadString('\n')
+		if e != nil {
+			return "", e
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			return line, nil
+		}
+		conn.SetDeadline(time.Now().Add(ml.timeout()))
+	}
+}
+
+// loadPayload replaces the dataset with the rdb the master sends after a
+// FULLRESYNC. It comes either as a bulk string, or, when the master streams
+// it as it goes, as "$EOF:<mark>" followed by the rdb and then the mark.
+func (ml *MasterLink) loadPayload(conn net.Conn, br *bufio.Reader) error {
+	line, e := ml.readLine(conn, br)
+	if e != nil {
+		return e
+	}
+	var payload io.Reader
+	var size int64
+	if mark, isEOF := strings.CutPrefix(line, "$EOF:"); isEOF && len(mark) == replEOFMarkLen {
+		payload = newEOFMarkReader(br, []byte(mark))
+	} else if size, e = strconv.ParseInt(strings.TrimPrefix(line, "$"), 10, 64); e == nil && line[0] == '$' && size >= 0 {
+		payload = io.LimitReader(br, size)
+	} else {
+		return ErrReplHandshake{"PSYNC", line}
+	}
+	payload = deadlineReader{payload, conn, ml.timeout()}
+
+	server := ml.server
+	mode, _ := server.Config.Get("repl-diskless-load")
+	switch {
+	case mode == DisklessLoadSwapDB:
+		e = ml.loadSwap(payload)
+	case mode == DisklessLoadOnEmptyDB && server.KVStore.Len() == 0:
+		e = ml.loadLive(payload, size)
+	default:
+		e = ml.loadFromDisk(payload, size)
+	}
+	if e != nil {
+		return e
+	}
+
+	// the aof still holds the dataset we just threw away, start it over from the new one.
+	if server.AOF != nil {
+		server.Exec.Lock()
+		if e := server.AOF.StartRewrite(server.Dataset()); e != nil {
+			fmt.Println("[err] failed to rewrite the aof after a full sync", e)
+		}
+		server.Exec.Unlock()
+	}
+	return nil
+}
+
+// loadLive clears the dataset and loads payload straight into it. Like
+// loading at startup, clients are kept off the stores by the loading state
+// until it's done, which lets INFO and friends still answer.
+func (ml *MasterLink) loadLive(payload io.Reader, size int64) error {
+	server := ml.server
+	db := server.Dataset()
+	server.Exec.Lock()
+	server.Loading.Begin(size)
+	db.DB.Clear()
+	db.Expiry.Clear()
+	db.Functions.Flush()
+	server.Watches.TouchAll()
+	server.Exec.Unlock()
+	defer server.Loading.Finish()
+
+	loader := NewRDBLoaderInto(db)
+	e := NewRDBStreamParser(progressReader{payload, server.Loading}, progressVisitor{loader, server.Loading}).
+		SkipZeroChecksum(true).
+		Parse()
+	if e != nil {
+		return e
+	}
+	if _, e := io.Copy(io.Discard, payload); e != nil {
+		return e
+	}
+	fmt.Println("[repl] loaded", loader.Keys(), "keys from the master")
+	return nil
+}
+
+// loadFromDisk saves the payload to a temp file before loading it, we keep
+// serving the old dataset until the whole rdb has arrived.
+func (ml *MasterLink) loadFromDisk(payload io.Reader, size int64) error {
+	dir, _ := ml.server.Config.Get("dir")
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+	f, e := os.CreateTemp(dir, "temp-repl-*.rdb")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if size, e = io.Copy(f, payload); e != nil {
+		return e
+	}
+	if _, e := f.Seek(0, io.SeekStart); e != nil {
+		return e
+	}
+	return ml.loadLive(f, size)
+}
+
+// loadSwap loads the payload into a fresh dataset while we keep serving the
+// old one, and swaps it in once it has all loaded. A failed sync leaves the
+// old dataset in place, at the price of holding both in memory. It's the
+// stores' contents that are swapped rather than the stores, so whatever
+// reads them without holding Exec never sees the server's fields change.
+func (ml *MasterLink) loadSwap(payload io.Reader) error {
+	db := NewRevivedDb()
+	loader := NewRDBLoaderInto(db)
+	if e := NewRDBStreamParser(payload, loader).SkipZeroChecksum(true).Parse(); e != nil {
+		return e
+	}
+	if _, e := io.Copy(io.Discard, payload); e != nil {
+		return e
+	}
+	server := ml.server
+	server.Exec.Lock()
+	server.KVStore.Replace(db.DB)
+	server.ExpiryStore.Replace(db.Expiry)
+	server.Functions.Replace(db.Functions)
+	server.Watches.TouchAll()
+	server.Exec.Unlock()
+	fmt.Println("[repl] swapped in", loader.Keys(), "keys from the master")
+	return nil
+}
+
+// stream applies the writes the master sends, nobody gets a reply to them.
+// Each one is passed on to our replicas as it's applied, byte for byte, so
+// their offsets stay the master's offsets. A transaction is only passed on,
+// and counted in our offset, once its EXEC has been applied: if the link
+// drops part way through one we carry on from before its MULTI.
+func (ml *MasterLink) stream(conn net.Conn, br *bufio.Reader) error {
+	server := ml.server
+	ctx := NewRequestContext(io.Discard, server)
+	ctx.FromMaster, ctx.InExec, ctx.Client = true, true, NewClient()
+	var pending []byte
+	pr := NewProtocolReader(deadlineReader{br, conn, ml.timeout()}, &RespParser{}).KeepRaw()
+	for {
+		msg, e := pr.ReadProto()
+		if e != nil {
+			return e
+		}
+		if ml.stopped() {
+			return ErrReplLinkStopped
+		}
+		var args []RespValue
+		if msg.isArray() {
+			args = msg.Value.([]RespValue)
+		}
+		// the master asking where we're up to is answered, not applied, and
+		// the answer doesn't count the question.
+		getack := len(args) >= 2 && args[0].EqualAsciiInsensitive("replconf") && args[1].EqualAsciiInsensitive("getack")
+		if getack {
+			if e := ml.sendAck(conn); e != nil {
+				return e
+			}
+		}
+		// the write and its place in the stream go together, anyone taking a
+		// snapshot for our own replicas sees both or neither.
+		server.Exec.Lock()
+		pending = append(pending, pr.Raw()...)
+		if !inTransaction(ctx.Client, args) {
+			if !ml.repl.proxy(ml, pending) {
+				server.Exec.Unlock()
+				return ErrReplLinkStopped
+			}
+			pending = pending[:0]
+		}
+		if args != nil && !getack {
+			ctx.Router.Route(ctx, args)
+		}
+		server.Exec.Unlock()
+		ml.touch()
+	}
+}
+
+// inTransaction is whether a command from our master is part of a
+// transaction that its EXEC (or DISCARD) hasn't ended yet.
+func inTransaction(c *Client, args []RespValue) bool {
+	if len(args) == 0 {
+		return c.queueing() != nil
+	}
+	if c.queueing() == nil {
+		return args[0].EqualAsciiInsensitive("multi")
+	}
+	return !args[0].EqualAsciiInsensitive("exec") && !args[0].EqualAsciiInsensitive("discard")
+}
+
+// ackLoop tells the master how far we've got every second, until done is
+// closed. It's how the master knows we're alive and how far behind we are.
+func (ml *MasterLink) ackLoop(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+	for {
+		if e := ml.sendAck(conn); e != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAck sends REPLCONF ACK with our offset, it's the only thing we ever
+// write to the master once the stream has started.
+func (ml *MasterLink) sendAck(conn net.Conn) error {
+	payload, e := RespValue{Array, bulkStrings("REPLCONF", "ACK", strconv.FormatInt(ml.Offset(), 10))}.Serialize()
+	if e != nil {
+		return e
+	}
+	ml.writeLock.Lock()
+	defer ml.writeLock.Unlock()
+	_, e = deadlineWriter{conn, ml.timeout()}.Write(payload)
+	return e
+}
+
+// timeout is how long the master can go quiet before we give up on it.
+func (ml *MasterLink) timeout() time.Duration {
+	return replTimeout(ml.server.Config)
+}
+
+// InfoLines reports the replica fields of redis' INFO replication section.
+func (ml *MasterLink) InfoLines() []string {
+	offset := ml.Offset()
+	priority, _ := ml.server.Config.Get("replica-priority")
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	status, syncing := "down", 0
+	if ml.state == ReplStateConnected {
+		status = "up"
+	}
+	if ml.state == ReplStateTransfer {
+		syncing = 1
+	}
+	lastIO := -1
+	if !ml.lastIO.IsZero() {
+		lastIO = int(time.Since(ml.lastIO).Seconds())
+	}
+	lines := []string{
+		fmt.Sprintf("master_host:%s", ml.host),
+		fmt.Sprintf("master_port:%s", ml.port),
+		fmt.Sprintf("master_link_status:%s", status),
+		fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+		fmt.Sprintf("master_sync_in_progress:%d", syncing),
+		fmt.Sprintf("slave_repl_offset:%d", offset),
+		fmt.Sprintf("slave_priority:%s", priority),
+	}
+	if status == "down" {
+		lines = append(lines, fmt.Sprintf("master_link_down_since_seconds:%d", int(time.Since(ml.downSince).Seconds())))
+	}
+	return lines
+}
+
+// deadlineReader pushes the connection's deadline back on every read, so the
+// link only times out when the master goes quiet.
+type deadlineReader struct {
+	r       io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (dr deadlineReader) Read(p []byte) (int, error) {
+	dr.conn.SetDeadline(time.Now().Add(dr.timeout))
+	return dr.r.Read(p)
+}
+
+// parseReplicaOf splits a "host port" address, as given to --replicaof.
+func parseReplicaOf(addr string) (string, string, error) {
+	fields := strings.Fields(addr)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("invalid replicaof '%s', expected 'host port'", addr)
+	}
+	if _, e := strconv.ParseUint(fields[1], 10, 16); e != nil {
+		return "", "", fmt.Errorf("invalid replicaof port '%s'", fields[1])
+	}
+	return fields[0], fields[1], nil
+}
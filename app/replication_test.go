@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// fakeMaster answers a replica's handshake the way redis does, and reports
+// the PSYNC it was sent.
+func fakeMaster(t *testing.T, l net.Listener, psyncReply string) (net.Conn, []string) {
+	conn, e := l.Accept()
+	if e != nil {
+		t.Error(e)
+		return nil, nil
+	}
+	pr := NewProtocolReader(conn, &RespParser{})
+	var psync []string
+	for _, reply := range []string{"+PONG", "+OK", "+OK", psyncReply} {
+		cmd, e := pr.ReadProto()
+		if e != nil {
+			t.Error(e)
+			return nil, nil
+		}
+		psync = psync[:0]
+		for _, arg := range cmd.Value.([]RespValue) {
+			psync = append(psync, arg.String())
+		}
+		conn.Write([]byte(reply + "\r\n"))
+	}
+	return conn, psync
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicaSync(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	master := NewRevivedDb()
+	master.DB.Set("a", RespValue{BulkString, []byte("1")})
+	var rdb bytes.Buffer
+	if e := writeRDBSnapshot(NewRDBFileWriter(&rdb), master); e != nil {
+		t.Fatal(e)
+	}
+	writes, _ := RespValue{Array, bulkStrings("SET", "b", "2")}.Serialize()
+	more, _ := RespValue{Array, bulkStrings("SET", "c", "3")}.Serialize()
+	replid := "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
+
+	ctx := newTestContext(nil)
+	ctx.Router = initCommandRouter(NewCommandRouter())
+	ctx.Config.Set("dir", t.TempDir())
+	ctx.KVStore.Set("stale", RespValue{BulkString, []byte("x")})
+
+	synced := make(chan struct{})
+	go func() {
+		conn, psync := fakeMaster(t, l, "+FULLRESYNC "+replid+" 100")
+		if conn == nil {
+			return
+		}
+		if psync[1] != "?" || psync[2] != "-1" {
+			t.Errorf("expected a full sync to be asked for, got %v", psync)
+		}
+		conn.Write([]byte("\n\n$" + strconv.Itoa(rdb.Len()) + "\r\n"))
+		conn.Write(rdb.Bytes())
+		conn.Write(writes)
+		<-synced
+		conn.Close()
+
+		// the replica comes back asking to carry on from where it got to.
+		conn, psync = fakeMaster(t, l, "+CONTINUE")
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		if want := strconv.Itoa(100 + len(writes) + 1); psync[1] != replid || psync[2] != want {
+			t.Errorf("expected PSYNC %s %s, got %v", replid, want, psync)
+		}
+		conn.Write(more)
+		<-synced
+	}()
+
+	ctx.Repl.ReplicaOf(ctx.Server, host, port)
+	link := ctx.Repl.Master()
+	waitFor(t, "the first write", func() bool { return link.Offset() == int64(100+len(writes)) })
+	if _, exists := ctx.KVStore.Get("stale"); exists {
+		t.Fatal("expected the full sync to replace the dataset")
+	}
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if got, _ := ctx.KVStore.Get(k); got.String() != v {
+			t.Fatalf("expected %s=%s, got '%s'", k, v, got.String())
+		}
+	}
+	synced <- struct{}{}
+
+	waitFor(t, "the partial resync", func() bool { return link.Offset() == int64(100+len(writes)+len(more)) })
+	if got, _ := ctx.KVStore.Get("c"); got.String() != "3" {
+		t.Fatalf("expected the write after the resync to be applied, got '%s'", got.String())
+	}
+	if link.State() != ReplStateConnected {
+		t.Fatalf("expected the link to be up, got %s", link.State())
+	}
+	synced <- struct{}{}
+
+	ctx.Repl.Detach()
+	if ctx.Repl.Master() != nil || ctx.Repl.InfoLines()[0] != "role:master" {
+		t.Fatal("expected REPLICAOF NO ONE to make us a master")
+	}
+}
+
+func TestReplBacklog(t *testing.T) {
+	b := NewReplBacklog(8, 100)
+	b.Write([]byte("abcde"))
+	if got, ok := b.From(103); !ok || string(got) != "cde" {
+		t.Fatalf("expected cde, got %q %v", got, ok)
+	}
+	b.Write([]byte("fghijk"))
+	if b.FirstOffset() != 104 || b.Histlen() != 8 {
+		t.Fatalf("expected the backlog to hold 104 onwards, got %d (%d bytes)", b.FirstOffset(), b.Histlen())
+	}
+	if got, ok := b.From(104); !ok || string(got) != "defghijk" {
+		t.Fatalf("expected the wrapped tail, got %q %v", got, ok)
+	}
+	if _, ok := b.From(103); ok {
+		t.Fatal("expected an overwritten offset to be refused")
+	}
+	if got, ok := b.From(112); !ok || len(got) != 0 {
+		t.Fatal("expected a replica that is up to date to be given nothing")
+	}
+}
+
+// startTestServer serves ctx on a local port, the way main does.
+func startTestServer(t *testing.T, ctx RequestContext) string {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go handleConnection(conn, ctx.Router, NewRequestContext(conn, ctx.Server))
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestMasterReplica(t *testing.T) {
+	for _, mode := range []struct{ sync, load string }{
+		{"no", DisklessLoadDisabled},
+		{"yes", DisklessLoadDisabled},
+		{"yes", DisklessLoadSwapDB},
+		{"no", DisklessLoadOnEmptyDB},
+	} {
+		t.Run("diskless-sync="+mode.sync+",diskless-load="+mode.load, func(t *testing.T) {
+			testMasterReplica(t, mode.sync, mode.load)
+		})
+	}
+}
+
+func testMasterReplica(t *testing.T, disklessSync string, disklessLoad string) {
+	router := initCommandRouter(NewCommandRouter())
+	master := newTestContext(nil)
+	master.Router = router
+	master.Config.Set("dir", t.TempDir())
+	master.Config.Set("repl-backlog-size", "1mb")
+	master.Config.Set("repl-diskless-sync", disklessSync)
+	master.Config.Set("repl-diskless-sync-delay", "0")
+	port := startTestServer(t, master)
+
+	router.Route(master, bulkStrings("SET", "a", "1"))
+	router.Route(master, bulkStrings("SET", "gone", "1", "PX", "1"))
+
+	replica := newTestContext(nil)
+	replica.Router = router
+	replica.Config.Set("dir", t.TempDir())
+	replica.Config.Set("repl-diskless-load", disklessLoad)
+	replica.Repl.ReplicaOf(replica.Server, "127.0.0.1", port)
+	t.Cleanup(replica.Repl.Detach)
+	link := replica.Repl.Master()
+	waitFor(t, "the full sync", func() bool { return link.State() == ReplStateConnected })
+	if got, _ := replica.KVStore.Get("a"); got.String() != "1" {
+		t.Fatalf("expected a=1 from the rdb, got '%s'", got.String())
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if activeExpireCycle(master) != 1 {
+		t.Fatal("expected the expired key to be deleted")
+	}
+	router.Route(master, bulkStrings("SET", "b", "2"))
+	_, offset := master.Repl.ReplID()
+	waitFor(t, "the stream", func() bool { return link.Offset() == offset })
+	if _, exists := replica.KVStore.Get("gone"); exists {
+		t.Fatal("expected the expiry to reach the replica as a DEL")
+	}
+	if got, _ := replica.KVStore.Get("b"); got.String() != "2" {
+		t.Fatalf("expected b=2 on the replica, got '%s'", got.String())
+	}
+
+	// a replica that drops off briefly only gets what it missed.
+	replica.KVStore.Set("marker", RespValue{BulkString, []byte("kept")})
+	link.lock.Lock()
+	link.conn.Close()
+	link.lock.Unlock()
+	router.Route(master, bulkStrings("SET", "c", "3"))
+	_, offset = master.Repl.ReplID()
+	waitFor(t, "the partial resync", func() bool { return link.Offset() == offset && link.State() == ReplStateConnected })
+	if _, exists := replica.KVStore.Get("marker"); !exists {
+		t.Fatal("expected a partial resync, the dataset was replaced")
+	}
+	if got, _ := replica.KVStore.Get("c"); got.String() != "3" {
+		t.Fatalf("expected the missed write, got '%s'", got.String())
+	}
+	waitFor(t, "the master to list the replica", func() bool { return len(master.Repl.Replicas()) == 1 })
+}
+
+func TestEOFMarkReader(t *testing.T) {
+	mark := "0123456789012345678901234567890123456789"
+	body := strings.Repeat("rdb bytes ", 1000)
+	er := newEOFMarkReader(iotest.OneByteReader(strings.NewReader(body+mark)), []byte(mark))
+	got, e := io.ReadAll(er)
+	if e != nil || string(got) != body {
+		t.Fatalf("expected the body without the mark, got %d bytes, %v", len(got), e)
+	}
+	er = newEOFMarkReader(strings.NewReader(body), []byte(mark))
+	if _, e := io.ReadAll(er); e != io.ErrUnexpectedEOF {
+		t.Fatalf("expected a transfer cut short to be an error, got %v", e)
+	}
+}
+
+func TestWaitAndMinReplicas(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	master := newTestContext(nil)
+	master.Router = router
+	master.Config.Set("dir", t.TempDir())
+	port := startTestServer(t, master)
+
+	replica := newTestContext(nil)
+	replica.Router = router
+	replica.Config.Set("dir", t.TempDir())
+	replica.Repl.ReplicaOf(replica.Server, "127.0.0.1", port)
+	t.Cleanup(replica.Repl.Detach)
+	waitFor(t, "the replica to come online", func() bool {
+		replicas := master.Repl.Replicas()
+		return len(replicas) == 1 && replicas[0].Good(time.Second)
+	})
+
+	var out bytes.Buffer
+	client := NewRequestContext(&out, master.Server)
+	router.Route(client, bulkStrings("SET", "a", "1"))
+	router.Route(client, bulkStrings("WAIT", "1", "0"))
+	if out.String() != "+OK\r\n:1\r\n" {
+		t.Fatalf("expected the write to be acked by the replica, got %q", out.String())
+	}
+
+	out.Reset()
+	start := time.Now()
+	router.Route(client, bulkStrings("WAIT", "2", "100"))
+	if out.String() != ":1\r\n" || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("expected WAIT to time out with 1 replica, got %q after %v", out.String(), time.Since(start))
+	}
+
+	out.Reset()
+	master.Config.Set("min-replicas-max-lag", "10")
+	master.Config.Set("min-replicas-to-write", "2")
+	router.Route(client, bulkStrings("SET", "b", "2"))
+	master.Config.Set("min-replicas-to-write", "1")
+	router.Route(client, bulkStrings("SET", "b", "2"))
+	if out.String() != "-"+ErrNoReplicas.Error()+"\r\n+OK\r\n" {
+		t.Fatalf("expected the write to need 2 good replicas, got %q", out.String())
+	}
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	replica := newTestContext(nil)
+	replica.Router = router
+	// nothing listens on port 1, so the link stays down.
+	replica.Repl.ReplicaOf(replica.Server, "127.0.0.1", "1")
+	t.Cleanup(replica.Repl.Detach)
+
+	var out bytes.Buffer
+	client := NewRequestContext(&out, replica.Server)
+	router.Route(client, bulkStrings("SET", "a", "1"))
+	replica.Config.Set("replica-read-only", "no")
+	router.Route(client, bulkStrings("SET", "a", "1"))
+	if out.String() != "-"+ErrReadOnlyReplica.Error()+"\r\n+OK\r\n" {
+		t.Fatalf("expected writes only once the replica is writable, got %q", out.String())
+	}
+
+	out.Reset()
+	router.Route(client, bulkStrings("GET", "a"))
+	replica.Config.Set("replica-serve-stale-data", "no")
+	router.Route(client, bulkStrings("GET", "a"))
+	if out.String() != "$1\r\n1\r\n-"+ErrMasterDown.Error()+"\r\n" {
+		t.Fatalf("expected stale reads to be refused, got %q", out.String())
+	}
+
+	out.Reset()
+	router.Route(client, bulkStrings("INFO", "replication"))
+	if !bytes.Contains(out.Bytes(), []byte("master_link_status:down")) {
+		t.Fatalf("expected INFO to answer while the link is down, got %q", out.String())
+	}
+
+	// the master's own writes get through whatever the settings.
+	replica.Config.Set("replica-read-only", "yes")
+	stream := NewRequestContext(&out, replica.Server)
+	stream.FromMaster = true
+	router.Route(stream, bulkStrings("SET", "b", "2"))
+	if got, _ := replica.KVStore.Get("b"); got.String() != "2" {
+		t.Fatal("expected the master's write to be applied")
+	}
+}
+
+// startTestNode starts a server that replicas can connect to, replicating
+// masterPort unless it's "".
+func startTestNode(t *testing.T, router CommandRouter, masterPort string) (RequestContext, string) {
+	ctx := newTestContext(nil)
+	ctx.Router = router
+	ctx.Config.Set("dir", t.TempDir())
+	ctx.Config.Set("repl-diskless-sync-delay", "0")
+	port := startTestServer(t, ctx)
+	ctx.Config.Set("port", port)
+	if masterPort != "" {
+		ctx.Repl.ReplicaOf(ctx.Server, "127.0.0.1", masterPort)
+	}
+	t.Cleanup(ctx.Repl.Detach)
+	return ctx, port
+}
+
+func linkUp(ctx RequestContext) bool {
+	link := ctx.Repl.Master()
+	return link != nil && link.State() == ReplStateConnected
+}
+
+func TestChainedReplicas(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	master, port := startTestNode(t, router, "")
+	router.Route(master, bulkStrings("SET", "a", "1"))
+	replica, replicaPort := startTestNode(t, router, port)
+	waitFor(t, "the replica to sync", func() bool { return linkUp(replica) })
+	chained, _ := startTestNode(t, router, replicaPort)
+	waitFor(t, "the chained replica to sync", func() bool { return linkUp(chained) })
+
+	router.Route(master, bulkStrings("SET", "b", "2"))
+	replid, offset := master.Repl.ReplID()
+	waitFor(t, "the stream to reach the end of the chain", func() bool { return chained.Repl.Master().Offset() == offset })
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if got, _ := chained.KVStore.Get(k); got.String() != v {
+			t.Fatalf("expected %s=%s at the end of the chain, got '%s'", k, v, got.String())
+		}
+	}
+	if got, _ := chained.Repl.ReplID(); got != replid {
+		t.Fatalf("expected the whole chain to share the master's replid, got %s", got)
+	}
+}
+
+func TestPromoteReplica(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	master, port := startTestNode(t, router, "")
+	router.Route(master, bulkStrings("SET", "a", "1"))
+	promoted, promotedPort := startTestNode(t, router, port)
+	other, _ := startTestNode(t, router, port)
+	waitFor(t, "the replicas to sync", func() bool { return linkUp(promoted) && linkUp(other) })
+	router.Route(master, bulkStrings("SET", "b", "2"))
+	oldID, offset := master.Repl.ReplID()
+	waitFor(t, "the replicas to catch up", func() bool {
+		return promoted.Repl.Master().Offset() == offset && other.Repl.Master().Offset() == offset
+	})
+
+	var out bytes.Buffer
+	router.Route(NewRequestContext(&out, promoted.Server), bulkStrings("REPLICAOF", "NO", "ONE"))
+	if out.String() != "+OK\r\n" || promoted.Repl.Master() != nil {
+		t.Fatalf("expected the replica to be promoted, got %q", out.String())
+	}
+	newID, _ := promoted.Repl.ReplID()
+	info := strings.Join(promoted.Repl.InfoLines(), "\n")
+	if newID == oldID || !strings.Contains(info, "master_replid2:"+oldID) || !strings.Contains(info, "second_repl_offset:"+strconv.FormatInt(offset+1, 10)) {
+		t.Fatalf("expected a new replid with the old one kept as replid2, got\n%s", info)
+	}
+	router.Route(promoted, bulkStrings("SET", "c", "3"))
+
+	// the other replica carries on from the old history, a full sync would drop the marker.
+	other.KVStore.Set("marker", RespValue{BulkString, []byte("kept")})
+	other.Repl.ReplicaOf(other.Server, "127.0.0.1", promotedPort)
+	_, offset = promoted.Repl.ReplID()
+	waitFor(t, "the partial resync", func() bool { return linkUp(other) && other.Repl.Master().Offset() == offset })
+	if _, exists := other.KVStore.Get("marker"); !exists {
+		t.Fatal("expected a partial resync through the secondary replid, the dataset was replaced")
+	}
+	if got, _ := other.KVStore.Get("c"); got.String() != "3" {
+		t.Fatalf("expected the promoted replica's write, got '%s'", got.String())
+	}
+	if got, _ := other.Repl.ReplID(); got != newID {
+		t.Fatalf("expected the replica to follow the new replid, got %s", got)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	master, port := startTestNode(t, router, "")
+	target, targetPort := startTestNode(t, router, port)
+	waitFor(t, "the replica to come online", func() bool {
+		replicas := master.Repl.Replicas()
+		return len(replicas) == 1 && replicas[0].Online()
+	})
+
+	var out bytes.Buffer
+	client := NewRequestContext(&out, master.Server)
+	router.Route(client, bulkStrings("FAILOVER", "TO", "127.0.0.1", "1"))
+	router.Route(client, bulkStrings("FAILOVER", "FORCE"))
+	router.Route(client, bulkStrings("FAILOVER", "ABORT"))
+	want := "-ERR FAILOVER target HOST and PORT is not a replica.\r\n" +
+		"-ERR FAILOVER with force option requires both a timeout and target HOST and IP.\r\n" +
+		"-ERR No failover in progress.\r\n"
+	if out.String() != want {
+		t.Fatalf("expected the bad failovers to be refused, got %q", out.String())
+	}
+
+	out.Reset()
+	router.Route(client, bulkStrings("SET", "a", "1"))
+	router.Route(client, bulkStrings("FAILOVER", "TO", "127.0.0.1", targetPort, "TIMEOUT", "5000"))
+	if out.String() != "+OK\r\n+OK\r\n" {
+		t.Fatalf("expected the failover to start, got %q", out.String())
+	}
+	waitFor(t, "the roles to swap", func() bool {
+		return target.Repl.Master() == nil && linkUp(master) && master.Repl.WritesPaused() == nil
+	})
+
+	out.Reset()
+	router.Route(client, bulkStrings("SET", "b", "2"))
+	if out.String() != "-"+ErrReadOnlyReplica.Error()+"\r\n" {
+		t.Fatalf("expected the old master to be read only, got %q", out.String())
+	}
+	router.Route(target, bulkStrings("SET", "b", "2"))
+	_, offset := target.Repl.ReplID()
+	waitFor(t, "the new master's write", func() bool { return master.Repl.Master().Offset() == offset })
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if got, _ := master.KVStore.Get(k); got.String() != v {
+			t.Fatalf("expected %s=%s on the old master, got '%s'", k, v, got.String())
+		}
+	}
+	if !strings.Contains(strings.Join(master.Repl.InfoLines(), "\n"), "master_failover_state:no-failover") {
+		t.Fatal("expected the failover to be over")
+	}
+}
@@ -258,6 +258,9 @@ func serializeWithPrefixSlice(prefix []byte, body []byte) []byte {
 }
 
 func Deserialize(b []byte) (RespValue, int, error) {
+	if len(b) == 0 {
+		return incomplete()
+	}
 	switch b[0] {
 	case '+':
 		return DeserializeSimpleString(b)
@@ -270,7 +273,7 @@ func Deserialize(b []byte) (RespValue, int, error) {
 	case '*':
 		return DeserializeArray(b)
 	}
-	return RespValue{}, 0, nil
+	return err(ErrDeserializeUnexpectedType(b[0]))
 }
 
 func DeserializeSimpleString(b []byte) (RespValue, int, error) {
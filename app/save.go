@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var SaveCommand = Command{"save", save, 0}
+var BgSaveCommand = Command{"bgsave", bgsave, 0}
+var LastSaveCommand = Command{"lastsave", lastsave, CmdLoading}
+
+// SHUTDOWN NOSAVE is one of the commands that still runs while a script is
+// busy, it's the way out of one that can't be killed.
+var ShutdownCommand = Command{"shutdown", shutdown, CmdLoading | CmdStale | CmdNoScript}
+
+// exitProcess is how SHUTDOWN exits, tests swap it for something that doesn't.
+var exitProcess = os.Exit
+
+var ErrBgSaveInProgress = errors.New("ERR Background save already in progress")
+
+// RDBSaver writes the dataset to the configured rdb file. Saves run from a
+// copy on write snapshot, so writes carry on while the file is written.
+type RDBSaver struct {
+	lock     sync.Mutex
+	saving   bool
+	lastSave time.Time
+	lastErr  error
+}
+
+func NewRDBSaver() *RDBSaver {
+	return &RDBSaver{lastSave: time.Now()}
+}
+
+// Save writes snapshot to the rdb file and releases it. The file is written
+// under a temp name and renamed into place, so the rdb file on disk is always complete.
+func (rs *RDBSaver) Save(config *SharedRWStore[string], keys *KeyRing, snapshot RevivedDB) error {
+	defer snapshot.Release()
+	e := writeRDBFile(config, keys, snapshot)
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.lastErr = e
+	if e == nil {
+		rs.lastSave = time.Now()
+	}
+	return e
+}
+
+// Background runs Save in a goroutine, only one can run at a time.
+func (rs *RDBSaver) Background(config *SharedRWStore[string], keys *KeyRing, snapshot RevivedDB) error {
+	rs.lock.Lock()
+	if rs.saving {
+		rs.lock.Unlock()
+		snapshot.Release()
+		return ErrBgSaveInProgress
+	}
+	rs.saving = true
+	rs.lock.Unlock()
+
+	go func() {
+		start := time.Now()
+		e := rs.Save(config, keys, snapshot)
+		rs.lock.Lock()
+		rs.saving = false
+		rs.lock.Unlock()
+		if e != nil {
+			fmt.Println("[err] background save failed", e)
+			return
+		}
+		fmt.Println("background save finished in", time.Since(start))
+	}()
+	return nil
+}
+
+func (rs *RDBSaver) LastSave() time.Time {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.lastSave
+}
+
+// InfoLines reports the rdb fields of the persistence section of INFO.
+func (rs *RDBSaver) InfoLines() []string {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	status := "ok"
+	if rs.lastErr != nil {
+		status = "err"
+	}
+	saving := 0
+	if rs.saving {
+		saving = 1
+	}
+	return []string{
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", saving),
+		fmt.Sprintf("rdb_last_save_time:%d", rs.lastSave.Unix()),
+		fmt.Sprintf("rdb_last_bgsave_status:%s", status),
+	}
+}
+
+func writeRDBFile(config *SharedRWStore[string], keys *KeyRing, db RevivedDB) error {
+	dir, _ := config.Get("dir")
+	dbfilename, _ := config.Get("dbfilename")
+	compression, _ := config.Get("rdbcompression")
+	checksum, _ := config.Get("rdbchecksum")
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+
+	tmp := filepath.Join(dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, e := os.Create(tmp)
+	if e != nil {
+		return e
+	}
+	w, e := MaybeEncrypt(f, keys)
+	if e == nil {
+		rw := NewRDBFileWriter(w).Compression(compression == "yes").Checksum(checksum == "yes")
+		e = writeRDBSnapshot(rw, db)
+	}
+	if e == nil {
+		e = w.Close()
+	}
+	if e == nil {
+		e = f.Sync()
+	}
+	if closeErr := f.Close(); e == nil {
+		e = closeErr
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	if e := os.Rename(tmp, filepath.Join(dir, dbfilename)); e != nil {
+		return e
+	}
+	return syncDir(dir)
+}
+
+// neither save command takes the write lock, sharing Exec is enough to keep
+// writes out while the snapshot is taken, and they carry on while it is written.
+func save(ctx RequestContext, args []RespValue) {
+	if e := ctx.RDB.Save(ctx.Config, ctx.Keys, ctx.Dataset().Snapshot()); e != nil {
+		ctx.SendError("ERR " + e.Error())
+		return
+	}
+	ctx.SendSimpleString("OK")
+}
+
+func bgsave(ctx RequestContext, args []RespValue) {
+	if e := ctx.RDB.Background(ctx.Config, ctx.Keys, ctx.Dataset().Snapshot()); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	ctx.SendSimpleString("Background saving started")
+}
+
+func lastsave(ctx RequestContext, args []RespValue) {
+	ctx.SendResp(RespValue{Integer, int(ctx.RDB.LastSave().Unix())})
+}
+
+// shutdown is SHUTDOWN [NOSAVE|SAVE]. SAVE writes the rdb file first, and
+// the server stays up if that fails. The aof is flushed to disk either way.
+func shutdown(ctx RequestContext, args []RespValue) {
+	if e := checkArity("shutdown", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	saving := len(args) == 1 && args[0].EqualAsciiInsensitive("save")
+	if len(args) > 1 || (len(args) == 1 && !saving && !args[0].EqualAsciiInsensitive("nosave")) {
+		ctx.SendError("ERR syntax error")
+		return
+	}
+	if saving {
+		if e := ctx.RDB.Save(ctx.Config, ctx.Keys, ctx.Dataset().Snapshot()); e != nil {
+			fmt.Println("[err] failed to save before shutting down", e)
+			ctx.SendError("ERR Errors trying to SHUTDOWN. Check logs.")
+			return
+		}
+	}
+	if ctx.AOF != nil {
+		if e := ctx.AOF.Close(); e != nil {
+			fmt.Println("[err] failed to close the aof", e)
+		}
+	}
+	fmt.Println("shutting down")
+	exitProcess(0)
+}
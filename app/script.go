@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+var ErrNotFromScript = errors.New("ERR This Redis command is not allowed from script")
+var ErrWriteFromReadOnly = errors.New("ERR Write commands are not allowed from read-only scripts.")
+var ErrNotBusy = errors.New("NOTBUSY No scripts in execution right now.")
+var ErrUnkillable = errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+var ErrUnkillableFromMaster = errors.New("UNKILLABLE The busy script was sent by a master instance in the context of replication and cannot be killed.")
+
+// ErrBusy is the reply to everything but the command that can kill the
+// script that's busy, which is either SCRIPT KILL or FUNCTION KILL.
+type ErrBusy string
+
+func (e ErrBusy) Error() string {
+	return fmt.Sprintf("BUSY Redis is busy running a script. You can only call %s or SHUTDOWN NOSAVE.", string(e))
+}
+
+// scripts write, and hold Exec throughout, so that they run atomically.
+var EvalCommand = Command{"eval", eval, CmdWrite | CmdNoScript}
+var EvalShaCommand = Command{"evalsha", evalSha, CmdWrite | CmdNoScript}
+var ScriptCommand = Command{"script", scriptCmd, CmdLoading | CmdStale | CmdNoScript}
+
+// Scripts are the scripts that have been sent with EVAL or SCRIPT LOAD,
+// compiled and kept by the sha1 of their source, for EVALSHA.
+type Scripts struct {
+	lock    sync.RWMutex
+	scripts map[string]*luaProto
+}
+
+func NewScripts() *Scripts {
+	return &Scripts{scripts: map[string]*luaProto{}}
+}
+
+func scriptSha(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+// Load compiles a script and keeps it, it's only compiled the once.
+func (s *Scripts) Load(src string) (string, *luaProto, error) {
+	sha := scriptSha(src)
+	if proto, ok := s.Get(sha); ok {
+		return sha, proto, nil
+	}
+	proto, e := LuaCompile("user_script", src)
+	if e != nil {
+		return "", nil, fmt.Errorf("ERR Error compiling script (new function): %s", e)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scripts[sha] = proto
+	return sha, proto, nil
+}
+
+func (s *Scripts) Get(sha string) (*luaProto, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	proto, ok := s.scripts[strings.ToLower(sha)]
+	return proto, ok
+}
+
+func (s *Scripts) Flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scripts = map[string]*luaProto{}
+}
+
+// RunningScripts are the scripts and functions being run right now, oldest
+// first. Only one that writes can run at a time, but FCALL_ROs can run
+// alongside each other.
+type RunningScripts struct {
+	lock sync.Mutex
+	runs []*scriptRun
+}
+
+func NewRunningScripts() *RunningScripts {
+	return &RunningScripts{}
+}
+
+func (rs *RunningScripts) add(run *scriptRun) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.runs = append(rs.runs, run)
+}
+
+func (rs *RunningScripts) remove(run *scriptRun) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if i := slices.Index(rs.runs, run); i >= 0 {
+		rs.runs = slices.Delete(rs.runs, i, i+1)
+	}
+}
+
+// Busy is an error once the oldest script has been running for longer than
+// busy-reply-threshold, until it finishes or is killed.
+func (rs *RunningScripts) Busy(config *SharedRWStore[string]) error {
+	threshold := busyReplyThreshold(config)
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if len(rs.runs) == 0 || threshold <= 0 || time.Since(rs.runs[0].started) < threshold {
+		return nil
+	}
+	return ErrBusy(rs.runs[0].killCommand())
+}
+
+// Kill stops the oldest script, as long as it hasn't written anything yet:
+// what it's done so far has been applied and propagated, and can't be
+// taken back. function is whether it's FUNCTION KILL rather than SCRIPT KILL.
+func (rs *RunningScripts) Kill(function bool) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if len(rs.runs) == 0 {
+		return ErrNotBusy
+	}
+	run := rs.runs[0]
+	switch {
+	case run.ctx.FromMaster:
+		return ErrUnkillableFromMaster
+	case run.wrote.Load():
+		return ErrUnkillable
+	case run.function != function:
+		return ErrBusy(run.killCommand())
+	}
+	run.killed.Store(true)
+	return nil
+}
+
+// busyReplyThreshold is how long a script can run before other clients are
+// told it's busy, rather than waiting on it. 0 means they always wait.
+func busyReplyThreshold(config *SharedRWStore[string]) time.Duration {
+	threshold, _ := config.Get("busy-reply-threshold")
+	ms, e := strconv.Atoi(threshold)
+	if e != nil {
+		ms = 5000
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// busyCommand is whether a command is one of the few that run while a script
+// is busy. They don't wait on Exec, the script they're there to stop has it.
+func busyCommand(name string, args []RespValue) bool {
+	switch name {
+	case "script", "function":
+		return len(args) == 1 && args[0].EqualAsciiInsensitive("kill")
+	case "shutdown":
+		return len(args) == 1 && args[0].EqualAsciiInsensitive("nosave")
+	}
+	return false
+}
+
+// lockExec takes Exec, to itself for a write. A client that was already
+// waiting on it when a script went busy would otherwise wait the script
+// out, so while it waits it's told once a script is busy, like it would've
+// been had it arrived later. Our master is always waited on.
+func lockExec(ctx RequestContext, write bool) error {
+	lock, unlock, tryLock := ctx.Exec.RLock, ctx.Exec.RUnlock, ctx.Exec.TryRLock
+	if write {
+		lock, unlock, tryLock = ctx.Exec.Lock, ctx.Exec.Unlock, ctx.Exec.TryLock
+	}
+	if ctx.FromMaster {
+		lock()
+		return nil
+	}
+	if tryLock() {
+		return nil
+	}
+	// the lock's taken in the order it's asked for, so it's waited on
+	// rather than tried over and over, and let go again if we've given up.
+	locked, gaveUp := make(chan struct{}), make(chan struct{})
+	go func() {
+		lock()
+		select {
+		case locked <- struct{}{}:
+		case <-gaveUp:
+			unlock()
+		}
+	}()
+	ticker := time.NewTicker(lockExecBusyCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-locked:
+			return nil
+		case <-ticker.C:
+			if e := ctx.Running.Busy(ctx.Config); e != nil {
+				close(gaveUp)
+				return e
+			}
+		}
+	}
+}
+
+// lockExecBusyCheck is how often a client waiting on Exec checks whether a
+// script has gone busy.
+const lockExecBusyCheck = 10 * time.Millisecond
+
+// eval is EVAL script numkeys [key ...] [arg ...].
+func eval(ctx RequestContext, args []RespValue) {
+	if e := checkArity("eval", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	sha, proto, e := ctx.Scripts.Load(args[0].String())
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	runScript(ctx, sha, proto, args[1:])
+}
+
+// evalSha is EVALSHA sha1 numkeys [key ...] [arg ...], for running a script
+// that's been sent before without sending it again.
+func evalSha(ctx RequestContext, args []RespValue) {
+	if e := checkArity("evalsha", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	sha := strings.ToLower(args[0].String())
+	proto, ok := ctx.Scripts.Get(sha)
+	if !ok {
+		ctx.SendError(ErrNoScript.Error())
+		return
+	}
+	runScript(ctx, sha, proto, args[1:])
+}
+
+// scriptKeysArgs splits numkeys [key ...] [arg ...] into the keys and the args.
+func scriptKeysArgs(args []RespValue) ([]RespValue, []RespValue, error) {
+	numKeys, e := args[0].ToInt()
+	switch {
+	case e != nil:
+		return nil, nil, errors.New("ERR value is not an integer or out of range")
+	case numKeys < 0:
+		return nil, nil, errors.New("ERR Number of keys can't be negative")
+	case numKeys > len(args)-1:
+		return nil, nil, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+// scriptKeys are the keys EVAL and EVALSHA declare, for cluster mode.
+func scriptKeys(args []RespValue) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	keys, _, e := scriptKeysArgs(args[1:])
+	if e != nil {
+		return nil
+	}
+	return everyKey(keys)
+}
+
+// runScript runs a script with Exec held, so nobody sees the dataset part
+// way through it. Its writes are propagated between a MULTI and an EXEC,
+// the same as a transaction's are, rather than the script itself: replicas
+// and the aof get what it did, whatever it does when it's run again.
+func runScript(ctx RequestContext, sha string, proto *luaProto, args []RespValue) {
+	keys, argv, e := scriptKeysArgs(args)
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+
+	run := newScriptRun(ctx, false, false)
+	L := run.state()
+	L.Globals.Set("KEYS", luaStringArray(keys))
+	L.Globals.Set("ARGV", luaStringArray(argv))
+	L.Globals.readonly = true
+	rets, e := L.Run(proto)
+	run.finish(rets, e, sha)
+}
+
+func newScriptRun(ctx RequestContext, readOnly bool, function bool) *scriptRun {
+	run := &scriptRun{ctx: ctx, out: &bytes.Buffer{}, readOnly: readOnly, function: function, started: time.Now()}
+	run.inner = ctx
+	run.inner.Connection, run.inner.InExec = run.out, true
+	// inside EXEC the transaction is already wrapping the writes.
+	if ctx.Client == nil || ctx.Client.tx == nil || !ctx.Client.tx.running {
+		run.tx = &transaction{running: true}
+		run.inner.Client = &Client{tx: run.tx}
+	}
+	ctx.Running.add(run)
+	return run
+}
+
+// state is a new lua state for the script to run in, with the redis library.
+func (run *scriptRun) state() *LuaState {
+	L := NewLuaState()
+	L.OpenLibs()
+	lib := NewLuaTable(0, 16)
+	luaRegister(lib, redisCalls(func() *scriptRun { return run }))
+	luaRegister(lib, map[string]func(*LuaState, []any) []any{"log": luaRedisLog})
+	luaLogLevels(lib)
+	lib.readonly = true
+	L.Globals.Set("redis", lib)
+	L.strict = true
+	L.Hook = run.hook
+	return L
+}
+
+// hook stops the script once it's been killed.
+func (run *scriptRun) hook(L *LuaState) {
+	if run.killed.Load() {
+		L.Kill(luaReplyTable("err", "ERR Script killed by user with "+run.killCommand()+"..."))
+	}
+}
+
+// killCommand is the command that kills the script.
+func (run *scriptRun) killCommand() string {
+	if run.function {
+		return "FUNCTION KILL"
+	}
+	return "SCRIPT KILL"
+}
+
+// finish closes off the script's writes and replies with what it returned,
+// or the error it raised. name is what the script is known by in errors.
+func (run *scriptRun) finish(rets []any, e error, name string) {
+	run.ctx.Running.remove(run)
+	if run.tx != nil && run.tx.propagated {
+		run.inner.Propagate(bulkStrings("EXEC"))
+	}
+	if e != nil {
+		run.ctx.SendError(scriptError(e.(*LuaError), name))
+		return
+	}
+	var ret any
+	if len(rets) > 0 {
+		ret = rets[0]
+	}
+	run.ctx.SendResp(luaToResp(ret, 0))
+}
+
+// scriptError is the reply for an error a script raised. Errors from
+// redis.call are passed on as they are.
+func scriptError(e *LuaError, sha string) string {
+	if t, ok := e.Value.(*LuaTable); ok {
+		if msg, ok := t.GetString("err").(string); ok {
+			return oneLine(msg)
+		}
+	}
+	return oneLine(fmt.Sprintf("ERR %s script: %s", e.Error(), sha))
+}
+
+// oneLine is msg made fit for an error or status reply.
+func oneLine(msg string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
+
+func luaStringArray(args []RespValue) *LuaTable {
+	t := NewLuaTable(len(args), 0)
+	for _, arg := range args {
+		t.Append(arg.String())
+	}
+	return t
+}
+
+// scriptRun is a script being run, and what its redis.call()s run with.
+type scriptRun struct {
+	ctx      RequestContext
+	inner    RequestContext // for the commands the script calls, writing to out
+	out      *bytes.Buffer
+	tx       *transaction // wraps the script's writes, nil when it's run by EXEC
+	readOnly bool         // the script said it doesn't write
+	function bool         // it's a function rather than a script, FUNCTION KILL kills it
+	started  time.Time
+
+	// set from the connections running SCRIPT KILL, while the script runs.
+	wrote  atomic.Bool // it's called a write command, so it can't be killed
+	killed atomic.Bool
+}
+
+// redisCalls are the parts of the redis library for running commands, and
+// for making replies. current is the script run they're for, a function
+// library's callbacks are called from a different one every time.
+func redisCalls(current func() *scriptRun) map[string]func(*LuaState, []any) []any {
+	return map[string]func(*LuaState, []any) []any{
+		"call": func(L *LuaState, args []any) []any {
+			reply := current().call(L, args)
+			if t, ok := reply.(*LuaTable); ok && t.GetString("err") != nil {
+				panic(&LuaError{t})
+			}
+			return []any{reply}
+		},
+		"pcall": func(L *LuaState, args []any) []any {
+			return []any{current().call(L, args)}
+		},
+		"error_reply": func(L *LuaState, args []any) []any {
+			return []any{luaReplyTable("err", L.checkString(args, 0, "error_reply"))}
+		},
+		"status_reply": func(L *LuaState, args []any) []any {
+			return []any{luaReplyTable("ok", L.checkString(args, 0, "status_reply"))}
+		},
+		"sha1hex": func(L *LuaState, args []any) []any {
+			return []any{scriptSha(L.checkString(args, 0, "sha1hex"))}
+		},
+	}
+}
+
+var scriptLogLevels = []string{"debug", "verbose", "notice", "warning"}
+
+func luaRedisLog(L *LuaState, args []any) []any {
+	if len(args) < 2 {
+		L.Errorf("redis.log() requires two arguments or more.")
+	}
+	level := L.checkInt(args, 0, "log")
+	if level < 0 || level >= len(scriptLogLevels) {
+		L.Errorf("Invalid debug level.")
+	}
+	parts := make([]string, 0, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		parts = append(parts, L.checkString(args, i, "log"))
+	}
+	fmt.Println("[script]", scriptLogLevels[level], strings.Join(parts, " "))
+	return nil
+}
+
+// luaLogLevels adds redis.LOG_DEBUG and friends, for redis.log().
+func luaLogLevels(lib *LuaTable) {
+	for i, name := range scriptLogLevels {
+		lib.Set("LOG_"+strings.ToUpper(name), float64(i))
+	}
+}
+
+func luaReplyTable(field, msg string) *LuaTable {
+	t := NewLuaTable(0, 1)
+	t.Set(field, msg)
+	return t
+}
+
+// call runs a command for redis.call() and redis.pcall(), its reply is
+// converted to lua the way redis does it. It's an {err=...} table when the
+// command fails, or couldn't be run from a script at all.
+func (run *scriptRun) call(L *LuaState, args []any) any {
+	if len(args) == 0 {
+		L.Errorf("Please specify at least one argument for this redis lib call")
+	}
+	cmdArgs := make([]RespValue, len(args))
+	for i, arg := range args {
+		switch a := arg.(type) {
+		case string:
+			cmdArgs[i] = RespValue{BulkString, []byte(a)}
+		case float64:
+			cmdArgs[i] = RespValue{BulkString, []byte(luaNumberString(a))}
+		default:
+			return luaReplyTable("err", "ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	cmd, known := run.ctx.Router.commands[cmdArgs[0].ToLower()]
+	if !known {
+		return luaReplyTable("err", "ERR Unknown Redis command called from script")
+	}
+	if cmd.Flags&(CmdNoScript|CmdBlocking) != 0 {
+		return luaReplyTable("err", ErrNotFromScript.Error())
+	}
+	if run.readOnly && cmd.Flags&CmdWrite != 0 {
+		return luaReplyTable("err", ErrWriteFromReadOnly.Error())
+	}
+	if cmd.Flags&CmdWrite != 0 {
+		run.wrote.Store(true)
+	}
+	run.out.Reset()
+	if e := run.ctx.Router.Route(run.inner, cmdArgs); e != nil {
+		return luaReplyTable("err", "ERR "+e.Error())
+	}
+	reply, _, e := Deserialize(run.out.Bytes())
+	if e != nil {
+		return luaReplyTable("err", "ERR "+e.Error())
+	}
+	return respToLua(reply)
+}
+
+// respToLua converts a command's reply for a script: integers are numbers,
+// bulk strings are strings, nulls are false, and status and error replies
+// are {ok=...} and {err=...} tables.
+func respToLua(v RespValue) any {
+	switch v.Type {
+	case Integer:
+		return float64(v.Value.(int))
+	case BulkString:
+		return string(v.Value.([]byte))
+	case SimpleString:
+		return luaReplyTable("ok", string(v.Value.([]byte)))
+	case SimpleError:
+		return luaReplyTable("err", string(v.Value.([]byte)))
+	case Array:
+		elements := v.Value.([]RespValue)
+		t := NewLuaTable(len(elements), 0)
+		for i, el := range elements {
+			t.Set(float64(i+1), respToLua(el))
+		}
+		return t
+	}
+	return false
+}
+
+// luaToResp converts what a script returns into its reply: numbers are
+// truncated to integers, tables are arrays up to their first nil, unless
+// they have an err or ok field, which makes them an error or status reply.
+// true is 1, and false and nil are null.
+func luaToResp(v any, depth int) RespValue {
+	switch x := v.(type) {
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return RespValue{Integer, math.MinInt64}
+		}
+		return RespValue{Integer, int(x)}
+	case string:
+		return RespValue{BulkString, []byte(x)}
+	case bool:
+		if x {
+			return RespValue{Integer, 1}
+		}
+	case *LuaTable:
+		if msg, ok := x.GetString("err").(string); ok {
+			return RespValue{SimpleError, []byte(oneLine(msg))}
+		}
+		if msg, ok := x.GetString("ok").(string); ok {
+			return RespValue{SimpleString, []byte(oneLine(msg))}
+		}
+		if depth >= luaMaxCallDepth {
+			return RespValue{SimpleError, []byte("ERR reached lua stack limit")}
+		}
+		var elements []RespValue
+		for i := 1; ; i++ {
+			el := x.Get(float64(i))
+			if el == nil {
+				break
+			}
+			elements = append(elements, luaToResp(el, depth+1))
+		}
+		return RespValue{Array, elements}
+	}
+	return RespValue{NullBulkString, nil}
+}
+
+// scriptCmd is SCRIPT LOAD, EXISTS and FLUSH, for managing the scripts
+// EVALSHA can run.
+func scriptCmd(ctx RequestContext, args []RespValue) {
+	if e := checkArity("script", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	sub, args := args[0].ToLower(), args[1:]
+	switch {
+	case sub == "load" && len(args) == 1:
+		sha, _, e := ctx.Scripts.Load(args[0].String())
+		if e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendResp(RespValue{BulkString, []byte(sha)})
+	case sub == "exists" && len(args) >= 1:
+		exists := make([]RespValue, len(args))
+		for i, arg := range args {
+			_, ok := ctx.Scripts.Get(arg.String())
+			exists[i] = RespValue{Integer, 0}
+			if ok {
+				exists[i].Value = 1
+			}
+		}
+		ctx.SendResp(RespValue{Array, exists})
+	case sub == "flush" && len(args) <= 1:
+		// there's nothing to free in the background, ASYNC is the same as SYNC.
+		if len(args) == 1 && !args[0].EqualAsciiInsensitive("async") && !args[0].EqualAsciiInsensitive("sync") {
+			ctx.SendError("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+			return
+		}
+		ctx.Scripts.Flush()
+		ctx.SendSimpleString("OK")
+	case sub == "kill" && len(args) == 0:
+		if e := ctx.Running.Kill(false); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendSimpleString("OK")
+	default:
+		ctx.SendError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try SCRIPT HELP.", sub))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(nil)
+	ctx.Router = router
+	ctx.Client = NewClient()
+
+	set := "return redis.call('SET', KEYS[1], ARGV[1])"
+	setSha := scriptSha(set)
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"EVAL", "return 1"}, "-ERR wrong number of arguments for 'eval' command\r\n"},
+		{[]string{"EVAL", "return 1", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"EVAL", "return 1", "2", "a"}, "-ERR Number of keys can't be greater than number of args\r\n"},
+
+		// how what a script returns is converted.
+		{[]string{"EVAL", "return 3.99", "0"}, ":3\r\n"},
+		{[]string{"EVAL", "return 'hi'", "0"}, "$2\r\nhi\r\n"},
+		{[]string{"EVAL", "return {1, 'two', {3}, nil, 5}", "0"}, "*3\r\n:1\r\n$3\r\ntwo\r\n*1\r\n:3\r\n"},
+		{[]string{"EVAL", "return true", "0"}, ":1\r\n"},
+		{[]string{"EVAL", "return false", "0"}, "$-1\r\n"},
+		{[]string{"EVAL", "return nil", "0"}, "$-1\r\n"},
+		{[]string{"EVAL", "return {ok = 'fine'}", "0"}, "+fine\r\n"},
+		{[]string{"EVAL", "return redis.error_reply('MY error')", "0"}, "-MY error\r\n"},
+		{[]string{"EVAL", "return redis.status_reply('PONG')", "0"}, "+PONG\r\n"},
+		{[]string{"EVAL", "return {KEYS[1], KEYS[2], ARGV[1], #ARGV}", "2", "a", "b", "c"}, "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n:1\r\n"},
+
+		// and how what commands reply is.
+		{[]string{"EVAL", set, "1", "k", "v"}, "+OK\r\n"},
+		{[]string{"EVALSHA", setSha, "1", "k", "w"}, "+OK\r\n"},
+		{[]string{"GET", "k"}, "$1\r\nw\r\n"},
+		{[]string{"EVAL", "return type(redis.call('GET', 'missing'))", "0"}, "$7\r\nboolean\r\n"},
+		{[]string{"EVAL", "return redis.call('SET', 'n', 10) and redis.call('GET', 'n') + 1", "0"}, ":11\r\n"},
+		{[]string{"EVAL", "return redis.call('SET', 'a', '1').ok", "0"}, "$2\r\nOK\r\n"},
+		{[]string{"EVAL", "return redis.call('DEL', 'a', 'n', 'missing')", "0"}, ":2\r\n"},
+		{[]string{"EVAL", "return redis.call('SET', 'a', '1', 'PX', 'soon')", "0"}, "-strconv.Atoi: parsing \"soon\": invalid syntax\r\n"},
+		{[]string{"EVAL", "local r = redis.pcall('SET', 'a', '1', 'PX', 'soon') return type(r.err)", "0"}, "$6\r\nstring\r\n"},
+		{[]string{"EVAL", "return redis.pcall('NOSUCH')", "0"}, "-ERR Unknown Redis command called from script\r\n"},
+		{[]string{"EVAL", "return redis.call('EVAL', 'return 1', 0)", "0"}, "-" + ErrNotFromScript.Error() + "\r\n"},
+		{[]string{"EVAL", "return redis.call('MULTI')", "0"}, "-" + ErrNotFromScript.Error() + "\r\n"},
+		{[]string{"EVAL", "return redis.call('GET', {})", "0"}, "-ERR Lua redis lib command arguments must be strings or integers\r\n"},
+
+		// errors from the script itself.
+		{[]string{"EVAL", "return +", "0"}, "-ERR Error compiling script (new function): user_script:1: unexpected symbol near '+'\r\n"},
+		{[]string{"EVAL", "error('oops')", "0"}, "-ERR user_script:1: oops script: " + scriptSha("error('oops')") + "\r\n"},
+		{[]string{"EVAL", "return nope", "0"}, "-ERR user_script:1: Script attempted to access nonexistent global variable 'nope' script: " + scriptSha("return nope") + "\r\n"},
+		{[]string{"EVAL", "x = 1", "0"}, "-ERR user_script:1: Attempt to modify a readonly table script: " + scriptSha("x = 1") + "\r\n"},
+
+		{[]string{"SCRIPT", "EXISTS", setSha, "ffff"}, "*2\r\n:1\r\n:0\r\n"},
+		{[]string{"SCRIPT", "LOAD", "return 'loaded'"}, "$40\r\n" + scriptSha("return 'loaded'") + "\r\n"},
+		{[]string{"EVALSHA", scriptSha("return 'loaded'"), "0"}, "$6\r\nloaded\r\n"},
+		{[]string{"SCRIPT", "FLUSH", "LATER"}, "-ERR SCRIPT FLUSH only support SYNC|ASYNC option\r\n"},
+		{[]string{"SCRIPT", "FLUSH"}, "+OK\r\n"},
+		{[]string{"EVALSHA", setSha, "1", "k", "v"}, "-" + ErrNoScript.Error() + "\r\n"},
+
+		// scripts can be queued in a transaction like anything else.
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"EVAL", set, "1", "t", "1"}, "+QUEUED\r\n"},
+		{[]string{"EVAL", "return redis.call('GET', 't')", "0"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*2\r\n+OK\r\n$1\r\n1\r\n"},
+	} {
+		if reply := clusterDo(router, ctx, test.args...); reply != test.want {
+			t.Fatalf("%v: expected %q, got %q", test.args, test.want, reply)
+		}
+	}
+}
+
+func TestEvalPropagation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "appendonlydir")
+	aof, e := NewAppendOnlyFile(dir, "appendonly.aof", AppendFsyncAlways)
+	if e != nil {
+		t.Fatal(e)
+	}
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(aof)
+	ctx.Router = router
+	ctx.Client = NewClient()
+	if e := aof.Open(ctx.Server); e != nil {
+		t.Fatal(e)
+	}
+	// a script's writes are logged rather than the script, between a MULTI
+	// and an EXEC. one that doesn't write leaves nothing behind.
+	clusterDo(router, ctx, "EVAL", "redis.call('SET', 'a', '1') redis.call('DEL', 'a')", "0")
+	clusterDo(router, ctx, "EVAL", "return redis.call('GET', 'a')", "0")
+	aof.Close()
+
+	logged, _ := os.ReadFile(lastIncr(t, aof))
+	want := "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\nDEL\r\n$1\r\na\r\n*1\r\n$4\r\nEXEC\r\n"
+	if string(logged) != want {
+		t.Fatalf("expected the script's writes between MULTI and EXEC, got %q", logged)
+	}
+}
+
+func TestScriptKill(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	ctx := newTestContext(nil)
+	ctx.Router = router
+	ctx.Config.Set("busy-reply-threshold", "50")
+	clusterDo(router, ctx, "FUNCTION", "LOAD", "#!lua name=spin\nredis.register_function{function_name = 'spin', callback = function() while true do end end, flags = {'no-writes'}}")
+	exitCode := -1
+	exitProcess = func(code int) { exitCode = code }
+	t.Cleanup(func() { exitProcess = os.Exit })
+
+	// run starts a script on a connection of its own, and waits for it to be busy.
+	run := func(args ...string) chan string {
+		caller := ctx
+		caller.Client = NewClient()
+		reply := make(chan string, 1)
+		go func() { reply <- clusterDo(router, caller, args...) }()
+		waitFor(t, "the script to be busy", func() bool { return ctx.Running.Busy(ctx.Config) != nil })
+		return reply
+	}
+	busy := func(kill string) string {
+		return "-" + ErrBusy(kill).Error() + "\r\n"
+	}
+	expect := func(args []string, want string) {
+		t.Helper()
+		if reply := clusterDo(router, ctx, args...); reply != want {
+			t.Fatalf("%v: expected %q, got %q", args, want, reply)
+		}
+	}
+
+	// not even pcall can stop a script from being killed.
+	reply := run("EVAL", "while true do pcall(function() while true do end end) end", "0")
+	expect([]string{"GET", "a"}, busy("SCRIPT KILL"))
+	expect([]string{"SCRIPT", "LOAD", "return 1"}, busy("SCRIPT KILL"))
+	expect([]string{"FUNCTION", "KILL"}, busy("SCRIPT KILL"))
+	expect([]string{"SCRIPT", "KILL"}, "+OK\r\n")
+	if got := <-reply; got != "-ERR Script killed by user with SCRIPT KILL...\r\n" {
+		t.Fatalf("expected the script to have been killed, got %q", got)
+	}
+	expect([]string{"SCRIPT", "KILL"}, "-"+ErrNotBusy.Error()+"\r\n")
+	expect([]string{"GET", "a"}, "$-1\r\n")
+
+	// clients that were already waiting on the script when it went busy are
+	// told so too, rather than waiting it out.
+	do := func(reply chan string, args ...string) {
+		caller := ctx
+		caller.Client = NewClient()
+		go func() { reply <- clusterDo(router, caller, args...) }()
+	}
+	reply = make(chan string, 1)
+	do(reply, "EVAL", "while true do end", "0")
+	waitFor(t, "the script to start", func() bool {
+		ctx.Running.lock.Lock()
+		defer ctx.Running.lock.Unlock()
+		return len(ctx.Running.runs) > 0
+	})
+	waiting := make(chan string, 3)
+	do(waiting, "GET", "a")
+	do(waiting, "SET", "a", "1")
+	do(waiting, "FUNCTION", "DELETE", "spin")
+	for range 3 {
+		if got := <-waiting; got != busy("SCRIPT KILL") {
+			t.Fatalf("expected a client waiting on the script to be told it's busy, got %q", got)
+		}
+	}
+	expect([]string{"SCRIPT", "KILL"}, "+OK\r\n")
+	<-reply
+	expect([]string{"GET", "a"}, "$-1\r\n")
+
+	reply = run("FCALL_RO", "spin", "0")
+	expect([]string{"SCRIPT", "KILL"}, busy("FUNCTION KILL"))
+	expect([]string{"FUNCTION", "KILL"}, "+OK\r\n")
+	if got := <-reply; got != "-ERR Script killed by user with FUNCTION KILL...\r\n" {
+		t.Fatalf("expected the function to have been killed, got %q", got)
+	}
+
+	// once a script has written it has to be left to finish, or the server shut down.
+	reply = run("EVAL", "redis.call('SET', 'a', '1') while true do end", "0")
+	expect([]string{"SCRIPT", "KILL"}, "-"+ErrUnkillable.Error()+"\r\n")
+	expect([]string{"SHUTDOWN"}, busy("SCRIPT KILL"))
+	expect([]string{"SHUTDOWN", "NOSAVE"}, "")
+	if exitCode != 0 {
+		t.Fatal("SHUTDOWN NOSAVE didn't exit")
+	}
+	// the server would be gone by now, the script has to be stopped by hand.
+	ctx.Running.lock.Lock()
+	ctx.Running.runs[0].killed.Store(true)
+	ctx.Running.lock.Unlock()
+	<-reply
+}
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often a sentinel does things, like redis' sentinel.
+const (
+	sentinelTick           = 100 * time.Millisecond
+	sentinelPingPeriod     = time.Second
+	sentinelInfoPeriod     = 10 * time.Second
+	sentinelFastInfoPeriod = time.Second // while the master is down, or being failed over
+	sentinelHelloPeriod    = 2 * time.Second
+	sentinelAskPeriod      = time.Second
+	sentinelAskForget      = 5 * time.Second // how long another sentinel's word that the master is down counts for
+	sentinelReconfDelay    = 4 * sentinelHelloPeriod
+	sentinelMaxDesync      = time.Second // spreads out sentinels starting failovers at the same time
+	sentinelElectionMax    = 10 * time.Second
+	sentinelCommandTimeout = time.Second
+)
+
+// the steps of a failover, as SENTINEL MASTER reports them.
+const (
+	SentinelFailoverNone          = "none"
+	SentinelFailoverWaitStart     = "wait_start"     // asking the other sentinels to make us the leader
+	SentinelFailoverWaitPromotion = "wait_promotion" // waiting for the replica we picked to become a master
+)
+
+var ErrSentinelNoGoodReplica = errors.New("NOGOODSLAVE No suitable replica to promote")
+var ErrSentinelInProgress = errors.New("INPROG Failover already in progress")
+
+// ErrSentinelReply is an error reply from an instance we're talking to.
+type ErrSentinelReply string
+
+func (e ErrSentinelReply) Error() string {
+	return string(e)
+}
+
+// Sentinel watches a master and its replicas, and together with the other
+// sentinels watching the same master, promotes one of the replicas when the
+// master goes down. Replicas are found in the master's INFO. Sentinels tell
+// each other about themselves and where the master is with hellos, which are
+// sent to each other directly rather than over the instances' pub/sub like
+// redis does it, there's no pub/sub to send them over.
+type Sentinel struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	config          *SharedRWStore[string]
+	runid           string
+	stop            chan struct{}
+
+	lock          sync.Mutex
+	master        *sentinelInstance
+	replicas      map[string]*sentinelInstance // by address
+	peers         map[string]*sentinelPeer     // by address
+	sdown         bool
+	odown         bool
+	currentEpoch  int64
+	configEpoch   int64  // the epoch of the failover that made the master the master
+	leader        string // who we voted for, in leaderEpoch
+	leaderEpoch   int64
+	failoverState string
+	failoverEpoch int64
+	nextFailover  time.Time // no failover starts before this, so that we don't race another sentinel's
+	promoted      *sentinelInstance
+}
+
+// NewSentinel reads the sentinel-* options, the master to monitor is given
+// to sentinel-monitor as "name host port quorum".
+func NewSentinel(config *SharedRWStore[string]) (*Sentinel, error) {
+	monitor, _ := config.Get("sentinel-monitor")
+	fields := strings.Fields(monitor)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid sentinel-monitor '%s', expected 'name host port quorum'", monitor)
+	}
+	if _, e := strconv.ParseUint(fields[2], 10, 16); e != nil {
+		return nil, fmt.Errorf("invalid sentinel-monitor port '%s'", fields[2])
+	}
+	quorum, e := strconv.Atoi(fields[3])
+	if e != nil || quorum <= 0 {
+		return nil, fmt.Errorf("invalid sentinel-monitor quorum '%s'", fields[3])
+	}
+	downAfter, e := sentinelMillis(config, "sentinel-down-after-milliseconds")
+	if e != nil {
+		return nil, e
+	}
+	failoverTimeout, e := sentinelMillis(config, "sentinel-failover-timeout")
+	if e != nil {
+		return nil, e
+	}
+
+	s := &Sentinel{
+		name:            fields[0],
+		quorum:          quorum,
+		downAfter:       downAfter,
+		failoverTimeout: failoverTimeout,
+		config:          config,
+		runid:           newReplID(),
+		stop:            make(chan struct{}),
+		replicas:        map[string]*sentinelInstance{},
+		peers:           map[string]*sentinelPeer{},
+		failoverState:   SentinelFailoverNone,
+	}
+	s.master = newSentinelInstance(fields[1], fields[2])
+	known, _ := config.Get("sentinel-known-sentinels")
+	for _, addr := range strings.Fields(known) {
+		host, port, e := net.SplitHostPort(addr)
+		if e != nil {
+			return nil, fmt.Errorf("invalid sentinel-known-sentinels address '%s'", addr)
+		}
+		s.peers[addr] = newSentinelPeer(host, port)
+	}
+	return s, nil
+}
+
+func sentinelMillis(config *SharedRWStore[string], option string) (time.Duration, error) {
+	value, _ := config.Get(option)
+	ms, e := strconv.Atoi(value)
+	if e != nil || ms <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", option, value)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Start watches the master and talks to the other sentinels, until the process exits.
+func (s *Sentinel) Start() {
+	fmt.Println("[sentinel] monitoring", s.name, s.master.Addr(), "quorum", s.quorum, "as", s.runid)
+	s.lock.Lock()
+	go s.monitor(s.master)
+	for _, peer := range s.peers {
+		go s.talk(peer)
+	}
+	s.lock.Unlock()
+	go s.cron()
+}
+
+// Stop stops all of the sentinel's goroutines, for tests.
+func (s *Sentinel) Stop() {
+	close(s.stop)
+}
+
+// pause waits a tick, returning false once the sentinel is stopped.
+func (s *Sentinel) pause() bool {
+	select {
+	case <-s.stop:
+		return false
+	case <-time.After(sentinelTick):
+		return true
+	}
+}
+
+// every waits for the next tick, returning false once the sentinel is stopped.
+func (s *Sentinel) every(ticker *time.Ticker) bool {
+	select {
+	case <-s.stop:
+		return false
+	case <-ticker.C:
+		return true
+	}
+}
+
+// sentinelInstance is a master or replica we're watching. Its fields are
+// guarded by the sentinel's lock, apart from the client.
+type sentinelInstance struct {
+	host   string
+	port   string
+	client *sentinelClient
+
+	lastPong      time.Time // the last time it answered a PING
+	lastInfo      time.Time
+	role          string
+	masterHost    string // who a replica says its master is
+	masterPort    string
+	reportedSince time.Time // since when it has reported the role and master it does
+	linkUp        bool
+	offset        int64
+	priority      int
+}
+
+func newSentinelInstance(host string, port string) *sentinelInstance {
+	addr := net.JoinHostPort(host, port)
+	// an instance gets down-after-milliseconds to answer its first PING.
+	return &sentinelInstance{host: host, port: port, client: newSentinelClient(addr), lastPong: time.Now(), priority: 100}
+}
+
+func (si *sentinelInstance) Addr() string {
+	return net.JoinHostPort(si.host, si.port)
+}
+
+// sentinelPeer is another sentinel watching the same master, its fields are
+// guarded by the sentinel's lock, apart from the client.
+type sentinelPeer struct {
+	host   string
+	port   string
+	client *sentinelClient
+
+	runid       string
+	lastHello   time.Time // the last time it said hello
+	masterDown  bool      // what it told us the last time we asked
+	downReplied time.Time
+	leader      string // who it voted for, in leaderEpoch
+	leaderEpoch int64
+	askedEpoch  int64 // the failover epoch we last asked it to vote in
+}
+
+func newSentinelPeer(host string, port string) *sentinelPeer {
+	return &sentinelPeer{host: host, port: port, client: newSentinelClient(net.JoinHostPort(host, port))}
+}
+
+// monitor pings an instance every second, and reads its INFO every ten (or
+// every second while something is going on). Instances are never forgotten,
+// it runs for as long as the sentinel does.
+func (s *Sentinel) monitor(inst *sentinelInstance) {
+	var lastPing, lastInfo time.Time
+	ticker := time.NewTicker(sentinelTick)
+	defer ticker.Stop()
+	for s.every(ticker) {
+		// pinged at least twice within down-after-milliseconds, one late reply isn't down.
+		if time.Since(lastPing) >= min(sentinelPingPeriod, s.downAfter/2) {
+			lastPing = time.Now()
+			reply, e := inst.client.Do("PING")
+			// an instance that's loading, or has lost its own master, is still up.
+			valid := e == nil && reply.String() == "PONG"
+			if e, isReply := e.(ErrSentinelReply); isReply {
+				valid = strings.HasPrefix(string(e), "LOADING") || strings.HasPrefix(string(e), "MASTERDOWN")
+			}
+			if valid {
+				s.lock.Lock()
+				inst.lastPong = time.Now()
+				s.lock.Unlock()
+			}
+		}
+		if time.Since(lastInfo) >= s.infoPeriod() {
+			lastInfo = time.Now()
+			if e := s.refreshInfo(inst); e == nil {
+				s.fixReplicaConfig(inst)
+			}
+		}
+	}
+}
+
+func (s *Sentinel) infoPeriod() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sdown || s.failoverState != SentinelFailoverNone {
+		return sentinelFastInfoPeriod
+	}
+	return sentinelInfoPeriod
+}
+
+// refreshInfo reads what an instance says about its place in the
+// replication setup, a master's INFO is how we find its replicas.
+func (s *Sentinel) refreshInfo(inst *sentinelInstance) error {
+	reply, e := inst.client.Do("INFO", "replication")
+	if e != nil {
+		return e
+	}
+	fields := map[string]string{}
+	var replicas [][2]string
+	for _, line := range strings.Split(reply.String(), "\r\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields[key] = value
+		if strings.HasPrefix(key, "slave") && strings.Contains(value, "ip=") {
+			var ip, port string
+			for _, kv := range strings.Split(value, ",") {
+				if v, isIP := strings.CutPrefix(kv, "ip="); isIP {
+					ip = v
+				} else if v, isPort := strings.CutPrefix(kv, "port="); isPort {
+					port = v
+				}
+			}
+			replicas = append(replicas, [2]string{ip, port})
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	role := fields["role"]
+	if role == "slave" {
+		role = "replica"
+	}
+	if role != inst.role || fields["master_host"] != inst.masterHost || fields["master_port"] != inst.masterPort {
+		inst.reportedSince = time.Now()
+	}
+	inst.role, inst.masterHost, inst.masterPort = role, fields["master_host"], fields["master_port"]
+	inst.linkUp = fields["master_link_status"] == "up"
+	inst.offset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	if priority, e := strconv.Atoi(fields["slave_priority"]); e == nil {
+		inst.priority = priority
+	}
+	inst.lastInfo = time.Now()
+	if inst == s.master {
+		for _, replica := range replicas {
+			s.addReplica(replica[0], replica[1])
+		}
+	}
+	return nil
+}
+
+// addReplica starts watching a replica we've just heard of, called with the lock held.
+func (s *Sentinel) addReplica(host string, port string) *sentinelInstance {
+	addr := net.JoinHostPort(host, port)
+	if replica, exists := s.replicas[addr]; exists || addr == s.master.Addr() {
+		return replica
+	}
+	replica := newSentinelInstance(host, port)
+	s.replicas[addr] = replica
+	fmt.Println("[sentinel] +slave", addr, "of", s.name)
+	go s.monitor(replica)
+	return replica
+}
+
+// fixReplicaConfig points a replica that's following the wrong master (or
+// none, like an old master coming back after a failover) at ours. It's only
+// done once the replica has been that way for a while and nothing else is
+// going on, it may just be that we haven't heard about a failover yet.
+func (s *Sentinel) fixReplicaConfig(inst *sentinelInstance) {
+	s.lock.Lock()
+	master := s.master
+	wrong := inst != master && (inst.role == "master" || inst.masterHost != master.host || inst.masterPort != master.port)
+	fix := wrong && !s.sdown && s.failoverState == SentinelFailoverNone && time.Since(inst.reportedSince) > sentinelReconfDelay
+	if fix {
+		inst.reportedSince = time.Now()
+	}
+	s.lock.Unlock()
+	if !fix {
+		return
+	}
+	fmt.Println("[sentinel] +fix-slave-config", inst.Addr(), "to follow", master.Addr())
+	if _, e := inst.client.Do("REPLICAOF", master.host, master.port); e != nil {
+		fmt.Println("[sentinel] failed to reconfigure", inst.Addr(), e)
+	}
+}
+
+// talk says hello to another sentinel every couple of seconds, and while
+// the master looks down to us asks whether it does to them too. While we're
+// trying to become the leader of a failover, the asking is also asking for
+// their vote.
+func (s *Sentinel) talk(peer *sentinelPeer) {
+	var lastHello, lastAsk time.Time
+	ticker := time.NewTicker(sentinelTick)
+	defer ticker.Stop()
+	for s.every(ticker) {
+		if time.Since(lastHello) >= sentinelHelloPeriod {
+			lastHello = time.Now()
+			s.hello(peer)
+		}
+
+		s.lock.Lock()
+		if _, known := s.peers[net.JoinHostPort(peer.host, peer.port)]; !known {
+			s.lock.Unlock()
+			return
+		}
+		candidate := "*"
+		electing := s.failoverState == SentinelFailoverWaitStart && peer.askedEpoch != s.failoverEpoch
+		if s.failoverState == SentinelFailoverWaitStart {
+			candidate = s.runid
+			peer.askedEpoch = s.failoverEpoch
+		}
+		ask := s.sdown && (electing || time.Since(lastAsk) >= sentinelAskPeriod)
+		host, port, epoch := s.master.host, s.master.port, s.currentEpoch
+		s.lock.Unlock()
+		if !ask {
+			continue
+		}
+
+		lastAsk = time.Now()
+		reply, e := peer.client.Do("SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatInt(epoch, 10), candidate)
+		if e != nil || !reply.isArray() || len(reply.Value.([]RespValue)) != 3 {
+			continue
+		}
+		parts := reply.Value.([]RespValue)
+		leaderEpoch, _ := strconv.ParseInt(parts[2].String(), 10, 64)
+		s.lock.Lock()
+		peer.masterDown = parts[0].String() == "1"
+		peer.downReplied = time.Now()
+		if candidate != "*" {
+			peer.leader, peer.leaderEpoch = parts[1].String(), leaderEpoch
+		}
+		s.lock.Unlock()
+	}
+}
+
+// hello tells another sentinel about us and where we think the master is.
+// A sentinel that answers with our own id is us, listed by mistake.
+func (s *Sentinel) hello(peer *sentinelPeer) {
+	s.lock.Lock()
+	port, _ := s.config.Get("port")
+	args := []string{"SENTINEL", "HELLO", "", port, s.runid, strconv.FormatInt(s.currentEpoch, 10),
+		s.name, s.master.host, s.master.port, strconv.FormatInt(s.configEpoch, 10)}
+	s.lock.Unlock()
+	args[2], _ = s.config.Get("sentinel-announce-ip")
+	if args[2] == "" {
+		if args[2] = peer.client.LocalIP(); args[2] == "" {
+			return
+		}
+	}
+	reply, e := peer.client.Do(args...)
+	if e != nil {
+		return
+	}
+	if reply.String() == s.runid {
+		fmt.Println("[sentinel] forgetting", peer.client.addr, "it's us")
+		s.lock.Lock()
+		delete(s.peers, net.JoinHostPort(peer.host, peer.port))
+		s.lock.Unlock()
+	}
+}
+
+// Hello is another sentinel telling us about itself, and about the master.
+// Sentinels we haven't heard of are added, and a master with a newer config
+// epoch than ours means there's been a failover we weren't the leader of.
+func (s *Sentinel) Hello(host string, port string, runid string, currentEpoch int64, name string, masterHost string, masterPort string, configEpoch int64) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if runid == s.runid {
+		return s.runid
+	}
+	addr := net.JoinHostPort(host, port)
+	peer, known := s.peers[addr]
+	if !known {
+		peer = newSentinelPeer(host, port)
+		s.peers[addr] = peer
+		fmt.Println("[sentinel] +sentinel", addr, runid)
+		go s.talk(peer)
+	}
+	peer.runid, peer.lastHello = runid, time.Now()
+	if currentEpoch > s.currentEpoch {
+		s.currentEpoch = currentEpoch
+		fmt.Println("[sentinel] +new-epoch", currentEpoch)
+	}
+	if name == s.name && configEpoch > s.configEpoch && net.JoinHostPort(masterHost, masterPort) != s.master.Addr() {
+		s.switchMaster(masterHost, masterPort, configEpoch)
+	}
+	return s.runid
+}
+
+// IsMasterDown answers another sentinel asking whether we think the master
+// at host:port is down. When runid isn't "*" it's also asking for our vote
+// in epoch, which we give to whoever asks first in each epoch.
+func (s *Sentinel) IsMasterDown(host string, port string, epoch int64, runid string) (bool, string, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	down := s.sdown && s.master.host == host && s.master.port == port
+	if runid == "*" {
+		return down, "*", 0
+	}
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		fmt.Println("[sentinel] +new-epoch", epoch)
+	}
+	if s.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		s.leader, s.leaderEpoch = runid, epoch
+		fmt.Println("[sentinel] +vote-for-leader", runid, epoch)
+		// whoever we voted for gets a head start on a failover of its own.
+		if runid != s.runid {
+			s.nextFailover = time.Now().Add(2*s.failoverTimeout + rand.N(sentinelMaxDesync))
+		}
+	}
+	return down, s.leader, s.leaderEpoch
+}
+
+// cron works out whether the master is down, and starts a failover when
+// enough sentinels agree that it is.
+func (s *Sentinel) cron() {
+	s.lock.Lock()
+	s.nextFailover = time.Now().Add(rand.N(sentinelMaxDesync))
+	s.lock.Unlock()
+	ticker := time.NewTicker(sentinelTick)
+	defer ticker.Stop()
+	for s.every(ticker) {
+		s.lock.Lock()
+		s.checkDown()
+		start := s.odown && s.failoverState == SentinelFailoverNone && time.Now().After(s.nextFailover)
+		var epoch int64
+		if start {
+			epoch = s.startFailover()
+		}
+		s.lock.Unlock()
+		if start {
+			go s.failover(epoch, false)
+		}
+	}
+}
+
+// checkDown updates sdown, the master not answering us, and odown, a quorum
+// of sentinels (us included) saying it isn't answering them. Called with the lock held.
+func (s *Sentinel) checkDown() {
+	sdown := time.Since(s.master.lastPong) > s.downAfter
+	if sdown != s.sdown {
+		s.sdown = sdown
+		fmt.Println("[sentinel]", map[bool]string{true: "+sdown", false: "-sdown"}[sdown], "master", s.name, s.master.Addr())
+	}
+	agree := 0
+	if s.sdown {
+		agree = 1
+		for _, peer := range s.peers {
+			if peer.masterDown && time.Since(peer.downReplied) < sentinelAskForget {
+				agree++
+			}
+		}
+	}
+	odown := agree >= s.quorum
+	if odown != s.odown {
+		s.odown = odown
+		fmt.Println("[sentinel]", map[bool]string{true: "+odown", false: "-odown"}[odown], "master", s.name, s.master.Addr(), "#quorum", agree, "/", s.quorum)
+	}
+}
+
+// startFailover starts a new epoch and votes for ourselves in it, called
+// with the lock held.
+func (s *Sentinel) startFailover() int64 {
+	s.currentEpoch++
+	s.failoverEpoch = s.currentEpoch
+	s.failoverState = SentinelFailoverWaitStart
+	s.leader, s.leaderEpoch = s.runid, s.currentEpoch
+	s.nextFailover = time.Now().Add(2*s.failoverTimeout + rand.N(sentinelMaxDesync))
+	fmt.Println("[sentinel] +try-failover master", s.name, "epoch", s.currentEpoch)
+	return s.currentEpoch
+}
+
+// Failover starts a failover without asking the other sentinels, it's what
+// SENTINEL FAILOVER does.
+func (s *Sentinel) Failover() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failoverState != SentinelFailoverNone {
+		return ErrSentinelInProgress
+	}
+	if s.bestReplica() == nil {
+		return ErrSentinelNoGoodReplica
+	}
+	epoch := s.startFailover()
+	go s.failover(epoch, true)
+	return nil
+}
+
+// failover runs one attempt at a failover: it waits to be elected leader
+// (unless forced), promotes the best replica, and points the others at it.
+func (s *Sentinel) failover(epoch int64, forced bool) {
+	deadline := time.Now().Add(min(sentinelElectionMax, s.failoverTimeout))
+	for !forced {
+		s.lock.Lock()
+		elected := s.elected(epoch)
+		s.lock.Unlock()
+		if elected {
+			break
+		}
+		if time.Now().After(deadline) {
+			s.abortFailover(epoch, "-failover-abort-not-elected")
+			return
+		}
+		if !s.pause() {
+			return
+		}
+	}
+	fmt.Println("[sentinel] +elected-leader master", s.name, "epoch", epoch)
+
+	s.lock.Lock()
+	promoted := s.bestReplica()
+	if promoted == nil {
+		s.lock.Unlock()
+		s.abortFailover(epoch, "-failover-abort-no-good-slave")
+		return
+	}
+	s.promoted = promoted
+	s.failoverState = SentinelFailoverWaitPromotion
+	s.lock.Unlock()
+
+	fmt.Println("[sentinel] +selected-slave", promoted.Addr())
+	deadline = time.Now().Add(s.failoverTimeout)
+	for {
+		if _, e := promoted.client.Do("REPLICAOF", "NO", "ONE"); e == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			s.abortFailover(epoch, "-failover-abort-slave-timeout")
+			return
+		}
+		if !s.pause() {
+			return
+		}
+	}
+	for {
+		if e := s.refreshInfo(promoted); e == nil {
+			s.lock.Lock()
+			isMaster := promoted.role == "master"
+			s.lock.Unlock()
+			if isMaster {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			s.abortFailover(epoch, "-failover-abort-slave-timeout")
+			return
+		}
+		if !s.pause() {
+			return
+		}
+	}
+	fmt.Println("[sentinel] +promoted-slave", promoted.Addr())
+
+	s.lock.Lock()
+	var others []*sentinelInstance
+	for _, replica := range s.replicas {
+		if replica != promoted {
+			others = append(others, replica)
+		}
+	}
+	s.lock.Unlock()
+	// replicas we can't reach now are put right by fixReplicaConfig later.
+	for _, replica := range others {
+		if _, e := replica.client.Do("REPLICAOF", promoted.host, promoted.port); e != nil {
+			fmt.Println("[sentinel] failed to reconfigure", replica.Addr(), e)
+			continue
+		}
+		fmt.Println("[sentinel] +slave-reconf-sent", replica.Addr())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.switchMaster(promoted.host, promoted.port, epoch)
+	s.failoverState, s.promoted = SentinelFailoverNone, nil
+	fmt.Println("[sentinel] +failover-end master", s.name)
+}
+
+// elected is whether we have the votes of a majority of the sentinels, and
+// at least a quorum of them, in epoch. Called with the lock held.
+func (s *Sentinel) elected(epoch int64) bool {
+	votes := 0
+	if s.leader == s.runid && s.leaderEpoch == epoch {
+		votes++
+	}
+	for _, peer := range s.peers {
+		if peer.leader == s.runid && peer.leaderEpoch == epoch {
+			votes++
+		}
+	}
+	return votes > (len(s.peers)+1)/2 && votes >= s.quorum
+}
+
+func (s *Sentinel) abortFailover(epoch int64, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failoverEpoch == epoch {
+		s.failoverState, s.promoted = SentinelFailoverNone, nil
+	}
+	fmt.Println("[sentinel]", reason, "master", s.name, "epoch", epoch)
+}
+
+// bestReplica picks the replica to promote: one that's answering us and
+// that we've heard from lately, with the lowest priority, then the most
+// data, then the lowest address. Priority 0 replicas are never promoted.
+// Called with the lock held.
+func (s *Sentinel) bestReplica() *sentinelInstance {
+	var candidates []*sentinelInstance
+	for _, replica := range s.replicas {
+		if replica.role != "replica" || replica.priority == 0 || time.Since(replica.lastPong) > s.downAfter ||
+			time.Since(replica.lastInfo) > 5*sentinelInfoPeriod {
+			continue
+		}
+		candidates = append(candidates, replica)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	slices.SortFunc(candidates, func(a, b *sentinelInstance) int {
+		if a.priority != b.priority {
+			return a.priority - b.priority
+		}
+		if a.offset != b.offset {
+			return int(b.offset - a.offset)
+		}
+		return strings.Compare(a.Addr(), b.Addr())
+	})
+	return candidates[0]
+}
+
+// switchMaster makes host:port the master, and the old master one of its
+// replicas, to be pointed at the new one when it comes back. Called with the lock held.
+func (s *Sentinel) switchMaster(host string, port string, epoch int64) {
+	old := s.master
+	addr := net.JoinHostPort(host, port)
+	master, known := s.replicas[addr]
+	if !known {
+		master = newSentinelInstance(host, port)
+		go s.monitor(master)
+	}
+	delete(s.replicas, addr)
+	s.replicas[old.Addr()] = old
+	s.master = master
+	s.master.lastPong = time.Now()
+	s.configEpoch = epoch
+	s.sdown, s.odown = false, false
+	for _, peer := range s.peers {
+		peer.masterDown = false
+	}
+	fmt.Println("[sentinel] +switch-master", s.name, old.host, old.port, host, port)
+}
+
+// MasterAddr is where clients should find the master.
+func (s *Sentinel) MasterAddr() (string, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.master.host, s.master.port
+}
+
+// sentinelClient is a connection to an instance or another sentinel, it's
+// dialled on first use and again after any error.
+type sentinelClient struct {
+	addr string
+	lock sync.Mutex
+	conn net.Conn
+	pr   *ProtocolReader[RespValue]
+}
+
+func newSentinelClient(addr string) *sentinelClient {
+	return &sentinelClient{addr: addr}
+}
+
+// Do sends a command and reads its reply, error replies come back as ErrSentinelReply.
+func (sc *sentinelClient) Do(parts ...string) (RespValue, error) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	var none RespValue
+	if e := sc.connect(); e != nil {
+		return none, e
+	}
+	payload, e := RespValue{Array, bulkStrings(parts...)}.Serialize()
+	if e != nil {
+		return none, e
+	}
+	sc.conn.SetDeadline(time.Now().Add(sentinelCommandTimeout))
+	_, e = sc.conn.Write(payload)
+	reply := none
+	if e == nil {
+		reply, e = sc.pr.ReadProto()
+	}
+	if e != nil {
+		sc.conn.Close()
+		sc.conn = nil
+		return none, e
+	}
+	if reply.Type == SimpleError {
+		return reply, ErrSentinelReply(reply.String())
+	}
+	return reply, nil
+}
+
+func (sc *sentinelClient) connect() error {
+	if sc.conn != nil {
+		return nil
+	}
+	conn, e := net.DialTimeout("tcp", sc.addr, sentinelCommandTimeout)
+	if e != nil {
+		return e
+	}
+	sc.conn, sc.pr = conn, NewProtocolReader(conn, &RespParser{})
+	return nil
+}
+
+// LocalIP is the address our connection comes from, how the other end can
+// reach us. It's "" when we can't connect.
+func (sc *sentinelClient) LocalIP() string {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.connect() != nil {
+		return ""
+	}
+	ip, _, _ := net.SplitHostPort(sc.conn.LocalAddr().String())
+	return ip
+}
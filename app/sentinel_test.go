@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProxy forwards connections to a server, killing it cuts everyone off
+// from the server as if it had died.
+type testProxy struct {
+	l     net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func startTestProxy(t *testing.T, port string) (*testProxy, string) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	p := &testProxy{l: l}
+	t.Cleanup(p.Kill)
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			upstream, e := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+			if e != nil {
+				conn.Close()
+				continue
+			}
+			p.lock.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.lock.Unlock()
+			go io.Copy(conn, upstream)
+			go io.Copy(upstream, conn)
+		}
+	}()
+	_, proxyPort, _ := net.SplitHostPort(l.Addr().String())
+	return p, proxyPort
+}
+
+func (p *testProxy) Kill() {
+	p.l.Close()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// startTestSentinels starts n sentinels that know about each other, all
+// watching the master at port.
+func startTestSentinels(t *testing.T, n int, port string) []RequestContext {
+	var listeners []net.Listener
+	var addrs []string
+	for i := 0; i < n; i++ {
+		l, e := net.Listen("tcp", "127.0.0.1:0")
+		if e != nil {
+			t.Fatal(e)
+		}
+		t.Cleanup(func() { l.Close() })
+		listeners = append(listeners, l)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	var sentinels []RequestContext
+	for i, l := range listeners {
+		config := NewServerConfig()
+		_, ownPort, _ := net.SplitHostPort(addrs[i])
+		config.Set("port", ownPort)
+		config.Set("sentinel-monitor", "mymaster 127.0.0.1 "+port+" 2")
+		config.Set("sentinel-down-after-milliseconds", "300")
+		config.Set("sentinel-failover-timeout", "2000")
+		config.Set("sentinel-known-sentinels", strings.Join(append(append([]string(nil), addrs[:i]...), addrs[i+1:]...), " "))
+		sentinel, e := NewSentinel(config)
+		if e != nil {
+			t.Fatal(e)
+		}
+		server := NewServer(NewKVStore(), NewExpiryStore(), config)
+		server.Sentinel = sentinel
+		server.Router = initSentinelRouter(NewCommandRouter())
+		go func() {
+			for {
+				conn, e := l.Accept()
+				if e != nil {
+					return
+				}
+				go handleConnection(conn, server.Router, NewRequestContext(conn, server))
+			}
+		}()
+		sentinel.Start()
+		t.Cleanup(sentinel.Stop)
+		sentinels = append(sentinels, NewRequestContext(io.Discard, server))
+	}
+	return sentinels
+}
+
+func waitForWithin(t *testing.T, what string, within time.Duration, cond func() bool) {
+	deadline := time.Now().Add(within)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSentinelConfig(t *testing.T) {
+	for _, monitor := range []string{"", "mymaster 127.0.0.1 6379", "mymaster 127.0.0.1 notaport 2", "mymaster 127.0.0.1 6379 0"} {
+		config := NewServerConfig()
+		config.Set("sentinel-monitor", monitor)
+		config.Set("sentinel-down-after-milliseconds", "30000")
+		config.Set("sentinel-failover-timeout", "180000")
+		if _, e := NewSentinel(config); e == nil {
+			t.Errorf("expected sentinel-monitor '%s' to be refused", monitor)
+		}
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	router := initCommandRouter(NewCommandRouter())
+	master, port := startTestNode(t, router, "")
+	proxy, proxyPort := startTestProxy(t, port)
+	router.Route(master, bulkStrings("SET", "a", "1"))
+	replicas := make([]RequestContext, 2)
+	ports := make([]string, 2)
+	for i := range replicas {
+		replicas[i], ports[i] = startTestNode(t, router, proxyPort)
+	}
+	// the first replica can't be promoted, so the second one is.
+	replicas[0].Config.Set("replica-priority", "0")
+	waitFor(t, "the replicas to sync", func() bool { return linkUp(replicas[0]) && linkUp(replicas[1]) })
+
+	sentinels := startTestSentinels(t, 3, proxyPort)
+	waitFor(t, "the sentinels to find the replicas and each other", func() bool {
+		for _, s := range sentinels {
+			if len(s.Sentinel.ReplicaFields()) != 2 || len(s.Sentinel.PeerFields()) != 2 {
+				return false
+			}
+		}
+		return true
+	})
+
+	var out bytes.Buffer
+	client := NewRequestContext(&out, sentinels[0].Server)
+	sentinels[0].Router.Route(client, bulkStrings("SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"))
+	sentinels[0].Router.Route(client, bulkStrings("SENTINEL", "GET-MASTER-ADDR-BY-NAME", "other"))
+	if want := "*2\r\n$9\r\n127.0.0.1\r\n$" + strconv.Itoa(len(proxyPort)) + "\r\n" + proxyPort + "\r\n*-1\r\n"; out.String() != want {
+		t.Fatalf("expected the master's address, got %q", out.String())
+	}
+
+	proxy.Kill()
+	waitForWithin(t, "every sentinel to switch to the new master", 20*time.Second, func() bool {
+		for _, s := range sentinels {
+			if _, masterPort := s.Sentinel.MasterAddr(); masterPort != ports[1] {
+				return false
+			}
+		}
+		return true
+	})
+	if replicas[1].Repl.Master() != nil {
+		t.Fatal("expected the replica to have been promoted")
+	}
+	waitFor(t, "the other replica to follow the new master", func() bool {
+		link := replicas[0].Repl.Master()
+		return linkUp(replicas[0]) && link.port == ports[1]
+	})
+	router.Route(replicas[1], bulkStrings("SET", "b", "2"))
+	_, offset := replicas[1].Repl.ReplID()
+	waitFor(t, "the new master's write", func() bool { return replicas[0].Repl.Master().Offset() == offset })
+	if got, _ := replicas[0].KVStore.Get("a"); got.String() != "1" {
+		t.Fatalf("expected the old master's data to survive the failover, got '%s'", got.String())
+	}
+}
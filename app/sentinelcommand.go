@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var SentinelCommand = Command{"sentinel", sentinelCmd, CmdLoading | CmdStale}
+
+// a sentinel only answers a few commands, it has no data of its own.
+func initSentinelRouter(router CommandRouter) CommandRouter {
+	router.Register(PingCommand)
+	router.Register(InfoCommand)
+	router.Register(ConfigCommand)
+	router.Register(SentinelCommand)
+	return router
+}
+
+// runSentinel is main for --sentinel, it serves the SENTINEL command while
+// watching the master given by sentinel-monitor.
+func runSentinel(config *SharedRWStore[string]) int {
+	sentinel, err := NewSentinel(config)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	server := NewServer(NewKVStore(), NewExpiryStore(), config)
+	server.Sentinel = sentinel
+	router := initSentinelRouter(NewCommandRouter())
+	server.Router = router
+
+	address := getIpV6Address(config)
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Println("Failed to bind to", address)
+		return 1
+	}
+	fmt.Println("sentinel listening on", address)
+	sentinel.Start()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection: ", err.Error())
+			return 1
+		}
+		go handleConnection(conn, router, NewRequestContext(conn, server))
+	}
+}
+
+// how many arguments each SENTINEL subcommand takes.
+var sentinelSubcommandArgs = map[string]int{
+	"get-master-addr-by-name": 1, "master": 1, "masters": 0, "replicas": 1, "slaves": 1, "sentinels": 1,
+	"failover": 1, "myid": 0, "is-master-down-by-addr": 4, "hello": 8,
+}
+
+// sentinelCmd is SENTINEL <subcommand>, for clients looking for the master,
+// and for the other sentinels.
+func sentinelCmd(ctx RequestContext, args []RespValue) {
+	s := ctx.Sentinel
+	if s == nil {
+		ctx.SendError("ERR This instance has sentinel support disabled")
+		return
+	}
+	if len(args) == 0 {
+		ctx.SendError("ERR wrong number of arguments for 'sentinel' command")
+		return
+	}
+	sub, args := args[0].ToLower(), args[1:]
+	n, known := sentinelSubcommandArgs[sub]
+	if !known {
+		ctx.SendError(fmt.Sprintf("ERR Unknown sentinel subcommand '%s'", sub))
+		return
+	}
+	if len(args) != n {
+		ctx.SendError(fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", sub))
+		return
+	}
+	// the subcommands about a master take its name first.
+	if n == 1 && sub != "get-master-addr-by-name" && args[0].String() != s.name {
+		ctx.SendError("ERR No such master with that name")
+		return
+	}
+
+	switch sub {
+	case "get-master-addr-by-name":
+		if args[0].String() != s.name {
+			ctx.Connection.Write(SerializeNullArray())
+			return
+		}
+		host, port := s.MasterAddr()
+		ctx.SendStringArray([]string{host, port})
+	case "master":
+		ctx.SendStringArray(s.MasterFields())
+	case "masters":
+		ctx.SendResp(RespValue{Array, []RespValue{stringArray(s.MasterFields())}})
+	case "replicas", "slaves":
+		ctx.SendResp(fieldArrays(s.ReplicaFields()))
+	case "sentinels":
+		ctx.SendResp(fieldArrays(s.PeerFields()))
+	case "failover":
+		if e := s.Failover(); e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		ctx.SendSimpleString("OK")
+	case "myid":
+		ctx.SendResp(RespValue{BulkString, []byte(s.runid)})
+	case "is-master-down-by-addr":
+		epoch, e := strconv.ParseInt(args[2].String(), 10, 64)
+		if e != nil {
+			ctx.SendError("ERR value is not an integer or out of range")
+			return
+		}
+		down, leader, leaderEpoch := s.IsMasterDown(args[0].String(), args[1].String(), epoch, args[3].String())
+		isDown := 0
+		if down {
+			isDown = 1
+		}
+		ctx.SendResp(RespValue{Array, []RespValue{{Integer, isDown}, {BulkString, []byte(leader)}, {Integer, int(leaderEpoch)}}})
+	case "hello":
+		// not a redis subcommand, redis sentinels say hello over pub/sub.
+		currentEpoch, e1 := strconv.ParseInt(args[3].String(), 10, 64)
+		configEpoch, e2 := strconv.ParseInt(args[7].String(), 10, 64)
+		if e1 != nil || e2 != nil {
+			ctx.SendError("ERR value is not an integer or out of range")
+			return
+		}
+		runid := s.Hello(args[0].String(), args[1].String(), args[2].String(), currentEpoch,
+			args[4].String(), args[5].String(), args[6].String(), configEpoch)
+		ctx.SendResp(RespValue{BulkString, []byte(runid)})
+	}
+}
+
+func stringArray(parts []string) RespValue {
+	return RespValue{Array, bulkStrings(parts...)}
+}
+
+func fieldArrays(all [][]string) RespValue {
+	arr := make([]RespValue, 0, len(all))
+	for _, fields := range all {
+		arr = append(arr, stringArray(fields))
+	}
+	return RespValue{Array, arr}
+}
+
+// MasterFields describes the master the way SENTINEL MASTER does, as a flat
+// list of field names and values.
+func (s *Sentinel) MasterFields() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return []string{
+		"name", s.name,
+		"ip", s.master.host,
+		"port", s.master.port,
+		"flags", s.masterFlags(),
+		"last-ping-reply", strconv.FormatInt(time.Since(s.master.lastPong).Milliseconds(), 10),
+		"num-slaves", strconv.Itoa(len(s.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(s.peers)),
+		"quorum", strconv.Itoa(s.quorum),
+		"config-epoch", strconv.FormatInt(s.configEpoch, 10),
+		"failover-state", s.failoverState,
+		"down-after-milliseconds", strconv.FormatInt(s.downAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(s.failoverTimeout.Milliseconds(), 10),
+	}
+}
+
+// masterFlags is called with the lock held.
+func (s *Sentinel) masterFlags() string {
+	flags := []string{"master"}
+	if s.sdown {
+		flags = append(flags, "s_down")
+	}
+	if s.odown {
+		flags = append(flags, "o_down")
+	}
+	if s.failoverState != SentinelFailoverNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	return strings.Join(flags, ",")
+}
+
+// ReplicaFields describes each replica the way SENTINEL REPLICAS does.
+func (s *Sentinel) ReplicaFields() [][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var all [][]string
+	for _, replica := range s.replicas {
+		flags := "slave"
+		if time.Since(replica.lastPong) > s.downAfter {
+			flags += ",s_down"
+		}
+		if replica == s.promoted {
+			flags += ",promoted"
+		}
+		status := "err"
+		if replica.linkUp {
+			status = "ok"
+		}
+		all = append(all, []string{
+			"name", replica.Addr(),
+			"ip", replica.host,
+			"port", replica.port,
+			"flags", flags,
+			"role-reported", replica.role,
+			"master-host", replica.masterHost,
+			"master-port", replica.masterPort,
+			"master-link-status", status,
+			"slave-repl-offset", strconv.FormatInt(replica.offset, 10),
+			"slave-priority", strconv.Itoa(replica.priority),
+		})
+	}
+	return all
+}
+
+// PeerFields describes the other sentinels the way SENTINEL SENTINELS does.
+func (s *Sentinel) PeerFields() [][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var all [][]string
+	for addr, peer := range s.peers {
+		lastHello := int64(-1)
+		if !peer.lastHello.IsZero() {
+			lastHello = time.Since(peer.lastHello).Milliseconds()
+		}
+		all = append(all, []string{
+			"name", addr,
+			"ip", peer.host,
+			"port", peer.port,
+			"runid", peer.runid,
+			"flags", "sentinel",
+			"last-hello-message", strconv.FormatInt(lastHello, 10),
+			"voted-leader", peer.leader,
+			"voted-leader-epoch", strconv.FormatInt(peer.leaderEpoch, 10),
+		})
+	}
+	return all
+}
+
+// InfoLines is the sentinel section of INFO.
+func (s *Sentinel) InfoLines() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := "ok"
+	if s.odown {
+		status = "odown"
+	} else if s.sdown {
+		status = "sdown"
+	}
+	return []string{
+		"sentinel_masters:1",
+		fmt.Sprintf("sentinel_current_epoch:%d", s.currentEpoch),
+		fmt.Sprintf("master0:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			s.name, status, s.master.Addr(), len(s.replicas), len(s.peers)+1),
+	}
+}
@@ -1,23 +1,58 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
+	"strconv"
 )
 
 // Ensures gofmt doesn't remove the "net" and "os" imports in stage 1 (feel free to remove this!)
 func main() {
+	if len(os.Args) > 1 {
+		if tool, exists := subcommands[os.Args[1]]; exists {
+			os.Exit(tool(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
 	// You can use print statements as follows for debugging, they'll be visible when running tests.
 	fmt.Println("Logs from your program will appear here!")
 	config := initServerConfig(NewServerConfig())
-	db, expiryStore, err := SetupServerDbs(config)
+	if sentinel, _ := config.Get("sentinel"); sentinel == "yes" {
+		os.Exit(runSentinel(config))
+	}
+	server := NewServer(NewKVStore(), NewExpiryStore(), config)
+	// marked as loading before we accept anyone, so no client sees a half loaded db.
+	server.Loading.Begin(0)
+	keys, err := keyRingFromConfig(config)
 	if err != nil {
-		os.Exit(2)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server.Keys = keys
+	aof, err := initAppendOnlyFile(config, keys)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server.AOF = aof
+	var masterHost, masterPort string
+	if replicaOf, _ := config.Get("replicaof"); replicaOf != "" {
+		if masterHost, masterPort, err = parseReplicaOf(replicaOf); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if enabled, _ := config.Get("cluster-enabled"); enabled == "yes" {
+		if server.Cluster, err = NewCluster(config); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// in a cluster, who we replicate comes from the node config.
+		masterHost, masterPort = server.Cluster.MasterAddr()
 	}
 
 	address := getIpV6Address(config)
@@ -28,8 +63,31 @@ func main() {
 		os.Exit(1)
 	}
 	fmt.Println("listening on", address)
+	if server.Cluster != nil {
+		busAddress := fmt.Sprintf("0.0.0.0:%s", server.Cluster.myself.busPort)
+		bus, err := net.Listen("tcp", busAddress)
+		if err != nil {
+			fmt.Println("Failed to bind the cluster bus to", busAddress)
+			os.Exit(1)
+		}
+		server.Cluster.Start(server, bus)
+	}
 
 	router := initCommandRouter(NewCommandRouter())
+	server.Router = router
+	go func() {
+		loadCtx := NewRequestContext(io.Discard, server)
+		if err := LoadServerDbs(loadCtx, router); err != nil {
+			os.Exit(2)
+		}
+		// the master's dataset replaces ours, but only once we've got ours off disk.
+		if masterHost != "" {
+			server.Repl.ReplicaOf(server, masterHost, masterPort)
+		}
+		go expireCron(server)
+	}()
+	go server.Repl.cron(server)
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -37,13 +95,23 @@ func main() {
 
 			os.Exit(1)
 		}
-		ctx := NewRequestContext(conn, db, expiryStore, config)
+		ctx := NewRequestContext(conn, server)
 		go handleConnection(conn, router, ctx)
 	}
 }
 
+// subcommands run instead of the server, to work on its files offline.
+var subcommands = map[string]func(args []string, stdout io.Writer, stderr io.Writer) int{
+	"rdb":     runRDBTool,
+	"backup":  runBackupTool,
+	"restore": runRestoreTool,
+}
+
 func handleConnection(conn net.Conn, router CommandRouter, ctx RequestContext) {
 	defer conn.Close()
+	defer ctx.Repl.Disconnected(conn)
+	ctx.Client = NewClient()
+	defer ctx.unwatchAll()
 	pp := NewProtocolReader(conn, &RespParser{})
 	for {
 		args, err := pp.ReadProto()
@@ -68,6 +136,38 @@ func initCommandRouter(router CommandRouter) CommandRouter {
 	router.Register(PingCommand)
 	router.Register(ConfigCommand)
 	router.Register(KeysCommand)
+	router.Register(InfoCommand)
+	router.Register(BgRewriteAOFCommand)
+	router.Register(SaveCommand)
+	router.Register(BgSaveCommand)
+	router.Register(LastSaveCommand)
+	router.Register(ShutdownCommand)
+	router.Register(FlushAllCommand)
+	router.Register(FlushDBCommand)
+	router.Register(ReplicaOfCommand)
+	router.Register(SlaveOfCommand)
+	router.Register(PsyncCommand)
+	router.Register(ReplConfCommand)
+	router.Register(DelCommand)
+	router.Register(WaitCommand)
+	router.Register(FailoverCommand)
+	router.Register(ClusterCommand)
+	router.Register(DumpCommand)
+	router.Register(RestoreCommand)
+	router.Register(RestoreAskingCommand)
+	router.Register(MigrateCommand)
+	router.Register(AskingCommand)
+	router.Register(MultiCommand)
+	router.Register(ExecCommand)
+	router.Register(DiscardCommand)
+	router.Register(WatchCommand)
+	router.Register(UnwatchCommand)
+	router.Register(EvalCommand)
+	router.Register(EvalShaCommand)
+	router.Register(ScriptCommand)
+	router.Register(FunctionCommand)
+	router.Register(FCallCommand)
+	router.Register(FCallROCommand)
 	return router
 }
 
@@ -79,38 +179,117 @@ func initServerConfig(sc *SharedRWStore[string]) *SharedRWStore[string] {
 	return sc
 }
 
+// every option can be given on the command line and read back with CONFIG GET.
+var cliOptions = []struct {
+	name  string
+	value string
+	usage string
+}{
+	{"dir", "/tmp/redis-data", "the directory for redis data files"},
+	{"dbfilename", "dump.rdb", "the name of the db file to write to"},
+	{"port", "6379", "the port to bind this server to"},
+	{"rdbcompression", "yes", "lzf compress long strings when writing rdb files"},
+	{"rdbchecksum", "yes", "write a crc64 checksum at the end of rdb files"},
+	{"rdb-skip-zero-checksum", "yes", "accept rdb files whose checksum is zero without verifying them"},
+	{"rdb-corrupt-policy", CorruptPolicyRefuse, "what to do with a corrupt rdb file: refuse to start, start empty, or truncate to the keys before the corruption"},
+	{"appendonly", "no", "log every write to the append only file, and load from it at startup"},
+	{"appendfilename", "appendonly.aof", "the prefix for the names of the append only files"},
+	{"appenddirname", "appendonlydir", "the directory, inside dir, that holds the append only files"},
+	{"appendfsync", AppendFsyncEverysec, "when to fsync the append only file: always, everysec or no"},
+	{"aof-load-truncated", "yes", "load an append only file whose last command was cut short, instead of refusing to start"},
+	{"encryption-key-file", "", "encrypt the rdb and aof files with the AES-256 key in this file (32 bytes, or 64 hex characters)"},
+	{"encryption-old-key-files", "", "comma separated key files that are only used to decrypt files written before a key rotation"},
+	{"aof-timestamp-enabled", "yes", "annotate the append only file with timestamps, needed to restore backups to a point in time"},
+	{"aof-use-rdb-preamble", "yes", "write the base of a rewritten append only file in rdb format"},
+	{"auto-aof-rewrite-percentage", "100", "rewrite the append only file once it grows by this percentage of its size after the last rewrite, 0 disables"},
+	{"auto-aof-rewrite-min-size", "64mb", "never automatically rewrite an append only file smaller than this"},
+	{"replicaof", "", "replicate the master at this \"host port\" address"},
+	{"repl-timeout", "60", "seconds the replication link can go quiet before it is considered down"},
+	{"repl-backlog-size", "1mb", "how much of the replication stream to keep for replicas that reconnect"},
+	{"repl-ping-replica-period", "10", "seconds between the pings a master sends its replicas"},
+	{"min-replicas-to-write", "0", "refuse writes unless at least this many replicas are connected and keeping up, 0 disables"},
+	{"min-replicas-max-lag", "10", "seconds since its last ack for a replica to still count towards min-replicas-to-write"},
+	{"repl-diskless-sync", "yes", "stream the rdb for a full sync straight to the replicas' sockets, instead of writing it to disk first"},
+	{"repl-diskless-sync-delay", "5", "seconds to wait for more replicas to join a transfer over the socket before starting it"},
+	{"repl-diskless-sync-max-replicas", "0", "start a transfer over the socket as soon as this many replicas have joined it, 0 waits out the delay"},
+	{"repl-diskless-load", DisklessLoadDisabled, "how a replica loads the rdb from its master: disabled saves it to disk first, on-empty-db loads it from the socket when we have no data, swapdb loads it from the socket alongside the old data"},
+	{"replica-read-only", "yes", "refuse writes from clients while we are a replica"},
+	{"replica-serve-stale-data", "yes", "keep answering reads while we are a replica that has lost its master, or is still syncing with it"},
+	{"replica-priority", "100", "sentinels promote the replica with the lowest priority first, 0 is never promoted"},
+	{"sentinel-monitor", "", "as a sentinel, the master to monitor as \"name host port quorum\", quorum sentinels have to agree it's down for a failover"},
+	{"sentinel-down-after-milliseconds", "30000", "as a sentinel, how long an instance can go without answering before it's considered down"},
+	{"sentinel-failover-timeout", "180000", "as a sentinel, how long a failover gets to complete, a failed one is retried after twice this"},
+	{"sentinel-known-sentinels", "", "as a sentinel, the \"host:port\" addresses of other sentinels monitoring the same master, more are found as they say hello"},
+	{"sentinel-announce-ip", "", "as a sentinel, the address other sentinels should reach us on, the one our connections to them come from by default"},
+	{"cluster-config-file", "nodes.conf", "in cluster mode, the file in dir that lists the nodes of the cluster and the slots each one serves"},
+	{"cluster-announce-ip", "", "in cluster mode, the address clients and other nodes should reach us on"},
+	{"cluster-port", "0", "in cluster mode, the port of the cluster bus the nodes talk to each other on, 0 is port plus 10000"},
+	{"cluster-node-timeout", "15000", "in cluster mode, milliseconds a node can go without answering before it's considered failing"},
+	{"busy-reply-threshold", "5000", "milliseconds a script can run before other clients are told it's busy, 0 never tells them"},
+}
+
+// switches are options that don't take a value, they read back as "yes" or "no".
+var cliSwitches = []struct {
+	name  string
+	usage string
+}{
+	{"sentinel", "run as a sentinel, watching sentinel-monitor's master and failing it over when it goes down"},
+	{"cluster-enabled", "run as a node of a cluster, serving the hash slots cluster-config-file gives us"},
+}
+
 func parseCliOptions() [][]string {
-	args := [][]string{
-		{"dir", ""},
-		{"dbfilename", ""},
-		{"port", ""},
-	}
-	flag.StringVar(&args[0][1], "dir", "/tmp/redis-data", "the directory for redis data files")
-	flag.StringVar(&args[1][1], "dbfilename", "dump.rdb", "the name of the db file to write to")
-	flag.StringVar(&args[2][1], "port", "6379", "the port to bind this server to")
+	args := make([][]string, len(cliOptions))
+	for i, opt := range cliOptions {
+		args[i] = []string{opt.name, ""}
+		flag.StringVar(&args[i][1], opt.name, opt.value, opt.usage)
+	}
+	switches := make([]*bool, len(cliSwitches))
+	for i, sw := range cliSwitches {
+		switches[i] = flag.Bool(sw.name, false, sw.usage)
+	}
 	flag.Parse()
+	for i, sw := range cliSwitches {
+		value := "no"
+		if *switches[i] {
+			value = "yes"
+		}
+		args = append(args, []string{sw.name, value})
+	}
 	return args
 }
 
-func SetupServerDbs(config *SharedRWStore[string]) (*SharedRWStore[RespValue], *SharedRWStore[Timestamp], error) {
-	dir, _ := config.Get("dir")               // should always exist
-	dbfilename, _ := config.Get("dbfilename") // should always exist
-	path := filepath.Join(dir, dbfilename)
-	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
-		fmt.Println("rdb file doesn't exist, starting fresh db instance")
-		return NewKVStore(), NewExpiryStore(), nil
+// initAppendOnlyFile returns nil when aof is disabled, so nothing gets logged.
+func initAppendOnlyFile(config *SharedRWStore[string], keys *KeyRing) (*AppendOnlyFile, error) {
+	enabled, _ := config.Get("appendonly")
+	if enabled != "yes" {
+		return nil, nil
+	}
+	dir, _ := config.Get("dir")
+	dirname, _ := config.Get("appenddirname")
+	name, _ := config.Get("appendfilename")
+	fsync, _ := config.Get("appendfsync")
+	preamble, _ := config.Get("aof-use-rdb-preamble")
+	timestamps, _ := config.Get("aof-timestamp-enabled")
+	perc, _ := config.Get("auto-aof-rewrite-percentage")
+	minSize, _ := config.Get("auto-aof-rewrite-min-size")
+
+	percentage, err := strconv.Atoi(perc)
+	if err != nil || percentage < 0 {
+		return nil, fmt.Errorf("invalid auto-aof-rewrite-percentage '%s'", perc)
 	}
-	rdbParser, err := NewRDBFileParser(path)
+	minBytes, err := ParseMemorySize(minSize)
 	if err != nil {
-		fmt.Println("err initiating rdbfile parser, starting fresh db instance", err)
-		return NewKVStore(), NewExpiryStore(), err
+		return nil, err
 	}
-	dbs, parseErr := rdbParser.Parse()
-	if parseErr != nil {
-		fmt.Println("err parsing rdb file, starting fresh db instance", parseErr)
-		return NewKVStore(), NewExpiryStore(), parseErr
+	aof, err := NewAppendOnlyFile(filepath.Join(dir, dirname), name, fsync)
+	if err != nil {
+		return nil, err
 	}
-	return dbs[0].DB, dbs[0].Expiry, nil
+	return aof.Legacy(filepath.Join(dir, name)).
+		RDBPreamble(preamble == "yes").
+		Timestamps(timestamps == "yes").
+		Encryption(keys).
+		AutoRewrite(percentage, minBytes), nil
 }
 
 func getIpV6Address(config *SharedRWStore[string]) string {
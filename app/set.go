@@ -5,11 +5,12 @@ import (
 	"time"
 )
 
-var SetCommand = Command{"set", set}
+var SetCommand = Command{"set", set, CmdWrite}
 
 var SetArgsParser = NewArgumentsParser().
 	NumPositionals(2).
-	Argument(ArgDef{"PX", false, true})
+	Argument(ArgDef{"PX", false, true}).
+	Argument(ArgDef{"PXAT", false, true})
 
 func set(ctx RequestContext, args []RespValue) {
 	parsedArgs, e := SetArgsParser.Parse(args)
@@ -20,19 +21,37 @@ func set(ctx RequestContext, args []RespValue) {
 
 	key, value := parsedArgs.GetPos(0).String(), parsedArgs.GetPos(1)
 
+	var expiry time.Time
 	if px, exists := parsedArgs.GetArg("PX"); exists {
 		milli, e := strconv.Atoi(px.value.String())
 		if e != nil {
 			ctx.SendError(e.Error())
 			return
 		}
-		expiry := time.Duration(milli) * time.Millisecond
+		expiry = time.Now().Add(time.Duration(milli) * time.Millisecond)
+	}
+
+	if pxat, exists := parsedArgs.GetArg("PXAT"); exists {
+		milli, e := strconv.ParseInt(pxat.value.String(), 10, 64)
+		if e != nil {
+			ctx.SendError(e.Error())
+			return
+		}
+		expiry = time.UnixMilli(milli)
+	}
+
+	if !expiry.IsZero() {
 		ctx.KVStore.Set(key, value)
-		ctx.ExpiryStore.Set(key, NewTimestamp(expiry))
+		ctx.ExpiryStore.Set(key, NewTimestampFromExpiry(expiry))
+		// relative expiries are propagated as absolute ones, so replaying them later doesn't extend them.
+		ctx.Propagate(bulkStrings("SET", key, value.String(), "PXAT", strconv.FormatInt(expiry.UnixMilli(), 10)))
 		ctx.SendSimpleString("OK")
 		return
 	}
 
 	ctx.KVStore.Set(key, value)
+	// a plain set makes the key persistent again.
+	ctx.ExpiryStore.Delete(key)
+	ctx.Propagate(bulkStrings("SET", key, value.String()))
 	ctx.SendSimpleString("OK")
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// WAIT blocks for as long as it takes the replicas to ack, it can't hold
+// Exec that long, the writes it waits on need it.
+var WaitCommand = Command{"wait", wait, CmdBlocking}
+
+var WaitArgsParser = NewArgumentsParser().NumPositionals(2)
+
+// wait returns once numreplicas replicas have applied every write made before
+// it, or once timeout milliseconds have passed (0 waits forever), with the
+// number of replicas that had.
+func wait(ctx RequestContext, args []RespValue) {
+	parsedArgs, e := WaitArgsParser.Parse(args)
+	if e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	numReplicas, e := strconv.Atoi(parsedArgs.GetPos(0).String())
+	if e != nil {
+		ctx.SendError("ERR value is not an integer or out of range")
+		return
+	}
+	timeout, e := strconv.Atoi(parsedArgs.GetPos(1).String())
+	if e != nil {
+		ctx.SendError("ERR timeout is not an integer or out of range")
+		return
+	}
+	if timeout < 0 {
+		ctx.SendError("ERR timeout is negative")
+		return
+	}
+	if ctx.Repl.Master() != nil {
+		ctx.SendError("ERR WAIT cannot be used with replica instances")
+		return
+	}
+
+	_, target := ctx.Repl.ReplID()
+	if acked := ctx.Repl.Acked(target); acked >= numReplicas {
+		ctx.SendResp(RespValue{Integer, acked})
+		return
+	}
+
+	// ask for acks now rather than waiting for the next round of them. The
+	// request is part of the stream, so it's written like any other write.
+	ctx.Exec.Lock()
+	ctx.Repl.Feed(bulkStrings("REPLCONF", "GETACK", "*"))
+	ctx.Exec.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		acks := ctx.Repl.AckNotify()
+		acked := ctx.Repl.Acked(target)
+		if acked >= numReplicas {
+			ctx.SendResp(RespValue{Integer, acked})
+			return
+		}
+		select {
+		case <-acks:
+		case <-expired:
+			ctx.SendResp(RespValue{Integer, acked})
+			return
+		}
+	}
+}
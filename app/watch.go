@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrWatchInMulti = errors.New("ERR WATCH inside MULTI is not allowed")
+
+var WatchCommand = Command{"watch", watch, CmdLoading | CmdStale | CmdNoScript}
+var UnwatchCommand = Command{"unwatch", unwatch, CmdLoading | CmdStale | CmdNoScript}
+
+// Watches are the versions of the keys clients are WATCHing. A key's version
+// goes up every time it's modified, a client's EXEC is refused if any of the
+// keys it watched has moved on since. Nobody cares about the version of a
+// key nobody's watching, so those aren't kept.
+type Watches struct {
+	lock sync.Mutex
+	keys map[string]*watchedKey
+}
+
+type watchedKey struct {
+	version  uint64
+	watchers int
+}
+
+// watch is where a client's watch on a key started.
+type watchState struct {
+	version uint64
+	live    bool // the key existed, if it's expired by EXEC that counts as a change
+}
+
+func NewWatches() *Watches {
+	return &Watches{keys: map[string]*watchedKey{}}
+}
+
+// Watch starts watching key, returning its current version.
+func (w *Watches) Watch(key string) uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	k, exists := w.keys[key]
+	if !exists {
+		k = &watchedKey{}
+		w.keys[key] = k
+	}
+	k.watchers++
+	return k.version
+}
+
+// Unwatch is the end of a watch on key, its version is forgotten once
+// nobody's watching it.
+func (w *Watches) Unwatch(key string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if k, exists := w.keys[key]; exists {
+		if k.watchers--; k.watchers == 0 {
+			delete(w.keys, key)
+		}
+	}
+}
+
+// Version is key's version, for a key that's being watched.
+func (w *Watches) Version(key string) uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if k, exists := w.keys[key]; exists {
+		return k.version
+	}
+	return 0
+}
+
+// Touch bumps the version of any of keys that are being watched.
+func (w *Watches) Touch(keys ...string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, key := range keys {
+		if k, exists := w.keys[key]; exists {
+			k.version++
+		}
+	}
+}
+
+// TouchAll bumps every watched key, for when the whole dataset is flushed or
+// replaced.
+func (w *Watches) TouchAll() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, k := range w.keys {
+		k.version++
+	}
+}
+
+// touchWritten bumps the versions of the keys a propagated write modified.
+// Anything that changes a key propagates it, that's how the aof and our
+// replicas hear about it, so nothing is missed.
+func (w *Watches) touchWritten(args []RespValue) {
+	name := args[0].ToLower()
+	if name == "flushall" || name == "flushdb" {
+		w.TouchAll()
+	} else if keysOf, keyed := commandKeys[name]; keyed {
+		w.Touch(keysOf(args[1:])...)
+	}
+}
+
+// watch is WATCH key [key ...], the client's next EXEC only runs if none of
+// the keys have been modified in the meantime.
+func watch(ctx RequestContext, args []RespValue) {
+	if e := checkArity("watch", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	if ctx.Client == nil {
+		ctx.SendError(ErrNotInMulti.Error())
+		return
+	}
+	if ctx.Client.tx != nil {
+		ctx.SendError(ErrWatchInMulti.Error())
+		return
+	}
+	if ctx.Client.watching == nil {
+		ctx.Client.watching = map[string]watchState{}
+	}
+	for _, key := range everyKey(args) {
+		if _, already := ctx.Client.watching[key]; already {
+			continue
+		}
+		version := ctx.Watches.Watch(key)
+		ctx.Client.watching[key] = watchState{version, ctx.liveKey(key)}
+	}
+	ctx.SendSimpleString("OK")
+}
+
+// unwatch is UNWATCH, it drops all of the client's watches.
+func unwatch(ctx RequestContext, args []RespValue) {
+	if e := checkArity("unwatch", args); e != nil {
+		ctx.SendError(e.Error())
+		return
+	}
+	ctx.unwatchAll()
+	ctx.SendSimpleString("OK")
+}
+
+// unwatchAll drops the client's watches.
+func (rc RequestContext) unwatchAll() {
+	if rc.Client == nil {
+		return
+	}
+	for key := range rc.Client.watching {
+		rc.Watches.Unwatch(key)
+	}
+	rc.Client.watching = nil
+}
+
+// watchedKeyChanged is whether a key the client is watching has been
+// modified, or has expired, since it started watching it. Called with Exec
+// held, so nothing changes while EXEC goes ahead.
+func (rc RequestContext) watchedKeyChanged() bool {
+	if rc.Client == nil {
+		return false
+	}
+	for key, w := range rc.Client.watching {
+		if rc.Watches.Version(key) != w.version || (w.live && !rc.liveKey(key)) {
+			return true
+		}
+	}
+	return false
+}